@@ -31,6 +31,7 @@ import (
 	"github.com/ngaut/unistore/server"
 	"github.com/pingcap/badger"
 	"github.com/pingcap/badger/y"
+	"github.com/pingcap/kvproto/pkg/cdcpb"
 	"github.com/pingcap/kvproto/pkg/deadlock"
 	"github.com/pingcap/kvproto/pkg/tikvpb"
 	"github.com/pingcap/log"
@@ -147,6 +148,7 @@ func main() {
 	listenAddr := conf.Server.StoreAddr[strings.IndexByte(conf.Server.StoreAddr, ':'):]
 	l, err := net.Listen("tcp", listenAddr)
 	deadlock.RegisterDeadlockServer(grpcServer, tikvServer)
+	cdcpb.RegisterChangeDataServer(grpcServer, tikvServer)
 	if err != nil {
 		log.S().Fatal(err)
 	}
@@ -29,12 +29,37 @@ type Config struct {
 
 // RaftStore is the config for raft store.
 type RaftStore struct {
-	PdHeartbeatTickInterval  string `toml:"pd-heartbeat-tick-interval"`  // pd-heartbeat-tick-interval in seconds
-	RaftStoreMaxLeaderLease  string `toml:"raft-store-max-leader-lease"` // raft-store-max-leader-lease in milliseconds
-	RaftBaseTickInterval     string `toml:"raft-base-tick-interval"`     // raft-base-tick-interval in milliseconds
-	RaftHeartbeatTicks       int    `toml:"raft-heartbeat-ticks"`        // raft-heartbeat-ticks times
-	RaftElectionTimeoutTicks int    `toml:"raft-election-timeout-ticks"` // raft-election-timeout-ticks times
-	CustomRaftLog            bool   `toml:"custom-raft-log"`
+	PdHeartbeatTickInterval   string `toml:"pd-heartbeat-tick-interval"`  // pd-heartbeat-tick-interval in seconds
+	RaftStoreMaxLeaderLease   string `toml:"raft-store-max-leader-lease"` // raft-store-max-leader-lease in milliseconds
+	RaftBaseTickInterval      string `toml:"raft-base-tick-interval"`     // raft-base-tick-interval in milliseconds
+	RaftHeartbeatTicks        int    `toml:"raft-heartbeat-ticks"`        // raft-heartbeat-ticks times
+	RaftElectionTimeoutTicks  int    `toml:"raft-election-timeout-ticks"` // raft-election-timeout-ticks times
+	CoalesceHeartbeats        bool   `toml:"coalesce-heartbeats"`
+	CustomRaftLog             bool   `toml:"custom-raft-log"`
+	CustomRaftLogVersion      uint16 `toml:"custom-raft-log-version"`
+	DiskReserveSpace          uint64 `toml:"disk-reserve-space"`    // disk-reserve-space in bytes
+	SnapBuildRateLimit        uint64 `toml:"snap-build-rate-limit"` // snap-build-rate-limit in bytes per second
+	SnapSendRateLimit         uint64 `toml:"snap-send-rate-limit"`  // snap-send-rate-limit in bytes per second
+	SnapApplyRateLimit        uint64 `toml:"snap-apply-rate-limit"` // snap-apply-rate-limit in bytes per second
+	SnapCompression           string `toml:"snap-compression"`      // snap-compression: none, lz4 or zstd
+	SnapResume                bool   `toml:"snap-resume"`
+	SnapGenerateOnFollower    bool   `toml:"snap-generate-on-follower"`
+	SnapDelegateTimeout       string `toml:"snap-delegate-timeout"`         // snap-delegate-timeout in minutes
+	CDCResolvedTsInterval     string `toml:"cdc-resolved-ts-interval"`      // cdc-resolved-ts-interval in seconds
+	ProposalTimeout           string `toml:"proposal-timeout"`              // proposal-timeout in seconds
+	RaftLogFetchMaxBytes      uint64 `toml:"raft-log-fetch-max-bytes"`      // raft-log-fetch-max-bytes in bytes
+	RaftEntryCacheMemoryLimit uint64 `toml:"raft-entry-cache-memory-limit"` // raft-entry-cache-memory-limit in bytes
+	RaftEngine                string `toml:"raft-engine"`                   // raft-engine: badger or log
+	RaftEngineFileSize        int64  `toml:"raft-engine-file-size"`         // raft-engine-file-size in bytes
+
+	FlowControlPendingCompactionSoftLimit uint64 `toml:"flow-control-pending-compaction-soft-limit"` // flow-control-pending-compaction-soft-limit in bytes
+	FlowControlPendingCompactionHardLimit uint64 `toml:"flow-control-pending-compaction-hard-limit"` // flow-control-pending-compaction-hard-limit in bytes
+	FlowControlSlowdownRate               uint64 `toml:"flow-control-slowdown-rate"`                 // flow-control-slowdown-rate in bytes per second
+	FlowControlApplyPendingLimit          uint64 `toml:"flow-control-apply-pending-limit"`           // flow-control-apply-pending-limit in raft logs
+
+	InspectInterval      string `toml:"inspect-interval"`       // inspect-interval in seconds
+	InspectSlowThreshold string `toml:"inspect-slow-threshold"` // inspect-slow-threshold in seconds
+	SlowScoreThreshold   uint64 `toml:"slow-score-threshold"`   // slow-score-threshold from 1 to 100
 }
 
 // ParseCompression parses the string s and returns a compression type.
@@ -56,12 +81,29 @@ const MB = 1024 * 1024
 var DefaultConf = Config{
 	Config: config.DefaultConf,
 	RaftStore: RaftStore{
-		PdHeartbeatTickInterval:  "20s",
-		RaftStoreMaxLeaderLease:  "9s",
-		RaftBaseTickInterval:     "1s",
-		RaftHeartbeatTicks:       2,
-		RaftElectionTimeoutTicks: 10,
-		CustomRaftLog:            true,
+		PdHeartbeatTickInterval:   "20s",
+		RaftStoreMaxLeaderLease:   "9s",
+		RaftBaseTickInterval:      "1s",
+		RaftHeartbeatTicks:        2,
+		RaftElectionTimeoutTicks:  10,
+		CustomRaftLog:             true,
+		SnapCompression:           "none",
+		SnapDelegateTimeout:       "5m",
+		CDCResolvedTsInterval:     "1s",
+		ProposalTimeout:           "10s",
+		RaftLogFetchMaxBytes:      32 * MB,
+		RaftEntryCacheMemoryLimit: 1024 * MB,
+		RaftEngine:                "badger",
+		RaftEngineFileSize:        128 * MB,
+
+		FlowControlPendingCompactionSoftLimit: 192 * 1024 * MB,
+		FlowControlPendingCompactionHardLimit: 256 * 1024 * MB,
+		FlowControlSlowdownRate:               16 * MB,
+		FlowControlApplyPendingLimit:          100000,
+
+		InspectInterval:      "1s",
+		InspectSlowThreshold: "500ms",
+		SlowScoreThreshold:   80,
 	},
 }
 
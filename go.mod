@@ -8,17 +8,21 @@ require (
 	github.com/golang/protobuf v1.3.4
 	github.com/gorilla/websocket v1.4.1 // indirect
 	github.com/grpc-ecosystem/grpc-gateway v1.14.3 // indirect
+	github.com/klauspost/compress v1.10.5
 	github.com/onsi/ginkgo v1.9.0 // indirect
 	github.com/onsi/gomega v1.6.0 // indirect
 	github.com/pierrec/lz4 v2.5.2+incompatible
 	github.com/pingcap/badger v1.5.1-0.20200908111422-2e78ee155d19
 	github.com/pingcap/errors v0.11.5-0.20201126102027-b0a155152ca3
+	github.com/pingcap/failpoint v0.0.0-20210316064728-7acb0f0a3dfd
 	github.com/pingcap/kvproto v0.0.0-20210308063835-39b884695fb8
 	github.com/pingcap/log v0.0.0-20210317133921-96f4fcab92a4
 	github.com/pingcap/tidb v1.1.0-beta.0.20210407104700-3d8084e972d1
+	github.com/prometheus/client_golang v1.5.1
 	github.com/shirou/gopsutil v3.21.2+incompatible
 	github.com/spaolacci/murmur3 v1.1.0 // indirect
 	github.com/stretchr/testify v1.6.1
+	github.com/tikv/pd v1.1.0-beta.0.20210323121136-78679e5e209d
 	github.com/uber-go/atomic v1.4.0
 	github.com/zhangjinpeng1987/raft v0.0.0-20200819064223-df31bb68a018
 	go.etcd.io/bbolt v1.3.4 // indirect
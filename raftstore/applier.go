@@ -22,7 +22,9 @@ import (
 	"github.com/pingcap/badger"
 	"github.com/pingcap/badger/y"
 	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/cdcpb"
 	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/errorpb"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
@@ -69,6 +71,26 @@ func (q *pendingCmdQueue) takeConfChange() *pendingCmd {
 	return cmd
 }
 
+// removeExpired completes the expired commands with a timeout error and removes them.
+func (q *pendingCmdQueue) removeExpired(now time.Time) {
+	normals := q.normals[:0]
+	for _, cmd := range q.normals {
+		if cmd.cb.expired(now) {
+			cmd.cb.timeout()
+		} else {
+			normals = append(normals, cmd)
+		}
+	}
+	for i := len(normals); i < len(q.normals); i++ {
+		q.normals[i] = pendingCmd{}
+	}
+	q.normals = normals
+	if q.confChange != nil && q.confChange.cb.expired(now) {
+		q.confChange.cb.timeout()
+		q.confChange = nil
+	}
+}
+
 // TODO: seems we don't need to separate conf change from normal entries.
 func (q *pendingCmdQueue) setConfChange(cmd *pendingCmd) {
 	q.confChange = cmd
@@ -170,22 +192,21 @@ type applyExecContext struct {
 type applyCallback struct {
 	region *metapb.Region
 	cbs    []*Callback
+	resps  []*raft_cmdpb.RaftCmdResponse
 }
 
 func (c *applyCallback) invokeAll(doneApplyTime time.Time) {
-	for _, cb := range c.cbs {
+	for i, cb := range c.cbs {
 		if cb != nil {
 			cb.applyDoneTime = doneApplyTime
-			cb.wg.Done()
+			cb.Done(c.resps[i])
 		}
 	}
 }
 
 func (c *applyCallback) push(cb *Callback, resp *raft_cmdpb.RaftCmdResponse) {
-	if cb != nil {
-		cb.resp = resp
-	}
 	c.cbs = append(c.cbs, cb)
+	c.resps = append(c.resps, resp)
 }
 
 type proposal struct {
@@ -280,6 +301,16 @@ type applyContext struct {
 	enableSyncLog bool
 	// Whether to use the delete range API instead of deleting one by one.
 	useDeleteRange bool
+
+	// cdcObserver observes the rows of the regions subscribed by CDC, the rows of the command being
+	// applied are collected in cdcRows if cdcObserving is true.
+	cdcObserver  *cdcObserver
+	cdcObserving bool
+	cdcRows      []*cdcpb.Event_Row
+
+	// flowController counts the raft logs waiting to be applied.
+	flowController *flowController
+	slowScore      *slowScore
 }
 
 func newApplyContext(tag string, regionScheduler chan<- task, engines *Engines,
@@ -336,6 +367,7 @@ func (ac *applyContext) commitOpt(d *applier, persistent bool) {
 // Writes all the changes into badger.
 func (ac *applyContext) writeToDB() {
 	if ac.wb.size != 0 {
+		mustEvalFailpoint(FailpointApplyBeforeWriteKV)
 		if err := ac.wb.WriteToKV(ac.engines.kv); err != nil {
 			panic(err)
 		}
@@ -381,6 +413,46 @@ func (ac *applyContext) getTxn() *badger.Txn {
 	return ac.txn
 }
 
+// observeLock collects the prewrite row of the lock.
+func (ac *applyContext) observeLock(rawKey, val []byte) {
+	if !ac.cdcObserving {
+		return
+	}
+	lock := mvcc.DecodeLock(val)
+	if row := newCDCRow(rawKey, &lock, cdcpb.Event_PREWRITE); row != nil {
+		ac.cdcRows = append(ac.cdcRows, row)
+	}
+}
+
+// observeCommit collects the commit row of the lock, the keys committed without a prewrite are
+// collected as COMMITTED rows.
+func (ac *applyContext) observeCommit(rawKey, val []byte, commitTS uint64, onePC bool) {
+	if !ac.cdcObserving {
+		return
+	}
+	tp := cdcpb.Event_COMMIT
+	if onePC {
+		tp = cdcpb.Event_COMMITTED
+	}
+	lock := mvcc.DecodeLock(val)
+	if row := newCDCRow(rawKey, &lock, tp); row != nil {
+		row.CommitTs = commitTS
+		ac.cdcRows = append(ac.cdcRows, row)
+	}
+}
+
+// observeRollback collects the rollback row of a prewritten key.
+func (ac *applyContext) observeRollback(rawKey []byte, startTS uint64) {
+	if !ac.cdcObserving {
+		return
+	}
+	ac.cdcRows = append(ac.cdcRows, &cdcpb.Event_Row{
+		StartTs: startTS,
+		Type:    cdcpb.Event_ROLLBACK,
+		Key:     y.SafeCopy(nil, rawKey),
+	})
+}
+
 func (ac *applyContext) flush() {
 	// TODO: this check is too hacky, need to be more verbose and less buggy.
 	t := ac.timer
@@ -431,6 +503,10 @@ func notifyStaleReq(term uint64, cb *Callback) {
 
 // Checks if a write is needed to be issued before handling the command.
 func shouldWriteToEngine(rlog raftlog.RaftLog, wbKeys int) bool {
+	if custom, ok := rlog.(*raftlog.CustomRaftLog); ok {
+		// The range deletion reads the keys to delete from the engine.
+		return custom.Type() == raftlog.TypeDeleteRange
+	}
 	cmd := rlog.GetRaftCmdRequest()
 	if cmd == nil {
 		return false
@@ -628,7 +704,11 @@ func (a *applier) handleRaftEntryNormal(aCtx *applyContext, entry *eraftpb.Entry
 	if len(entry.Data) > 0 {
 		var rlog raftlog.RaftLog
 		if entry.Data[0] == raftlog.CustomRaftLogFlag {
-			rlog = raftlog.NewCustom(entry.Data)
+			cl, err := raftlog.DecodeCustom(entry.Data)
+			if err != nil {
+				panic(fmt.Sprintf("%s failed to decode entry %d: %v", a.tag, index, err))
+			}
+			rlog = cl
 		} else {
 			cmd := new(raft_cmdpb.RaftCmdRequest)
 			err := cmd.Unmarshal(entry.Data)
@@ -653,9 +733,7 @@ func (a *applier) handleRaftEntryNormal(aCtx *applyContext, entry *eraftpb.Entry
 			break
 		}
 		// apparently, all the callbacks whose term is less than entry's term are stale.
-		cb := &aCtx.cbs[len(aCtx.cbs)-1]
-		cmd.cb.resp = ErrRespStaleCommand(term)
-		cb.cbs = append(cb.cbs, cmd.cb)
+		aCtx.cbs[len(aCtx.cbs)-1].push(cmd.cb, ErrRespStaleCommand(term))
 	}
 	return applyResult{}
 }
@@ -748,6 +826,7 @@ func (a *applier) applyRaftCmd(aCtx *applyContext, index, term uint64,
 
 	aCtx.execCtx = a.newCtx(index, term)
 	aCtx.wb.SetSafePoint()
+	aCtx.cdcObserving = aCtx.cdcObserver.isObserved(a.region.Id)
 	resp, applyResult, err := a.execRaftCmd(aCtx, rlog)
 	if err != nil {
 		// clear dirty values.
@@ -758,7 +837,20 @@ func (a *applier) applyRaftCmd(aCtx *applyContext, index, term uint64,
 			log.S().Errorf("execute raft command region_id %d, peer_id %d, err %v", a.region.Id, a.id, err)
 		}
 		resp = ErrResp(err)
+	} else {
+		if aCtx.wb.hasNewVersionAfterSafePoint() {
+			// Write the previous raft logs first, every badger transaction still holds whole raft logs
+			// with the apply state.
+			tail := aCtx.wb.cutAfterSafePoint()
+			aCtx.commit(a)
+			aCtx.wb.appendAfterSafePoint(tail)
+		}
+		if len(aCtx.cdcRows) > 0 {
+			aCtx.cdcObserver.onApply(a.region.Id, aCtx.cdcRows)
+		}
 	}
+	aCtx.cdcObserving = false
+	aCtx.cdcRows = nil
 	if applyResult.tp == applyResultTypeWaitMergeResource {
 		return resp, applyResult
 	}
@@ -771,19 +863,24 @@ func (a *applier) applyRaftCmd(aCtx *applyContext, index, term uint64,
 		switch x := applyResult.data.(type) {
 		case *execResultChangePeer:
 			a.region = x.cp.region
+			aCtx.cdcObserver.updateRegion(a.region)
 		case *execResultSplitRegion:
 			a.region = x.derived
 			a.metrics.sizeDiffHint = 0
 			a.metrics.deleteKeysHint = 0
+			aCtx.cdcObserver.deregisterRegion(a.region.Id, cdcEpochNotMatch(x.regions...))
 		case *execResultPrepareMerge:
 			a.region = x.region
 			a.isMerging = true
+			aCtx.cdcObserver.deregisterRegion(a.region.Id, cdcEpochNotMatch(a.region))
 		case *execResultCommitMerge:
 			a.region = x.region
 			a.lastMergeVersion = x.region.RegionEpoch.Version
+			aCtx.cdcObserver.deregisterRegion(a.region.Id, cdcEpochNotMatch(a.region))
 		case *execResultRollbackMerge:
 			a.region = x.region
 			a.isMerging = false
+			aCtx.cdcObserver.deregisterRegion(a.region.Id, cdcEpochNotMatch(a.region))
 		default:
 		}
 	}
@@ -871,8 +968,7 @@ func (a *applier) execAdminCmd(aCtx *applyContext, req *raft_cmdpb.RaftCmdReques
 func (a *applier) execWriteCmd(aCtx *applyContext, rlog raftlog.RaftLog) (
 	resp *raft_cmdpb.RaftCmdResponse, result applyResult) {
 	if cl, ok := rlog.(*raftlog.CustomRaftLog); ok {
-		resp = a.execCustomLog(aCtx, cl)
-		return
+		return a.execCustomLog(aCtx, cl)
 	}
 	req := rlog.GetRaftCmdRequest()
 	requests := req.GetRequests()
@@ -886,6 +982,10 @@ func (a *applier) execWriteCmd(aCtx *applyContext, rlog raftlog.RaftLog) (
 			a.execCommit(aCtx, *x)
 		case *rollbackOp:
 			a.execRollback(aCtx, *x)
+		case *raft_cmdpb.PutRequest:
+			a.execRawPut(aCtx, x.Key, x.Value)
+		case *raft_cmdpb.DeleteRequest:
+			a.execRawDelete(aCtx, x.Key)
 		case *raft_cmdpb.DeleteRangeRequest:
 			a.execDeleteRange(aCtx, x)
 			rangeDeleted = true
@@ -912,12 +1012,13 @@ func (a *applier) execWriteCmd(aCtx *applyContext, rlog raftlog.RaftLog) (
 }
 
 func (a *applier) execCustomLog(actx *applyContext, cl *raftlog.CustomRaftLog) (
-	resp *raft_cmdpb.RaftCmdResponse) {
+	resp *raft_cmdpb.RaftCmdResponse, result applyResult) {
 	var cnt int
 	switch cl.Type() {
 	case raftlog.TypePrewrite, raftlog.TypePessimisticLock:
 		cl.IterateLock(func(key, val []byte) {
 			actx.wb.SetLock(key, val)
+			actx.observeLock(key, val)
 			cnt++
 		})
 	case raftlog.TypeCommit:
@@ -930,6 +1031,7 @@ func (a *applier) execCustomLog(actx *applyContext, cl *raftlog.CustomRaftLog) (
 			actx.wb.Rollback(y.KeyWithTs(key, startTS))
 			if deleteLock {
 				actx.wb.DeleteLock(key)
+				actx.observeRollback(key, startTS)
 			}
 			cnt++
 		})
@@ -938,6 +1040,39 @@ func (a *applier) execCustomLog(actx *applyContext, cl *raftlog.CustomRaftLog) (
 			actx.wb.DeleteLock(key)
 			cnt++
 		})
+	case raftlog.TypeDeleteRange:
+		cl.IterateDeleteRange(func(startKey, endKey []byte) {
+			a.deleteRange(actx, startKey, endKey)
+			cnt++
+		})
+		result = applyResult{
+			tp:   applyResultTypeExecResult,
+			data: &execResultDeleteRange{},
+		}
+	case raftlog.TypeRawPut:
+		cl.IterateRawPut(func(key, val []byte) {
+			a.execRawPut(actx, key, val)
+			cnt++
+		})
+	case raftlog.TypeRawDelete:
+		cl.IterateRawDelete(func(key []byte) {
+			a.execRawDelete(actx, key)
+			cnt++
+		})
+	case raftlog.TypePessimisticLockWithForUpdateTS:
+		cl.IteratePessimisticLockWithForUpdateTS(func(key, val []byte, forUpdateTS uint64) {
+			if !a.isStalePessimisticLock(actx, key, val, forUpdateTS) {
+				actx.wb.SetLock(key, val)
+				actx.observeLock(key, val)
+			}
+			cnt++
+		})
+	case raftlog.TypeOnePC:
+		// The keys are committed directly, only the pessimistic locks of the transaction are deleted.
+		cl.IterateOnePC(func(key, val []byte, commitTS uint64) {
+			a.commitOnePC(actx, key, val, commitTS)
+			cnt++
+		})
 	}
 	resp = &raft_cmdpb.RaftCmdResponse{Header: &raft_cmdpb.RaftResponseHeader{}}
 	resp.Responses = make([]*raft_cmdpb.Response, cnt)
@@ -999,6 +1134,9 @@ func createWriteCmdOps(requests []*raft_cmdpb.Request) (ops []interface{}) {
 				ops = append(ops, &rollbackOp{
 					delLock: req.Delete,
 				})
+			case CFDefault:
+				// This is raw delete.
+				ops = append(ops, req.Delete)
 			default:
 				panic("unreachable")
 			}
@@ -1017,6 +1155,9 @@ func createWriteCmdOps(requests []*raft_cmdpb.Request) (ops []interface{}) {
 			case CFLock:
 				// Prewrite with short value.
 				ops = append(ops, &prewriteOp{putLock: put})
+			case CFDefault:
+				// This is raw put.
+				ops = append(ops, put)
 			case CFWrite:
 				writeType := put.Value[0]
 				if writeType == mvcc.WriteTypeRollback {
@@ -1050,7 +1191,7 @@ func createWriteCmdOps(requests []*raft_cmdpb.Request) (ops []interface{}) {
 				}
 			}
 		case raft_cmdpb.CmdType_DeleteRange:
-			ops = append(ops, &req.DeleteRange)
+			ops = append(ops, req.DeleteRange)
 		case raft_cmdpb.CmdType_IngestSST:
 			panic("ingestSST not unsupported")
 		case raft_cmdpb.CmdType_Snap, raft_cmdpb.CmdType_Get:
@@ -1069,6 +1210,7 @@ func createWriteCmdOps(requests []*raft_cmdpb.Request) (ops []interface{}) {
 func (a *applier) execPrewrite(aCtx *applyContext, op prewriteOp) {
 	key, value := convertPrewriteToLock(op, aCtx.getTxn())
 	aCtx.wb.SetLock(key, value)
+	aCtx.observeLock(key, value)
 }
 
 func convertPrewriteToLock(op prewriteOp, txn *badger.Txn) (key, value []byte) {
@@ -1076,7 +1218,7 @@ func convertPrewriteToLock(op prewriteOp, txn *badger.Txn) (key, value []byte) {
 	if err != nil {
 		panic(op.putLock.Key)
 	}
-	lock, err := mvcc.ParseLockCFValue(op.putLock.Value)
+	lock, err := parseRaftLockCFValue(op.putLock.Value)
 	if err != nil {
 		panic(op.putLock.Value)
 	}
@@ -1101,6 +1243,21 @@ func (a *applier) execCommit(aCtx *applyContext, op commitOp) {
 }
 
 func (a *applier) commitLock(aCtx *applyContext, rawKey []byte, val []byte, commitTS uint64) {
+	a.commitValue(aCtx, rawKey, val, commitTS)
+	aCtx.wb.DeleteLock(rawKey)
+	aCtx.observeCommit(rawKey, val, commitTS, false)
+}
+
+func (a *applier) commitOnePC(aCtx *applyContext, rawKey []byte, val []byte, commitTS uint64) {
+	a.commitValue(aCtx, rawKey, val, commitTS)
+	aCtx.observeCommit(rawKey, val, commitTS, true)
+	if len(a.getLock(aCtx, rawKey)) > 0 {
+		aCtx.wb.DeleteLock(rawKey)
+	}
+}
+
+// commitValue writes the value of the lock committed at commitTS.
+func (a *applier) commitValue(aCtx *applyContext, rawKey []byte, val []byte, commitTS uint64) {
 	lock := mvcc.DecodeLock(val)
 	var sizeDiff int64
 	userMeta := mvcc.NewDBUserMeta(lock.StartTS, commitTS)
@@ -1113,20 +1270,40 @@ func (a *applier) commitLock(aCtx *applyContext, rawKey []byte, val []byte, comm
 	if sizeDiff > 0 {
 		a.metrics.sizeDiffHint += uint64(sizeDiff)
 	}
-	aCtx.wb.DeleteLock(rawKey)
 }
 
-func (a *applier) getLock(aCtx *applyContext, rawKey []byte) []byte {
-	if val := aCtx.engines.kv.LockStore.Get(rawKey, nil); len(val) > 0 {
-		return val
+// isStalePessimisticLock returns true if the lock of the same transaction already exists with a
+// newer for-update-ts, or it's already prewritten. It happens when a pessimistic lock request is
+// retried, the late lock must not overwrite the newer one. A prewritten lock is also updated in this
+// way to push its min-commit-ts, which is never stale.
+func (a *applier) isStalePessimisticLock(aCtx *applyContext, rawKey, val []byte, forUpdateTS uint64) bool {
+	return isStalePessimisticLock(a.getLock(aCtx, rawKey), val, forUpdateTS)
+}
+
+// isStalePessimisticLock returns true if the pessimistic lock val must not overwrite the existing lock oldVal.
+func isStalePessimisticLock(oldVal, val []byte, forUpdateTS uint64) bool {
+	if len(oldVal) == 0 {
+		return false
 	}
+	oldLock, lock := mvcc.DecodeLock(oldVal), mvcc.DecodeLock(val)
+	if oldLock.StartTS != lock.StartTS || lock.Op != uint8(kvrpcpb.Op_PessimisticLock) {
+		return false
+	}
+	return oldLock.Op != uint8(kvrpcpb.Op_PessimisticLock) || oldLock.ForUpdateTS > forUpdateTS
+}
+
+// getLock returns the lock of the key, the lock entries in the write batch are newer than the lock store.
+func (a *applier) getLock(aCtx *applyContext, rawKey []byte) []byte {
 	lockEntries := aCtx.wb.lockEntries
 	for i := len(lockEntries) - 1; i >= 0; i-- {
 		if bytes.Equal(lockEntries[i].Key.UserKey, rawKey) {
+			if lockEntries[i].UserMeta[0] == mvcc.LockUserMetaDeleteByte {
+				return nil
+			}
 			return lockEntries[i].Value
 		}
 	}
-	return nil
+	return aCtx.engines.kv.LockStore.Get(rawKey, nil)
 }
 
 func (a *applier) execRollback(aCtx *applyContext, op rollbackOp) {
@@ -1135,9 +1312,11 @@ func (a *applier) execRollback(aCtx *applyContext, op rollbackOp) {
 		if err != nil {
 			panic(op.putWrite.Key)
 		}
-		aCtx.wb.Rollback(y.KeyWithTs(rawKey, mvcc.DecodeKeyTS(remain)))
+		startTS := mvcc.DecodeKeyTS(remain)
+		aCtx.wb.Rollback(y.KeyWithTs(rawKey, startTS))
 		if op.delLock != nil {
 			aCtx.wb.DeleteLock(rawKey)
+			aCtx.observeRollback(rawKey, startTS)
 		}
 		return
 	}
@@ -1150,7 +1329,22 @@ func (a *applier) execRollback(aCtx *applyContext, op rollbackOp) {
 	}
 }
 
+// execRawPut puts the raw kv data, the raw kv data is put into the default CF in the raft command like TiKV.
+func (a *applier) execRawPut(aCtx *applyContext, key, val []byte) {
+	aCtx.wb.Set(y.KeyWithTs(RawDataKey(key), KvTS), val)
+	a.metrics.sizeDiffHint += uint64(len(key) + len(val))
+}
+
+func (a *applier) execRawDelete(aCtx *applyContext, key []byte) {
+	aCtx.wb.Delete(y.KeyWithTs(RawDataKey(key), KvTS))
+}
+
 func (a *applier) execDeleteRange(aCtx *applyContext, req *raft_cmdpb.DeleteRangeRequest) {
+	if req.Cf == CFDefault {
+		// The raw keys are not encoded.
+		a.deleteRange(aCtx, RawDataKey(req.StartKey), RawDataEndKey(req.EndKey))
+		return
+	}
 	_, startKey, err := codec.DecodeBytes(req.StartKey, nil)
 	if err != nil {
 		panic(req.StartKey)
@@ -1159,6 +1353,11 @@ func (a *applier) execDeleteRange(aCtx *applyContext, req *raft_cmdpb.DeleteRang
 	if err != nil {
 		panic(req.EndKey)
 	}
+	a.deleteRange(aCtx, startKey, endKey)
+}
+
+// deleteRange deletes the data and the locks in the range [startKey, endKey) of the decoded keys.
+func (a *applier) deleteRange(aCtx *applyContext, startKey, endKey []byte) {
 	txn := aCtx.getTxn()
 	it := dbreader.NewIterator(txn, false, startKey, endKey)
 	for it.Seek(startKey); it.Valid(); it.Next() {
@@ -1166,7 +1365,7 @@ func (a *applier) execDeleteRange(aCtx *applyContext, req *raft_cmdpb.DeleteRang
 		if bytes.Compare(item.Key(), endKey) >= 0 {
 			break
 		}
-		aCtx.wb.Delete(y.KeyWithTs(item.KeyCopy(nil), item.Version()+1))
+		aCtx.wb.Delete(tombstoneKey(item.KeyCopy(nil), item.Version()))
 	}
 	it.Close()
 	lockIt := aCtx.engines.kv.LockStore.NewIterator()
@@ -1294,6 +1493,9 @@ func (a *applier) execBatchSplit(aCtx *applyContext, req *raft_cmdpb.AdminReques
 		err = errors.New("missing split key")
 		return
 	}
+	if err = evalFailpoint(FailpointApplyBeforeSplit); err != nil {
+		return
+	}
 	derived := new(metapb.Region)
 	if err := CloneMsg(a.region, derived); err != nil {
 		panic(err)
@@ -1470,6 +1672,8 @@ func (a *applier) handleApply(aCtx *applyContext, apply *apply) {
 		apply.entries[i] = eraftpb.Entry{}
 	}
 	apply.entries = apply.entries[:0]
+	// The commands proposed before a leader change may never be committed.
+	a.pendingCmds.removeExpired(time.Now())
 	if a.waitMergeState != nil {
 		return
 	}
@@ -1504,6 +1708,7 @@ func (a *applier) handleProposal(regionProposal *regionProposal) {
 			a.pendingCmds.appendNormal(cmd)
 		}
 	}
+	a.pendingCmds.removeExpired(time.Now())
 }
 
 func (a *applier) destroy(aCtx *applyContext) {
@@ -1516,6 +1721,7 @@ func (a *applier) destroy(aCtx *applyContext) {
 	}
 	log.S().Infof("%s remove applier", a.tag)
 	a.stopped = true
+	aCtx.cdcObserver.deregisterRegion(regionID, &cdcpb.Error{RegionNotFound: &errorpb.RegionNotFound{RegionId: regionID}})
 	for _, cmd := range a.pendingCmds.normals {
 		notifyRegionRemoved(a.region.Id, a.id, cmd)
 	}
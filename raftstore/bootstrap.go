@@ -62,7 +62,7 @@ func BootstrapStore(engines *Engines, clussterID, storeID uint64) error {
 	if !empty {
 		return errors.New("kv store is not empty and ahs alread had data")
 	}
-	empty, err = isRangeEmpty(engines.raft, MinKey, MaxDataKey)
+	empty, err = engines.raft.IsEmpty()
 	if err != nil {
 		return err
 	}
@@ -151,19 +151,17 @@ func writeInitialRaftState(raftWB *WriteBatch, regionID uint64) {
 
 // ClearPrepareBootstrap clears the cluster information and raft state.
 func ClearPrepareBootstrap(engines *Engines, regionID uint64) error {
-	err := engines.raft.Update(func(txn *badger.Txn) error {
-		return txn.Delete(RaftStateKey(regionID))
-	})
-	if err != nil {
-		return errors.WithStack(err)
+	raftWB := new(WriteBatch)
+	raftWB.Delete(y.KeyWithTs(RaftStateKey(regionID), RaftTS))
+	if err := engines.WriteRaft(raftWB); err != nil {
+		return err
 	}
 	wb := new(WriteBatch)
 	wb.Delete(y.KeyWithTs(prepareBootstrapKey, KvTS))
 	// should clear raft initial state too.
 	wb.Delete(y.KeyWithTs(RegionStateKey(regionID), KvTS))
 	wb.Delete(y.KeyWithTs(ApplyStateKey(regionID), KvTS))
-	err = engines.WriteKV(wb)
-	if err != nil {
+	if err := engines.WriteKV(wb); err != nil {
 		return err
 	}
 	return engines.SyncKVWAL()
@@ -45,7 +45,7 @@ func TestBootstrapStore(t *testing.T) {
 	require.Nil(t, err)
 	raftApplyState.Unmarshal(val)
 	raftLocalState := raftState{}
-	val, err = getValue(engines.raft, RaftStateKey(1))
+	val, err = engines.raft.GetState(1)
 	require.Nil(t, err)
 	raftLocalState.Unmarshal(val)
 
@@ -0,0 +1,350 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/cdcpb"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+)
+
+var errCDCCongested = errors.New("cdc stream is congested")
+
+const (
+	// cdcConnBufferSize is the number of events buffered for a stream, the stream is closed if the client
+	// can't keep up, so a slow client never blocks the applier.
+	cdcConnBufferSize = 4096
+	// cdcMaxBatchEvents is the max number of events sent in a ChangeDataEvent.
+	cdcMaxBatchEvents = 64
+	// cdcMaxBatchRows is the max number of rows in an event of the incremental scan.
+	cdcMaxBatchRows = 128
+)
+
+// cdcConn is an EventFeed stream, the events are sent by its own goroutine.
+type cdcConn struct {
+	stream    cdcpb.ChangeData_EventFeedServer
+	eventCh   chan *cdcpb.Event
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+func newCDCConn(stream cdcpb.ChangeData_EventFeedServer) *cdcConn {
+	return &cdcConn{
+		stream:  stream,
+		eventCh: make(chan *cdcpb.Event, cdcConnBufferSize),
+		closeCh: make(chan struct{}),
+	}
+}
+
+// send queues the event without blocking, the conn is closed if the buffer is full.
+func (c *cdcConn) send(event *cdcpb.Event) {
+	select {
+	case <-c.closeCh:
+	case c.eventCh <- event:
+	default:
+		c.close(errCDCCongested)
+	}
+}
+
+func (c *cdcConn) close(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.closeCh)
+	})
+}
+
+func (c *cdcConn) run() {
+	for {
+		var events []*cdcpb.Event
+		select {
+		case <-c.closeCh:
+			return
+		case event := <-c.eventCh:
+			events = append(make([]*cdcpb.Event, 0, cdcMaxBatchEvents), event)
+		}
+		for len(events) < cdcMaxBatchEvents && len(c.eventCh) > 0 {
+			events = append(events, <-c.eventCh)
+		}
+		if err := c.stream.Send(&cdcpb.ChangeDataEvent{Events: events}); err != nil {
+			c.close(err)
+			return
+		}
+	}
+}
+
+// cdcDownstream is a region subscribed by a stream.
+type cdcDownstream struct {
+	conn         *cdcConn
+	regionID     uint64
+	requestID    uint64
+	checkpointTS uint64
+	// startKey and endKey are the decoded keys of the subscribed range, a nil endKey means no upper bound.
+	startKey []byte
+	endKey   []byte
+
+	// The rows applied during the incremental scan are kept in pending, and sent after the scan.
+	initialized bool
+	pending     []*cdcpb.Event_Row
+}
+
+func (d *cdcDownstream) inRange(key []byte) bool {
+	return bytes.Compare(key, d.startKey) >= 0 && (d.endKey == nil || bytes.Compare(key, d.endKey) < 0)
+}
+
+func (d *cdcDownstream) sendRows(rows []*cdcpb.Event_Row) {
+	entries := make([]*cdcpb.Event_Row, 0, len(rows))
+	for _, row := range rows {
+		if d.inRange(row.Key) {
+			entries = append(entries, row)
+		}
+	}
+	if len(entries) > 0 {
+		d.sendEntries(entries)
+	}
+}
+
+func (d *cdcDownstream) sendEntries(entries []*cdcpb.Event_Row) {
+	d.conn.send(&cdcpb.Event{
+		RegionId:  d.regionID,
+		RequestId: d.requestID,
+		Event:     &cdcpb.Event_Entries_{Entries: &cdcpb.Event_Entries{Entries: entries}},
+	})
+}
+
+func (d *cdcDownstream) sendError(err *cdcpb.Error) {
+	d.conn.send(&cdcpb.Event{
+		RegionId:  d.regionID,
+		RequestId: d.requestID,
+		Event:     &cdcpb.Event_Error{Error: err},
+	})
+}
+
+// cdcDelegate keeps the downstreams of a region.
+type cdcDelegate struct {
+	region      *metapb.Region
+	downstreams []*cdcDownstream
+	resolvedTS  uint64
+}
+
+// cdcObserver observes the rows applied by the applier and sends them to the downstreams of the regions.
+//
+// A region is registered between two apply batches, so all the changes applied before it's registered
+// are already written to the kv engine and can be read by the incremental scan, and all the changes
+// after it are observed.
+type cdcObserver struct {
+	applyMu   sync.RWMutex
+	mu        sync.RWMutex
+	delegates map[uint64]*cdcDelegate
+}
+
+func newCDCObserver() *cdcObserver {
+	return &cdcObserver{delegates: make(map[uint64]*cdcDelegate)}
+}
+
+// beginApply is called by the apply worker before an apply batch, endApply is called after the batch
+// is written to the kv engine.
+func (o *cdcObserver) beginApply() {
+	if o != nil {
+		o.applyMu.RLock()
+	}
+}
+
+func (o *cdcObserver) endApply() {
+	if o != nil {
+		o.applyMu.RUnlock()
+	}
+}
+
+func (o *cdcObserver) isObserved(regionID uint64) bool {
+	if o == nil {
+		return false
+	}
+	o.mu.RLock()
+	_, ok := o.delegates[regionID]
+	o.mu.RUnlock()
+	return ok
+}
+
+// register adds the downstream to the region, it returns false if the request is duplicated.
+func (o *cdcObserver) register(region *metapb.Region, ds *cdcDownstream) bool {
+	o.applyMu.Lock()
+	defer o.applyMu.Unlock()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	d := o.delegates[region.Id]
+	if d == nil {
+		d = &cdcDelegate{region: region}
+		o.delegates[region.Id] = d
+	}
+	for _, old := range d.downstreams {
+		if old.conn == ds.conn && old.requestID == ds.requestID {
+			return false
+		}
+	}
+	d.downstreams = append(d.downstreams, ds)
+	return true
+}
+
+// finishScan sends the rows applied during the incremental scan of the downstream.
+func (o *cdcObserver) finishScan(ds *cdcDownstream) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	ds.sendEntries([]*cdcpb.Event_Row{{Type: cdcpb.Event_INITIALIZED}})
+	ds.sendRows(ds.pending)
+	ds.pending = nil
+	ds.initialized = true
+}
+
+// onApply sends the rows of an applied command to the downstreams of the region.
+func (o *cdcObserver) onApply(regionID uint64, rows []*cdcpb.Event_Row) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	d := o.delegates[regionID]
+	if d == nil {
+		return
+	}
+	for _, ds := range d.downstreams {
+		if ds.initialized {
+			ds.sendRows(rows)
+		} else {
+			ds.pending = append(ds.pending, rows...)
+		}
+	}
+}
+
+// updateRegion updates the region of a conf change, the downstreams are kept.
+func (o *cdcObserver) updateRegion(region *metapb.Region) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	if d := o.delegates[region.Id]; d != nil {
+		d.region = region
+	}
+	o.mu.Unlock()
+}
+
+// deregisterRegion removes all the downstreams of the region with the error.
+func (o *cdcObserver) deregisterRegion(regionID uint64, err *cdcpb.Error) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	d := o.delegates[regionID]
+	if d == nil {
+		return
+	}
+	log.S().Infof("region %d deregistered from cdc, err %v", regionID, err)
+	for _, ds := range d.downstreams {
+		ds.sendError(err)
+	}
+	delete(o.delegates, regionID)
+}
+
+// deregisterConn removes all the downstreams of the closed stream.
+func (o *cdcObserver) deregisterConn(conn *cdcConn) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for regionID, d := range o.delegates {
+		downstreams := d.downstreams[:0]
+		for _, ds := range d.downstreams {
+			if ds.conn != conn {
+				downstreams = append(downstreams, ds)
+			}
+		}
+		d.downstreams = downstreams
+		if len(downstreams) == 0 {
+			delete(o.delegates, regionID)
+		}
+	}
+}
+
+// regions returns the observed regions.
+func (o *cdcObserver) regions() []*metapb.Region {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	regions := make([]*metapb.Region, 0, len(o.delegates))
+	for _, d := range o.delegates {
+		regions = append(regions, d.region)
+	}
+	return regions
+}
+
+// sendResolvedTS sends the resolved ts to the initialized downstreams of the region, the resolved ts
+// never goes backward.
+func (o *cdcObserver) sendResolvedTS(regionID, ts uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	d := o.delegates[regionID]
+	if d == nil || ts <= d.resolvedTS {
+		return
+	}
+	d.resolvedTS = ts
+	for _, ds := range d.downstreams {
+		if ds.initialized {
+			ds.conn.send(&cdcpb.Event{
+				RegionId:  regionID,
+				RequestId: ds.requestID,
+				Event:     &cdcpb.Event_ResolvedTs{ResolvedTs: ts},
+			})
+		}
+	}
+}
+
+// newCDCRow returns the row of the lock, or nil if the lock doesn't change the value of the key.
+func newCDCRow(key []byte, lock *mvcc.Lock, tp cdcpb.Event_LogType) *cdcpb.Event_Row {
+	row := &cdcpb.Event_Row{
+		StartTs: lock.StartTS,
+		Type:    tp,
+		Key:     y.SafeCopy(nil, key),
+	}
+	switch kvrpcpb.Op(lock.Op) {
+	case kvrpcpb.Op_Put, kvrpcpb.Op_Insert:
+		row.OpType = cdcpb.Event_Row_PUT
+		row.Value = y.SafeCopy(nil, lock.Value)
+	case kvrpcpb.Op_Del:
+		row.OpType = cdcpb.Event_Row_DELETE
+	default:
+		return nil
+	}
+	return row
+}
+
+// toCDCError converts the region error to the CDC error, the errors other than not leader and epoch
+// not match are returned as region not found, the client retries them in the same way.
+func toCDCError(regionID uint64, err *errorpb.Error) *cdcpb.Error {
+	switch {
+	case err.GetNotLeader() != nil:
+		return &cdcpb.Error{NotLeader: err.NotLeader}
+	case err.GetEpochNotMatch() != nil:
+		return &cdcpb.Error{EpochNotMatch: err.EpochNotMatch}
+	case err.GetRegionNotFound() != nil:
+		return &cdcpb.Error{RegionNotFound: err.RegionNotFound}
+	}
+	return &cdcpb.Error{RegionNotFound: &errorpb.RegionNotFound{RegionId: regionID}}
+}
+
+func cdcEpochNotMatch(regions ...*metapb.Region) *cdcpb.Error {
+	return &cdcpb.Error{EpochNotMatch: &errorpb.EpochNotMatch{CurrentRegions: regions}}
+}
@@ -0,0 +1,287 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"time"
+
+	"github.com/pingcap/badger"
+	"github.com/pingcap/kvproto/pkg/cdcpb"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/store/mockstore/unistore/pd"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+// CDCService implements the cdcpb.ChangeDataServer interface, it streams the committed rows of the
+// subscribed regions on the leader.
+//
+// A subscription starts with an incremental scan, which sends the rows committed after the checkpoint
+// ts as COMMITTED rows and the locks as PREWRITE rows, then an INITIALIZED row. After that, the applied
+// rows are sent as they are applied, and the rows applied during the scan may be sent twice. The
+// resolved ts of a region is the min start ts of the locks in the region and a ts allocated by PD,
+// it's sent periodically after the subscription is initialized. The async commit and 1PC
+// transactions are not considered by the resolved ts.
+type CDCService struct {
+	bundle             *mvcc.DBBundle
+	rm                 *RaftRegionManager
+	pdClient           pd.Client
+	observer           *cdcObserver
+	clock              Clock
+	resolvedTSInterval time.Duration
+	closeCh            chan struct{}
+}
+
+// NewCDCService returns the CDC service of the store, the region manager checks the leaders of the
+// subscribed regions. The service should be closed after it's not used.
+func (ris *RaftInnerServer) NewCDCService(rm *RaftRegionManager, pdClient pd.Client) *CDCService {
+	s := &CDCService{
+		bundle:             ris.engines.kv,
+		rm:                 rm,
+		pdClient:           pdClient,
+		observer:           ris.cdcObserver,
+		clock:              ris.raftConfig.Clock,
+		resolvedTSInterval: ris.raftConfig.CDCResolvedTsInterval,
+		closeCh:            make(chan struct{}),
+	}
+	go s.runResolver()
+	return s
+}
+
+// Close stops the resolved ts of the service.
+func (s *CDCService) Close() {
+	close(s.closeCh)
+}
+
+// EventFeed implements the cdcpb.ChangeDataServer EventFeed method.
+func (s *CDCService) EventFeed(stream cdcpb.ChangeData_EventFeedServer) error {
+	conn := newCDCConn(stream)
+	go conn.run()
+	defer s.observer.deregisterConn(conn)
+	reqCh := make(chan *cdcpb.ChangeDataRequest)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				conn.close(err)
+				return
+			}
+			select {
+			case reqCh <- req:
+			case <-conn.closeCh:
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case req := <-reqCh:
+			if req.GetNotifyTxnStatus() == nil {
+				s.register(conn, req)
+			}
+		case <-conn.closeCh:
+			return conn.err
+		}
+	}
+}
+
+func (s *CDCService) register(conn *cdcConn, req *cdcpb.ChangeDataRequest) {
+	ds := &cdcDownstream{
+		conn:         conn,
+		regionID:     req.RegionId,
+		requestID:    req.RequestId,
+		checkpointTS: req.CheckpointTs,
+	}
+	region, regErr := s.checkRegion(req.RegionId, req.RegionEpoch)
+	if regErr != nil {
+		ds.sendError(toCDCError(req.RegionId, regErr))
+		return
+	}
+	// The keys of the request are encoded like the region keys.
+	ds.startKey, ds.endKey = RawStartKey(region), RawEndKey(region)
+	if len(req.StartKey) > 0 {
+		if _, key, err := codec.DecodeBytes(req.StartKey, nil); err == nil && bytes.Compare(key, ds.startKey) > 0 {
+			ds.startKey = key
+		}
+	}
+	if len(req.EndKey) > 0 {
+		if _, key, err := codec.DecodeBytes(req.EndKey, nil); err == nil && bytes.Compare(key, ds.endKey) < 0 {
+			ds.endKey = key
+		}
+	}
+	if bytes.Equal(ds.endKey, MaxDataKey) {
+		ds.endKey = nil
+	}
+	if !s.observer.register(region, ds) {
+		ds.sendError(&cdcpb.Error{DuplicateRequest: &cdcpb.DuplicateRequest{RegionId: req.RegionId}})
+		return
+	}
+	log.S().Infof("region %d registered to cdc, request %d, checkpoint ts %d", req.RegionId, req.RequestId, req.CheckpointTs)
+	go s.incrementalScan(ds)
+}
+
+// incrementalScan sends the rows committed after the checkpoint ts and the locks of the downstream.
+func (s *CDCService) incrementalScan(ds *cdcDownstream) {
+	txn := s.bundle.DB.NewTransaction(false)
+	defer txn.Discard()
+	opts := badger.DefaultIteratorOptions
+	opts.AllVersions = true
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	rows := make([]*cdcpb.Event_Row, 0, cdcMaxBatchRows)
+	flush := func() {
+		if len(rows) > 0 {
+			ds.sendEntries(rows)
+			rows = make([]*cdcpb.Event_Row, 0, cdcMaxBatchRows)
+		}
+	}
+	// The raw kv data is out of the data range.
+	endKey := ds.endKey
+	if endKey == nil {
+		endKey = MaxDataKey
+	}
+	for it.Seek(ds.startKey); it.Valid(); it.Next() {
+		item := it.Item()
+		if bytes.Compare(item.Key(), endKey) >= 0 {
+			break
+		}
+		meta := mvcc.DBUserMeta(item.UserMeta())
+		if len(meta) == 0 || item.IsEmpty() || meta.CommitTS() <= ds.checkpointTS ||
+			isExtraTxnStatusKey(item.Key(), meta.StartTS()) {
+			continue
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			ds.conn.close(err)
+			return
+		}
+		row := &cdcpb.Event_Row{
+			StartTs:  meta.StartTS(),
+			CommitTs: meta.CommitTS(),
+			Type:     cdcpb.Event_COMMITTED,
+			OpType:   cdcpb.Event_Row_PUT,
+			Key:      item.KeyCopy(nil),
+			Value:    val,
+		}
+		if len(val) == 0 {
+			row.OpType = cdcpb.Event_Row_DELETE
+		}
+		rows = append(rows, row)
+		if len(rows) == cdcMaxBatchRows {
+			flush()
+		}
+	}
+	lockIt := s.bundle.LockStore.NewIterator()
+	for lockIt.Seek(ds.startKey); lockIt.Valid(); lockIt.Next() {
+		if !ds.inRange(lockIt.Key()) {
+			break
+		}
+		lock := mvcc.DecodeLock(lockIt.Value())
+		if row := newCDCRow(lockIt.Key(), &lock, cdcpb.Event_PREWRITE); row != nil {
+			rows = append(rows, row)
+		}
+		if len(rows) == cdcMaxBatchRows {
+			flush()
+		}
+	}
+	flush()
+	s.observer.finishScan(ds)
+}
+
+func (s *CDCService) runResolver() {
+	ticker := s.clock.NewTicker(s.resolvedTSInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case <-ticker.C():
+		}
+		regions := s.observer.regions()
+		if len(regions) == 0 {
+			continue
+		}
+		// The ts must be allocated before the locks are read, the transactions prewritten after it
+		// are committed at a greater ts.
+		physical, logical, err := s.pdClient.GetTS(context.Background())
+		if err != nil {
+			log.S().Warnf("get ts for cdc resolved ts failed, err %v", err)
+			continue
+		}
+		ts := uint64(physical)<<18 + uint64(logical)
+		for _, region := range regions {
+			s.resolve(region, ts)
+		}
+	}
+}
+
+// resolve sends the resolved ts of the region, or deregisters the region if the store is not its leader.
+func (s *CDCService) resolve(region *metapb.Region, ts uint64) {
+	if _, regErr := s.checkRegion(region.Id, region.RegionEpoch); regErr != nil {
+		s.observer.deregisterRegion(region.Id, toCDCError(region.Id, regErr))
+		return
+	}
+	startKey, endKey := RawStartKey(region), RawEndKey(region)
+	minStartTS := uint64(math.MaxUint64)
+	it := s.bundle.LockStore.NewIterator()
+	for it.Seek(startKey); it.Valid(); it.Next() {
+		if bytes.Compare(it.Key(), endKey) >= 0 {
+			break
+		}
+		lock := mvcc.DecodeLock(it.Value())
+		// The pessimistic locks are prewritten before they are committed.
+		if lock.Op != uint8(kvrpcpb.Op_PessimisticLock) && lock.StartTS < minStartTS {
+			minStartTS = lock.StartTS
+		}
+	}
+	if minStartTS < ts {
+		ts = minStartTS
+	}
+	s.observer.sendResolvedTS(region.Id, ts)
+}
+
+// checkRegion returns the region if its epoch matches and the store is its leader.
+func (s *CDCService) checkRegion(regionID uint64, epoch *metapb.RegionEpoch) (*metapb.Region, *errorpb.Error) {
+	ctx := &kvrpcpb.Context{RegionId: regionID, RegionEpoch: epoch}
+	regCtx, regErr := s.rm.regionManager.GetRegionFromCtx(ctx)
+	if regErr != nil {
+		return nil, regErr
+	}
+	// The CDC requests don't have the peer, the leader is checked with the peer on the store.
+	region := regCtx.Meta()
+	ctx.Peer = findPeer(region, s.rm.storeMeta.Id)
+	if ctx.Peer == nil {
+		return nil, &errorpb.Error{Message: "region not found", RegionNotFound: &errorpb.RegionNotFound{RegionId: regionID}}
+	}
+	if _, regErr = s.rm.GetRegionFromCtx(ctx); regErr != nil {
+		return nil, regErr
+	}
+	return region, nil
+}
+
+// isExtraTxnStatusKey returns true if the key is the op lock or rollback record of the transaction,
+// which is encoded with the start ts as the suffix.
+func isExtraTxnStatusKey(key []byte, startTS uint64) bool {
+	if len(key) <= 8 {
+		return false
+	}
+	_, ts, err := codec.DecodeUintDesc(key[len(key)-8:])
+	return err == nil && ts == startTS
+}
@@ -0,0 +1,180 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/cdcpb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// testEventFeedStream is an EventFeed stream, the requests and events are passed by channels.
+type testEventFeedStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	reqCh   chan *cdcpb.ChangeDataRequest
+	eventCh chan *cdcpb.ChangeDataEvent
+	events  []*cdcpb.Event
+}
+
+func newTestEventFeedStream(ctx context.Context) *testEventFeedStream {
+	return &testEventFeedStream{
+		ctx:     ctx,
+		reqCh:   make(chan *cdcpb.ChangeDataRequest, 16),
+		eventCh: make(chan *cdcpb.ChangeDataEvent, 1024),
+	}
+}
+
+func (s *testEventFeedStream) Send(e *cdcpb.ChangeDataEvent) error {
+	select {
+	case s.eventCh <- e:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+func (s *testEventFeedStream) Recv() (*cdcpb.ChangeDataRequest, error) {
+	select {
+	case req := <-s.reqCh:
+		return req, nil
+	case <-s.ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+func (s *testEventFeedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *testEventFeedStream) nextEvent(t *testing.T) *cdcpb.Event {
+	for len(s.events) == 0 {
+		select {
+		case e := <-s.eventCh:
+			s.events = e.Events
+		case <-time.After(testClusterTimeout):
+			require.FailNow(t, "cdc event timeout")
+		}
+	}
+	e := s.events[0]
+	s.events = s.events[1:]
+	return e
+}
+
+// nextRows returns the rows of the next n entries, the resolved ts events are skipped.
+func (s *testEventFeedStream) nextRows(t *testing.T, n int) []*cdcpb.Event_Row {
+	var rows []*cdcpb.Event_Row
+	for len(rows) < n {
+		e := s.nextEvent(t)
+		if e.GetResolvedTs() > 0 {
+			continue
+		}
+		require.Nil(t, e.GetError())
+		rows = append(rows, e.GetEntries().GetEntries()...)
+	}
+	require.Len(t, rows, n)
+	return rows
+}
+
+func TestCDCEventFeed(t *testing.T) {
+	c := newTestCluster(t, 1, func(cfg *Config) {
+		cfg.CDCResolvedTsInterval = 50 * time.Millisecond
+	})
+	defer c.Shutdown()
+
+	k1, k2, k3 := []byte("t1"), []byte("t2"), []byte("t3")
+	c.MustPut(k1, []byte("v1"))
+	lockTS := c.MustPrewrite(k2, []byte("v2"))
+
+	store := c.getStore(c.storeIDs[0])
+	svc := store.server.NewCDCService(store.rm, store.pdCli)
+	defer svc.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := newTestEventFeedStream(ctx)
+	go func() {
+		_ = svc.EventFeed(stream)
+	}()
+
+	// The region manager may not know the leader yet, retry the request until it's registered.
+	var requestID uint64
+	var event *cdcpb.Event
+	c.retry(func() bool {
+		region := c.GetRegion(k1)
+		requestID++
+		stream.reqCh <- &cdcpb.ChangeDataRequest{
+			RegionId:    region.Id,
+			RegionEpoch: region.RegionEpoch,
+			RequestId:   requestID,
+		}
+		event = stream.nextEvent(t)
+		return event.GetError() == nil
+	}, "failed to register region to cdc")
+	stream.events = append([]*cdcpb.Event{event}, stream.events...)
+
+	// The incremental scan sends the committed rows, the locks and an initialized row.
+	rows := stream.nextRows(t, 3)
+	require.Equal(t, cdcpb.Event_COMMITTED, rows[0].Type)
+	require.Equal(t, k1, rows[0].Key)
+	require.Equal(t, []byte("v1"), rows[0].Value)
+	require.Equal(t, cdcpb.Event_PREWRITE, rows[1].Type)
+	require.Equal(t, k2, rows[1].Key)
+	require.Equal(t, lockTS, rows[1].StartTs)
+	require.Equal(t, cdcpb.Event_INITIALIZED, rows[2].Type)
+
+	// The applied rows are sent after the scan.
+	c.MustPut(k3, []byte("v3"))
+	rows = stream.nextRows(t, 2)
+	require.Equal(t, cdcpb.Event_PREWRITE, rows[0].Type)
+	require.Equal(t, k3, rows[0].Key)
+	require.Equal(t, cdcpb.Event_Row_PUT, rows[0].OpType)
+	require.Equal(t, []byte("v3"), rows[0].Value)
+	require.Equal(t, cdcpb.Event_COMMIT, rows[1].Type)
+	require.Equal(t, k3, rows[1].Key)
+	require.Equal(t, rows[0].StartTs, rows[1].StartTs)
+	require.Greater(t, rows[1].CommitTs, rows[1].StartTs)
+
+	// The resolved ts is held back by the lock of k2.
+	for {
+		if e := stream.nextEvent(t); e.GetResolvedTs() > 0 {
+			require.Equal(t, lockTS, e.GetResolvedTs())
+			break
+		}
+	}
+
+	// The region is deregistered after it's split.
+	c.MustSplit(k3)
+	for {
+		e := stream.nextEvent(t)
+		if e.GetResolvedTs() > 0 {
+			continue
+		}
+		require.Equal(t, requestID, e.RequestId)
+		require.NotNil(t, e.GetError().GetEpochNotMatch())
+		break
+	}
+}
+
+func TestIsExtraTxnStatusKey(t *testing.T) {
+	key := []byte("t1")
+	require.True(t, isExtraTxnStatusKey(mvcc.EncodeExtraTxnStatusKey(key, 100), 100))
+	require.False(t, isExtraTxnStatusKey(mvcc.EncodeExtraTxnStatusKey(key, 100), 101))
+	require.False(t, isExtraTxnStatusKey(key, 100))
+}
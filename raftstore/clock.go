@@ -0,0 +1,143 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the time to the raftstore. The ticks, leases, stale peer checks and snapshot gc
+// all use it, so replacing it with a SimClock makes them controllable in tests.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	NewTicker(d time.Duration) ClockTicker
+}
+
+// ClockTicker delivers ticks like time.Ticker.
+type ClockTicker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SystemClock is the Clock of the system time.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (systemClock) NewTicker(d time.Duration) ClockTicker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// SimClock is a Clock whose time only moves when it's advanced. The tickers fire in the order they
+// are created, and like time.Ticker a tick is dropped if the last one is not received yet.
+type SimClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*simTicker
+}
+
+// NewSimClock creates a SimClock starting at start. The start should be close to the system time
+// because the modification time of the snapshot files is compared with the clock.
+func NewSimClock(start time.Time) *SimClock {
+	return &SimClock{now: start}
+}
+
+// Now implements the Clock Now method.
+func (c *SimClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Since implements the Clock Since method.
+func (c *SimClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// NewTicker implements the Clock NewTicker method.
+func (c *SimClock) NewTicker(d time.Duration) ClockTicker {
+	if d <= 0 {
+		panic("non-positive interval for SimClock.NewTicker")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &simTicker{
+		clock:    c,
+		ch:       make(chan time.Time, 1),
+		interval: d,
+		next:     c.now.Add(d),
+	}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance moves the time forward by d and fires the tickers that are due.
+func (c *SimClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		if t.next.After(c.now) {
+			continue
+		}
+		select {
+		case t.ch <- c.now:
+		default:
+		}
+		for !t.next.After(c.now) {
+			t.next = t.next.Add(t.interval)
+		}
+	}
+}
+
+type simTicker struct {
+	clock    *SimClock
+	ch       chan time.Time
+	interval time.Duration
+	next     time.Time
+}
+
+func (t *simTicker) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *simTicker) Stop() {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, ticker := range c.tickers {
+		if ticker == t {
+			c.tickers = append(c.tickers[:i], c.tickers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewSimClock(start)
+	require.Equal(t, start, clock.Now())
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, time.Duration(0), clock.Since(start))
+
+	ticker := clock.NewTicker(10 * time.Millisecond)
+	tick := func() (time.Time, bool) {
+		select {
+		case now := <-ticker.C():
+			return now, true
+		default:
+			return time.Time{}, false
+		}
+	}
+	clock.Advance(5 * time.Millisecond)
+	_, ok := tick()
+	require.False(t, ok)
+	clock.Advance(5 * time.Millisecond)
+	now, ok := tick()
+	require.True(t, ok)
+	require.Equal(t, start.Add(10*time.Millisecond), now)
+
+	// The ticks are dropped if they are not received.
+	clock.Advance(10 * time.Millisecond)
+	clock.Advance(10 * time.Millisecond)
+	now, ok = tick()
+	require.True(t, ok)
+	require.Equal(t, start.Add(20*time.Millisecond), now)
+	_, ok = tick()
+	require.False(t, ok)
+	// Advancing multiple intervals at once fires one tick.
+	clock.Advance(35 * time.Millisecond)
+	now, ok = tick()
+	require.True(t, ok)
+	require.Equal(t, start.Add(65*time.Millisecond), now)
+	clock.Advance(5 * time.Millisecond)
+	_, ok = tick()
+	require.True(t, ok)
+
+	ticker.Stop()
+	clock.Advance(time.Second)
+	_, ok = tick()
+	require.False(t, ok)
+	require.Equal(t, time.Second+70*time.Millisecond, clock.Since(start))
+
+	lease := NewLease(50*time.Millisecond, clock)
+	lease.Renew(clock.Now())
+	remote := lease.MaybeNewRemoteLease(1)
+	require.Equal(t, LeaseStateValid, lease.Inspect(nil))
+	require.Equal(t, LeaseStateValid, remote.Inspect(nil))
+	clock.Advance(50 * time.Millisecond)
+	require.Equal(t, LeaseStateExpired, lease.Inspect(nil))
+	require.Equal(t, LeaseStateExpired, remote.Inspect(nil))
+}
@@ -0,0 +1,909 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ngaut/unistore/config"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/pdpb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/pberror"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClusterReplication(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	defer c.Shutdown()
+
+	key, val := []byte("t1"), []byte("v1")
+	regionID := c.GetRegion(key).GetId()
+	for _, storeID := range c.storeIDs[1:] {
+		c.MustAddPeer(regionID, storeID)
+	}
+	c.MustPut(key, val)
+	require.Equal(t, val, c.MustGet(key))
+	for _, storeID := range c.storeIDs {
+		c.MustGetEqualOnStore(storeID, key, val)
+	}
+}
+
+func TestClusterTransferLeader(t *testing.T) {
+	c := newTestCluster(t, 2, nil)
+	defer c.Shutdown()
+
+	key := []byte("t1")
+	regionID := c.GetRegion(key).GetId()
+	peer := c.MustAddPeer(regionID, c.storeIDs[1])
+	c.MustTransferLeader(regionID, peer)
+	c.MustPut(key, []byte("v1"))
+	require.Equal(t, []byte("v1"), c.GetOnStore(c.storeIDs[1], key))
+}
+
+func TestClusterSplit(t *testing.T) {
+	c := newTestCluster(t, 1, nil)
+	defer c.Shutdown()
+
+	c.MustPut([]byte("t1"), []byte("v1"))
+	c.MustPut([]byte("t3"), []byte("v3"))
+	left, right := c.MustSplit([]byte("t2"))
+	require.Equal(t, left.GetId(), c.GetRegion([]byte("t1")).GetId())
+	require.Equal(t, right.GetId(), c.GetRegion([]byte("t3")).GetId())
+	c.MustPut([]byte("t4"), []byte("v4"))
+	require.Equal(t, []byte("v1"), c.MustGet([]byte("t1")))
+	require.Equal(t, []byte("v4"), c.MustGet([]byte("t4")))
+}
+
+func TestClusterRawKV(t *testing.T) {
+	for _, useCustomRaftLog := range []bool{false, true} {
+		c := newTestCluster(t, 2, nil)
+		c.globalConf.RaftStore.CustomRaftLog = useCustomRaftLog
+		c.globalConf.RaftStore.CustomRaftLogVersion = 1
+
+		for i := 1; i <= 4; i++ {
+			key := []byte(fmt.Sprintf("t%d", i))
+			c.mustRawWrite(key, func(wb rawWriteBatch) {
+				wb.RawPut(key, []byte(fmt.Sprintf("r%d", i)))
+			})
+		}
+		// The raw kv data doesn't mix with the MVCC data of the same key.
+		c.MustPut([]byte("t1"), []byte("v1"))
+		require.Equal(t, []byte("v1"), c.MustGet([]byte("t1")))
+		c.mustRawWrite([]byte("t1"), func(wb rawWriteBatch) {
+			wb.RawDelete([]byte("t1"))
+		})
+		left, right := c.MustSplit([]byte("t3"))
+		// The new peers are initialized by the snapshots, which carry the raw kv data.
+		c.MustAddPeer(left.GetId(), c.storeIDs[1])
+		c.MustAddPeer(right.GetId(), c.storeIDs[1])
+		for _, storeID := range c.storeIDs {
+			c.MustGetEqualOnStore(storeID, []byte("t1"), []byte("v1"))
+			c.MustRawGetEqualOnStore(storeID, []byte("t1"), nil)
+			c.MustRawGetEqualOnStore(storeID, []byte("t2"), []byte("r2"))
+			c.MustRawGetEqualOnStore(storeID, []byte("t4"), []byte("r4"))
+		}
+		c.mustRawWrite([]byte("t3"), func(wb rawWriteBatch) {
+			wb.RawDeleteRange([]byte("t3"), []byte("t5"))
+		})
+		c.mustRawWrite([]byte("t1"), func(wb rawWriteBatch) {
+			wb.RawPut([]byte("t1"), []byte("r1"))
+		})
+		for _, storeID := range c.storeIDs {
+			c.MustRawGetEqualOnStore(storeID, []byte("t1"), []byte("r1"))
+			c.MustRawGetEqualOnStore(storeID, []byte("t3"), nil)
+			c.MustRawGetEqualOnStore(storeID, []byte("t4"), nil)
+			c.MustGetEqualOnStore(storeID, []byte("t1"), []byte("v1"))
+		}
+		c.Shutdown()
+	}
+}
+
+func TestClusterDeleteRange(t *testing.T) {
+	for _, version := range []uint16{0, 1} {
+		conf := config.DefaultConf
+		conf.RaftStore.CustomRaftLogVersion = version
+		c := newTestClusterWithConf(t, 2, conf, nil)
+		c.MustAddPeer(c.GetRegion([]byte("t1")).GetId(), c.storeIDs[1])
+		for _, key := range []string{"t1", "t2", "t3"} {
+			c.MustPut([]byte(key), []byte("v"))
+		}
+		c.MustPrewrite([]byte("t2"), []byte("v2"))
+		c.mustDeleteRange([]byte("t1"), []byte("t3"))
+		for _, storeID := range c.storeIDs {
+			c.MustGetEqualOnStore(storeID, []byte("t1"), nil)
+			c.MustGetEqualOnStore(storeID, []byte("t2"), nil)
+			c.MustLockOnStore(storeID, []byte("t2"), 0)
+			c.MustGetEqualOnStore(storeID, []byte("t3"), []byte("v"))
+		}
+		c.Shutdown()
+	}
+}
+
+func TestClusterRestartStore(t *testing.T) {
+	c := newTestCluster(t, 3, nil)
+	defer c.Shutdown()
+
+	key := []byte("t1")
+	regionID := c.GetRegion(key).GetId()
+	for _, storeID := range c.storeIDs[1:] {
+		c.MustAddPeer(regionID, storeID)
+	}
+	stopped := c.storeIDs[2]
+	c.StopStore(stopped)
+	c.MustPut(key, []byte("v1"))
+	c.RestartStore(stopped)
+	c.MustGetEqualOnStore(stopped, key, []byte("v1"))
+}
+
+func TestClusterStopStoreLockStoreDumper(t *testing.T) {
+	c := newTestCluster(t, 1, nil)
+	defer c.Shutdown()
+
+	s := c.getStore(c.storeIDs[0])
+	dumper := s.server.lsDumper
+	c.StopStore(s.id)
+	select {
+	case <-dumper.stopCh:
+	default:
+		t.Fatal("lock store dumper is not stopped")
+	}
+}
+
+// TestClusterRestartStoreLocks restarts a store, the locks are restored from the raft logs in both formats.
+func TestClusterRestartStoreLocks(t *testing.T) {
+	for _, customRaftLog := range []bool{true, false} {
+		conf := config.DefaultConf
+		conf.RaftStore.CustomRaftLog = customRaftLog
+		c := newTestClusterWithConf(t, 3, conf, nil)
+		regionID := c.GetRegion([]byte("t1")).GetId()
+		for _, storeID := range c.storeIDs[1:] {
+			c.MustAddPeer(regionID, storeID)
+		}
+		restarted := c.storeIDs[2]
+		k1, k2, k3 := []byte("t1"), []byte("t2"), []byte("t3")
+		ts1 := c.MustPrewrite(k1, []byte("v1"))
+		lock2 := c.newTestLock(k2, []byte("v2"))
+		c.mustWriteLock(k2, lock2, 0)
+		c.MustLockOnStore(restarted, k2, lock2.StartTS)
+		c.StopStore(restarted)
+		c.mustWriteLock(k2, lock2, c.pd.allocID())
+		ts3 := c.MustPrewrite(k3, []byte("v3"))
+		c.RestartStore(restarted)
+		c.MustLockOnStore(restarted, k1, ts1)
+		c.MustLockOnStore(restarted, k2, 0)
+		c.MustLockOnStore(restarted, k3, ts3)
+		c.MustGetEqualOnStore(restarted, k2, []byte("v2"))
+
+		// The locks are restored after another restart, when the raft logs are applied already.
+		c.StopStore(restarted)
+		c.RestartStore(restarted)
+		c.MustLockOnStore(restarted, k1, ts1)
+		c.MustLockOnStore(restarted, k2, 0)
+		c.MustLockOnStore(restarted, k3, ts3)
+		c.Shutdown()
+	}
+}
+
+// TestClusterRestartStoreCustomLocks restarts a store, the lock changes of the custom raft log types of
+// version 1 are restored.
+func TestClusterRestartStoreCustomLocks(t *testing.T) {
+	conf := config.DefaultConf
+	conf.RaftStore.CustomRaftLogVersion = 1
+	c := newTestClusterWithConf(t, 2, conf, nil)
+	defer c.Shutdown()
+	c.MustAddPeer(c.GetRegion([]byte("t1")).GetId(), c.storeIDs[1])
+	restarted := c.storeIDs[1]
+	pessimisticLock := func(key []byte, startTS, forUpdateTS uint64) *mvcc.Lock {
+		lock := c.newTestLock(key, nil)
+		lock.StartTS, lock.ForUpdateTS, lock.Op = startTS, forUpdateTS, uint8(kvrpcpb.Op_PessimisticLock)
+		c.mustWrite(key, startTS, 0, func(wb mvcc.WriteBatch) {
+			wb.PessimisticLock(key, lock)
+		})
+		return lock
+	}
+
+	// The late pessimistic lock with an older for-update-ts doesn't overwrite the lock.
+	k1 := []byte("t1")
+	ts1 := c.pd.allocID()
+	pessimisticLock(k1, ts1, ts1+10)
+	pessimisticLock(k1, ts1, ts1+5)
+	// The 1PC commit deletes the pessimistic lock.
+	k2 := []byte("t2")
+	lock2 := pessimisticLock(k2, c.pd.allocID(), c.pd.allocID())
+	lock2.Op, lock2.Value = uint8(kvrpcpb.Op_Put), []byte("v2")
+	c.mustWrite(k2, lock2.StartTS, c.pd.allocID(), func(wb mvcc.WriteBatch) {
+		wb.(*customWriteBatch).onePC = true
+		wb.Commit(k2, lock2)
+	})
+	// The delete range deletes the lock.
+	k3 := []byte("t3")
+	c.MustPrewrite(k3, []byte("v3"))
+	c.mustDeleteRange(k3, []byte("t4"))
+	c.MustLockOnStore(restarted, k3, 0)
+
+	for i := 0; i < 2; i++ {
+		c.StopStore(restarted)
+		c.RestartStore(restarted)
+		c.MustLockOnStore(restarted, k1, ts1)
+		require.Equal(t, ts1+10, mvcc.DecodeLock(c.GetLockOnStore(restarted, k1)).ForUpdateTS)
+		c.MustLockOnStore(restarted, k2, 0)
+		c.MustGetEqualOnStore(restarted, k2, []byte("v2"))
+		c.MustLockOnStore(restarted, k3, 0)
+	}
+}
+
+// TestClusterRestartSnapshotLocks restarts a store after the peer is initialized by a snapshot with locks.
+func TestClusterRestartSnapshotLocks(t *testing.T) {
+	c := newTestCluster(t, 2, nil)
+	defer c.Shutdown()
+
+	key := []byte("t1")
+	startTS := c.MustPrewrite(key, []byte("v1"))
+	regionID := c.GetRegion(key).GetId()
+	s2 := c.storeIDs[1]
+	c.MustAddPeer(regionID, s2)
+	c.MustLockOnStore(s2, key, startTS)
+	c.StopStore(s2)
+	c.RestartStore(s2)
+	c.MustLockOnStore(s2, key, startTS)
+
+	// The raft logs after the snapshot are restored on the snapshot locks.
+	lock := c.newTestLock(key, []byte("v1"))
+	lock.StartTS = startTS
+	c.mustWriteLock(key, lock, c.pd.allocID())
+	key2 := []byte("t2")
+	startTS2 := c.MustPrewrite(key2, []byte("v2"))
+	c.MustLockOnStore(s2, key2, startTS2)
+	c.StopStore(s2)
+	c.RestartStore(s2)
+	c.MustLockOnStore(s2, key, 0)
+	c.MustLockOnStore(s2, key2, startTS2)
+}
+
+func TestClusterSnapshotAfterLogGC(t *testing.T) {
+	c := newTestCluster(t, 2, func(cfg *Config) {
+		cfg.RaftLogGcThreshold = 1
+		cfg.RaftLogGcCountLimit = 5
+		cfg.MergeMaxLogGap = 3
+	})
+	defer c.Shutdown()
+
+	regionID := c.GetRegion([]byte("t0")).GetId()
+	for i := 0; i < 20; i++ {
+		c.MustPut([]byte(fmt.Sprintf("t%d", i)), []byte("v"))
+	}
+	// The log has been compacted, so the new peer can only be initialized by a snapshot.
+	c.retry(func() bool {
+		state, err := getApplyState(c.getStore(c.storeIDs[0]).engines.kv.DB, regionID)
+		return err == nil && state.truncatedIndex > RaftInitLogIndex
+	}, "raft log of region %d is not compacted", regionID)
+	c.MustAddPeer(regionID, c.storeIDs[1])
+	for i := 0; i < 20; i++ {
+		c.MustGetEqualOnStore(c.storeIDs[1], []byte(fmt.Sprintf("t%d", i)), []byte("v"))
+	}
+}
+
+// TestClusterSnapDelegate adds a peer after the raft log is compacted, the leader asks the follower to
+// generate and send the snapshot.
+func TestClusterSnapDelegate(t *testing.T) {
+	sent := runSnapDelegate(t, false)
+	require.Greater(t, sent, int64(0))
+}
+
+// TestClusterSnapDelegateLost drops the snapshot delegation messages, the leader generates the snapshot
+// itself after the follower doesn't accept the request in time.
+func TestClusterSnapDelegateLost(t *testing.T) {
+	sent := runSnapDelegate(t, true)
+	require.Equal(t, int64(0), sent)
+}
+
+// runSnapDelegate returns the number of the snapshots sent by the follower.
+func runSnapDelegate(t *testing.T, dropDelegation bool) int64 {
+	c := newTestCluster(t, 3, func(cfg *Config) {
+		cfg.RaftLogGcThreshold = 1
+		cfg.RaftLogGcCountLimit = 5
+		cfg.MergeMaxLogGap = 3
+		cfg.SnapGenerateOnFollower = true
+	})
+	defer c.Shutdown()
+
+	s1, s2, s3 := c.storeIDs[0], c.storeIDs[1], c.storeIDs[2]
+	regionID := c.GetRegion([]byte("t0")).GetId()
+	c.MustAddPeer(regionID, s2)
+	for i := 0; i < 20; i++ {
+		c.MustPut([]byte(fmt.Sprintf("t%d", i)), []byte("v"))
+	}
+	c.retry(func() bool {
+		state, err := getApplyState(c.getStore(s1).engines.kv.DB, regionID)
+		return err == nil && state.truncatedIndex > RaftInitLogIndex
+	}, "raft log of region %d is not compacted", regionID)
+
+	if dropDelegation {
+		c.AddFilter(&DropFilter{Match: func(msg *rspb.RaftMessage) bool {
+			return msg.GetExtraMsg().GetType() == extraMsgTypeSnapDelegate
+		}})
+	}
+	// The matcher only counts the snapshots sent by the follower, nothing is dropped.
+	var sent int64
+	c.getStore(s2).server.AddRaftMessageFilter(&DropFilter{Match: func(msg *rspb.RaftMessage) bool {
+		if msg.GetMessage().GetMsgType() == eraftpb.MessageType_MsgSnapshot {
+			atomic.AddInt64(&sent, 1)
+		}
+		return false
+	}})
+	c.MustAddPeer(regionID, s3)
+	for i := 0; i < 20; i++ {
+		c.MustGetEqualOnStore(s3, []byte(fmt.Sprintf("t%d", i)), []byte("v"))
+	}
+	return atomic.LoadInt64(&sent)
+}
+
+func newTestClusterWithPeers(t *testing.T, key []byte) (*testCluster, uint64) {
+	c := newTestCluster(t, 3, nil)
+	regionID := c.mustAddPeers(key)
+	c.MustTransferLeader(regionID, findPeer(c.GetRegion(key), c.storeIDs[0]))
+	return c, regionID
+}
+
+// mustAddPeers adds peers on all the other stores to the region containing the key.
+func (c *testCluster) mustAddPeers(key []byte) uint64 {
+	regionID := c.GetRegion(key).GetId()
+	for _, storeID := range c.storeIDs[1:] {
+		c.MustAddPeer(regionID, storeID)
+	}
+	return regionID
+}
+
+// mustLeaderIn waits until the leader of the region is stable on one of the stores.
+func (c *testCluster) mustLeaderIn(regionID uint64, storeIDs ...uint64) {
+	c.retry(func() bool {
+		if !containsID(storeIDs, c.LeaderOf(regionID).GetStoreId()) {
+			return false
+		}
+		// Wait for the isolated leader to step down and stop reporting itself as the leader.
+		time.Sleep(300 * time.Millisecond)
+		return containsID(storeIDs, c.LeaderOf(regionID).GetStoreId())
+	}, "leader of region %d is not in stores %v", regionID, storeIDs)
+}
+
+func TestClusterPartitionLeader(t *testing.T) {
+	key := []byte("t1")
+	c, regionID := newTestClusterWithPeers(t, key)
+	defer c.Shutdown()
+
+	s1, s2, s3 := c.storeIDs[0], c.storeIDs[1], c.storeIDs[2]
+	c.Partition([]uint64{s1}, []uint64{s2, s3})
+	c.mustLeaderIn(regionID, s2, s3)
+	c.MustPut(key, []byte("v1"))
+	c.MustGetEqualOnStore(s2, key, []byte("v1"))
+	c.MustGetEqualOnStore(s3, key, []byte("v1"))
+	require.Nil(t, c.GetOnStore(s1, key))
+
+	c.ClearFilters()
+	c.MustGetEqualOnStore(s1, key, []byte("v1"))
+}
+
+// TestClusterGCIsolatedPeer covers the case b in peerMsgHandler.checkMessage: 2 is isolated and 1
+// removes 2. When 2 rejoins the cluster, its stale vote messages make 1 tell 2 to gc itself.
+func TestClusterGCIsolatedPeer(t *testing.T) {
+	key := []byte("t1")
+	c, regionID := newTestClusterWithPeers(t, key)
+	defer c.Shutdown()
+
+	s3 := c.storeIDs[2]
+	peer := findPeer(c.GetRegion(key), s3)
+	c.Partition(c.storeIDs[:2], []uint64{s3})
+	c.mustChangePeer(regionID, eraftpb.ConfChangeType_RemoveNode, peer)
+	c.MustPut(key, []byte("v1"))
+	state, err := getRegionLocalState(c.getStore(s3).engines.kv.DB, regionID)
+	require.Nil(t, err)
+	require.Equal(t, rspb.PeerState_Normal, state.GetState())
+
+	c.ClearFilters()
+	c.MustPeerTombstone(regionID, peer)
+}
+
+// TestClusterDelayedGCMessage sends a gc message to a peer which is still a member of the region in
+// PD, e.g. a delayed one, the peer isn't destroyed since PD doesn't confirm it's stale.
+func TestClusterDelayedGCMessage(t *testing.T) {
+	key := []byte("t1")
+	c, regionID := newTestClusterWithPeers(t, key)
+	defer c.Shutdown()
+
+	region := c.GetRegion(key)
+	s3 := c.storeIDs[2]
+	peer := findPeer(region, s3)
+	epoch := region.GetRegionEpoch()
+	require.Nil(t, c.getStore(s3).server.router.sendRaftMessage(&rspb.RaftMessage{
+		RegionId:    regionID,
+		FromPeer:    findPeer(region, c.storeIDs[0]),
+		ToPeer:      peer,
+		RegionEpoch: &metapb.RegionEpoch{ConfVer: epoch.GetConfVer() + 1, Version: epoch.GetVersion()},
+		IsTombstone: true,
+	}))
+	time.Sleep(300 * time.Millisecond)
+	state, err := getRegionLocalState(c.getStore(s3).engines.kv.DB, regionID)
+	require.Nil(t, err)
+	require.Equal(t, rspb.PeerState_Normal, state.GetState())
+
+	c.MustPut(key, []byte("v1"))
+	c.MustGetEqualOnStore(s3, key, []byte("v1"))
+}
+
+func TestClusterDropSnapshot(t *testing.T) {
+	c := newTestCluster(t, 2, nil)
+	defer c.Shutdown()
+
+	key := []byte("t1")
+	c.MustPut(key, []byte("v1"))
+	regionID := c.GetRegion(key).GetId()
+	s2 := c.storeIDs[1]
+	c.AddFilter(NewDropSnapshotFilter())
+	c.mustChangePeer(regionID, eraftpb.ConfChangeType_AddNode, &metapb.Peer{Id: c.pd.allocID(), StoreId: s2})
+	time.Sleep(300 * time.Millisecond)
+	require.Nil(t, c.GetOnStore(s2, key))
+
+	c.ClearFilters()
+	c.MustGetEqualOnStore(s2, key, []byte("v1"))
+}
+
+func TestClusterDelayAndDuplicate(t *testing.T) {
+	key := []byte("t1")
+	c, _ := newTestClusterWithPeers(t, key)
+	defer c.Shutdown()
+
+	c.AddFilter(&DelayFilter{Match: MatchToStore(c.storeIDs[2]), Delay: 5 * time.Millisecond, Jitter: 20 * time.Millisecond})
+	c.AddFilter(&DuplicateFilter{Match: MatchMsgType(eraftpb.MessageType_MsgAppend)})
+	for i := 0; i < 10; i++ {
+		c.MustPut([]byte(fmt.Sprintf("t%d", i)), []byte("v"))
+	}
+	for _, storeID := range c.storeIDs {
+		for i := 0; i < 10; i++ {
+			c.MustGetEqualOnStore(storeID, []byte(fmt.Sprintf("t%d", i)), []byte("v"))
+		}
+	}
+}
+
+func TestClusterPauseApply(t *testing.T) {
+	c := newTestCluster(t, 1, nil)
+	defer c.Shutdown()
+
+	key := []byte("t1")
+	require.Nil(t, EnableFailpoint(FailpointApplyBeforeWriteKV, "pause"))
+	done := make(chan struct{})
+	go func() {
+		c.MustPut(key, []byte("v1"))
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("apply is not paused")
+	case <-time.After(200 * time.Millisecond):
+	}
+	require.Nil(t, DisableFailpoint(FailpointApplyBeforeWriteKV))
+	<-done
+	require.Equal(t, []byte("v1"), c.MustGet(key))
+}
+
+func TestClusterSplitFailure(t *testing.T) {
+	c := newTestCluster(t, 1, nil)
+	defer c.Shutdown()
+
+	region := c.GetRegion([]byte("t1"))
+	require.Nil(t, EnableFailpoint(FailpointApplyBeforeSplit, `1*return("split failure")`))
+	defer DisableFailpoint(FailpointApplyBeforeSplit)
+	var leader *metapb.Peer
+	c.retry(func() bool {
+		leader = c.LeaderOf(region.GetId())
+		return leader != nil
+	}, "no leader for region %d", region.GetId())
+	regions, err := c.getStore(leader.GetStoreId()).server.GetRaftstoreRouter().SplitRegion(&kvrpcpb.Context{
+		RegionId:    region.GetId(),
+		RegionEpoch: region.GetRegionEpoch(),
+		Peer:        leader,
+	}, [][]byte{codec.EncodeBytes(nil, []byte("t2"))})
+	require.Nil(t, err)
+	require.Nil(t, regions)
+	require.Equal(t, region.GetId(), c.GetRegion([]byte("t3")).GetId())
+
+	left, right := c.MustSplit([]byte("t2"))
+	require.Equal(t, left.GetId(), c.GetRegion([]byte("t1")).GetId())
+	require.Equal(t, right.GetId(), c.GetRegion([]byte("t3")).GetId())
+}
+
+// TestClusterRecoverApplyingSnapshot restarts a store crashed after the snapshot is ingested but
+// before the region state is updated, the snapshot is applied again by recoverFromApplyingState.
+func TestClusterRecoverApplyingSnapshot(t *testing.T) {
+	c := newTestCluster(t, 2, nil)
+	defer c.Shutdown()
+
+	key := []byte("t1")
+	c.MustPut(key, []byte("v1"))
+	regionID := c.GetRegion(key).GetId()
+	s2 := c.storeIDs[1]
+	require.Nil(t, EnableFailpoint(FailpointRegionApplySnapBeforeUpdateState, `1*return("crash")`))
+	defer DisableFailpoint(FailpointRegionApplySnapBeforeUpdateState)
+	c.mustChangePeer(regionID, eraftpb.ConfChangeType_AddNode, &metapb.Peer{Id: c.pd.allocID(), StoreId: s2})
+	// The data is ingested but the region is left in the Applying state.
+	c.retry(func() bool {
+		state, err := getRegionLocalState(c.getStore(s2).engines.kv.DB, regionID)
+		return err == nil && state.GetState() == rspb.PeerState_Applying && c.GetOnStore(s2, key) != nil
+	}, "snapshot of region %d is not ingested", regionID)
+	// The sst files built for the ingestion are removed.
+	c.retry(func() bool {
+		files, err := filepath.Glob(filepath.Join(c.getStore(s2).engines.kvPath, "ingest_convert_*.sst"))
+		return err == nil && len(files) == 0
+	}, "sst files of region %d are not removed", regionID)
+
+	c.StopStore(s2)
+	c.RestartStore(s2)
+	c.retry(func() bool {
+		state, err := getRegionLocalState(c.getStore(s2).engines.kv.DB, regionID)
+		return err == nil && state.GetState() == rspb.PeerState_Normal
+	}, "snapshot of region %d is not recovered", regionID)
+	c.MustGetEqualOnStore(s2, key, []byte("v1"))
+}
+
+func TestBankHistoryCheck(t *testing.T) {
+	h := &bankHistory{initial: []int{10, 10}}
+	h.addTxn(bankTxn{startTS: 1, commitTS: 3, reads: map[int]int{0: 10, 1: 10}, writes: map[int]int{0: 5, 1: 15}})
+	h.addTxn(bankTxn{startTS: 4, commitTS: 6, reads: map[int]int{0: 5, 1: 15}, writes: map[int]int{0: 0, 1: 20}})
+	h.addRead(bankRead{ts: 2, balances: []int{10, 10}})
+	h.addRead(bankRead{ts: 5, balances: []int{5, 15}})
+	require.Nil(t, h.check())
+
+	// The read misses the transfer committed before it.
+	h.addRead(bankRead{ts: 7, balances: []int{5, 15}})
+	require.NotNil(t, h.check())
+	h.reads = h.reads[:2]
+	// The transfer reads a stale balance, the first transfer is lost.
+	h.addTxn(bankTxn{startTS: 7, commitTS: 8, reads: map[int]int{0: 5, 1: 15}, writes: map[int]int{0: 0, 1: 20}})
+	require.NotNil(t, h.check())
+	h.txns = h.txns[:2]
+	// The total balance is changed.
+	h.addRead(bankRead{ts: 9, balances: []int{0, 15}})
+	require.NotNil(t, h.check())
+}
+
+// runBank runs the bank workload under random leader transfers, splits and store restarts chosen by
+// the random source of the cluster, then checks the history for snapshot isolation.
+func runBank(t *testing.T, c *testCluster) {
+	const accounts = 10
+	w := newBankWorkload(c, accounts, 100)
+
+	stopCh := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- w.run(4, 2, stopCh)
+	}()
+	rnd := c.rnd
+	for start := time.Now(); time.Since(start) < 3*time.Second; time.Sleep(100 * time.Millisecond) {
+		acctKey := w.key(rnd.Intn(accounts))
+		switch rnd.Intn(3) {
+		case 0:
+			region := c.GetRegion(acctKey)
+			peers := region.GetPeers()
+			c.MustTransferLeader(region.GetId(), peers[rnd.Intn(len(peers))])
+		case 1:
+			c.MustSplit(acctKey)
+		case 2:
+			storeID := c.storeIDs[rnd.Intn(len(c.storeIDs))]
+			c.StopStore(storeID)
+			time.Sleep(200 * time.Millisecond)
+			c.RestartStore(storeID)
+		}
+	}
+	close(stopCh)
+	require.Nil(t, <-errCh)
+	require.Nil(t, w.read())
+	require.Nil(t, w.history.check())
+	require.NotEmpty(t, w.history.txns)
+	t.Logf("checked %d transfers and %d reads", len(w.history.txns), len(w.history.reads))
+}
+
+func TestClusterBank(t *testing.T) {
+	c, _ := newTestClusterWithPeers(t, []byte("t_account"))
+	defer c.Shutdown()
+	runBank(t, c)
+}
+
+// TestClusterBankRaftCmdLog runs the bank workload with the locks written in the raft commands instead
+// of the CustomRaftLog.
+func TestClusterBankRaftCmdLog(t *testing.T) {
+	conf := config.DefaultConf
+	conf.RaftStore.CustomRaftLog = false
+	c := newTestClusterWithConf(t, 3, conf, nil)
+	defer c.Shutdown()
+	c.mustAddPeers([]byte("t_account"))
+	runBank(t, c)
+}
+
+func TestClusterBankSimClock(t *testing.T) {
+	c := newSimTestCluster(t, 3, nil)
+	defer c.Shutdown()
+	c.mustAddPeers([]byte("t_account"))
+	runBank(t, c)
+}
+
+// leaseValid returns true if the peer of the region on the store can serve the local reads.
+func (c *testCluster) leaseValid(storeID, regionID uint64) bool {
+	s := c.getStore(storeID)
+	if s == nil {
+		return false
+	}
+	ps := s.server.router.get(regionID)
+	if ps == nil {
+		return false
+	}
+	lease := (*RemoteLease)(atomic.LoadPointer(&ps.peer.peer.leaderChecker.leaderLease))
+	return lease != nil && lease.Inspect(nil) == LeaseStateValid
+}
+
+// TestClusterSimClockLease isolates the leader while the clock is paused, the isolated leader keeps
+// its lease and no one campaigns until the clock is advanced.
+func TestClusterSimClockLease(t *testing.T) {
+	c := newSimTestCluster(t, 3, nil)
+	defer c.Shutdown()
+	key := []byte("t1")
+	regionID := c.mustAddPeers(key)
+	s1 := c.storeIDs[0]
+	c.MustTransferLeader(regionID, findPeer(c.GetRegion(key), s1))
+	c.MustPut(key, []byte("v1"))
+	c.retry(func() bool {
+		return c.leaseValid(s1, regionID)
+	}, "lease of region %d is not valid", regionID)
+
+	c.PauseClock()
+	c.Partition([]uint64{s1}, c.storeIDs[1:])
+	time.Sleep(300 * time.Millisecond)
+	require.True(t, c.leaseValid(s1, regionID))
+	require.Equal(t, s1, c.LeaderOf(regionID).GetStoreId())
+
+	cfg := newTestRaftConfig()
+	c.AdvanceClock(cfg.RaftStoreMaxLeaderLease)
+	require.False(t, c.leaseValid(s1, regionID))
+
+	c.ResumeClock()
+	c.mustLeaderIn(regionID, c.storeIDs[1:]...)
+	c.ClearFilters()
+	c.MustPut(key, []byte("v2"))
+	c.MustGetEqualOnStore(s1, key, []byte("v2"))
+}
+
+// TestClusterProposalTimeout proposes to an isolated leader, the commands can't be committed and
+// are completed by the timeout or the cancellation instead of blocking the callers.
+func TestClusterProposalTimeout(t *testing.T) {
+	c := newSimTestCluster(t, 3, nil)
+	defer c.Shutdown()
+	key := []byte("t1")
+	regionID := c.mustAddPeers(key)
+	s1 := c.storeIDs[0]
+	c.MustTransferLeader(regionID, findPeer(c.GetRegion(key), s1))
+	c.MustPut(key, []byte("v1"))
+
+	// The isolated leader doesn't step down while the clock is paused.
+	c.PauseClock()
+	c.Partition([]uint64{s1}, c.storeIDs[1:])
+	region := c.GetRegion(key)
+	ctx := &kvrpcpb.Context{
+		RegionId:    regionID,
+		RegionEpoch: region.RegionEpoch,
+		Peer:        findPeer(region, s1),
+	}
+	s := c.getStore(s1)
+	conf := c.globalConf
+	conf.RaftStore.ProposalTimeout = "200ms"
+	writer := NewDBWriter(&conf, s.server.GetRaftstoreRouter())
+	newPrewrite := func() mvcc.WriteBatch {
+		lock := c.newTestLock(key, []byte("v2"))
+		wb := writer.NewWriteBatch(lock.StartTS, 0, ctx)
+		wb.Prewrite(key, lock)
+		return wb
+	}
+	timeouts := testutil.ToFloat64(proposalTimeout)
+	err := writer.Write(newPrewrite())
+	pbErr, ok := err.(*pberror.PBError)
+	require.True(t, ok, "%v", err)
+	require.Equal(t, new(ErrProposalTimeout).Error(), pbErr.RequestErr.Message)
+	require.Equal(t, timeouts+1, testutil.ToFloat64(proposalTimeout))
+
+	// The callers cancel the write and the leadership check.
+	canceled := testutil.ToFloat64(proposalCanceled)
+	cancelCtx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	err = writer.(*raftDBWriter).WriteContext(cancelCtx, newPrewrite())
+	pbErr, ok = err.(*pberror.PBError)
+	require.True(t, ok, "%v", err)
+	require.Equal(t, new(ErrProposalCanceled).Error(), pbErr.RequestErr.Message)
+	// The lease is expired, the leadership is checked by a read index command.
+	c.AdvanceClock(newTestRaftConfig().RaftStoreMaxLeaderLease)
+	checker := s.server.router.get(regionID).peer.peer.leaderChecker
+	cancelCtx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	isLeaderErr := checker.IsLeaderContext(cancelCtx, ctx, s.server.GetRaftstoreRouter())
+	require.NotNil(t, isLeaderErr)
+	require.Equal(t, new(ErrProposalCanceled).Error(), isLeaderErr.Message)
+	require.Equal(t, canceled+2, testutil.ToFloat64(proposalCanceled))
+
+	// The dropped commands are never committed, the responses from the new term are ignored.
+	c.ResumeClock()
+	c.mustLeaderIn(regionID, c.storeIDs[1:]...)
+	c.ClearFilters()
+	c.MustPut(key, []byte("v3"))
+	c.MustGetEqualOnStore(s1, key, []byte("v3"))
+}
+
+// TestClusterEntryCacheMemoryLimit checks the entry caches are evicted when they exceed the memory
+// limit of the stores, and the evicted entries are read from the raft engine.
+func TestClusterEntryCacheMemoryLimit(t *testing.T) {
+	c := newTestCluster(t, 3, func(cfg *Config) {
+		cfg.RaftEntryCacheMemoryLimit = 1
+	})
+	defer c.Shutdown()
+	key := []byte("t1")
+	regionID := c.mustAddPeers(key)
+	evicted := testutil.ToFloat64(entryCacheEvictedReplicated)
+	c.MustPut(key, []byte("v1"))
+	c.retry(func() bool {
+		return testutil.ToFloat64(entryCacheEvictedReplicated) > evicted
+	}, "entry caches of region %d are not evicted", regionID)
+	for _, id := range c.storeIDs {
+		mem := c.getStore(id).server.batchSystem.ctx.entryCacheMem
+		c.retry(func() bool {
+			return atomic.LoadInt64(&mem.size) == 0
+		}, "entry caches of store %d are not evicted", id)
+	}
+
+	// The follower catches up by the raft logs not in the cache.
+	s1 := c.storeIDs[0]
+	c.Partition([]uint64{s1}, c.storeIDs[1:])
+	c.mustLeaderIn(regionID, c.storeIDs[1:]...)
+	c.MustPut(key, []byte("v2"))
+	c.ClearFilters()
+	c.MustGetEqualOnStore(s1, key, []byte("v2"))
+}
+
+// TestClusterFlowControl checks the writes are rejected with ServerIsBusy when the kv engine is about to
+// stall, and accepted again after the engine catches up.
+func TestClusterFlowControl(t *testing.T) {
+	c := newTestCluster(t, 1, func(cfg *Config) {
+		// The engine stats are updated by the test.
+		cfg.FlowCheckTickInterval = time.Hour
+	})
+	defer c.Shutdown()
+	key := []byte("t1")
+	c.MustPut(key, []byte("v1"))
+
+	s := c.getStore(c.storeIDs[0])
+	flowController := s.server.batchSystem.ctx.flowController
+	flowController.updateEngineStats(flowController.cfg.FlowControlL0TablesHardLimit, 0)
+	region := c.GetRegion(key)
+	ctx := &kvrpcpb.Context{
+		RegionId:    region.Id,
+		RegionEpoch: region.RegionEpoch,
+		Peer:        region.Peers[0],
+	}
+	writer := NewDBWriter(&c.globalConf, s.server.GetRaftstoreRouter())
+	lock := c.newTestLock(key, []byte("v2"))
+	wb := writer.NewWriteBatch(lock.StartTS, 0, ctx)
+	wb.Prewrite(key, lock)
+	rejected := testutil.ToFloat64(flowControlRejectedStop)
+	err := writer.Write(wb)
+	pbErr, ok := err.(*pberror.PBError)
+	require.True(t, ok, "%v", err)
+	require.NotNil(t, pbErr.RequestErr.GetServerIsBusy(), "%v", pbErr.RequestErr)
+	require.Equal(t, rejected+1, testutil.ToFloat64(flowControlRejectedStop))
+	require.True(t, flowController.isBusy())
+
+	flowController.updateEngineStats(0, 0)
+	c.MustPut(key, []byte("v2"))
+	c.MustGetEqualOnStore(c.storeIDs[0], key, []byte("v2"))
+}
+
+// TestClusterStoreHeartbeatStats checks the thread loads and the disk latencies are reported to PD.
+func TestClusterStoreHeartbeatStats(t *testing.T) {
+	c := newTestCluster(t, 1, func(cfg *Config) {
+		cfg.PdStoreHeartbeatTickInterval = 100 * time.Millisecond
+	})
+	defer c.Shutdown()
+	c.MustPut([]byte("t1"), []byte("v1"))
+	hasKeys := func(pairs []*pdpb.RecordPair, keys ...string) bool {
+		found := make(map[string]bool)
+		for _, p := range pairs {
+			found[p.Key] = true
+		}
+		for _, key := range keys {
+			if !found[key] {
+				return false
+			}
+		}
+		return true
+	}
+	storeID := c.storeIDs[0]
+	c.retry(func() bool {
+		stats := c.pd.getStoreStats(storeID)
+		return stats != nil && hasKeys(stats.CpuUsages, "raft-worker", "apply-worker", "snap-worker", "pd-worker") &&
+			hasKeys(stats.OpLatencies, "kv_disk_probe", "raft_disk_probe")
+	}, "store %d heartbeat stats are not reported", storeID)
+}
+
+// TestClusterEvictSlowLeaders checks the leaders are transferred away from a slow store.
+func TestClusterEvictSlowLeaders(t *testing.T) {
+	c := newTestCluster(t, 3, func(cfg *Config) {
+		cfg.InspectInterval = 20 * time.Millisecond
+		cfg.InspectSlowThreshold = 100 * time.Millisecond
+	})
+	defer c.Shutdown()
+	key := []byte("t1")
+	regionID := c.mustAddPeers(key)
+	s1 := c.storeIDs[0]
+	c.MustTransferLeader(regionID, findPeer(c.GetRegion(key), s1))
+
+	// The raft ready of store 1 is slow.
+	slowScore := c.getStore(s1).server.batchSystem.ctx.slowScore
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+				slowScore.observe(inspectRaftReady, time.Second)
+			}
+		}
+	}()
+	c.mustLeaderIn(regionID, c.storeIDs[1:]...)
+	c.MustPut(key, []byte("v1"))
+	c.MustGetEqualOnStore(s1, key, []byte("v1"))
+}
+
+// TestClusterCoalesceHeartbeats checks the leaders of the regions sharing the stores are kept by the
+// coalesced heartbeats.
+func TestClusterCoalesceHeartbeats(t *testing.T) {
+	key := []byte("t1")
+	c, _ := newTestClusterWithPeers(t, key)
+	defer c.Shutdown()
+
+	keys := [][]byte{key, []byte("t2"), []byte("t3")}
+	c.MustSplit(keys[1])
+	c.MustSplit(keys[2])
+	leaders := make(map[uint64]*metapb.Peer)
+	for _, k := range keys {
+		regionID := c.GetRegion(k).GetId()
+		c.MustTransferLeader(regionID, findPeer(c.GetRegion(k), c.storeIDs[0]))
+		leaders[regionID] = c.LeaderOf(regionID)
+	}
+	coalesced := testutil.ToFloat64(heartbeatsCoalesced)
+	time.Sleep(500 * time.Millisecond)
+	require.Greater(t, testutil.ToFloat64(heartbeatsCoalesced), coalesced)
+	for regionID, leader := range leaders {
+		require.Equal(t, leader, c.LeaderOf(regionID))
+	}
+	for _, k := range keys {
+		c.MustPut(k, k)
+		c.MustGetEqualOnStore(c.storeIDs[2], k, k)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+)
+
+// A coalesced heartbeat carries the heartbeats and the heartbeat responses of all the regions sent
+// from one store to another in a raft worker round. It's a RaftMessage of the invalid region with
+// only the store IDs in the peers, and the heartbeats are encoded in the context of the message.
+// Every heartbeat is the msg type, region id, from peer id, to peer id, conf ver, version, term and
+// commit in uvarints. The receiver fans them out to the peers as the original raft messages.
+const coalescedHeartbeatFields = 8
+
+// canCoalesceHeartbeat returns true if the message is a heartbeat or a heartbeat response that can be
+// rebuilt from the coalesced fields. The heartbeats with a context are the read index requests, and
+// the ones without a commit may create the peer, they are sent as they are.
+func canCoalesceHeartbeat(msg *rspb.RaftMessage) bool {
+	m := msg.GetMessage()
+	switch m.GetMsgType() {
+	case eraftpb.MessageType_MsgHeartbeat:
+		if m.GetCommit() == RaftInvalidIndex {
+			return false
+		}
+	case eraftpb.MessageType_MsgHeartbeatResponse:
+	default:
+		return false
+	}
+	return msg.GetRegionId() != InvalidID && len(m.GetContext()) == 0 && !msg.GetIsTombstone() &&
+		msg.GetMergeTarget() == nil && msg.GetExtraMsg() == nil && len(msg.GetStartKey()) == 0
+}
+
+// isCoalescedHeartbeat returns true if the message is a coalesced heartbeat.
+func isCoalescedHeartbeat(msg *rspb.RaftMessage) bool {
+	return msg.GetRegionId() == InvalidID && msg.GetMessage().GetMsgType() == eraftpb.MessageType_MsgHeartbeat
+}
+
+func newCoalescedHeartbeat(msgs []*rspb.RaftMessage) *rspb.RaftMessage {
+	buf := make([]byte, 0, len(msgs)*coalescedHeartbeatFields*binary.MaxVarintLen64/2)
+	var tmp [binary.MaxVarintLen64]byte
+	for _, msg := range msgs {
+		m := msg.GetMessage()
+		for _, v := range [coalescedHeartbeatFields]uint64{
+			uint64(m.GetMsgType()), msg.GetRegionId(), msg.GetFromPeer().GetId(), msg.GetToPeer().GetId(),
+			msg.GetRegionEpoch().GetConfVer(), msg.GetRegionEpoch().GetVersion(), m.GetTerm(), m.GetCommit(),
+		} {
+			buf = append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+		}
+	}
+	return &rspb.RaftMessage{
+		FromPeer:    &metapb.Peer{StoreId: msgs[0].GetFromPeer().GetStoreId()},
+		ToPeer:      &metapb.Peer{StoreId: msgs[0].GetToPeer().GetStoreId()},
+		RegionEpoch: new(metapb.RegionEpoch),
+		Message: &eraftpb.Message{
+			MsgType: eraftpb.MessageType_MsgHeartbeat,
+			Context: buf,
+		},
+	}
+}
+
+// splitCoalescedHeartbeat rebuilds the raft messages of the regions from the coalesced heartbeat.
+func splitCoalescedHeartbeat(msg *rspb.RaftMessage) ([]*rspb.RaftMessage, error) {
+	fromStoreID, toStoreID := msg.GetFromPeer().GetStoreId(), msg.GetToPeer().GetStoreId()
+	buf := msg.GetMessage().GetContext()
+	var msgs []*rspb.RaftMessage
+	for len(buf) > 0 {
+		var fields [coalescedHeartbeatFields]uint64
+		for i := range fields {
+			v, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return nil, errors.Errorf("corrupted coalesced heartbeat from store %d", fromStoreID)
+			}
+			fields[i] = v
+			buf = buf[n:]
+		}
+		tp := eraftpb.MessageType(fields[0])
+		if tp != eraftpb.MessageType_MsgHeartbeat && tp != eraftpb.MessageType_MsgHeartbeatResponse {
+			return nil, errors.Errorf("unexpected message type %s in coalesced heartbeat from store %d", tp, fromStoreID)
+		}
+		msgs = append(msgs, &rspb.RaftMessage{
+			RegionId:    fields[1],
+			FromPeer:    &metapb.Peer{Id: fields[2], StoreId: fromStoreID},
+			ToPeer:      &metapb.Peer{Id: fields[3], StoreId: toStoreID},
+			RegionEpoch: &metapb.RegionEpoch{ConfVer: fields[4], Version: fields[5]},
+			Message: &eraftpb.Message{
+				MsgType: tp,
+				From:    fields[2],
+				To:      fields[3],
+				Term:    fields[6],
+				Commit:  fields[7],
+			},
+		})
+	}
+	return msgs, nil
+}
+
+// heartbeatCoalescer buffers the heartbeats to every store until it's flushed.
+type heartbeatCoalescer struct {
+	mu         sync.Mutex
+	heartbeats map[uint64][]*rspb.RaftMessage
+}
+
+func newHeartbeatCoalescer() *heartbeatCoalescer {
+	return &heartbeatCoalescer{heartbeats: make(map[uint64][]*rspb.RaftMessage)}
+}
+
+// add buffers the message and returns true if it can be coalesced.
+func (c *heartbeatCoalescer) add(msg *rspb.RaftMessage) bool {
+	if !canCoalesceHeartbeat(msg) {
+		return false
+	}
+	storeID := msg.GetToPeer().GetStoreId()
+	c.mu.Lock()
+	c.heartbeats[storeID] = append(c.heartbeats[storeID], msg)
+	c.mu.Unlock()
+	return true
+}
+
+// flush sends a coalesced heartbeat to every store, a single heartbeat is sent as it is.
+func (c *heartbeatCoalescer) flush(send func(msg *rspb.RaftMessage)) {
+	c.mu.Lock()
+	heartbeats := c.heartbeats
+	if len(heartbeats) == 0 {
+		c.mu.Unlock()
+		return
+	}
+	c.heartbeats = make(map[uint64][]*rspb.RaftMessage, len(heartbeats))
+	c.mu.Unlock()
+	for _, msgs := range heartbeats {
+		if len(msgs) == 1 {
+			send(msgs[0])
+			continue
+		}
+		heartbeatsCoalesced.Add(float64(len(msgs)))
+		send(newCoalescedHeartbeat(msgs))
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestHeartbeat(regionID, toStoreID uint64, tp eraftpb.MessageType, term, commit uint64) *rspb.RaftMessage {
+	from, to := regionID*10+1, regionID*10+toStoreID
+	return &rspb.RaftMessage{
+		RegionId:    regionID,
+		FromPeer:    &metapb.Peer{Id: from, StoreId: 1},
+		ToPeer:      &metapb.Peer{Id: to, StoreId: toStoreID},
+		RegionEpoch: &metapb.RegionEpoch{ConfVer: regionID + 1, Version: regionID + 2},
+		Message:     &eraftpb.Message{MsgType: tp, From: from, To: to, Term: term, Commit: commit},
+	}
+}
+
+func TestCoalescedHeartbeat(t *testing.T) {
+	c := newHeartbeatCoalescer()
+	var expected []*rspb.RaftMessage
+	for regionID := uint64(1); regionID <= 3; regionID++ {
+		hb := newTestHeartbeat(regionID, 2, eraftpb.MessageType_MsgHeartbeat, 5, 100+regionID)
+		require.True(t, c.add(hb))
+		expected = append(expected, hb)
+	}
+	resp := newTestHeartbeat(4, 2, eraftpb.MessageType_MsgHeartbeatResponse, 1<<40, 0)
+	require.True(t, c.add(resp))
+	expected = append(expected, resp)
+	single := newTestHeartbeat(5, 3, eraftpb.MessageType_MsgHeartbeat, 7, 8)
+	require.True(t, c.add(single))
+
+	// The heartbeats that can't be rebuilt are not coalesced.
+	hb := newTestHeartbeat(6, 2, eraftpb.MessageType_MsgHeartbeat, 5, RaftInvalidIndex)
+	require.False(t, c.add(hb))
+	hb = newTestHeartbeat(6, 2, eraftpb.MessageType_MsgHeartbeat, 5, 1)
+	hb.Message.Context = []byte("read index")
+	require.False(t, c.add(hb))
+	require.False(t, c.add(newTestHeartbeat(6, 2, eraftpb.MessageType_MsgAppend, 5, 1)))
+
+	var sent []*rspb.RaftMessage
+	c.flush(func(msg *rspb.RaftMessage) { sent = append(sent, msg) })
+	require.Len(t, sent, 2)
+	sort.Slice(sent, func(i, j int) bool {
+		return sent[i].GetToPeer().GetStoreId() < sent[j].GetToPeer().GetStoreId()
+	})
+	require.True(t, isCoalescedHeartbeat(sent[0]))
+	require.Equal(t, uint64(1), sent[0].GetFromPeer().GetStoreId())
+	require.Equal(t, single, sent[1])
+	require.False(t, isCoalescedHeartbeat(sent[1]))
+
+	msgs, err := splitCoalescedHeartbeat(sent[0])
+	require.Nil(t, err)
+	require.Equal(t, expected, msgs)
+
+	sent = sent[:0]
+	c.flush(func(msg *rspb.RaftMessage) { sent = append(sent, msg) })
+	require.Len(t, sent, 0)
+
+	coalesced := newCoalescedHeartbeat(expected)
+	coalesced.Message.Context = coalesced.Message.Context[:len(coalesced.Message.Context)-1]
+	_, err = splitCoalescedHeartbeat(coalesced)
+	require.NotNil(t, err)
+}
@@ -24,6 +24,7 @@ import (
 const (
 	KB          uint64 = 1024
 	MB          uint64 = 1024 * 1024
+	GB          uint64 = 1024 * 1024 * 1024
 	SplitSizeMb uint64 = 96
 )
 
@@ -40,6 +41,12 @@ type Config struct {
 	// store capacity. 0 means no limit.
 	Capacity uint64
 
+	// When the free space of kv, raft or snap path drops below the reserve, new writes are rejected.
+	// 0 means no reserve.
+	DiskReserveSpace uint64
+	// Interval to check the free space of the store paths.
+	DiskCheckTickInterval time.Duration
+
 	// raft_base_tick_interval is a base tick interval (ms).
 	RaftBaseTickInterval        time.Duration
 	RaftHeartbeatTicks          int
@@ -48,6 +55,9 @@ type Config struct {
 	RaftMaxElectionTimeoutTicks int
 	RaftMaxSizePerMsg           uint64
 	RaftMaxInflightMsgs         int
+	// CoalesceHeartbeats sends the heartbeats of all the regions to a store in one message every raft
+	// worker round, all the stores must support it before enabling.
+	CoalesceHeartbeats bool
 
 	// When the entry exceed the max size, reject to propose it.
 	RaftEntryMaxSize uint64
@@ -63,6 +73,9 @@ type Config struct {
 	RaftLogGcSizeLimit uint64
 	// When a peer is not responding for this time, leader will not keep entry cache for it.
 	RaftEntryCacheLifeTime time.Duration
+	// The memory budget of the entry caches of all the regions, the caches of the coldest regions
+	// are evicted when it's exceeded. 0 means no limit.
+	RaftEntryCacheMemoryLimit uint64
 	// When a peer is newly added, reject transferring leader to the peer for a while.
 	RaftRejectTransferLeaderDuration time.Duration
 
@@ -136,6 +149,57 @@ type Config struct {
 	ConcurrentSendSnapLimit uint64
 	ConcurrentRecvSnapLimit uint64
 
+	// Bytes per second limits of snapshot IO shared by all the regions in the store, 0 means no limit.
+	// The send limit also applies to receiving snapshots.
+	SnapBuildRateLimit uint64
+	SnapSendRateLimit  uint64
+	SnapApplyRateLimit uint64
+
+	// SnapCompression is the compression of the snapshot chunks sent by this store, "none", "lz4" or "zstd".
+	// All the stores must support it before enabling.
+	SnapCompression string
+	// SnapResume lets the receiver keep the data of broken snapshot transfers, and the sender resume from
+	// the received size. All the stores must support it before enabling.
+	SnapResume bool
+
+	// SnapGenerateOnFollower lets the leader ask a caught-up follower to generate and send the snapshots,
+	// all the stores must support it before enabling.
+	SnapGenerateOnFollower bool
+	// The leader generates the snapshot itself if the follower doesn't send it in time, or doesn't accept
+	// the request in a few election timeouts.
+	SnapDelegateTimeout time.Duration
+
+	// Interval to send the resolved ts of the regions subscribed by CDC.
+	CDCResolvedTsInterval time.Duration
+
+	// A raft command is completed with a timeout error if it's not applied in time, 0 means no timeout.
+	ProposalTimeout time.Duration
+
+	// The raft logs missing in the entry cache are fetched in the background for the lagging followers,
+	// the bytes being fetched are limited by it. 0 means the raft logs are read in the raft worker.
+	RaftLogFetchMaxBytes uint64
+
+	// Interval to check the level 0 tables and the pending compaction bytes of the kv engine.
+	FlowCheckTickInterval time.Duration
+	// Writes are slowed down to FlowControlSlowdownRate bytes per second above the soft limits, and
+	// rejected above the hard limits, 0 means no limit.
+	FlowControlL0TablesSoftLimit          int
+	FlowControlL0TablesHardLimit          int
+	FlowControlPendingCompactionSoftLimit uint64
+	FlowControlPendingCompactionHardLimit uint64
+	FlowControlSlowdownRate               uint64
+	// Writes are rejected when the raft logs waiting to be applied exceed it, 0 means no limit.
+	FlowControlApplyPendingLimit uint64
+	// The target size of the level 1 of the kv engine, used to estimate the pending compaction bytes.
+	KVEngineL1Size int64
+
+	// Interval to inspect the latencies of the store for the slow score, 0 means no inspection.
+	InspectInterval time.Duration
+	// A round of inspection is slow if any latency exceeds it.
+	InspectSlowThreshold time.Duration
+	// The leaders are transferred away when the slow score reaches it, 0 means never.
+	SlowScoreThreshold uint64
+
 	GrpcInitialWindowSize uint64
 	GrpcKeepAliveTime     time.Duration
 	GrpcKeepAliveTimeout  time.Duration
@@ -146,6 +210,9 @@ type Config struct {
 	Labels        []StoreLabel
 
 	SplitCheck *splitCheckConfig
+
+	// Clock provides the time to the raftstore, it can be replaced by a SimClock in tests.
+	Clock Clock
 }
 
 type splitCheckConfig struct {
@@ -188,6 +255,8 @@ func NewDefaultConfig() *Config {
 		RaftdbPath:                  "",
 		SnapPath:                    "snap",
 		Capacity:                    0,
+		DiskReserveSpace:            0,
+		DiskCheckTickInterval:       1 * time.Second,
 		RaftBaseTickInterval:        1 * time.Second,
 		RaftHeartbeatTicks:          2,
 		RaftElectionTimeoutTicks:    10,
@@ -195,6 +264,7 @@ func NewDefaultConfig() *Config {
 		RaftMaxElectionTimeoutTicks: 0,
 		RaftMaxSizePerMsg:           1 * MB,
 		RaftMaxInflightMsgs:         256,
+		CoalesceHeartbeats:          false,
 		RaftEntryMaxSize:            8 * MB,
 		RaftLogGCTickInterval:       10 * time.Second,
 		RaftLogGcThreshold:          50,
@@ -202,6 +272,7 @@ func NewDefaultConfig() *Config {
 		RaftLogGcCountLimit:              splitSize * 3 / 4 / KB,
 		RaftLogGcSizeLimit:               splitSize * 3 / 4,
 		RaftEntryCacheLifeTime:           30 * time.Second,
+		RaftEntryCacheMemoryLimit:        1024 * MB,
 		RaftRejectTransferLeaderDuration: 3 * time.Second,
 		SplitRegionCheckTickInterval:     10 * time.Second,
 		RegionSplitCheckDiff:             splitSize / 8,
@@ -237,12 +308,35 @@ func NewDefaultConfig() *Config {
 		StoreMaxBatchSize:        1024,
 		ConcurrentSendSnapLimit:  32,
 		ConcurrentRecvSnapLimit:  32,
-		GrpcInitialWindowSize:    2 * 1024 * 1024,
-		GrpcKeepAliveTime:        3 * time.Second,
-		GrpcKeepAliveTimeout:     60 * time.Second,
-		GrpcRaftConnNum:          1,
-		Addr:                     "127.0.0.1:20160",
-		SplitCheck:               newDefaultSplitCheckConfig(),
+		SnapBuildRateLimit:       0,
+		SnapSendRateLimit:        0,
+		SnapApplyRateLimit:       0,
+		SnapCompression:          "none",
+		SnapResume:               false,
+		SnapGenerateOnFollower:   false,
+		SnapDelegateTimeout:      5 * time.Minute,
+		CDCResolvedTsInterval:    1 * time.Second,
+		ProposalTimeout:          10 * time.Second,
+		RaftLogFetchMaxBytes:     32 * MB,
+		FlowCheckTickInterval:    1 * time.Second,
+		// The kv engine compacts level 0 above 4 tables and stalls the writes at 8 tables by default.
+		FlowControlL0TablesSoftLimit:          6,
+		FlowControlL0TablesHardLimit:          7,
+		FlowControlPendingCompactionSoftLimit: 192 * GB,
+		FlowControlPendingCompactionHardLimit: 256 * GB,
+		FlowControlSlowdownRate:               16 * MB,
+		FlowControlApplyPendingLimit:          100000,
+		KVEngineL1Size:                        int64(512 * MB),
+		InspectInterval:                       1 * time.Second,
+		InspectSlowThreshold:                  500 * time.Millisecond,
+		SlowScoreThreshold:                    80,
+		GrpcInitialWindowSize:                 2 * 1024 * 1024,
+		GrpcKeepAliveTime:                     3 * time.Second,
+		GrpcKeepAliveTimeout:                  60 * time.Second,
+		GrpcRaftConnNum:                       1,
+		Addr:                                  "127.0.0.1:20160",
+		SplitCheck:                            newDefaultSplitCheckConfig(),
+		Clock:                                 SystemClock,
 	}
 }
 
@@ -350,5 +444,12 @@ func (c *Config) Validate() error {
 	if c.StoreMaxBatchSize == 0 {
 		return fmt.Errorf("store-max-batch-size should be greater than 0")
 	}
+	if _, err := parseSnapCompression(c.SnapCompression); err != nil {
+		return fmt.Errorf("snap-compression should be none, lz4 or zstd, current value is %v", c.SnapCompression)
+	}
+	if c.SlowScoreThreshold > maxSlowScore {
+		return fmt.Errorf("slow-score-threshold should be no more than %v, current value is %v",
+			maxSlowScore, c.SlowScoreThreshold)
+	}
 	return nil
 }
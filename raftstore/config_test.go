@@ -89,4 +89,12 @@ func TestConfigValidate(t *testing.T) {
 	cfg = NewDefaultConfig()
 	cfg.ApplyPoolSize = 0
 	require.NotNil(t, cfg.Validate())
+
+	cfg = NewDefaultConfig()
+	cfg.SnapCompression = "snappy"
+	require.NotNil(t, cfg.Validate())
+
+	cfg = NewDefaultConfig()
+	cfg.SlowScoreThreshold = 101
+	require.NotNil(t, cfg.Validate())
 }
@@ -14,6 +14,9 @@
 package raftstore
 
 import (
+	"bytes"
+	"context"
+	"sync"
 	"time"
 
 	"github.com/ngaut/unistore/config"
@@ -22,6 +25,7 @@ import (
 	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	rcpb "github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	"github.com/pingcap/log"
 	"github.com/pingcap/tidb/store/mockstore/unistore/metrics"
 	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
 	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/pberror"
@@ -29,8 +33,37 @@ import (
 )
 
 type raftDBWriter struct {
-	router           *router
-	useCustomRaftLog bool
+	router               *router
+	useCustomRaftLog     bool
+	customRaftLogVersion uint16
+	// proposalTimeout bounds the time to wait for a write, 0 means no timeout.
+	proposalTimeout time.Duration
+	// onePCCtxs is the set of the contexts of the prewrite requests marked by MarkOnePC.
+	onePCCtxs sync.Map
+}
+
+// OnePCMarker marks the prewrite requests trying 1PC. The MVCCStore commits the keys of a 1PC prewrite
+// request with the commit ts directly, the writer needs the mark to tell it from a normal commit.
+type OnePCMarker interface {
+	// MarkOnePC marks the prewrite request with the context, it returns false if the writer can't
+	// write 1PC commits, then the request must not try 1PC.
+	MarkOnePC(ctx *kvrpcpb.Context) bool
+	// UnmarkOnePC unmarks the prewrite request after it's handled.
+	UnmarkOnePC(ctx *kvrpcpb.Context)
+}
+
+// MarkOnePC implements the OnePCMarker MarkOnePC method.
+func (writer *raftDBWriter) MarkOnePC(ctx *kvrpcpb.Context) bool {
+	if ctx == nil || !writer.useCustomRaftLog || writer.customRaftLogVersion < raftlog.TypeOnePC.Version() {
+		return false
+	}
+	writer.onePCCtxs.Store(ctx, struct{}{})
+	return true
+}
+
+// UnmarkOnePC implements the OnePCMarker UnmarkOnePC method.
+func (writer *raftDBWriter) UnmarkOnePC(ctx *kvrpcpb.Context) {
+	writer.onePCCtxs.Delete(ctx)
 }
 
 func (writer *raftDBWriter) Open() {
@@ -50,7 +83,7 @@ type raftWriteBatch struct {
 
 func (wb *raftWriteBatch) Prewrite(key []byte, lock *mvcc.Lock) {
 	encodedKey := codec.EncodeBytes(nil, key)
-	putLock, putDefault := mvcc.EncodeLockCFValue(lock)
+	putLock, putDefault := encodeRaftLockCFValue(lock)
 	if len(putDefault) != 0 {
 		// Prewrite with large value.
 		putDefaultReq := &rcpb.Request{
@@ -136,7 +169,7 @@ func (wb *raftWriteBatch) Rollback(key []byte, deleteLock bool) {
 
 func (wb *raftWriteBatch) PessimisticLock(key []byte, lock *mvcc.Lock) {
 	encodedKey := codec.EncodeBytes(nil, key)
-	val, _ := mvcc.EncodeLockCFValue(lock)
+	val, _ := encodeRaftLockCFValue(lock)
 	wb.requests = append(wb.requests, &rcpb.Request{
 		CmdType: rcpb.CmdType_Put,
 		Put: &rcpb.PutRequest{
@@ -158,9 +191,85 @@ func (wb *raftWriteBatch) PessimisticRollback(key []byte) {
 	})
 }
 
+// RawPut puts the raw kv data. The raw keys are not encoded, and the data is put into the default CF like TiKV.
+func (wb *raftWriteBatch) RawPut(key, value []byte) {
+	wb.requests = append(wb.requests, &rcpb.Request{
+		CmdType: rcpb.CmdType_Put,
+		Put: &rcpb.PutRequest{
+			Cf:    CFDefault,
+			Key:   key,
+			Value: value,
+		},
+	})
+}
+
+func (wb *raftWriteBatch) RawDelete(key []byte) {
+	wb.requests = append(wb.requests, &rcpb.Request{
+		CmdType: rcpb.CmdType_Delete,
+		Delete: &rcpb.DeleteRequest{
+			Cf:  CFDefault,
+			Key: key,
+		},
+	})
+}
+
+func (wb *raftWriteBatch) RawDeleteRange(startKey, endKey []byte) {
+	wb.requests = append(wb.requests, &rcpb.Request{
+		CmdType: rcpb.CmdType_DeleteRange,
+		DeleteRange: &rcpb.DeleteRangeRequest{
+			Cf:       CFDefault,
+			StartKey: startKey,
+			EndKey:   endKey,
+		},
+	})
+}
+
+// DeleteRange deletes the transactional data and locks in [startKey, endKey), the keys are encoded
+// like the region keys.
+func (wb *raftWriteBatch) DeleteRange(startKey, endKey []byte) {
+	wb.requests = append(wb.requests, &rcpb.Request{
+		CmdType: rcpb.CmdType_DeleteRange,
+		DeleteRange: &rcpb.DeleteRangeRequest{
+			Cf:       CFWrite,
+			StartKey: codec.EncodeBytes(nil, startKey),
+			EndKey:   codec.EncodeBytes(nil, endKey),
+		},
+	})
+}
+
+// rangeWriteBatch is the write batch of a transactional delete range.
+type rangeWriteBatch interface {
+	mvcc.WriteBatch
+	DeleteRange(startKey, endKey []byte)
+}
+
+// rawWriteBatch is the write batch of the raw kv data.
+type rawWriteBatch interface {
+	mvcc.WriteBatch
+	RawPut(key, value []byte)
+	RawDelete(key []byte)
+	// RawDeleteRange deletes the raw kv data in [startKey, endKey), an empty endKey means no upper bound.
+	RawDeleteRange(startKey, endKey []byte)
+}
+
+// newRawWriteBatch returns a rawWriteBatch, the raw kv types of the custom raft log are only used if
+// the configured version supports them.
+func (writer *raftDBWriter) newRawWriteBatch(ctx *kvrpcpb.Context) rawWriteBatch {
+	if writer.useCustomRaftLog && writer.customRaftLogVersion >= raftlog.TypeRawPut.Version() {
+		return writer.NewWriteBatch(0, 0, ctx).(*customWriteBatch)
+	}
+	return &raftWriteBatch{ctx: ctx}
+}
+
 func (writer *raftDBWriter) NewWriteBatch(startTS, commitTS uint64, ctx *kvrpcpb.Context) mvcc.WriteBatch {
 	if writer.useCustomRaftLog {
-		return NewCustomWriteBatch(startTS, commitTS, ctx)
+		wb := NewCustomWriteBatch(startTS, commitTS, ctx).(*customWriteBatch)
+		wb.version = writer.customRaftLogVersion
+		if commitTS > 0 {
+			// Only the 1PC prewrite commits in the marked request.
+			_, wb.onePC = writer.onePCCtxs.Load(ctx)
+		}
+		return wb
 	}
 	return &raftWriteBatch{
 		ctx:      ctx,
@@ -170,10 +279,19 @@ func (writer *raftDBWriter) NewWriteBatch(startTS, commitTS uint64, ctx *kvrpcpb
 }
 
 func (writer *raftDBWriter) Write(batch mvcc.WriteBatch) error {
+	return writer.WriteContext(context.Background(), batch)
+}
+
+// WriteContext writes the batch through raft like Write, the command is canceled when the ctx is done
+// and ErrProposalCanceled is returned, but the command may still be applied if it's proposed already.
+func (writer *raftDBWriter) WriteContext(ctx context.Context, batch mvcc.WriteBatch) error {
 	cmd := &MsgRaftCmd{
 		SendTime: time.Now(),
 		Callback: NewCallback(),
 	}
+	if writer.proposalTimeout > 0 {
+		cmd.Deadline = cmd.SendTime.Add(writer.proposalTimeout)
+	}
 	var reqLen int
 	switch x := batch.(type) {
 	case *raftWriteBatch:
@@ -198,17 +316,18 @@ func (writer *raftDBWriter) Write(batch mvcc.WriteBatch) error {
 	if err != nil {
 		return err
 	}
-	cmd.Callback.wg.Wait()
+	resp := cmd.Callback.waitContext(ctx, writer.proposalTimeout)
 	waitDoneTime := time.Now()
 	metrics.RaftWriterWait.Observe(waitDoneTime.Sub(start).Seconds())
 	cb := cmd.Callback
-	if !cb.raftBeginTime.IsZero() {
+	// The times are not set by the workers before a timed out or canceled command is done.
+	if resp.Header.Error == nil && !cb.raftBeginTime.IsZero() {
 		metrics.WriteWaiteStepOne.Observe(cb.raftBeginTime.Sub(start).Seconds())
 		metrics.WriteWaiteStepTwo.Observe(cb.raftDoneTime.Sub(cb.raftBeginTime).Seconds())
 		metrics.WriteWaiteStepThree.Observe(cb.applyBeginTime.Sub(cb.raftDoneTime).Seconds())
 		metrics.WriteWaiteStepFour.Observe(cb.applyDoneTime.Sub(cb.applyBeginTime).Seconds())
 	}
-	return writer.checkResponse(cb.resp, reqLen)
+	return writer.checkResponse(resp, reqLen)
 }
 
 func (writer *raftDBWriter) checkResponse(resp *rcpb.RaftCmdResponse, reqCount int) error {
@@ -222,15 +341,60 @@ func (writer *raftDBWriter) checkResponse(resp *rcpb.RaftCmdResponse, reqCount i
 	return nil
 }
 
+// DeleteRange deletes the transactional data and locks in [startKey, endKey) of the region, the
+// latchHandle is the region of the request.
 func (writer *raftDBWriter) DeleteRange(startKey, endKey []byte, latchHandle mvcc.LatchHandle) error {
-	return nil // TODO: stub
+	regCtx, ok := latchHandle.(*regionCtx)
+	if !ok {
+		return errors.Errorf("delete range in unknown region %v", latchHandle)
+	}
+	region := regCtx.Meta()
+	peer := regCtx.peer()
+	if peer == nil {
+		return &ErrRegionNotFound{RegionID: region.Id}
+	}
+	// The range is limited in the region.
+	if bytes.Compare(startKey, regCtx.RawStart()) < 0 {
+		startKey = regCtx.RawStart()
+	}
+	if len(endKey) == 0 || bytes.Compare(endKey, regCtx.RawEnd()) > 0 {
+		endKey = regCtx.RawEnd()
+	}
+	if bytes.Compare(startKey, endKey) >= 0 {
+		return nil
+	}
+	ctx := &kvrpcpb.Context{
+		RegionId:    region.Id,
+		RegionEpoch: regCtx.getRegionEpoch(),
+		Peer:        peer,
+	}
+	var wb rangeWriteBatch
+	if writer.useCustomRaftLog && writer.customRaftLogVersion >= raftlog.TypeDeleteRange.Version() {
+		wb = writer.NewWriteBatch(0, 0, ctx).(*customWriteBatch)
+	} else {
+		wb = &raftWriteBatch{ctx: ctx}
+	}
+	wb.DeleteRange(startKey, endKey)
+	return writer.Write(wb)
 }
 
-// NewDBWriter creates a new mvcc.DBWriter.
+// NewDBWriter creates a new mvcc.DBWriter, it also implements OnePCMarker.
 func NewDBWriter(conf *config.Config, router *Router) mvcc.DBWriter {
+	version := conf.RaftStore.CustomRaftLogVersion
+	if version > raftlog.CustomRaftLogVersion {
+		log.S().Warnf("custom raft log version %d is not supported, use version %d instead",
+			version, raftlog.CustomRaftLogVersion)
+		version = raftlog.CustomRaftLogVersion
+	}
+	var proposalTimeout time.Duration
+	if conf.RaftStore.ProposalTimeout != "" {
+		proposalTimeout = config.ParseDuration(conf.RaftStore.ProposalTimeout)
+	}
 	return &raftDBWriter{
-		router:           router.router,
-		useCustomRaftLog: conf.RaftStore.CustomRaftLog,
+		router:               router.router,
+		useCustomRaftLog:     conf.RaftStore.CustomRaftLog,
+		customRaftLogVersion: version,
+		proposalTimeout:      proposalTimeout,
 	}
 }
 
@@ -286,6 +450,10 @@ type customWriteBatch struct {
 	startTS  uint64
 	commitTS uint64
 	builder  *raftlog.CustomBuilder
+	// version is the max version of the log types the batch can use.
+	version uint16
+	// onePC is set by the writer if the keys are prewritten and committed at once.
+	onePC bool
 }
 
 func (wb *customWriteBatch) setType(tp raftlog.CustomRaftLogType) {
@@ -303,6 +471,11 @@ func (wb *customWriteBatch) Prewrite(key []byte, lock *mvcc.Lock) {
 }
 
 func (wb *customWriteBatch) Commit(key []byte, lock *mvcc.Lock) {
+	if wb.onePC {
+		wb.setType(raftlog.TypeOnePC)
+		wb.builder.AppendOnePC(key, lock.MarshalBinary(), wb.commitTS)
+		return
+	}
 	wb.setType(raftlog.TypeCommit)
 	wb.builder.AppendCommit(key, lock.MarshalBinary(), wb.commitTS)
 }
@@ -313,6 +486,11 @@ func (wb *customWriteBatch) Rollback(key []byte, deleleLock bool) {
 }
 
 func (wb *customWriteBatch) PessimisticLock(key []byte, lock *mvcc.Lock) {
+	if wb.version >= raftlog.TypePessimisticLockWithForUpdateTS.Version() {
+		wb.setType(raftlog.TypePessimisticLockWithForUpdateTS)
+		wb.builder.AppendPessimisticLockWithForUpdateTS(key, lock.MarshalBinary(), lock.ForUpdateTS)
+		return
+	}
 	wb.setType(raftlog.TypePessimisticLock)
 	wb.builder.AppendLock(key, lock.MarshalBinary())
 }
@@ -322,6 +500,26 @@ func (wb *customWriteBatch) PessimisticRollback(key []byte) {
 	wb.builder.AppendPessimisticRollback(key)
 }
 
+func (wb *customWriteBatch) RawPut(key, value []byte) {
+	wb.setType(raftlog.TypeRawPut)
+	wb.builder.AppendRawPut(key, value)
+}
+
+func (wb *customWriteBatch) RawDelete(key []byte) {
+	wb.setType(raftlog.TypeRawDelete)
+	wb.builder.AppendRawDelete(key)
+}
+
+func (wb *customWriteBatch) DeleteRange(startKey, endKey []byte) {
+	wb.setType(raftlog.TypeDeleteRange)
+	wb.builder.AppendDeleteRange(startKey, endKey)
+}
+
+func (wb *customWriteBatch) RawDeleteRange(startKey, endKey []byte) {
+	wb.setType(raftlog.TypeDeleteRange)
+	wb.builder.AppendDeleteRange(RawDataKey(startKey), RawDataEndKey(endKey))
+}
+
 // NewCustomWriteBatch returns a new mvcc.WriteBatch.
 func NewCustomWriteBatch(startTS, commitTS uint64, ctx *kvrpcpb.Context) mvcc.WriteBatch {
 	header := raftlog.CustomHeader{
@@ -336,5 +534,6 @@ func NewCustomWriteBatch(startTS, commitTS uint64, ctx *kvrpcpb.Context) mvcc.Wr
 		startTS:  startTS,
 		commitTS: commitTS,
 		builder:  b,
+		version:  raftlog.CustomRaftLogVersion,
 	}
 }
@@ -20,7 +20,9 @@ import (
 
 	"github.com/ngaut/unistore/raftstore/raftlog"
 	"github.com/pingcap/badger"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
 	rfpb "github.com/pingcap/kvproto/pkg/raft_cmdpb"
 	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
 	"github.com/stretchr/testify/assert"
@@ -180,3 +182,352 @@ func TestRaftWriteBatch_Rollback(t *testing.T) {
 	val := engines.kv.LockStore.Get(primary, nil)
 	assert.Nil(t, val)
 }
+
+func TestCustomWriteBatch_Version(t *testing.T) {
+	ctx := &kvrpcpb.Context{RegionEpoch: new(metapb.RegionEpoch), Peer: new(metapb.Peer)}
+	lock := &mvcc.Lock{LockHdr: mvcc.LockHdr{StartTS: 100, ForUpdateTS: 110, Op: uint8(kvrpcpb.Op_PessimisticLock)}}
+	for _, version := range []uint16{0, 1} {
+		writer := &raftDBWriter{useCustomRaftLog: true, customRaftLogVersion: version}
+		wb := writer.NewWriteBatch(100, 0, ctx).(*customWriteBatch)
+		wb.PessimisticLock([]byte("k"), lock)
+		rlog, err := raftlog.DecodeCustom(wb.builder.Build().Marshal())
+		assert.Nil(t, err)
+		assert.Equal(t, version, rlog.Version())
+		if version == 0 {
+			assert.Equal(t, raftlog.TypePessimisticLock, rlog.Type())
+		} else {
+			assert.Equal(t, raftlog.TypePessimisticLockWithForUpdateTS, rlog.Type())
+		}
+	}
+}
+
+func TestCustomRaftLog_NewTypes(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	apply := new(applier)
+	applyCtx := newApplyContext("test", nil, engines, nil, NewDefaultConfig())
+	exec := func(tp raftlog.CustomRaftLogType, fn func(b *raftlog.CustomBuilder)) applyResult {
+		b := raftlog.NewBuilder(raftlog.CustomHeader{})
+		b.SetType(tp)
+		fn(b)
+		rlog, err := raftlog.DecodeCustom(b.Build().Marshal())
+		assert.Nil(t, err)
+		resp, result := apply.execWriteCmd(applyCtx, rlog)
+		assert.Equal(t, b.Len(), len(resp.Responses))
+		assert.Nil(t, applyCtx.wb.WriteToKV(engines.kv))
+		applyCtx.wb.Reset()
+		if applyCtx.txn != nil {
+			applyCtx.txn.Discard()
+			applyCtx.txn = nil
+		}
+		return result
+	}
+	get := func(key []byte) []byte {
+		var val []byte
+		assert.Nil(t, engines.kv.DB.View(func(txn *badger.Txn) error {
+			item, err := txn.Get(key)
+			if err == badger.ErrKeyNotFound {
+				return nil
+			}
+			assert.Nil(t, err)
+			val, err = item.ValueCopy(nil)
+			return err
+		}))
+		return val
+	}
+	getLock := func(key []byte) mvcc.Lock {
+		val := engines.kv.LockStore.Get(key, nil)
+		assert.NotNil(t, val)
+		return mvcc.DecodeLock(val)
+	}
+
+	// The raw kv data doesn't mix with the transactional data.
+	exec(raftlog.TypeRawPut, func(b *raftlog.CustomBuilder) {
+		b.AppendRawPut([]byte("tk1"), []byte("v1"))
+		b.AppendRawPut([]byte("tk2"), []byte("v2"))
+	})
+	assert.Equal(t, []byte("v1"), get(RawDataKey([]byte("tk1"))))
+	assert.Equal(t, []byte("v2"), get(RawDataKey([]byte("tk2"))))
+	assert.Nil(t, get([]byte("tk1")))
+	exec(raftlog.TypeRawDelete, func(b *raftlog.CustomBuilder) {
+		b.AppendRawDelete([]byte("tk1"))
+	})
+	assert.Nil(t, get(RawDataKey([]byte("tk1"))))
+	assert.Equal(t, []byte("v2"), get(RawDataKey([]byte("tk2"))))
+
+	// A pessimistic lock with an older for-update-ts doesn't overwrite the lock.
+	key := []byte("tk3")
+	pessimisticLock := func(forUpdateTS uint64) {
+		lock := &mvcc.Lock{LockHdr: mvcc.LockHdr{StartTS: 100, ForUpdateTS: forUpdateTS, Op: uint8(kvrpcpb.Op_PessimisticLock)}}
+		exec(raftlog.TypePessimisticLockWithForUpdateTS, func(b *raftlog.CustomBuilder) {
+			b.AppendPessimisticLockWithForUpdateTS(key, lock.MarshalBinary(), forUpdateTS)
+		})
+	}
+	pessimisticLock(120)
+	assert.Equal(t, uint64(120), getLock(key).ForUpdateTS)
+	pessimisticLock(110)
+	assert.Equal(t, uint64(120), getLock(key).ForUpdateTS)
+	pessimisticLock(130)
+	assert.Equal(t, uint64(130), getLock(key).ForUpdateTS)
+	// The same for-update-ts overwrites the lock.
+	exec(raftlog.TypePessimisticLockWithForUpdateTS, func(b *raftlog.CustomBuilder) {
+		lock := &mvcc.Lock{LockHdr: mvcc.LockHdr{StartTS: 100, ForUpdateTS: 130, TTL: 20, Op: uint8(kvrpcpb.Op_PessimisticLock)}}
+		b.AppendPessimisticLockWithForUpdateTS(key, lock.MarshalBinary(), 130)
+	})
+	assert.Equal(t, uint32(20), getLock(key).TTL)
+	// Nor a prewritten lock.
+	exec(raftlog.TypePrewrite, func(b *raftlog.CustomBuilder) {
+		lock := &mvcc.Lock{LockHdr: mvcc.LockHdr{StartTS: 100, ForUpdateTS: 130, Op: uint8(kvrpcpb.Op_Put)}, Value: []byte("v3")}
+		b.AppendLock(key, lock.MarshalBinary())
+	})
+	pessimisticLock(140)
+	assert.Equal(t, uint8(kvrpcpb.Op_Put), getLock(key).Op)
+	// But pushing the min-commit-ts of the prewritten lock is applied.
+	exec(raftlog.TypePessimisticLockWithForUpdateTS, func(b *raftlog.CustomBuilder) {
+		lock := &mvcc.Lock{LockHdr: mvcc.LockHdr{StartTS: 100, ForUpdateTS: 130, MinCommitTS: 150, Op: uint8(kvrpcpb.Op_Put)}, Value: []byte("v3")}
+		b.AppendPessimisticLockWithForUpdateTS(key, lock.MarshalBinary(), 130)
+	})
+	assert.Equal(t, uint64(150), getLock(key).MinCommitTS)
+
+	// 1PC commits the keys directly and deletes the pessimistic locks.
+	onePCKeys := [][]byte{[]byte("tk4"), []byte("tk5")}
+	key = onePCKeys[0]
+	pessimisticLock(150)
+	exec(raftlog.TypeOnePC, func(b *raftlog.CustomBuilder) {
+		for _, k := range onePCKeys {
+			lock := &mvcc.Lock{LockHdr: mvcc.LockHdr{StartTS: 100, Op: uint8(kvrpcpb.Op_Put)}, Value: k}
+			b.AppendOnePC(k, lock.MarshalBinary(), 200)
+		}
+	})
+	for _, k := range onePCKeys {
+		assert.Equal(t, k, get(k))
+		assert.Nil(t, engines.kv.LockStore.Get(k, nil))
+	}
+
+	// DeleteRange deletes the data and the locks in the range.
+	result := exec(raftlog.TypeDeleteRange, func(b *raftlog.CustomBuilder) {
+		b.AppendDeleteRange([]byte("tk3"), []byte("tk5"))
+	})
+	assert.IsType(t, &execResultDeleteRange{}, result.data)
+	assert.Nil(t, engines.kv.LockStore.Get([]byte("tk3"), nil))
+	assert.Nil(t, get([]byte("tk4")))
+	assert.Equal(t, []byte("tk5"), get([]byte("tk5")))
+	assert.Equal(t, []byte("v2"), get(RawDataKey([]byte("tk2"))))
+}
+
+func TestRaftWriteBatch_AsyncCommit(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	apply := new(applier)
+	applyCtx := newApplyContext("test", nil, engines, nil, NewDefaultConfig())
+	exec := func(wb *raftWriteBatch) {
+		apply.execWriteCmd(applyCtx, raftlog.NewRequest(&rfpb.RaftCmdRequest{
+			Header:   new(rfpb.RaftRequestHeader),
+			Requests: wb.requests,
+		}))
+		assert.Nil(t, applyCtx.wb.WriteToKV(engines.kv))
+		applyCtx.wb.Reset()
+	}
+
+	// The async commit lock keeps the secondaries.
+	primary := []byte("tk1")
+	asyncLock := &mvcc.Lock{
+		LockHdr: mvcc.LockHdr{StartTS: 100, TTL: 10, MinCommitTS: 110, Op: uint8(kvrpcpb.Op_Put),
+			PrimaryLen: uint16(len(primary)), UseAsyncCommit: true, SecondaryNum: 1},
+		Primary:     primary,
+		Secondaries: [][]byte{[]byte("tk2")},
+		Value:       []byte("v1"),
+	}
+	wb := &raftWriteBatch{startTS: 100}
+	wb.Prewrite(primary, asyncLock)
+	exec(wb)
+	val := engines.kv.LockStore.Get(primary, nil)
+	assert.NotNil(t, val)
+	assert.Equal(t, asyncLock.MarshalBinary(), val)
+}
+
+func TestCustomWriteBatch_OnePC(t *testing.T) {
+	commitType := func(writer *raftDBWriter, ctx *kvrpcpb.Context, commitTS uint64) raftlog.CustomRaftLogType {
+		wb := writer.NewWriteBatch(100, commitTS, ctx).(*customWriteBatch)
+		wb.Commit([]byte("tk"), &mvcc.Lock{LockHdr: mvcc.LockHdr{StartTS: 100, Op: uint8(kvrpcpb.Op_Put)}, Value: []byte("v")})
+		rlog, err := raftlog.DecodeCustom(wb.builder.Build().Marshal())
+		assert.Nil(t, err)
+		return rlog.Type()
+	}
+	newCtx := func() *kvrpcpb.Context {
+		return &kvrpcpb.Context{RegionEpoch: new(metapb.RegionEpoch), Peer: new(metapb.Peer)}
+	}
+
+	// Only the commit in the marked prewrite request is a 1PC commit.
+	writer := &raftDBWriter{useCustomRaftLog: true, customRaftLogVersion: 1}
+	prewriteCtx, commitCtx := newCtx(), newCtx()
+	assert.True(t, writer.MarkOnePC(prewriteCtx))
+	assert.Equal(t, raftlog.TypeOnePC, commitType(writer, prewriteCtx, 200))
+	assert.Equal(t, raftlog.TypeCommit, commitType(writer, commitCtx, 200))
+	writer.UnmarkOnePC(prewriteCtx)
+	assert.Equal(t, raftlog.TypeCommit, commitType(writer, prewriteCtx, 200))
+
+	// The writers that can't write 1PC commits don't mark the requests.
+	assert.False(t, (&raftDBWriter{useCustomRaftLog: true}).MarkOnePC(newCtx()))
+	assert.False(t, (&raftDBWriter{customRaftLogVersion: 1}).MarkOnePC(newCtx()))
+	assert.False(t, writer.MarkOnePC(nil))
+}
+
+func TestCustomWriteBatch_LockInWriteBatch(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	apply := new(applier)
+	applyCtx := newApplyContext("test", nil, engines, nil, NewDefaultConfig())
+	key := []byte("tk")
+	exec := func(tp raftlog.CustomRaftLogType, fn func(b *raftlog.CustomBuilder)) {
+		b := raftlog.NewBuilder(raftlog.CustomHeader{})
+		b.SetType(tp)
+		fn(b)
+		rlog, err := raftlog.DecodeCustom(b.Build().Marshal())
+		assert.Nil(t, err)
+		apply.execWriteCmd(applyCtx, rlog)
+	}
+	prewrite := func(startTS uint64) {
+		exec(raftlog.TypePrewrite, func(b *raftlog.CustomBuilder) {
+			lock := &mvcc.Lock{LockHdr: mvcc.LockHdr{StartTS: startTS, Op: uint8(kvrpcpb.Op_Put)}, Value: []byte("v")}
+			b.AppendLock(key, lock.MarshalBinary())
+		})
+	}
+	commit := func(startTS, commitTS uint64) {
+		exec(raftlog.TypeCommit, func(b *raftlog.CustomBuilder) {
+			lock := &mvcc.Lock{LockHdr: mvcc.LockHdr{StartTS: startTS, Op: uint8(kvrpcpb.Op_Put)}, Value: []byte("v")}
+			b.AppendCommit(key, lock.MarshalBinary(), commitTS)
+		})
+	}
+	prewrite(100)
+	assert.Nil(t, applyCtx.wb.WriteToKV(engines.kv))
+	applyCtx.wb.Reset()
+	assert.NotNil(t, engines.kv.LockStore.Get(key, nil))
+
+	// The lock deleted in the write batch is not read from the lock store.
+	commit(100, 110)
+	assert.Nil(t, apply.getLock(applyCtx, key))
+	// The lock written in the write batch is newer than the lock store.
+	prewrite(120)
+	assert.Equal(t, uint64(120), mvcc.DecodeLock(apply.getLock(applyCtx, key)).StartTS)
+	commit(120, 130)
+	assert.Nil(t, apply.getLock(applyCtx, key))
+}
+
+func TestApplyMultiVersions(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	region := &metapb.Region{Id: 1, RegionEpoch: &metapb.RegionEpoch{ConfVer: 1, Version: 1}}
+	a := &applier{region: region, applyState: applyState{appliedIndex: 5}}
+	applyCtx := newApplyContext("test", nil, engines, nil, NewDefaultConfig())
+	applyCtx.prepareFor(a)
+	key := []byte("tk")
+	appliedIndex := func() uint64 {
+		txn := engines.kv.DB.NewTransaction(false)
+		defer txn.Discard()
+		idx, err := loadAppliedIdx(region.Id, txn)
+		assert.Nil(t, err)
+		return idx
+	}
+	getValues := func() (vals []string) {
+		txn := engines.kv.DB.NewTransaction(false)
+		defer txn.Discard()
+		it := txn.NewIterator(badger.IteratorOptions{AllVersions: true})
+		defer it.Close()
+		for it.Seek(key); it.Valid() && bytes.Equal(it.Item().Key(), key); it.Next() {
+			val, err := it.Item().Value()
+			assert.Nil(t, err)
+			vals = append(vals, string(val))
+		}
+		return
+	}
+	// A follower applies the commits of the same key in one batch when it catches up.
+	for i, val := range []string{"v1", "v2"} {
+		b := raftlog.NewBuilder(raftlog.CustomHeader{RegionID: region.Id, Epoch: raftlog.NewEpoch(1, 1)})
+		b.SetType(raftlog.TypeCommit)
+		startTS := uint64(10 * (i + 1))
+		lock := &mvcc.Lock{LockHdr: mvcc.LockHdr{StartTS: startTS, Op: uint8(kvrpcpb.Op_Put)}, Value: []byte(val)}
+		b.AppendCommit(key, lock.MarshalBinary(), startTS+1)
+		entry := &eraftpb.Entry{Index: uint64(6 + i), Term: 1, Data: b.Build().Marshal()}
+		a.handleRaftEntryNormal(applyCtx, entry)
+	}
+	// The first raft log is written with its apply state before the second one.
+	assert.Equal(t, uint64(6), appliedIndex())
+	assert.Equal(t, []string{"v1"}, getValues())
+
+	applyCtx.finishFor(a, nil)
+	applyCtx.writeToDB()
+	assert.Equal(t, uint64(7), appliedIndex())
+	assert.Equal(t, []string{"v2", "v1"}, getValues())
+}
+
+func TestRawWriteBatch(t *testing.T) {
+	ctx := &kvrpcpb.Context{RegionEpoch: new(metapb.RegionEpoch), Peer: new(metapb.Peer)}
+	for _, useCustomRaftLog := range []bool{false, true} {
+		engines := newTestEngines(t)
+		apply := new(applier)
+		applyCtx := newApplyContext("test", nil, engines, nil, NewDefaultConfig())
+		writer := &raftDBWriter{useCustomRaftLog: useCustomRaftLog, customRaftLogVersion: 1}
+		exec := func(fn func(wb rawWriteBatch)) {
+			wb := writer.newRawWriteBatch(ctx)
+			fn(wb)
+			var rlog raftlog.RaftLog
+			switch x := wb.(type) {
+			case *customWriteBatch:
+				assert.True(t, useCustomRaftLog)
+				rlog = x.builder.Build()
+			case *raftWriteBatch:
+				assert.False(t, useCustomRaftLog)
+				rlog = raftlog.NewRequest(&rfpb.RaftCmdRequest{Header: new(rfpb.RaftRequestHeader), Requests: x.requests})
+			}
+			apply.execWriteCmd(applyCtx, rlog)
+			assert.Nil(t, applyCtx.wb.WriteToKV(engines.kv))
+			applyCtx.wb.Reset()
+			if applyCtx.txn != nil {
+				applyCtx.txn.Discard()
+				applyCtx.txn = nil
+			}
+		}
+		scan := func() (kvs []string) {
+			assert.Nil(t, engines.kv.DB.View(func(txn *badger.Txn) error {
+				region := &metapb.Region{Peers: []*metapb.Peer{new(metapb.Peer)}}
+				pairs, err := scanRaw(txn, region, new(kvrpcpb.KeyRange), 10, false, false)
+				for _, pair := range pairs {
+					kvs = append(kvs, string(pair.Key)+"="+string(pair.Value))
+				}
+				return err
+			}))
+			return
+		}
+		exec(func(wb rawWriteBatch) {
+			for _, key := range []string{"a", "b", "c", "d"} {
+				wb.RawPut([]byte(key), []byte("v"+key))
+			}
+		})
+		// The raw data should not be seen as MVCC data.
+		assert.Nil(t, engines.kv.DB.View(func(txn *badger.Txn) error {
+			_, err := txn.Get([]byte("a"))
+			assert.Equal(t, badger.ErrKeyNotFound, err)
+			return nil
+		}))
+		assert.Equal(t, []string{"a=va", "b=vb", "c=vc", "d=vd"}, scan())
+		exec(func(wb rawWriteBatch) {
+			wb.RawDelete([]byte("b"))
+		})
+		assert.Equal(t, []string{"a=va", "c=vc", "d=vd"}, scan())
+		// A deleted key can be put again.
+		exec(func(wb rawWriteBatch) {
+			wb.RawPut([]byte("b"), []byte("vb2"))
+		})
+		assert.Equal(t, []string{"a=va", "b=vb2", "c=vc", "d=vd"}, scan())
+		exec(func(wb rawWriteBatch) {
+			wb.RawDeleteRange([]byte("b"), []byte("d"))
+		})
+		assert.Equal(t, []string{"a=va", "d=vd"}, scan())
+		exec(func(wb rawWriteBatch) {
+			wb.RawDeleteRange([]byte("c"), nil)
+		})
+		assert.Equal(t, []string{"a=va"}, scan())
+		cleanUpTestEngineData(engines)
+	}
+}
@@ -39,7 +39,7 @@ type regionSnapshot struct {
 	index       uint64
 }
 
-func (rs *regionSnapshot) redoLocks(raft *badger.DB, redoIdx uint64) error {
+func (rs *regionSnapshot) redoLocks(raft RaftEngine, redoIdx uint64) error {
 	regionID := rs.regionState.Region.Id
 	item, err := rs.txn.Get(ApplyStateKey(regionID))
 	if err != nil {
@@ -52,7 +52,7 @@ func (rs *regionSnapshot) redoLocks(raft *badger.DB, redoIdx uint64) error {
 	var applyState applyState
 	applyState.Unmarshal(val)
 	appliedIdx := applyState.appliedIndex
-	entries, _, err := fetchEntriesTo(raft, regionID, redoIdx, appliedIdx+1, math.MaxUint64, nil)
+	entries, _, err := raft.FetchEntries(regionID, redoIdx, appliedIdx+1, math.MaxUint64, nil)
 	if err != nil {
 		return err
 	}
@@ -69,12 +69,12 @@ func (rs *regionSnapshot) redoLocks(raft *badger.DB, redoIdx uint64) error {
 type Engines struct {
 	kv       *mvcc.DBBundle
 	kvPath   string
-	raft     *badger.DB
+	raft     RaftEngine
 	raftPath string
 }
 
 // NewEngines creates a new Engines.
-func NewEngines(kvEngine *mvcc.DBBundle, raftEngine *badger.DB, kvPath, raftPath string) *Engines {
+func NewEngines(kvEngine *mvcc.DBBundle, raftEngine RaftEngine, kvPath, raftPath string) *Engines {
 	return &Engines{
 		kv:       kvEngine,
 		kvPath:   kvPath,
@@ -168,6 +168,8 @@ type WriteBatch struct {
 	safePointLock int
 	safePointSize int
 	safePointUndo int
+	// versions maps the user keys of the entries before the safe point to their versions.
+	versions map[string]uint64
 }
 
 // Len returns the length of the WriteBatch.
@@ -252,6 +254,12 @@ func (wb *WriteBatch) SetMsg(key y.Key, msg proto.Message) error {
 
 // SetSafePoint sets a safe point.
 func (wb *WriteBatch) SetSafePoint() {
+	if wb.versions == nil {
+		wb.versions = make(map[string]uint64)
+	}
+	for _, entry := range wb.entries[wb.safePoint:] {
+		wb.versions[string(entry.Key.UserKey)] = entry.Key.Version
+	}
 	wb.safePoint = len(wb.entries)
 	wb.safePointLock = len(wb.lockEntries)
 	wb.safePointSize = wb.size
@@ -264,6 +272,37 @@ func (wb *WriteBatch) RollbackToSafePoint() {
 	wb.size = wb.safePointSize
 }
 
+// hasNewVersionAfterSafePoint checks if an entry after the safe point writes a key before the safe point
+// with a different version. A badger transaction keeps only the last entry of a key, so the entries
+// must be written in separate transactions.
+func (wb *WriteBatch) hasNewVersionAfterSafePoint() bool {
+	for _, entry := range wb.entries[wb.safePoint:] {
+		if version, ok := wb.versions[string(entry.Key.UserKey)]; ok && version != entry.Key.Version {
+			return true
+		}
+	}
+	return false
+}
+
+// cutAfterSafePoint removes the entries after the safe point and returns them in a new WriteBatch.
+func (wb *WriteBatch) cutAfterSafePoint() *WriteBatch {
+	tail := &WriteBatch{
+		entries:     append([]*badger.Entry(nil), wb.entries[wb.safePoint:]...),
+		lockEntries: append([]*badger.Entry(nil), wb.lockEntries[wb.safePointLock:]...),
+		size:        wb.size - wb.safePointSize,
+	}
+	wb.RollbackToSafePoint()
+	return tail
+}
+
+// appendAfterSafePoint appends the entries of the WriteBatch after the safe point.
+func (wb *WriteBatch) appendAfterSafePoint(tail *WriteBatch) {
+	wb.SetSafePoint()
+	wb.entries = append(wb.entries, tail.entries...)
+	wb.lockEntries = append(wb.lockEntries, tail.lockEntries...)
+	wb.size += tail.size
+}
+
 // WriteToKV flushes WriteBatch to DB by two steps:
 // 	1. Write entries to badger. After save ApplyState to badger, subsequent regionSnapshot will start at new raft index.
 //	2. Update lockStore, the date in lockStore may be older than the DB, so we need to restore then entries from raft log.
@@ -310,27 +349,8 @@ func (wb *WriteBatch) WriteToKV(bundle *mvcc.DBBundle) error {
 }
 
 // WriteToRaft flushes WriteBatch to raft.
-func (wb *WriteBatch) WriteToRaft(db *badger.DB) error {
-	if len(wb.entries) > 0 {
-		start := time.Now()
-		err := db.Update(func(txn *badger.Txn) error {
-			for _, entry := range wb.entries {
-				if len(entry.Value) == 0 {
-					entry.SetDelete()
-				}
-				err1 := txn.SetEntry(entry)
-				if err1 != nil {
-					return err1
-				}
-			}
-			return nil
-		})
-		metrics.RaftDBUpdate.Observe(time.Since(start).Seconds())
-		if err != nil {
-			return errors.WithStack(err)
-		}
-	}
-	return nil
+func (wb *WriteBatch) WriteToRaft(engine RaftEngine) error {
+	return engine.Write(wb)
 }
 
 // MustWriteToKV wraps WriteToKV and will panic if error is not nil.
@@ -342,8 +362,8 @@ func (wb *WriteBatch) MustWriteToKV(db *mvcc.DBBundle) {
 }
 
 // MustWriteToRaft wraps WriteToRaft and will panic if error is not nil.
-func (wb *WriteBatch) MustWriteToRaft(db *badger.DB) {
-	err := wb.WriteToRaft(db)
+func (wb *WriteBatch) MustWriteToRaft(engine RaftEngine) {
+	err := wb.WriteToRaft(engine)
 	if err != nil {
 		panic(err)
 	}
@@ -364,6 +384,9 @@ func (wb *WriteBatch) Reset() {
 	wb.safePointLock = 0
 	wb.safePointSize = 0
 	wb.safePointUndo = 0
+	for key := range wb.versions {
+		delete(wb.versions, key)
+	}
 }
 
 // Todo, the following code redundant to unistore/tikv/worker.go, just as a place holder now.
@@ -377,6 +400,11 @@ func deleteRange(db *mvcc.DBBundle, startKey, endKey []byte) error {
 	reader := dbreader.NewDBReader(startKey, endKey, txn)
 	keys = collectRangeKeys(reader.GetIter(), startKey, endKey, keys)
 	reader.Close()
+	rawStart, rawEnd := rawDataRange(startKey, endKey)
+	txn = db.DB.NewTransaction(false)
+	reader = dbreader.NewDBReader(rawStart, rawEnd, txn)
+	keys = collectRangeKeys(reader.GetIter(), rawStart, rawEnd, keys)
+	reader.Close()
 	if err := deleteKeysInBatch(db, keys, delRangeBatchSize); err != nil {
 		return err
 	}
@@ -424,8 +452,7 @@ func deleteKeysInBatch(db *mvcc.DBBundle, keys []y.Key, batchSize int) error {
 		keys = keys[batchSize:]
 		dbBatch := new(WriteBatch)
 		for _, key := range batchKeys {
-			key.Version++
-			dbBatch.Delete(key)
+			dbBatch.Delete(tombstoneKey(key.UserKey, key.Version))
 		}
 		if err := dbBatch.WriteToKV(db); err != nil {
 			return err
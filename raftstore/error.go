@@ -77,6 +77,22 @@ func (e *ErrStaleCommand) Error() string {
 	return "stale command"
 }
 
+// ErrProposalTimeout is returned when the command is not applied before its deadline, the command
+// may still be applied later.
+type ErrProposalTimeout struct{}
+
+func (e *ErrProposalTimeout) Error() string {
+	return "proposal timeout"
+}
+
+// ErrProposalCanceled is returned when the command is canceled by the caller, the command may still
+// be applied if it's already proposed.
+type ErrProposalCanceled struct{}
+
+func (e *ErrProposalCanceled) Error() string {
+	return "proposal canceled"
+}
+
 // ErrStoreNotMatch is returned when the store is not match.
 type ErrStoreNotMatch struct {
 	RequestStoreID uint64
@@ -0,0 +1,92 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync/atomic"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/failpoint"
+)
+
+// The failpoints at the persistence and apply boundaries of the raftstore. They are enabled by
+// EnableFailpoint with the failpoint terms, e.g. "panic", "sleep(100)", `return("io error")`, "pause"
+// or "1*return(true)". A paused failpoint blocks until it's disabled.
+const (
+	// FailpointRaftBeforeSaveKV is evaluated in the ready handler before writing the kv batch.
+	FailpointRaftBeforeSaveKV = "raft_before_save_kv"
+	// FailpointRaftBetweenSave is evaluated in the ready handler between writing the kv batch and the raft batch.
+	FailpointRaftBetweenSave = "raft_between_save"
+	// FailpointRaftAfterSave is evaluated in the ready handler after the ready is persisted.
+	FailpointRaftAfterSave = "raft_after_save"
+	// FailpointApplyBeforeWriteKV is evaluated before the applier writes the applied entries.
+	FailpointApplyBeforeWriteKV = "apply_before_write_kv"
+	// FailpointApplyBeforeSplit is evaluated before executing a split, an error fails the split.
+	FailpointApplyBeforeSplit = "apply_before_split"
+	// FailpointSnapApplyItem is evaluated for each item applied from a snapshot, an error aborts the apply.
+	FailpointSnapApplyItem = "snap_apply_item"
+	// FailpointRegionApplySnapBeforeIngest is evaluated before ingesting the applied snapshot tables.
+	FailpointRegionApplySnapBeforeIngest = "region_apply_snap_before_ingest"
+	// FailpointRegionApplySnapBeforeUpdateState is evaluated after ingesting the snapshot tables but
+	// before the region state is updated from Applying to Normal, an error skips the update like a crash.
+	FailpointRegionApplySnapBeforeUpdateState = "region_apply_snap_before_update_state"
+	// FailpointLockStoreBeforeDump is evaluated before the lock store is dumped to file.
+	FailpointLockStoreBeforeDump = "lockstore_before_dump"
+)
+
+const failpointPrefix = "github.com/ngaut/unistore/raftstore/"
+
+// enabledFailpoints avoids evaluating the failpoints when none is enabled.
+var enabledFailpoints int32
+
+// EnableFailpoint enables the named failpoint with the terms.
+func EnableFailpoint(name, terms string) error {
+	if failpoint.Disable(failpointPrefix+name) == nil {
+		atomic.AddInt32(&enabledFailpoints, -1)
+	}
+	if err := failpoint.Enable(failpointPrefix+name, terms); err != nil {
+		return err
+	}
+	atomic.AddInt32(&enabledFailpoints, 1)
+	return nil
+}
+
+// DisableFailpoint disables the named failpoint and releases the paused goroutines.
+func DisableFailpoint(name string) error {
+	if err := failpoint.Disable(failpointPrefix + name); err != nil {
+		return err
+	}
+	atomic.AddInt32(&enabledFailpoints, -1)
+	return nil
+}
+
+// evalFailpoint evaluates the named failpoint. It returns an error if the failpoint returns a value.
+func evalFailpoint(name string) error {
+	if atomic.LoadInt32(&enabledFailpoints) == 0 {
+		return nil
+	}
+	val, err := failpoint.Eval(failpointPrefix + name)
+	if err != nil || val == nil {
+		return nil
+	}
+	return errors.Errorf("failpoint %s: %v", name, val)
+}
+
+// mustEvalFailpoint evaluates the named failpoint and panics if it returns a value, it's used where
+// the error can't be handled, like a write failure.
+func mustEvalFailpoint(name string) {
+	if err := evalFailpoint(name); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailpoint(t *testing.T) {
+	const name = "test_failpoint"
+	require.Nil(t, evalFailpoint(name))
+
+	require.Nil(t, EnableFailpoint(name, `1*return("io error")`))
+	// Enabling twice doesn't leak the counter.
+	require.Nil(t, EnableFailpoint(name, `1*return("io error")`))
+	err := evalFailpoint(name)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "io error")
+	require.Nil(t, evalFailpoint(name))
+	require.Panics(t, func() {
+		require.Nil(t, EnableFailpoint(name, "return(true)"))
+		mustEvalFailpoint(name)
+	})
+
+	require.Nil(t, EnableFailpoint(name, "sleep(50)"))
+	start := time.Now()
+	require.Nil(t, evalFailpoint(name))
+	require.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	require.Nil(t, EnableFailpoint(name, "pause"))
+	done := make(chan struct{})
+	go func() {
+		require.Nil(t, evalFailpoint(name))
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("failpoint is not paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.Nil(t, DisableFailpoint(name))
+	<-done
+	require.NotNil(t, DisableFailpoint(name))
+	require.Equal(t, int32(0), enabledFailpoints)
+}
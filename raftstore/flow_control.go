@@ -0,0 +1,169 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/ngaut/unistore/raftstore/raftlog"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/table/sstable"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+const (
+	flowStateNormal uint32 = iota
+	flowStateSlowdown
+	flowStateStop
+)
+
+// flowController throttles the writes before the kv engine stalls them. The engine blocks the writes
+// of the apply worker when the level 0 tables reach the stall limit, and the proposals keep piling up
+// behind it, so the writes are slowed down above the soft limits and rejected with ErrServerIsBusy
+// above the hard limits of the engine, or when too many raft logs are waiting to be applied.
+type flowController struct {
+	cfg *Config
+	// limiter bounds the write bytes in the slowdown state.
+	limiter *rate.Limiter
+	// state is updated by the store worker and read by the raft worker.
+	state uint32
+	// pendingApply is the count of the raft logs sent to the apply worker but not applied yet.
+	pendingApply int64
+}
+
+func newFlowController(cfg *Config) *flowController {
+	f := &flowController{cfg: cfg}
+	if cfg.FlowControlSlowdownRate > 0 {
+		f.limiter = NewIOLimiter(cfg.FlowControlSlowdownRate)
+	}
+	return f
+}
+
+func overLimit(v, limit uint64) bool {
+	return limit > 0 && v >= limit
+}
+
+// updateEngineStats updates the state by the level 0 tables and the pending compaction bytes of the
+// kv engine.
+func (f *flowController) updateEngineStats(l0Tables int, pendingCompactionBytes uint64) {
+	cfg := f.cfg
+	state := flowStateNormal
+	if overLimit(uint64(l0Tables), uint64(cfg.FlowControlL0TablesHardLimit)) ||
+		overLimit(pendingCompactionBytes, cfg.FlowControlPendingCompactionHardLimit) {
+		state = flowStateStop
+	} else if overLimit(uint64(l0Tables), uint64(cfg.FlowControlL0TablesSoftLimit)) ||
+		overLimit(pendingCompactionBytes, cfg.FlowControlPendingCompactionSoftLimit) {
+		state = flowStateSlowdown
+	}
+	flowControlL0Tables.Set(float64(l0Tables))
+	flowControlPendingCompaction.Set(float64(pendingCompactionBytes))
+	if old := atomic.SwapUint32(&f.state, state); old != state {
+		log.Info("kv engine flow state changed", zap.Uint32("from", old), zap.Uint32("to", state),
+			zap.Int("L0 tables", l0Tables), zap.Uint64("pending compaction bytes", pendingCompactionBytes))
+	}
+}
+
+// isBusy returns true if the writes are throttled.
+func (f *flowController) isBusy() bool {
+	return atomic.LoadUint32(&f.state) != flowStateNormal ||
+		overLimit(uint64(atomic.LoadInt64(&f.pendingApply)), f.cfg.FlowControlApplyPendingLimit)
+}
+
+func (f *flowController) addPendingApply(n int) {
+	atomic.AddInt64(&f.pendingApply, int64(n))
+}
+
+// raftLogSize returns the marshalled size of the raft log without marshalling it.
+func raftLogSize(rlog raftlog.RaftLog) int {
+	if req := rlog.GetRaftCmdRequest(); req != nil {
+		return req.Size()
+	}
+	return len(rlog.Marshal())
+}
+
+// checkWrite returns an ErrServerIsBusy if the write of size bytes should be rejected.
+func (f *flowController) checkWrite(size int) error {
+	backoffMs := uint64(f.cfg.FlowCheckTickInterval / time.Millisecond)
+	if overLimit(uint64(atomic.LoadInt64(&f.pendingApply)), f.cfg.FlowControlApplyPendingLimit) {
+		flowControlRejectedApply.Inc()
+		return &ErrServerIsBusy{Reason: "too many raft logs are waiting to be applied", BackoffMs: backoffMs}
+	}
+	switch atomic.LoadUint32(&f.state) {
+	case flowStateStop:
+		flowControlRejectedStop.Inc()
+		return &ErrServerIsBusy{Reason: "kv engine is about to stall writes", BackoffMs: backoffMs}
+	case flowStateSlowdown:
+		if f.limiter == nil {
+			return nil
+		}
+		n := size
+		if n > f.limiter.Burst() {
+			n = f.limiter.Burst()
+		}
+		if !f.limiter.AllowN(time.Now(), n) {
+			flowControlRejectedSlowdown.Inc()
+			return &ErrServerIsBusy{Reason: "writes are slowed down for kv engine compaction", BackoffMs: backoffMs}
+		}
+	}
+	return nil
+}
+
+// countApplyEntries returns the count of the raft logs to apply in the messages.
+func countApplyEntries(msgs []Msg) int {
+	var n int
+	for _, msg := range msgs {
+		if msg.Type == MsgTypeApply {
+			n += len(msg.Data.(*apply).entries)
+		}
+	}
+	return n
+}
+
+// kvEngineFlowStats returns the count of the level 0 tables and the estimated pending compaction bytes
+// of the kv engine. The level 0 tables are all pending, and a lower level has the bytes over its target
+// size pending, the target size of level 1 is l1Size and it grows 10 times every level.
+func kvEngineFlowStats(db *badger.DB, dir string, l1Size int64) (int, uint64) {
+	var l0Tables int
+	var levelSizes []int64
+	for _, t := range db.Tables() {
+		for len(levelSizes) <= t.Level {
+			levelSizes = append(levelSizes, 0)
+		}
+		if t.Level == 0 {
+			l0Tables++
+		}
+		if info, err := os.Stat(sstable.NewFilename(t.ID, dir)); err == nil {
+			levelSizes[t.Level] += info.Size()
+		}
+	}
+	var pending uint64
+	target := l1Size
+	// The last level is not compacted.
+	for level := 0; level < len(levelSizes)-1; level++ {
+		size := levelSizes[level]
+		if level == 0 {
+			pending += uint64(size)
+			continue
+		}
+		if size > target {
+			pending += uint64(size - target)
+		}
+		target *= 10
+	}
+	return l0Tables, pending
+}
@@ -0,0 +1,97 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"testing"
+
+	"github.com/ngaut/unistore/raftstore/raftlog"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPutLog(valueSize int) raftlog.RaftLog {
+	return raftlog.NewRequest(&raft_cmdpb.RaftCmdRequest{
+		Header: new(raft_cmdpb.RaftRequestHeader),
+		Requests: []*raft_cmdpb.Request{{
+			CmdType: raft_cmdpb.CmdType_Put,
+			Put:     &raft_cmdpb.PutRequest{Key: []byte("k"), Value: make([]byte, valueSize)},
+		}},
+	})
+}
+
+func TestFlowController(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.FlowControlL0TablesSoftLimit = 2
+	cfg.FlowControlL0TablesHardLimit = 4
+	cfg.FlowControlPendingCompactionSoftLimit = 100 * MB
+	cfg.FlowControlPendingCompactionHardLimit = 200 * MB
+	cfg.FlowControlSlowdownRate = 1024
+	cfg.FlowControlApplyPendingLimit = 10
+	f := newFlowController(cfg)
+	rlog := newTestPutLog(512)
+
+	f.updateEngineStats(1, 10*MB)
+	require.False(t, f.isBusy())
+	for i := 0; i < 10; i++ {
+		require.Nil(t, f.checkWrite(raftLogSize(rlog)))
+	}
+
+	// The writes are limited by bytes in the slowdown state.
+	f.updateEngineStats(2, 0)
+	require.True(t, f.isBusy())
+	require.Nil(t, f.checkWrite(raftLogSize(rlog)))
+	err := f.checkWrite(raftLogSize(rlog))
+	require.IsType(t, &ErrServerIsBusy{}, err)
+	require.Equal(t, uint64(1000), err.(*ErrServerIsBusy).BackoffMs)
+	f.updateEngineStats(0, 100*MB)
+	require.Equal(t, flowStateSlowdown, f.state)
+
+	// All the writes are rejected in the stop state.
+	f.updateEngineStats(4, 0)
+	require.Equal(t, flowStateStop, f.state)
+	require.IsType(t, &ErrServerIsBusy{}, f.checkWrite(raftLogSize(newTestPutLog(0))))
+	f.updateEngineStats(0, 200*MB)
+	require.Equal(t, flowStateStop, f.state)
+
+	f.updateEngineStats(0, 0)
+	require.False(t, f.isBusy())
+	require.Nil(t, f.checkWrite(raftLogSize(rlog)))
+
+	// The writes are rejected when too many raft logs are waiting to be applied.
+	f.addPendingApply(10)
+	require.True(t, f.isBusy())
+	require.IsType(t, &ErrServerIsBusy{}, f.checkWrite(raftLogSize(rlog)))
+	f.addPendingApply(-1)
+	require.False(t, f.isBusy())
+	require.Nil(t, f.checkWrite(raftLogSize(rlog)))
+
+	// 0 means no limit.
+	f = newFlowController(&Config{FlowCheckTickInterval: cfg.FlowCheckTickInterval})
+	f.updateEngineStats(100, 1000*GB)
+	f.addPendingApply(100000)
+	require.False(t, f.isBusy())
+	require.Nil(t, f.checkWrite(raftLogSize(rlog)))
+}
+
+func TestRaftLogSize(t *testing.T) {
+	rlog := newTestPutLog(512)
+	require.Equal(t, len(rlog.Marshal()), raftLogSize(rlog))
+
+	b := raftlog.NewBuilder(raftlog.CustomHeader{})
+	b.SetType(raftlog.TypePrewrite)
+	b.AppendLock([]byte("k"), make([]byte, 512))
+	rlog = b.Build()
+	require.Equal(t, len(rlog.Marshal()), raftLogSize(rlog))
+}
@@ -16,6 +16,7 @@ package raftstore
 import (
 	"bytes"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/ngaut/unistore/raftstore/raftlog"
@@ -36,6 +37,8 @@ type peerFsm struct {
 	stopped  bool
 	hasReady bool
 	ticker   *ticker
+	// lastValidateTime is the time the peer asked PD to validate it on a gc message.
+	lastValidateTime time.Time
 }
 
 // PeerEventContext represents a peer event context.
@@ -196,7 +199,13 @@ func (d *peerMsgHandler) HandleMsgs(msgs ...Msg) {
 		case MsgTypeClearRegionSize:
 			d.onClearRegionSize()
 		case MsgTypeStart:
-			d.startTicker()
+			d.onStart()
+		case MsgTypeRaftLogFetched:
+			d.onRaftLogFetched(msg.Data.(*raftLogFetchResult))
+		case MsgTypeEvictLeader:
+			d.onEvictLeader()
+		case MsgTypeStalePeer:
+			d.onStalePeer(msg.Data.(*MsgStalePeer))
 		case MsgTypeNoop:
 		}
 	}
@@ -227,6 +236,13 @@ func (d *peerMsgHandler) onTick() {
 	}
 }
 
+func (d *peerMsgHandler) onStart() {
+	store := d.peer.Store()
+	store.logFetcher = d.ctx.raftLogFetcher
+	store.cache.setMemory(d.ctx.entryCacheMem)
+	d.startTicker()
+}
+
 func (d *peerMsgHandler) startTicker() {
 	if d.peer.PendingMergeState != nil {
 		d.notifyPrepareMerge()
@@ -262,7 +278,7 @@ func (d *peerMsgHandler) onGCSnap(snaps []SnapKeyWithSending) {
 				d.ctx.snapMgr.DeleteSnapshot(key, snap, false)
 			} else if fi, err1 := snap.Meta(); err1 == nil {
 				modTime := fi.ModTime()
-				if time.Since(modTime) > d.ctx.cfg.SnapGcTimeout {
+				if d.ctx.cfg.Clock.Since(modTime) > d.ctx.cfg.SnapGcTimeout {
 					log.S().Infof("%s snap file %s has been expired, delete", d.tag(), key)
 					d.ctx.snapMgr.DeleteSnapshot(key, snap, false)
 				}
@@ -280,6 +296,22 @@ func (d *peerMsgHandler) onGCSnap(snaps []SnapKeyWithSending) {
 	}
 }
 
+// onEvictLeader transfers the leadership to a caught-up voter in other stores.
+func (d *peerMsgHandler) onEvictLeader() {
+	if d.stopped || !d.peer.IsLeader() {
+		return
+	}
+	for _, peer := range d.region().Peers {
+		if peer.StoreId == d.storeID() || peer.Role == metapb.PeerRole_Learner {
+			continue
+		}
+		if d.peer.readyToTransferLeader(d.ctx.cfg, peer) {
+			d.peer.transferLeader(peer)
+			return
+		}
+	}
+}
+
 func (d *peerMsgHandler) onClearRegionSize() {
 	d.peer.ApproximateSize = nil
 	d.peer.ApproximateKeys = nil
@@ -289,6 +321,9 @@ func (d *peerMsgHandler) onSignificantMsg(msg *MsgSignificant) {
 	switch msg.Type {
 	case MsgSignificantTypeStatus:
 		// Report snapshot status to the corresponding peer.
+		if d.onDelegatedSnapshotStatus(msg.ToPeerID, msg.SnapshotStatus) {
+			return
+		}
 		d.reportSnapshotStatus(msg.ToPeerID, msg.SnapshotStatus)
 	case MsgSignificantTypeUnreachable:
 		d.peer.RaftGroup.ReportUnreachable(msg.ToPeerID)
@@ -317,6 +352,7 @@ func (d *peerMsgHandler) HandleRaftReadyAppend(proposals []*regionProposal) []*r
 	if p := d.peer.takeApplyProposals(); p != nil {
 		proposals = append(proposals, p)
 	}
+	d.maybeDelegateSnapGeneration()
 	readyRes := d.peer.HandleRaftReadyAppend(d.ctx.trans, d.ctx.applyMsgs, d.ctx.kvWB, d.ctx.raftWB, d.ctx.peerEventObserver)
 	if readyRes != nil {
 		d.ctx.ReadyRes = append(d.ctx.ReadyRes, readyRes)
@@ -347,6 +383,7 @@ func (d *peerMsgHandler) onRaftBaseTick() {
 	if d.peer.PendingRemove {
 		return
 	}
+	d.checkSnapDelegation()
 	// When having pending snapshot, if election timeout is met, it can't pass
 	// the pending conf change check because first index has been updated to
 	// a value that is larger than last index.
@@ -358,7 +395,7 @@ func (d *peerMsgHandler) onRaftBaseTick() {
 	}
 	// TODO: make Tick returns bool to indicate if there is ready.
 	d.peer.RaftGroup.Tick()
-	d.hasReady = d.peer.RaftGroup.HasReady()
+	d.hasReady = d.hasReady || d.peer.RaftGroup.HasReady()
 	d.ticker.schedule(PeerTickRaft)
 }
 
@@ -411,6 +448,10 @@ func (d *peerMsgHandler) onRaftMsg(msg *rspb.RaftMessage) error {
 		}
 		return nil
 	}
+	if msg.ExtraMsg != nil {
+		d.onExtraMessage(msg)
+		return nil
+	}
 	if d.checkMessage(msg) {
 		return nil
 	}
@@ -521,10 +562,11 @@ func handleStaleMsg(trans Transport, msg *rspb.RaftMessage, curEpoch *metapb.Reg
 			regionID, msgType, curEpoch)
 		return
 	}
+	// Reply to the stale peer.
 	gcMsg := &rspb.RaftMessage{
 		RegionId:    regionID,
-		FromPeer:    fromPeer,
-		ToPeer:      toPeer,
+		FromPeer:    toPeer,
+		ToPeer:      fromPeer,
 		RegionEpoch: curEpoch,
 	}
 	if targetRegion != nil {
@@ -550,8 +592,40 @@ func (d *peerMsgHandler) handleGCPeerMsg(msg *rspb.RaftMessage) {
 		log.S().Infof("%s receive stale gc msg, ignore", d.tag())
 		return
 	}
-	// TODO: ask pd to guarantee we are stale now.
-	log.S().Infof("%s peer %s receives gc message, trying to remove", d.tag(), msg.ToPeer)
+	// The gc message may be delayed, the peer is only destroyed after PD confirms it's stale. Many gc
+	// messages are sent to a stale peer, so it's validated at most once in an election timeout.
+	now := d.peer.clock.Now()
+	electionTimeout := d.ctx.cfg.RaftBaseTickInterval * time.Duration(d.ctx.cfg.RaftElectionTimeoutTicks)
+	if now.Sub(d.lastValidateTime) < electionTimeout {
+		return
+	}
+	d.lastValidateTime = now
+	log.S().Infof("%s peer %s receives gc message, check with pd whether it's stale", d.tag(), msg.ToPeer)
+	d.ctx.pdTaskSender <- task{
+		tp: taskTypePDValidatePeer,
+		data: &pdValidatePeerTask{
+			region: d.region(),
+			peer:   d.peer.Meta,
+		},
+	}
+}
+
+// onStalePeer destroys the peer after PD confirms it's not a member of the region.
+func (d *peerMsgHandler) onStalePeer(msg *MsgStalePeer) {
+	if d.peer.PendingRemove || d.stopped {
+		return
+	}
+	if !PeerEqual(d.peer.Meta, msg.Peer) {
+		log.S().Infof("%s receive stale peer msg of peer %s, ignore", d.tag(), msg.Peer)
+		return
+	}
+	// The peer is changed after PD is checked.
+	if IsEpochStale(msg.PDRegion.GetRegionEpoch(), d.region().GetRegionEpoch()) {
+		log.S().Infof("%s region epoch %s is newer than %s in pd, ignore stale peer msg",
+			d.tag(), d.region().GetRegionEpoch(), msg.PDRegion.GetRegionEpoch())
+		return
+	}
+	log.S().Infof("%s peer %s is confirmed stale by pd, trying to remove", d.tag(), msg.Peer)
 	if job := d.peer.MaybeDestroy(); job != nil {
 		d.handleDestroyPeer(job)
 	}
@@ -745,7 +819,7 @@ func (d *peerMsgHandler) onReadyChangePeer(cp changePeer) {
 		}
 
 		// Add this peer to cache and heartbeats.
-		now := time.Now()
+		now := d.peer.clock.Now()
 		d.peer.PeerHeartbeats[peerID] = now
 		if d.peer.IsLeader() {
 			d.peer.PeersStartPendingTime[peerID] = now
@@ -1034,6 +1108,14 @@ func (d *peerMsgHandler) preProposeRaftCommand(rlog raftlog.RaftLog) (*raft_cmdp
 }
 
 func (d *peerMsgHandler) proposeRaftCommand(rlog raftlog.RaftLog, cb *Callback) {
+	// The command may be canceled or expired while it's queued, don't propose it.
+	if cb.isDone() {
+		return
+	}
+	if cb.expired(time.Now()) {
+		cb.timeout()
+		return
+	}
 	resp, err := d.preProposeRaftCommand(rlog)
 	if err != nil {
 		cb.Done(ErrResp(err))
@@ -1054,6 +1136,17 @@ func (d *peerMsgHandler) proposeRaftCommand(rlog raftlog.RaftLog, cb *Callback)
 		cb.Done(ErrResp(err))
 		return
 	}
+	if !isAllowedWhenDiskFull(rlog) {
+		if atomic.LoadUint32(&d.ctx.diskFull) > 0 {
+			cb.Done(ErrResp(&ErrServerIsBusy{Reason: "disk is almost full"}))
+			return
+		}
+		if err := d.ctx.flowController.checkWrite(raftLogSize(rlog)); err != nil {
+			d.ctx.localStats.isBusy = 1
+			cb.Done(ErrResp(err))
+			return
+		}
+	}
 
 	// Note:
 	// The peer that is being checked is a leader. It might step down to be a follower later. It
@@ -1065,9 +1158,6 @@ func (d *peerMsgHandler) proposeRaftCommand(rlog raftlog.RaftLog, cb *Callback)
 	if d.peer.Propose(d.ctx.engine.kv, d.ctx.cfg, cb, rlog, resp) {
 		d.hasReady = true
 	}
-
-	// TODO: add timeout, if the command is not applied after timeout,
-	// we will call the callback with timeout error.
 }
 
 func (d *peerMsgHandler) findSiblingRegion() *metapb.Region {
@@ -1104,7 +1194,7 @@ func (d *peerMsgHandler) onRaftGCLogTick() {
 	// do not clean up the cache, it may keep growing.
 	dropCacheDuration := time.Duration(d.ctx.cfg.RaftHeartbeatTicks)*d.ctx.cfg.RaftBaseTickInterval +
 		d.ctx.cfg.RaftEntryCacheLifeTime
-	cacheAliveLimit := time.Now().Add(-dropCacheDuration)
+	cacheAliveLimit := d.peer.clock.Now().Add(-dropCacheDuration)
 
 	totalGCLogs := uint64(0)
 
@@ -1369,7 +1459,7 @@ func (d *peerMsgHandler) onCheckPeerStaleStateTick() {
 }
 
 func (d *peerMsgHandler) onReadyComputeHash(region *metapb.Region, index uint64, snap *mvcc.DBSnapshot) {
-	d.peer.ConsistencyState.LastCheckTime = time.Now()
+	d.peer.ConsistencyState.LastCheckTime = d.peer.clock.Now()
 	log.S().Infof("%s schedule compute hash task", d.tag())
 	d.ctx.computeHashTaskSender <- task{
 		tp: taskTypeComputeHash,
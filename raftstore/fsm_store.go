@@ -16,6 +16,7 @@ package raftstore
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -34,6 +35,7 @@ import (
 	"github.com/pingcap/tidb/store/mockstore/unistore/lockstore"
 	"github.com/pingcap/tidb/store/mockstore/unistore/pd"
 	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/dbreader"
+	"github.com/shirou/gopsutil/disk"
 )
 
 type storeMeta struct {
@@ -92,9 +94,19 @@ type GlobalContext struct {
 	raftLogGCTaskSender   chan<- task
 	splitCheckTaskSender  chan<- task
 	compactTaskSender     chan<- task
+	inspectTaskSender     chan<- task
 	pdClient              pd.Client
 	peerEventObserver     PeerEventObserver
+	cdcObserver           *cdcObserver
 	globalStats           *storeStats
+	// raftLogFetcher is nil if cfg.RaftLogFetchMaxBytes is 0.
+	raftLogFetcher *raftLogFetcher
+	entryCacheMem  *entryCacheMemory
+	// diskFull is set to 1 by the store worker when the free space drops below cfg.DiskReserveSpace.
+	diskFull       uint32
+	flowController *flowController
+	threadLoads    *threadLoads
+	slowScore      *slowScore
 }
 
 // StoreContext represents a store context.
@@ -126,6 +138,8 @@ type storeStats struct {
 // Transport represents the transport interface.
 type Transport interface {
 	Send(msg *rspb.RaftMessage) error
+	// Flush sends the buffered messages, it's called by the raft worker at the end of every round.
+	Flush()
 }
 
 func (pc *RaftContext) flushLocalStats() {
@@ -185,6 +199,12 @@ func (d *storeMsgHandler) onTick(tick StoreTick) {
 		d.onSnapMgrGC()
 	case StoreTickConsistencyCheck:
 		d.onComputeHashTick()
+	case StoreTickDiskCheck:
+		d.onDiskCheckTick()
+	case StoreTickFlowCheck:
+		d.onFlowCheckTick()
+	case StoreTickInspect:
+		d.onInspectTick()
 	}
 }
 
@@ -213,12 +233,15 @@ func (d *storeMsgHandler) start(store *metapb.Store) {
 		panic(fmt.Sprintf("store %d unable to start again %s", d.id, store))
 	}
 	d.id = store.Id
-	now := time.Now()
+	now := d.ctx.cfg.Clock.Now()
 	d.startTime = &now
 	d.ticker.scheduleStore(StoreTickCompactCheck)
 	d.ticker.scheduleStore(StoreTickPdStoreHeartbeat)
 	d.ticker.scheduleStore(StoreTickSnapGC)
 	d.ticker.scheduleStore(StoreTickConsistencyCheck)
+	d.ticker.scheduleStore(StoreTickDiskCheck)
+	d.ticker.scheduleStore(StoreTickFlowCheck)
+	d.ticker.scheduleStore(StoreTickInspect)
 }
 
 // loadPeers loads peers in this store. It scans the db engine, loads all regions
@@ -333,9 +356,8 @@ func (bs *raftBatchSystem) loadPeers() ([]*peerFsm, error) {
 
 func (bs *raftBatchSystem) clearStaleMeta(kvWB, raftWB *WriteBatch, originState *rspb.RegionLocalState) {
 	region := originState.Region
-	raftKey := RaftStateKey(region.Id)
 	raftState := raftState{}
-	val, err := getValue(bs.ctx.engine.raft, raftKey)
+	val, err := bs.ctx.engine.raft.GetState(region.Id)
 	if err != nil {
 		// it has been cleaned up.
 		return
@@ -352,13 +374,15 @@ func (bs *raftBatchSystem) clearStaleMeta(kvWB, raftWB *WriteBatch, originState
 }
 
 type workers struct {
-	pdWorker          *worker
-	raftLogGCWorker   *worker
-	computeHashWorker *worker
-	splitCheckWorker  *worker
-	regionWorker      *worker
-	compactWorker     *worker
-	wg                *sync.WaitGroup
+	pdWorker           *worker
+	raftLogGCWorker    *worker
+	computeHashWorker  *worker
+	splitCheckWorker   *worker
+	regionWorker       *worker
+	compactWorker      *worker
+	raftLogFetchWorker *worker
+	inspectWorker      *worker
+	wg                 *sync.WaitGroup
 }
 
 type raftBatchSystem struct {
@@ -368,6 +392,8 @@ type raftBatchSystem struct {
 	closeCh   chan struct{}
 	wg        *sync.WaitGroup
 	globalCfg *config.Config
+	// cdcObserver is set by the RaftInnerServer before the batch system is started.
+	cdcObserver *cdcObserver
 }
 
 func (bs *raftBatchSystem) start(
@@ -390,13 +416,15 @@ func (bs *raftBatchSystem) start(
 	}
 	wg := new(sync.WaitGroup)
 	bs.workers = &workers{
-		splitCheckWorker:  newWorker("split-check", wg),
-		regionWorker:      newWorker("snapshot-worker", wg),
-		raftLogGCWorker:   newWorker("raft-gc-worker", wg),
-		compactWorker:     newWorker("compact-worker", wg),
-		pdWorker:          pdWorker,
-		computeHashWorker: newWorker("compute-hash", wg),
-		wg:                wg,
+		splitCheckWorker:   newWorker("split-check", wg),
+		regionWorker:       newWorker("snapshot-worker", wg),
+		raftLogGCWorker:    newWorker("raft-gc-worker", wg),
+		compactWorker:      newWorker("compact-worker", wg),
+		pdWorker:           pdWorker,
+		computeHashWorker:  newWorker("compute-hash", wg),
+		raftLogFetchWorker: newWorker("raft-log-fetcher", wg),
+		inspectWorker:      newWorker("inspect-worker", wg),
+		wg:                 wg,
 	}
 	bs.ctx = &GlobalContext{
 		cfg:                   cfg,
@@ -413,9 +441,23 @@ func (bs *raftBatchSystem) start(
 		splitCheckTaskSender:  bs.workers.splitCheckWorker.sender,
 		raftLogGCTaskSender:   bs.workers.raftLogGCWorker.sender,
 		compactTaskSender:     bs.workers.compactWorker.sender,
+		inspectTaskSender:     bs.workers.inspectWorker.sender,
 		pdClient:              pdClient,
 		peerEventObserver:     observer,
+		cdcObserver:           bs.cdcObserver,
 		globalStats:           new(storeStats),
+		entryCacheMem:         &entryCacheMemory{limit: cfg.RaftEntryCacheMemoryLimit},
+		flowController:        newFlowController(cfg),
+		threadLoads:           newThreadLoads(),
+		slowScore:             newSlowScore(cfg.InspectSlowThreshold),
+	}
+	for _, w := range []*worker{bs.workers.splitCheckWorker, bs.workers.regionWorker, bs.workers.raftLogGCWorker,
+		bs.workers.compactWorker, bs.workers.pdWorker, bs.workers.computeHashWorker, bs.workers.raftLogFetchWorker,
+		bs.workers.inspectWorker} {
+		w.load = bs.ctx.threadLoads.register(w.name)
+	}
+	if cfg.RaftLogFetchMaxBytes > 0 {
+		bs.ctx.raftLogFetcher = newRaftLogFetcher(bs.workers.raftLogFetchWorker.sender, cfg.RaftLogFetchMaxBytes)
 	}
 	regionPeers, err := bs.loadPeers()
 	if err != nil {
@@ -436,8 +478,10 @@ func (bs *raftBatchSystem) startWorkers(peers []*peerFsm) {
 
 	bs.wg.Add(3) // raftWorker, applyWorker, storeWorker
 	rw := newRaftWorker(ctx, router.peerSender, router)
+	rw.load = ctx.threadLoads.register("raft-worker")
 	go rw.run(bs.closeCh, bs.wg)
 	aw := newApplyWorker(router, rw.applyCh, rw.applyCtx)
+	aw.load = ctx.threadLoads.register("apply-worker")
 	go aw.run(bs.wg)
 	sw := newStoreWorker(ctx, router)
 	go sw.run(bs.closeCh, bs.wg)
@@ -457,6 +501,8 @@ func (bs *raftBatchSystem) startWorkers(peers []*peerFsm) {
 	workers.compactWorker.start(&compactTaskHandler{engine: engines.kv.DB})
 	workers.pdWorker.start(newPDTaskHandler(ctx.store.Id, ctx.pdClient, bs.router))
 	workers.computeHashWorker.start(&computeHashTaskHandler{router: bs.router})
+	workers.raftLogFetchWorker.start(&raftLogFetchTaskHandler{engine: engines.raft, router: bs.router})
+	workers.inspectWorker.start(&inspectTaskHandler{engines: engines, slowScore: ctx.slowScore})
 }
 
 func (bs *raftBatchSystem) shutDown() {
@@ -474,6 +520,8 @@ func (bs *raftBatchSystem) shutDown() {
 	workers.computeHashWorker.sender <- stopTask
 	workers.pdWorker.sender <- stopTask
 	workers.compactWorker.sender <- stopTask
+	workers.raftLogFetchWorker.sender <- stopTask
+	workers.inspectWorker.sender <- stopTask
 	workers.wg.Wait()
 }
 
@@ -554,7 +602,7 @@ func (d *storeMsgHandler) onRaftMessage(msg *rspb.RaftMessage) error {
 		return nil
 	}
 	log.S().Debugf("handle raft message. from_peer:%d, to_peer:%d, store:%d, region:%d, msg_type:%s",
-		msg.FromPeer.Id, msg.ToPeer.Id, d.storeFsm.id, regionID, msg.Message.MsgType)
+		msg.FromPeer.Id, msg.ToPeer.Id, d.storeFsm.id, regionID, msg.GetMessage().GetMsgType())
 	if msg.ToPeer.StoreId != d.ctx.store.Id {
 		log.S().Warnf("store not match, ignore it. store_id:%d, to_store_id:%d, region_id:%d",
 			d.ctx.store.Id, msg.ToPeer.StoreId, regionID)
@@ -565,7 +613,7 @@ func (d *storeMsgHandler) onRaftMessage(msg *rspb.RaftMessage) error {
 		log.S().Errorf("missing region epoch in raft message, ignore it. region_id:%d", regionID)
 		return nil
 	}
-	if msg.IsTombstone || msg.MergeTarget != nil {
+	if msg.IsTombstone || msg.MergeTarget != nil || msg.ExtraMsg != nil {
 		// Target tombstone peer doesn't exist, so ignore it.
 		return nil
 	}
@@ -692,12 +740,17 @@ func (d *storeMsgHandler) storeHeartbeatPD() {
 	globalStats := d.ctx.globalStats
 	stats.BytesWritten = atomic.SwapUint64(&globalStats.engineTotalBytesWritten, 0)
 	stats.KeysWritten = atomic.SwapUint64(&globalStats.engineTotalKeysWritten, 0)
-	stats.IsBusy = atomic.SwapUint64(&globalStats.isBusy, 0) > 0
+	stats.IsBusy = atomic.SwapUint64(&globalStats.isBusy, 0) > 0 || atomic.LoadUint32(&d.ctx.diskFull) > 0 ||
+		d.ctx.flowController.isBusy()
+	stats.CpuUsages = d.ctx.threadLoads.collect()
+	stats.OpLatencies = append(stats.OpLatencies, &pdpb.RecordPair{Key: "slow_score", Value: uint64(d.ctx.slowScore.score)})
 	storeInfo := &pdStoreHeartbeatTask{
 		stats:    stats,
 		engine:   d.ctx.engine.kv.DB,
 		capacity: d.ctx.cfg.Capacity,
+		reserve:  d.ctx.cfg.DiskReserveSpace,
 		path:     d.ctx.engine.kvPath,
+		raftPath: d.ctx.engine.raftPath,
 	}
 	d.ctx.pdTaskSender <- task{tp: taskTypePDStoreHeartbeat, data: storeInfo}
 }
@@ -707,8 +760,90 @@ func (d *storeMsgHandler) onPDStoreHearbeatTick() {
 	d.ticker.scheduleStore(StoreTickPdStoreHeartbeat)
 }
 
+func (d *storeMsgHandler) onDiskCheckTick() {
+	d.ticker.scheduleStore(StoreTickDiskCheck)
+	reserve := d.ctx.cfg.DiskReserveSpace
+	if reserve == 0 {
+		return
+	}
+	available, err := minAvailableSpace(d.ctx.engine.kvPath, d.ctx.engine.raftPath, d.ctx.snapMgr.base)
+	if err != nil {
+		log.S().Errorf("check disk usage failed store_id %d, err %v", d.id, err)
+		return
+	}
+	if available < reserve {
+		if atomic.SwapUint32(&d.ctx.diskFull, 1) == 0 {
+			log.S().Warnf("store %d disk is almost full, available %d, reserve %d, reject new writes",
+				d.id, available, reserve)
+		}
+	} else if atomic.SwapUint32(&d.ctx.diskFull, 0) == 1 {
+		log.S().Infof("store %d disk space is enough again, available %d, reserve %d", d.id, available, reserve)
+	}
+}
+
+func (d *storeMsgHandler) onFlowCheckTick() {
+	d.ticker.scheduleStore(StoreTickFlowCheck)
+	l0Tables, pendingCompactionBytes := kvEngineFlowStats(d.ctx.engine.kv.DB, d.ctx.engine.kvPath, d.ctx.cfg.KVEngineL1Size)
+	d.ctx.flowController.updateEngineStats(l0Tables, pendingCompactionBytes)
+}
+
+func (d *storeMsgHandler) onInspectTick() {
+	d.ticker.scheduleStore(StoreTickInspect)
+	oldScore := d.ctx.slowScore.score
+	score := d.ctx.slowScore.tick()
+	if d.ctx.slowScore.startProbe() {
+		d.ctx.inspectTaskSender <- task{tp: taskTypeInspect}
+	}
+	threshold := float64(d.ctx.cfg.SlowScoreThreshold)
+	if threshold == 0 {
+		return
+	}
+	if score >= threshold {
+		if oldScore < threshold {
+			log.S().Warnf("store %d is slow, slow score %v, transfer the leaders away", d.id, score)
+		}
+		d.evictLeaders()
+	} else if oldScore >= threshold {
+		log.S().Infof("store %d is not slow anymore, slow score %v", d.id, score)
+	}
+}
+
+// evictLeaders asks all the leaders in the store to transfer the leadership to other stores.
+func (d *storeMsgHandler) evictLeaders() {
+	d.ctx.storeMetaLock.RLock()
+	regionIDs := make([]uint64, 0, len(d.ctx.storeMeta.regions))
+	for regionID := range d.ctx.storeMeta.regions {
+		regionIDs = append(regionIDs, regionID)
+	}
+	d.ctx.storeMetaLock.RUnlock()
+	for _, regionID := range regionIDs {
+		_ = d.ctx.router.send(regionID, NewPeerMsg(MsgTypeEvictLeader, regionID, nil))
+	}
+}
+
+// minAvailableSpace returns the minimum free space of the file systems holding the paths.
+func minAvailableSpace(paths ...string) (uint64, error) {
+	available := uint64(math.MaxUint64)
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		stat, err := disk.Usage(path)
+		if err != nil {
+			return 0, err
+		}
+		if stat.Free < available {
+			available = stat.Free
+		}
+	}
+	return available, nil
+}
+
 func (d *storeMsgHandler) handleSnapMgrGC() error {
 	mgr := d.ctx.snapMgr
+	if err := mgr.deleteStaleTmpFiles(d.ctx.cfg.SnapGcTimeout); err != nil {
+		return err
+	}
 	snapKeys, err := mgr.ListIdleSnap()
 	if err != nil {
 		return err
@@ -787,7 +922,7 @@ func (d *storeMsgHandler) onComputeHashTick() {
 		return
 	}
 	log.S().Infof("schedule consistency check for region %d, store %d", targetRegion.Id, peer.StoreId)
-	d.storeFsm.consistencyCheckTime[targetRegion.Id] = time.Now()
+	d.storeFsm.consistencyCheckTime[targetRegion.Id] = d.ctx.cfg.Clock.Now()
 	request := newAdminRequest(targetRegion.Id, peer)
 	request.AdminRequest = &raft_cmdpb.AdminRequest{
 		CmdType: raft_cmdpb.AdminCmdType_ComputeHash,
@@ -801,7 +936,7 @@ func (d *storeMsgHandler) onComputeHashTick() {
 }
 
 func (d *storeMsgHandler) findTargetRegionForComputeHash() *metapb.Region {
-	oldest := time.Now()
+	oldest := d.ctx.cfg.Clock.Now()
 	var targetRegion *metapb.Region
 	d.ctx.storeMetaLock.RLock()
 	defer d.ctx.storeMetaLock.RUnlock()
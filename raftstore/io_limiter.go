@@ -28,7 +28,9 @@ package raftstore
 
 import (
 	"io"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/time/rate"
 )
 
@@ -40,11 +42,69 @@ func NewInfLimiter() *IOLimiter {
 	return rate.NewLimiter(rate.Inf, 0)
 }
 
+// NewIOLimiter returns a new IOLimiter allows bytesPerSec bytes per second, 0 means no limit.
+func NewIOLimiter(bytesPerSec uint64) *IOLimiter {
+	if bytesPerSec == 0 {
+		return NewInfLimiter()
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), int(bytesPerSec))
+}
+
+// throttle blocks until the limiter allows n bytes, the blocked time is added to the throttled counter.
+func throttle(limiter *IOLimiter, n int, throttled prometheus.Counter) {
+	if limiter == nil || limiter.Limit() == rate.Inf {
+		return
+	}
+	var total time.Duration
+	burst := limiter.Burst()
+	for n > 0 {
+		m := n
+		if m > burst {
+			m = burst
+		}
+		delay := limiter.ReserveN(time.Now(), m).Delay()
+		if delay > 0 {
+			time.Sleep(delay)
+			total += delay
+		}
+		n -= m
+	}
+	if total > 0 {
+		throttled.Add(total.Seconds())
+	}
+}
+
 // LimitWriter represents a limit writer.
 type LimitWriter struct {
-	writer io.Writer
+	writer    io.Writer
+	limiter   *IOLimiter
+	throttled prometheus.Counter
+}
+
+// NewLimitWriter returns a new LimitWriter writes to w at the rate of the limiter.
+func NewLimitWriter(w io.Writer, limiter *IOLimiter, throttled prometheus.Counter) *LimitWriter {
+	return &LimitWriter{writer: w, limiter: limiter, throttled: throttled}
 }
 
 func (lw *LimitWriter) Write(b []byte) (int, error) {
+	throttle(lw.limiter, len(b), lw.throttled)
 	return lw.writer.Write(b)
 }
+
+// LimitReader represents a limit reader.
+type LimitReader struct {
+	reader    io.Reader
+	limiter   *IOLimiter
+	throttled prometheus.Counter
+}
+
+// NewLimitReader returns a new LimitReader reads from r at the rate of the limiter.
+func NewLimitReader(r io.Reader, limiter *IOLimiter, throttled prometheus.Counter) *LimitReader {
+	return &LimitReader{reader: r, limiter: limiter, throttled: throttled}
+}
+
+func (lr *LimitReader) Read(b []byte) (int, error) {
+	n, err := lr.reader.Read(b)
+	throttle(lr.limiter, n, lr.throttled)
+	return n, err
+}
@@ -41,9 +41,14 @@ const (
 	RaftStateSuffix         byte = 0x02
 	ApplyStateSuffix        byte = 0x03
 	SnapshotRaftStateSuffix byte = 0x04
+	SnapshotLocksSuffix     byte = 0x05
 
 	// For region meta
 	RegionStateSuffix byte = 0x01
+
+	// RawDataPrefix is the prefix of the raw kv data in the kv engine, it's greater than MaxDataKey so
+	// the raw kv data is out of the range of the transactional data of any region.
+	RawDataPrefix byte = 'w'
 )
 
 // keys
@@ -62,6 +67,8 @@ var (
 	// Following keys are all local keys, so the first byte must be 0x01.
 	prepareBootstrapKey = []byte{LocalPrefix, 0x01}
 	storeIdentKey       = []byte{LocalPrefix, 0x02}
+	// storeInspectKey is after the region meta keys, it's deleted to inspect the write latency.
+	storeInspectKey = []byte{LocalPrefix, 0x05}
 )
 
 func makeRaftRegionPrefix(regionID uint64, suffix byte) []byte {
@@ -112,6 +119,11 @@ func SnapshotRaftStateKey(regionID uint64) []byte {
 	return makeRaftRegionPrefix(regionID, SnapshotRaftStateSuffix)
 }
 
+// SnapshotLocksKey makes the key of the locks applied from the snapshot with the given region id.
+func SnapshotLocksKey(regionID uint64) []byte {
+	return makeRaftRegionPrefix(regionID, SnapshotLocksSuffix)
+}
+
 func decodeRegionMetaKey(key []byte) (uint64, byte, error) {
 	if len(RegionMetaMinKey)+8+1 != len(key) {
 		return 0, 0, errors.Errorf("invalid region meta key length for key %v", key)
@@ -142,6 +154,44 @@ func RegionStateKey(regionID uint64) []byte {
 	return key
 }
 
+// RawDataKey returns the key of the raw kv data in the kv engine.
+func RawDataKey(key []byte) []byte {
+	dataKey := make([]byte, 0, len(key)+1)
+	dataKey = append(dataKey, RawDataPrefix)
+	return append(dataKey, key...)
+}
+
+// RawDataEndKey returns the end key of the raw kv data in the kv engine for the raw end key, an empty
+// key means the end of all the raw kv data.
+func RawDataEndKey(key []byte) []byte {
+	if len(key) == 0 {
+		return []byte{RawDataPrefix + 1}
+	}
+	return RawDataKey(key)
+}
+
+// tombstoneKey returns the key to delete the key of the version in the kv engine. The raw kv data is
+// always written at KvTS, so it's deleted at KvTS to keep the later writes visible.
+func tombstoneKey(key []byte, version uint64) y.Key {
+	if len(key) > 0 && key[0] == RawDataPrefix {
+		return y.KeyWithTs(key, KvTS)
+	}
+	return y.KeyWithTs(key, version+1)
+}
+
+// rawDataRange returns the range of the raw kv data in the kv engine for the data range [startKey, endKey)
+// returned by RawStartKey and RawEndKey, so the first and the last region also own the raw keys out of
+// the TiDB data range.
+func rawDataRange(startKey, endKey []byte) ([]byte, []byte) {
+	if bytes.Equal(startKey, MinDataKey) {
+		startKey = nil
+	}
+	if bytes.Equal(endKey, MaxDataKey) {
+		endKey = nil
+	}
+	return RawDataKey(startKey), RawDataEndKey(endKey)
+}
+
 // RawStartKey gets the `start_key` of current region in encoded form.
 func RawStartKey(region *metapb.Region) []byte {
 	// only initialized region's start_key can be encoded, otherwise there must be bugs
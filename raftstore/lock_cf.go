@@ -0,0 +1,85 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+)
+
+// The lock CF value in the raft command uses the lock types of TiKV, while the snapshot uses the op.
+var raftLockTypes = [][2]byte{
+	{byte(kvrpcpb.Op_Put), mvcc.LockTypePut},
+	{byte(kvrpcpb.Op_Del), mvcc.LockTypeDelete},
+	{byte(kvrpcpb.Op_Lock), mvcc.LockTypeLock},
+	{byte(kvrpcpb.Op_PessimisticLock), mvcc.LockTypePessimistic},
+}
+
+// encodeRaftLockCFValue encodes the lock of the raft command like mvcc.EncodeLockCFValue, but keeps
+// the async commit secondaries which mvcc.EncodeLockCFValue drops. The large value is returned as
+// putDefault.
+func encodeRaftLockCFValue(lock *mvcc.Lock) (putLock, putDefault []byte) {
+	v := &lockCFValue{
+		primary:        lock.Primary,
+		startTS:        lock.StartTS,
+		ttl:            uint64(lock.TTL),
+		forUpdateTS:    lock.ForUpdateTS,
+		minCommitTS:    lock.MinCommitTS,
+		useAsyncCommit: lock.UseAsyncCommit,
+		secondaries:    lock.Secondaries,
+	}
+	for _, tp := range raftLockTypes {
+		if tp[0] == lock.Op {
+			v.lockType = tp[1]
+		}
+	}
+	if v.lockType == 0 {
+		panic("invalid lock op")
+	}
+	if len(lock.Value) <= shortValueMaxLen {
+		v.shortVal = lock.Value
+	} else {
+		putDefault = lock.Value
+	}
+	return encodeLockCFValue(v, nil), putDefault
+}
+
+// parseRaftLockCFValue parses the lock CF value encoded by encodeRaftLockCFValue.
+func parseRaftLockCFValue(data []byte) (lock mvcc.Lock, err error) {
+	v, err := decodeLockCFValue(data)
+	if err != nil {
+		return lock, err
+	}
+	found := false
+	for _, tp := range raftLockTypes {
+		if tp[1] == v.lockType {
+			lock.Op, found = tp[0], true
+		}
+	}
+	if !found {
+		return lock, errors.Errorf("invalid lock type %d", v.lockType)
+	}
+	lock.StartTS = v.startTS
+	lock.TTL = uint32(v.ttl)
+	lock.Primary = v.primary
+	lock.PrimaryLen = uint16(len(v.primary))
+	lock.Value = v.shortVal
+	lock.ForUpdateTS = v.forUpdateTS
+	lock.MinCommitTS = v.minCommitTS
+	lock.UseAsyncCommit = v.useAsyncCommit
+	lock.Secondaries = v.secondaries
+	lock.SecondaryNum = uint32(len(v.secondaries))
+	return lock, nil
+}
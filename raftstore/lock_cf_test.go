@@ -0,0 +1,81 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRaftLockCFValue(t *testing.T) {
+	primary := []byte("tk1")
+	locks := []*mvcc.Lock{
+		{LockHdr: mvcc.LockHdr{StartTS: 100, TTL: 10, Op: uint8(kvrpcpb.Op_Put)}, Value: []byte("v")},
+		{LockHdr: mvcc.LockHdr{StartTS: 100, Op: uint8(kvrpcpb.Op_Del)}},
+		{LockHdr: mvcc.LockHdr{StartTS: 100, ForUpdateTS: 110, Op: uint8(kvrpcpb.Op_PessimisticLock)}},
+		{LockHdr: mvcc.LockHdr{StartTS: 100, MinCommitTS: 120, Op: uint8(kvrpcpb.Op_Lock)}},
+		{LockHdr: mvcc.LockHdr{StartTS: 100, MinCommitTS: 120, Op: uint8(kvrpcpb.Op_Put), UseAsyncCommit: true,
+			SecondaryNum: 2}, Secondaries: [][]byte{[]byte("tk2"), []byte("tk3")}, Value: bytes.Repeat([]byte("v"), 100)},
+		{LockHdr: mvcc.LockHdr{StartTS: 100, MinCommitTS: 120, Op: uint8(kvrpcpb.Op_Put), UseAsyncCommit: true}},
+	}
+	for _, lock := range locks {
+		lock.Primary = primary
+		lock.PrimaryLen = uint16(len(primary))
+		putLock, putDefault := encodeRaftLockCFValue(lock)
+		// The encoding is compatible with mvcc.ParseLockCFValue.
+		parsed, err := mvcc.ParseLockCFValue(putLock)
+		require.Nil(t, err)
+		require.Equal(t, lock.StartTS, parsed.StartTS)
+		require.Equal(t, lock.MinCommitTS, parsed.MinCommitTS)
+
+		decoded, err := parseRaftLockCFValue(putLock)
+		require.Nil(t, err)
+		if len(lock.Value) > shortValueMaxLen {
+			require.Equal(t, lock.Value, putDefault)
+			decoded.Value = putDefault
+		}
+		require.Equal(t, lock.MarshalBinary(), decoded.MarshalBinary())
+	}
+	_, err := parseRaftLockCFValue([]byte{'X'})
+	require.NotNil(t, err)
+}
+
+func TestSnapLockCFValue(t *testing.T) {
+	v := &lockCFValue{
+		lockType:       byte(kvrpcpb.Op_Put),
+		primary:        []byte("tk1"),
+		startTS:        100,
+		ttl:            10,
+		shortVal:       []byte("v"),
+		forUpdateTS:    110,
+		minCommitTS:    120,
+		useAsyncCommit: true,
+		secondaries:    [][]byte{[]byte("tk2")},
+	}
+	decoded, err := decodeLockCFValue(encodeLockCFValue(v, nil))
+	require.Nil(t, err)
+	require.Equal(t, v, decoded)
+
+	// The snapshots without the async commit fields are still decoded.
+	v = &lockCFValue{lockType: byte(kvrpcpb.Op_Put), primary: []byte("tk1"), startTS: 100, ttl: 10, shortVal: []byte("v")}
+	decoded, err = decodeLockCFValue(encodeLockCFValue(v, nil))
+	require.Nil(t, err)
+	require.Equal(t, v, decoded)
+	_, err = decodeLockCFValue(append(encodeLockCFValue(v, nil), shortValuePrefix, 10))
+	require.NotNil(t, err)
+}
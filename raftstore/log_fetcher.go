@@ -0,0 +1,213 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync/atomic"
+
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng1987/raft"
+)
+
+// raftLogFetcher reads the raft logs missing in the entry caches for the lagging followers in the
+// background, so a slow follower doesn't block the raft worker shared by all the regions. The bytes
+// of the fetches in flight or waiting to be sent are bounded by maxBytes.
+type raftLogFetcher struct {
+	sender   chan<- task
+	maxBytes uint64
+	bytes    uint64
+}
+
+func newRaftLogFetcher(sender chan<- task, maxBytes uint64) *raftLogFetcher {
+	return &raftLogFetcher{sender: sender, maxBytes: maxBytes}
+}
+
+// schedule sends the fetch task to the worker, it returns false if the fetch bytes exceed the bound
+// or the worker is busy.
+func (f *raftLogFetcher) schedule(t *raftLogFetchTask) bool {
+	t.reserved = t.maxSize
+	if t.reserved > f.maxBytes {
+		t.reserved = f.maxBytes
+	}
+	if atomic.AddUint64(&f.bytes, t.reserved) > f.maxBytes {
+		f.release(t.reserved)
+		return false
+	}
+	select {
+	case f.sender <- task{tp: taskTypeRaftLogFetch, data: t}:
+		return true
+	default:
+		f.release(t.reserved)
+		return false
+	}
+}
+
+func (f *raftLogFetcher) release(n uint64) {
+	atomic.AddUint64(&f.bytes, ^(n - 1))
+}
+
+type raftLogFetchTask struct {
+	fetcher  *raftLogFetcher
+	regionID uint64
+	low      uint64
+	high     uint64
+	maxSize  uint64
+	// reserved is the bytes of the fetcher bound taken by the task, it's released after the entries
+	// are sent or dropped.
+	reserved uint64
+}
+
+// raftLogFetchResult is sent to the peer by MsgTypeRaftLogFetched.
+type raftLogFetchResult struct {
+	task *raftLogFetchTask
+	ents []eraftpb.Entry
+	err  error
+}
+
+type raftLogFetchTaskHandler struct {
+	engine RaftEngine
+	router *router
+}
+
+func (r *raftLogFetchTaskHandler) handle(t task) {
+	fetchTask := t.data.(*raftLogFetchTask)
+	ents, _, err := r.engine.FetchEntries(fetchTask.regionID, fetchTask.low, fetchTask.high, fetchTask.maxSize, nil)
+	res := &raftLogFetchResult{task: fetchTask, ents: ents, err: err}
+	if r.router.send(fetchTask.regionID, NewPeerMsg(MsgTypeRaftLogFetched, fetchTask.regionID, res)) != nil {
+		fetchTask.fetcher.release(fetchTask.reserved)
+	}
+}
+
+// raftLogFetch is a fetch started by the peer storage, res is nil until the entries are fetched.
+type raftLogFetch struct {
+	task *raftLogFetchTask
+	res  *raftLogFetchResult
+}
+
+// canFetchAsync returns true if the entries from low should be fetched in the background. The
+// applied entries are only read to replicate them to the lagging followers, the others are read
+// synchronously to apply them.
+func (ps *PeerStorage) canFetchAsync(low uint64) bool {
+	return ps.logFetcher != nil && low <= ps.applyState.appliedIndex
+}
+
+// fetchEntriesAsync returns the fetched entries from low, or schedules a fetch if there is none.
+// Raft has no "log temporarily unavailable" error, so no entries and a nil error are returned until
+// the entries are fetched, raft sends an empty append for the follower and retries later.
+func (ps *PeerStorage) fetchEntriesAsync(low, high, maxSize uint64) ([]eraftpb.Entry, error) {
+	if f := ps.logFetches[low]; f != nil {
+		if f.res == nil {
+			return nil, nil
+		}
+		delete(ps.logFetches, low)
+		ps.logFetcher.release(f.task.reserved)
+		if f.res.err != nil {
+			log.S().Warnf("%s fetch raft logs [%d, %d) failed, err %v", ps.Tag, low, f.task.high, f.res.err)
+			ents, _, err := ps.Engines.raft.FetchEntries(ps.region.Id, low, high, maxSize, nil)
+			return ents, err
+		}
+		var ents []eraftpb.Entry
+		var size uint64
+		for _, e := range f.res.ents {
+			size += uint64(e.Size())
+			if e.Index >= high || (len(ents) > 0 && size > maxSize) {
+				break
+			}
+			ents = append(ents, e)
+		}
+		return ents, nil
+	}
+	t := &raftLogFetchTask{
+		fetcher:  ps.logFetcher,
+		regionID: ps.region.Id,
+		low:      low,
+		high:     high,
+		maxSize:  maxSize,
+	}
+	if ps.logFetcher.schedule(t) {
+		if ps.logFetches == nil {
+			ps.logFetches = make(map[uint64]*raftLogFetch)
+		}
+		ps.logFetches[low] = &raftLogFetch{task: t}
+	}
+	return nil, nil
+}
+
+// onLogFetched keeps the fetched entries until raft reads them, it returns false if the fetch is
+// dropped.
+func (ps *PeerStorage) onLogFetched(res *raftLogFetchResult) bool {
+	f := ps.logFetches[res.task.low]
+	if f == nil || f.task != res.task || res.task.low <= ps.truncatedIndex() {
+		if f != nil && f.task == res.task {
+			delete(ps.logFetches, res.task.low)
+		}
+		res.task.fetcher.release(res.task.reserved)
+		return false
+	}
+	f.res = res
+	return true
+}
+
+func (ps *PeerStorage) dropLogFetch(low uint64) {
+	if f := ps.logFetches[low]; f != nil && f.res != nil {
+		ps.logFetcher.release(f.task.reserved)
+		delete(ps.logFetches, low)
+	}
+}
+
+// clearLogFetches drops the fetches, the results of the fetches in flight are dropped when they
+// arrive.
+func (ps *PeerStorage) clearLogFetches() {
+	for low := range ps.logFetches {
+		ps.dropLogFetch(low)
+		delete(ps.logFetches, low)
+	}
+}
+
+// onRaftLogFetched wakes up the followers waiting for the fetched entries.
+func (d *peerMsgHandler) onRaftLogFetched(res *raftLogFetchResult) {
+	if d.stopped {
+		res.task.fetcher.release(res.task.reserved)
+		return
+	}
+	if !d.peer.Store().onLogFetched(res) || !d.peer.IsLeader() {
+		return
+	}
+	// Raft has no API to resend the appends, step a heartbeat response for the followers waiting for
+	// the entries, the leader sends the appends to them as if it hears from them.
+	var waiting []uint64
+	d.peer.RaftGroup.WithProgress(func(id uint64, _ raft.ProgressType, pr raft.Progress) {
+		if id != d.peer.PeerID() && pr.Next == res.task.low && pr.State != raft.ProgressStateSnapshot {
+			waiting = append(waiting, id)
+		}
+	})
+	if len(waiting) == 0 {
+		// The followers have caught up in other ways, don't hold the fetched entries.
+		d.peer.Store().dropLogFetch(res.task.low)
+		return
+	}
+	for _, id := range waiting {
+		err := d.peer.RaftGroup.Step(eraftpb.Message{
+			MsgType: eraftpb.MessageType_MsgHeartbeatResponse,
+			From:    id,
+			To:      d.peer.PeerID(),
+			Term:    d.peer.Term(),
+		})
+		if err != nil {
+			log.S().Warnf("%s failed to resend append to %d, err %v", d.tag(), id, err)
+		}
+	}
+	d.hasReady = true
+}
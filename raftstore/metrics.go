@@ -0,0 +1,155 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import "github.com/prometheus/client_golang/prometheus"
+
+const (
+	namespace = "unistore"
+	subsystem = "raftstore"
+)
+
+// Raftstore metrics.
+var (
+	snapThrottledDuration = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "snap_throttled_seconds",
+			Help:      "Total time of snapshot IO blocked by the rate limiter.",
+		}, []string{"type"})
+
+	snapBuildThrottled = snapThrottledDuration.WithLabelValues("build")
+	snapSendThrottled  = snapThrottledDuration.WithLabelValues("send")
+	snapRecvThrottled  = snapThrottledDuration.WithLabelValues("recv")
+	snapApplyThrottled = snapThrottledDuration.WithLabelValues("apply")
+
+	proposalDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "proposal_dropped_total",
+			Help:      "Total number of raft commands completed by the timeout or the cancellation before they are applied.",
+		}, []string{"type"})
+
+	proposalTimeout  = proposalDropped.WithLabelValues("timeout")
+	proposalCanceled = proposalDropped.WithLabelValues("canceled")
+
+	entryCacheSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "entry_cache_size_bytes",
+			Help:      "Total bytes of the raft entry caches.",
+		})
+
+	entryCacheEvicted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "entry_cache_evicted_bytes_total",
+			Help:      "Total bytes of the raft entry caches evicted by the memory limit.",
+		}, []string{"type"})
+
+	entryCacheEvictedReplicated = entryCacheEvicted.WithLabelValues("replicated")
+	entryCacheEvictedApplied    = entryCacheEvicted.WithLabelValues("applied")
+
+	raftMsgDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "raft_msg_dropped_total",
+			Help:      "Total number of raft messages dropped by the raft client.",
+		}, []string{"type"})
+
+	raftMsgDroppedFull        = raftMsgDropped.WithLabelValues("full")
+	raftMsgDroppedUnreachable = raftMsgDropped.WithLabelValues("unreachable")
+
+	heartbeatsCoalesced = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "heartbeats_coalesced_total",
+			Help:      "Total number of raft heartbeats and heartbeat responses sent in the coalesced heartbeats.",
+		})
+
+	flowControlL0Tables = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "flow_control_l0_tables",
+			Help:      "Number of the level 0 tables of the kv engine.",
+		})
+
+	flowControlPendingCompaction = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "flow_control_pending_compaction_bytes",
+			Help:      "Estimated pending compaction bytes of the kv engine.",
+		})
+
+	flowControlRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "flow_control_rejected_total",
+			Help:      "Total number of writes rejected by the flow control.",
+		}, []string{"type"})
+
+	flowControlRejectedSlowdown = flowControlRejected.WithLabelValues("slowdown")
+	flowControlRejectedStop     = flowControlRejected.WithLabelValues("stop")
+	flowControlRejectedApply    = flowControlRejected.WithLabelValues("apply")
+
+	diskProbeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "disk_probe_duration_seconds",
+			Help:      "Bucketed histogram of the time to write and sync a small file on the store disks.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 20),
+		}, []string{"type"})
+
+	inspectDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "inspect_duration_seconds",
+			Help:      "Bucketed histogram of the latencies inspected for the slow score.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 20),
+		}, []string{"type"})
+
+	slowScoreGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "slow_score",
+			Help:      "Slow score of the store, from 1 to 100.",
+		})
+)
+
+func init() {
+	prometheus.MustRegister(snapThrottledDuration)
+	prometheus.MustRegister(proposalDropped)
+	prometheus.MustRegister(entryCacheSize)
+	prometheus.MustRegister(entryCacheEvicted)
+	prometheus.MustRegister(raftMsgDropped)
+	prometheus.MustRegister(heartbeatsCoalesced)
+	prometheus.MustRegister(flowControlL0Tables)
+	prometheus.MustRegister(flowControlPendingCompaction)
+	prometheus.MustRegister(flowControlRejected)
+	prometheus.MustRegister(diskProbeDuration)
+	prometheus.MustRegister(inspectDuration)
+	prometheus.MustRegister(slowScoreGauge)
+}
@@ -14,7 +14,8 @@
 package raftstore
 
 import (
-	"sync"
+	"context"
+	"sync/atomic"
 	"time"
 
 	"github.com/ngaut/unistore/raftstore/raftlog"
@@ -45,6 +46,11 @@ const (
 	MsgTypeStart                  MsgType = 14
 	MsgTypeApplyRes               MsgType = 15
 	MsgTypeNoop                   MsgType = 16
+	MsgTypeRaftLogFetched         MsgType = 17
+	// MsgTypeEvictLeader asks the leader to transfer the leadership away from the slow store.
+	MsgTypeEvictLeader MsgType = 18
+	// MsgTypeStalePeer tells the peer that PD confirms it's not a member of the region.
+	MsgTypeStalePeer MsgType = 19
 
 	MsgTypeStoreRaftMessage   MsgType = 101
 	MsgTypeStoreSnapshotStats MsgType = 102
@@ -86,27 +92,90 @@ func NewMsg(tp MsgType, data interface{}) Msg {
 
 // Callback represents a callback.
 type Callback struct {
-	resp           *raft_cmdpb.RaftCmdResponse
-	wg             sync.WaitGroup
+	resp *raft_cmdpb.RaftCmdResponse
+	// done is set to 1 by the first response, a command may be completed by the timeout or the
+	// cancellation before it's applied, the later responses are dropped.
+	done   uint32
+	doneCh chan struct{}
+	// deadline is the time after which the command is completed with a timeout error if it's not
+	// applied yet, the zero value means no deadline. It's set by the router from MsgRaftCmd.Deadline.
+	deadline       time.Time
 	raftBeginTime  time.Time
 	raftDoneTime   time.Time
 	applyBeginTime time.Time
 	applyDoneTime  time.Time
 }
 
-// Done sets the RaftCmdResponse and calls Done() on the WaitGroup.
+// Done sets the RaftCmdResponse and wakes up the waiter, only the first response is kept.
 func (cb *Callback) Done(resp *raft_cmdpb.RaftCmdResponse) {
 	if cb != nil {
-		cb.resp = resp
-		cb.wg.Done()
+		cb.finish(resp)
 	}
 }
 
+// Cancel completes the callback with an ErrProposalCanceled. The command is not proposed if it's
+// not proposed yet, otherwise it may still be applied.
+func (cb *Callback) Cancel() {
+	if cb.finish(ErrResp(new(ErrProposalCanceled))) {
+		proposalCanceled.Inc()
+	}
+}
+
+// timeout completes the callback with an ErrProposalTimeout if it's not done yet.
+func (cb *Callback) timeout() {
+	if cb.finish(ErrResp(new(ErrProposalTimeout))) {
+		proposalTimeout.Inc()
+	}
+}
+
+// finish returns true if the resp is the response of the callback.
+func (cb *Callback) finish(resp *raft_cmdpb.RaftCmdResponse) bool {
+	if !atomic.CompareAndSwapUint32(&cb.done, 0, 1) {
+		return false
+	}
+	cb.resp = resp
+	close(cb.doneCh)
+	return true
+}
+
+func (cb *Callback) isDone() bool {
+	return cb != nil && atomic.LoadUint32(&cb.done) == 1
+}
+
+// expired returns true if the deadline of the callback is not after now.
+func (cb *Callback) expired(now time.Time) bool {
+	return cb != nil && !cb.deadline.IsZero() && !now.Before(cb.deadline)
+}
+
+// wait waits for the response. If timeout is not 0, the callback is completed with an
+// ErrProposalTimeout after timeout, so the waiter is never blocked by a dropped command.
+func (cb *Callback) wait(timeout time.Duration) *raft_cmdpb.RaftCmdResponse {
+	return cb.waitContext(context.Background(), timeout)
+}
+
+// waitContext is like wait, but the callback is canceled when the ctx is done.
+func (cb *Callback) waitContext(ctx context.Context, timeout time.Duration) *raft_cmdpb.RaftCmdResponse {
+	var timeoutCh <-chan time.Time
+	if timeout != 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	select {
+	case <-cb.doneCh:
+	case <-timeoutCh:
+		cb.timeout()
+		<-cb.doneCh
+	case <-ctx.Done():
+		cb.Cancel()
+		<-cb.doneCh
+	}
+	return cb.resp
+}
+
 // NewCallback creates a new Callback.
 func NewCallback() *Callback {
-	cb := &Callback{}
-	cb.wg.Add(1)
-	return cb
+	return &Callback{doneCh: make(chan struct{})}
 }
 
 // PeerTick represents a peer tick.
@@ -131,6 +200,9 @@ const (
 	StoreTickPdStoreHeartbeat StoreTick = 1
 	StoreTickSnapGC           StoreTick = 2
 	StoreTickConsistencyCheck StoreTick = 3
+	StoreTickDiskCheck        StoreTick = 4
+	StoreTickFlowCheck        StoreTick = 5
+	StoreTickInspect          StoreTick = 6
 )
 
 // MsgSignificantType represents a significant type of msg.
@@ -152,6 +224,10 @@ type MsgSignificant struct {
 // MsgRaftCmd defines a message of raft command.
 type MsgRaftCmd struct {
 	SendTime time.Time
+	// Deadline is the wall time after which the command is completed with an ErrProposalTimeout if
+	// it's not applied yet, the zero value means no deadline. Like SendTime, it's not affected by
+	// the Clock of the raftstore because it bounds the time a caller waits.
+	Deadline time.Time
 	Request  raftlog.RaftLog
 	Callback *Callback
 }
@@ -193,6 +269,13 @@ type MsgGCSnap struct {
 	Snaps []SnapKeyWithSending
 }
 
+// MsgStalePeer defines a message which is sent by the pd worker after PD confirms the peer is removed
+// from the region.
+type MsgStalePeer struct {
+	Peer     *metapb.Peer
+	PDRegion *metapb.Region
+}
+
 // MsgStoreClearRegionSizeInRange defines a message which is used to clear region size in range.
 type MsgStoreClearRegionSizeInRange struct {
 	StartKey []byte
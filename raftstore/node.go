@@ -119,9 +119,8 @@ func (n *Node) Start(ctx context.Context, engines *Engines, trans Transport, sna
 		if err != nil {
 			return err
 		}
-		cb.wg.Wait()
-		if cb.resp.Header.Error != nil {
-			return &pberror.PBError{RequestErr: cb.resp.Header.Error}
+		if resp := cb.wait(0); resp.Header.Error != nil {
+			return &pberror.PBError{RequestErr: resp.Header.Error}
 		}
 	}
 
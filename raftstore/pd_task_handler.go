@@ -15,16 +15,17 @@ package raftstore
 
 import (
 	"context"
+	"os"
 	"time"
 
 	"github.com/ngaut/unistore/raftstore/raftlog"
 	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/pdpb"
 	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
-	"github.com/pingcap/kvproto/pkg/raft_serverpb"
 	"github.com/pingcap/log"
 	"github.com/pingcap/tidb/store/mockstore/unistore/pd"
 	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/process"
 )
 
 type pdTaskHandler struct {
@@ -35,14 +36,21 @@ type pdTaskHandler struct {
 	// statistics
 	storeStats storeStatistics
 	peerStats  map[uint64]*peerStatistics
+	// proc is nil if the process stats are not supported.
+	proc *process.Process
 }
 
 func newPDTaskHandler(storeID uint64, pdClient pd.Client, router *router) *pdTaskHandler {
+	proc, err := process.NewProcess(int32(os.Getpid()))
+	if err != nil {
+		log.S().Warnf("get process stats failed, err %v", err)
+	}
 	return &pdTaskHandler{
 		storeID:   storeID,
 		pdClient:  pdClient,
 		router:    router,
 		peerStats: make(map[uint64]*peerStatistics),
+		proc:      proc,
 	}
 }
 
@@ -209,6 +217,15 @@ func (r *pdTaskHandler) onStoreHeartbeat(t *pdStoreHeartbeatTask) {
 	if capacity > usedSize {
 		available = capacity - usedSize
 	}
+	if diskStat.Free < available {
+		available = diskStat.Free
+	}
+	// Hide the reserved space from PD, so it stops scheduling regions to this store before the disk is full.
+	if available > t.reserve {
+		available -= t.reserve
+	} else {
+		available = 0
+	}
 
 	t.stats.Capacity = capacity
 	t.stats.UsedSize = usedSize
@@ -220,6 +237,11 @@ func (r *pdTaskHandler) onStoreHeartbeat(t *pdStoreHeartbeatTask) {
 		StartTimestamp: uint64(r.storeStats.lastReport.Unix()),
 		EndTimestamp:   uint64(time.Now().Unix()),
 	}
+	r.fillProcessStats(t.stats, time.Since(r.storeStats.lastReport))
+	t.stats.OpLatencies = append(t.stats.OpLatencies, probeDisks(map[string]string{
+		"kv_disk_probe":   t.path,
+		"raft_disk_probe": t.raftPath,
+	})...)
 
 	r.storeStats.lastTotalReadBytes = r.storeStats.totalReadBytes
 	r.storeStats.lastTotalReadKeys = r.storeStats.totalReadKeys
@@ -230,6 +252,48 @@ func (r *pdTaskHandler) onStoreHeartbeat(t *pdStoreHeartbeatTask) {
 	}
 }
 
+// fillProcessStats fills the CPU usage and the disk IO rates of the process, the CPU usage is in percent
+// and the IO rates are in bytes per second.
+func (r *pdTaskHandler) fillProcessStats(stats *pdpb.StoreStats, interval time.Duration) {
+	if r.proc == nil {
+		return
+	}
+	// The percent is computed from the CPU time since the last call.
+	if percent, err := r.proc.Percent(0); err == nil {
+		stats.CpuUsages = append(stats.CpuUsages, &pdpb.RecordPair{Key: "process", Value: uint64(percent)})
+	}
+	io, err := r.proc.IOCounters()
+	if err != nil {
+		return
+	}
+	if seconds := interval.Seconds(); seconds > 0 && !r.storeStats.lastReport.IsZero() {
+		readRate := float64(io.ReadBytes-r.storeStats.lastIOReadBytes) / seconds
+		writeRate := float64(io.WriteBytes-r.storeStats.lastIOWriteBytes) / seconds
+		stats.ReadIoRates = append(stats.ReadIoRates, &pdpb.RecordPair{Key: "process", Value: uint64(readRate)})
+		stats.WriteIoRates = append(stats.WriteIoRates, &pdpb.RecordPair{Key: "process", Value: uint64(writeRate)})
+	}
+	r.storeStats.lastIOReadBytes = io.ReadBytes
+	r.storeStats.lastIOWriteBytes = io.WriteBytes
+}
+
+// probeDisks probes the write latency of the dirs, the latencies are in microseconds.
+func probeDisks(dirs map[string]string) []*pdpb.RecordPair {
+	var pairs []*pdpb.RecordPair
+	for key, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		dur, err := probeDiskLatency(dir)
+		if err != nil {
+			log.S().Warnf("probe disk %s failed, err %v", dir, err)
+			continue
+		}
+		diskProbeDuration.WithLabelValues(key).Observe(dur.Seconds())
+		pairs = append(pairs, &pdpb.RecordPair{Key: key, Value: uint64(dur / time.Microsecond)})
+	}
+	return pairs
+}
+
 func (r *pdTaskHandler) onReportBatchSplit(t *pdReportBatchSplitTask) {
 	if err := r.pdClient.ReportBatchSplit(context.TODO(), t.regions); err != nil {
 		log.S().Error(err)
@@ -312,15 +376,9 @@ func (r *pdTaskHandler) sendMergeFail(source uint64, target *metapb.Peer) {
 
 func (r *pdTaskHandler) sendDestroyPeer(local *metapb.Region, peer *metapb.Peer, pdRegion *metapb.Region) {
 	if err := r.router.send(local.GetId(), Msg{
-		Type:     MsgTypeRaftMessage,
+		Type:     MsgTypeStalePeer,
 		RegionID: local.GetId(),
-		Data: &raft_serverpb.RaftMessage{
-			RegionId:    local.GetId(),
-			FromPeer:    peer,
-			ToPeer:      peer,
-			RegionEpoch: pdRegion.GetRegionEpoch(),
-			IsTombstone: true,
-		},
+		Data:     &MsgStalePeer{Peer: peer, PDRegion: pdRegion},
 	}); err != nil {
 		log.S().Error(err)
 	}
@@ -332,6 +390,8 @@ type storeStatistics struct {
 	lastTotalReadBytes uint64
 	lastTotalReadKeys  uint64
 	lastReport         time.Time
+	lastIOReadBytes    uint64
+	lastIOWriteBytes   uint64
 }
 
 type peerStatistics struct {
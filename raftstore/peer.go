@@ -220,14 +220,16 @@ type RecentAddedPeer struct {
 	RejectDurationAsSecs uint64
 	ID                   uint64
 	AddedTime            time.Time
+	clock                Clock
 }
 
 // NewRecentAddedPeer returns a new RecentAddedPeer.
-func NewRecentAddedPeer(rejectDurationAsSecs uint64) *RecentAddedPeer {
+func NewRecentAddedPeer(rejectDurationAsSecs uint64, clock Clock) *RecentAddedPeer {
 	return &RecentAddedPeer{
 		RejectDurationAsSecs: rejectDurationAsSecs,
 		ID:                   0,
-		AddedTime:            time.Now(),
+		AddedTime:            clock.Now(),
+		clock:                clock,
 	}
 }
 
@@ -240,7 +242,7 @@ func (r *RecentAddedPeer) Update(id uint64, now time.Time) {
 // Contains returns true if the given id is equal to the RecentAddedPeer ID and elapsed time is before rejected time.
 func (r *RecentAddedPeer) Contains(id uint64) bool {
 	if r.ID == id {
-		now := time.Now()
+		now := r.clock.Now()
 		elapsedSecs := now.Sub(r.AddedTime).Seconds()
 		return uint64(elapsedSecs) < r.RejectDurationAsSecs
 	}
@@ -283,6 +285,11 @@ type Peer struct {
 	PeersStartPendingTime map[uint64]time.Time
 	RecentAddedPeer       *RecentAddedPeer
 
+	// The snapshot generation delegated to a follower when it's the leader.
+	delegatingSnap *delegatingSnap
+	// The snapshot generation accepted from the leader when it's a follower.
+	delegatedSnap *delegatedSnap
+
 	// an inaccurate difference in region size since last reset.
 	SizeDiffHint uint64
 	// delete keys' count since last reset.
@@ -315,6 +322,7 @@ type Peer struct {
 	leaderMissingTime            *time.Time
 	leaderLease                  *Lease
 	leaderChecker                leaderChecker
+	clock                        Clock
 
 	// If a snapshot is being applied asynchronously, messages should not be sent.
 	pendingMessages         []eraftpb.Message
@@ -353,7 +361,7 @@ func NewPeer(storeID uint64, cfg *Config, engines *Engines, region *metapb.Regio
 	if err != nil {
 		return nil, err
 	}
-	now := time.Now()
+	now := cfg.Clock.Now()
 	p := &Peer{
 		Meta:                  peer,
 		regionID:              region.GetId(),
@@ -364,7 +372,7 @@ func NewPeer(storeID uint64, cfg *Config, engines *Engines, region *metapb.Regio
 		peerCache:             make(map[uint64]*metapb.Peer),
 		PeerHeartbeats:        make(map[uint64]time.Time),
 		PeersStartPendingTime: make(map[uint64]time.Time),
-		RecentAddedPeer:       NewRecentAddedPeer(uint64(cfg.RaftRejectTransferLeaderDuration.Seconds())),
+		RecentAddedPeer:       NewRecentAddedPeer(uint64(cfg.RaftRejectTransferLeaderDuration.Seconds()), cfg.Clock),
 		ConsistencyState: &ConsistencyState{
 			LastCheckTime: now,
 			Index:         RaftInvalidIndex,
@@ -373,10 +381,13 @@ func NewPeer(storeID uint64, cfg *Config, engines *Engines, region *metapb.Regio
 		Tag:                   tag,
 		LastApplyingIdx:       appliedIndex,
 		lastUrgentProposalIdx: math.MaxInt64,
-		leaderLease:           NewLease(cfg.RaftStoreMaxLeaderLease),
+		leaderLease:           NewLease(cfg.RaftStoreMaxLeaderLease, cfg.Clock),
+		clock:                 cfg.Clock,
 	}
 
 	p.leaderChecker.peerID = p.PeerID()
+	p.leaderChecker.clock = cfg.Clock
+	p.leaderChecker.proposalTimeout = cfg.ProposalTimeout
 	p.leaderChecker.region = unsafe.Pointer(region)
 	p.leaderChecker.term.Store(p.Term())
 	p.leaderChecker.appliedIndexTerm.Store(ps.appliedIndexTerm)
@@ -474,6 +485,8 @@ func (p *Peer) Destroy(engine *Engines, keepData bool) error {
 	if err := p.Store().clearMeta(kvWB, raftWB); err != nil {
 		return err
 	}
+	p.Store().clearLogFetches()
+	p.Store().cache.clear()
 	var mergeState *rspb.MergeState
 	if p.PendingMergeState != nil {
 		mergeState = p.PendingMergeState
@@ -596,7 +609,7 @@ func (p *Peer) Send(trans Transport, msgs []eraftpb.Message) error {
 			// network partition from the new leader.
 			// For lease safety during leader transfer, transit `leader_lease`
 			// to suspect.
-			p.leaderLease.Suspect(time.Now())
+			p.leaderLease.Suspect(p.clock.Now())
 		default:
 		}
 	}
@@ -606,7 +619,7 @@ func (p *Peer) Send(trans Transport, msgs []eraftpb.Message) error {
 // Step steps the raft message.
 func (p *Peer) Step(m *eraftpb.Message) error {
 	if p.IsLeader() && m.GetFrom() != InvalidID {
-		p.PeerHeartbeats[m.GetFrom()] = time.Now()
+		p.PeerHeartbeats[m.GetFrom()] = p.clock.Now()
 		// As the leader we know we are not missing.
 		p.leaderMissingTime = nil
 	} else if m.GetFrom() == p.LeaderID() {
@@ -632,7 +645,7 @@ func (p *Peer) CheckPeers() {
 	region := p.Region()
 	for _, peer := range region.GetPeers() {
 		if _, ok := p.PeerHeartbeats[peer.GetId()]; !ok {
-			p.PeerHeartbeats[peer.GetId()] = time.Now()
+			p.PeerHeartbeats[peer.GetId()] = p.clock.Now()
 		}
 	}
 }
@@ -645,7 +658,7 @@ func (p *Peer) CollectDownPeers(maxDuration time.Duration) []*pdpb.PeerStats {
 			continue
 		}
 		if hb, ok := p.PeerHeartbeats[peer.GetId()]; ok {
-			elapsed := time.Since(hb)
+			elapsed := p.clock.Since(hb)
 			if elapsed > maxDuration {
 				stats := &pdpb.PeerStats{
 					Peer:        peer,
@@ -673,7 +686,7 @@ func (p *Peer) CollectPendingPeers() []*metapb.Peer {
 			if peer := p.getPeerFromCache(id); peer != nil {
 				pendingPeers = append(pendingPeers, peer)
 				if _, ok := p.PeersStartPendingTime[id]; !ok {
-					now := time.Now()
+					now := p.clock.Now()
 					p.PeersStartPendingTime[id] = now
 					log.S().Debugf("%v peer %v start pending at %v", p.Tag, id, now)
 				}
@@ -708,7 +721,7 @@ func (p *Peer) AnyNewPeerCatchUp(peerID uint64) bool {
 		if ok {
 			if progress.Match >= truncatedIdx {
 				delete(p.PeersStartPendingTime, peerID)
-				elapsed := time.Since(startPendingTime)
+				elapsed := p.clock.Since(startPendingTime)
 				log.S().Debugf("%v peer %v has caught up logs, elapsed: %v", p.Tag, peerID, elapsed)
 				return true
 			}
@@ -735,15 +748,15 @@ func (p *Peer) CheckStaleState(cfg *Config) StaleState {
 	// Mark down the time when we are called, so we can check later if it's been longer than it
 	// should be.
 	if p.leaderMissingTime == nil {
-		now := time.Now()
+		now := p.clock.Now()
 		p.leaderMissingTime = &now
 		return StaleStateValid
 	}
-	elapsed := time.Since(*p.leaderMissingTime)
+	elapsed := p.clock.Since(*p.leaderMissingTime)
 	if elapsed >= cfg.MaxLeaderMissingDuration {
 		// Resets the `leader_missing_time` to avoid sending the same tasks to
 		// PD worker continuously during the leader missing timeout.
-		now := time.Now()
+		now := p.clock.Now()
 		p.leaderMissingTime = &now
 		return StaleStateToValidate
 	} else if elapsed >= cfg.AbnormalLeaderMissingDuration && !naivePeer {
@@ -768,13 +781,14 @@ func (p *Peer) OnRoleChanged(observer PeerEventObserver, ready *raft.Ready) {
 			// It is recommended to update the lease expiring time right after
 			// this peer becomes leader because it's more convenient to do it here and
 			// it has no impact on the correctness.
-			p.MaybeRenewLeaderLease(time.Now())
+			p.MaybeRenewLeaderLease(p.clock.Now())
 			if !p.PendingRemove {
 				p.leaderChecker.term.Store(p.Term())
 			}
 			observer.OnRoleChange(p.getEventContext().RegionID, ss.RaftState)
 		} else if ss.RaftState == raft.StateFollower {
 			p.leaderLease.Expire()
+			p.Store().clearLogFetches()
 			observer.OnRoleChange(p.getEventContext().RegionID, ss.RaftState)
 		}
 	}
@@ -1092,7 +1106,7 @@ func (p *Peer) HandleRaftReadyApply(kv *mvcc.DBBundle, applyMsgs *applyMsgs, rea
 					// when the target region merges majority of this region, also
 					// it can not know when the target region writes new values.
 					// To prevent unsafe local read, we suspect its leader lease.
-					p.leaderLease.Suspect(time.Now())
+					p.leaderLease.Suspect(p.clock.Now())
 					mergeToBeUpdated = false
 				}
 			}
@@ -1287,7 +1301,7 @@ func (p *Peer) Propose(kv *mvcc.DBBundle, cfg *Config, cb *Callback, rlog raftlo
 
 // PostPropose tries to renew leader lease on every consistent read/write request.
 func (p *Peer) PostPropose(meta *ProposalMeta, isConfChange bool, cb *Callback) {
-	t := time.Now()
+	t := p.clock.Now()
 	meta.RenewLeaseTime = &t
 	proposal := &proposal{
 		isConfChange: isConfChange,
@@ -1454,7 +1468,7 @@ func (p *Peer) readIndex(cfg *Config, req *raft_cmdpb.RaftCmdRequest, errResp *r
 		return false
 	}
 
-	now := time.Now()
+	now := p.clock.Now()
 	renewLeaseTime := &now
 	readsLen := len(p.pendingReads.reads)
 	if readsLen > 0 {
@@ -1532,6 +1546,10 @@ func (p *Peer) preProposePrepareMerge(cfg *Config, req *raft_cmdpb.RaftCmdReques
 	if err != nil {
 		return err
 	}
+	if uint64(len(ents)) < lastIndex-minProgress {
+		// The entries are being fetched in the background.
+		return fmt.Errorf("log gap (%v, %v] is temporarily unavailable, skip merge", minProgress, lastIndex)
+	}
 	for _, entry := range ents {
 		entrySize += len(entry.Data)
 		if entry.EntryType == eraftpb.EntryType_EntryConfChange {
@@ -29,7 +29,6 @@ import (
 	"github.com/pingcap/kvproto/pkg/metapb"
 	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
 	"github.com/pingcap/log"
-	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/dbreader"
 	"github.com/zhangjinpeng1987/raft"
 )
 
@@ -95,9 +94,51 @@ func CompactRaftLog(tag string, state *applyState, compactIndex, compactTerm uin
 	return nil
 }
 
+// entryCacheMemory accounts the memory of the entry caches of all the regions in a store.
+type entryCacheMemory struct {
+	size int64
+	// limit is the memory budget of the entry caches, 0 means no limit.
+	limit uint64
+}
+
+func (m *entryCacheMemory) add(delta int64) {
+	if m == nil || delta == 0 {
+		return
+	}
+	atomic.AddInt64(&m.size, delta)
+	entryCacheSize.Add(float64(delta))
+}
+
+func (m *entryCacheMemory) exceeded() bool {
+	return m != nil && m.limit > 0 && atomic.LoadInt64(&m.size) > int64(m.limit)
+}
+
 // EntryCache represents an entry cache.
 type EntryCache struct {
 	cache []eraftpb.Entry
+	// size is the bytes of the cached entries, it's accounted in mem if mem is set.
+	size       uint64
+	mem        *entryCacheMemory
+	lastAppend time.Time
+}
+
+// setMemory accounts the cache in the store memory of the entry caches.
+func (ec *EntryCache) setMemory(mem *entryCacheMemory) {
+	ec.mem.add(-int64(ec.size))
+	ec.mem = mem
+	ec.mem.add(int64(ec.size))
+}
+
+func (ec *EntryCache) updateSize(added, removed []eraftpb.Entry) {
+	var delta int64
+	for i := range added {
+		delta += int64(added[i].Size())
+	}
+	for i := range removed {
+		delta -= int64(removed[i].Size())
+	}
+	ec.size = uint64(int64(ec.size) + delta)
+	ec.mem.add(delta)
 }
 
 func (ec *EntryCache) front() eraftpb.Entry {
@@ -145,21 +186,24 @@ func (ec *EntryCache) append(tag string, entries []eraftpb.Entry) {
 		firstIndex := entries[0].Index
 		cacheLastIndex := ec.back().Index
 		if cacheLastIndex >= firstIndex {
-			if ec.front().Index >= firstIndex {
-				ec.cache = ec.cache[:0]
-			} else {
-				left := ec.length() - int(cacheLastIndex-firstIndex+1)
-				ec.cache = ec.cache[:left]
+			left := 0
+			if ec.front().Index < firstIndex {
+				left = ec.length() - int(cacheLastIndex-firstIndex+1)
 			}
+			ec.updateSize(nil, ec.cache[left:])
+			ec.cache = ec.cache[:left]
 		} else if cacheLastIndex+1 < firstIndex {
 			panic(fmt.Sprintf("%s unexpected hole %d < %d", tag, cacheLastIndex, firstIndex))
 		}
 	}
 	ec.cache = append(ec.cache, entries...)
+	ec.updateSize(entries, nil)
 	if ec.length() > MaxCacheCapacity {
 		extraSize := ec.length() - MaxCacheCapacity
+		ec.updateSize(nil, ec.cache[:extraSize])
 		ec.cache = ec.cache[extraSize:]
 	}
+	ec.lastAppend = time.Now()
 }
 
 func (ec *EntryCache) compactTo(idx uint64) {
@@ -171,9 +215,15 @@ func (ec *EntryCache) compactTo(idx uint64) {
 		return
 	}
 	pos := mathutil.Min(int(idx-firstIdx), ec.length())
+	ec.updateSize(nil, ec.cache[:pos])
 	ec.cache = ec.cache[pos:]
 }
 
+func (ec *EntryCache) clear() {
+	ec.updateSize(nil, ec.cache)
+	ec.cache = nil
+}
+
 // ApplySnapResult defines a result of applying snapshot.
 type ApplySnapResult struct {
 	// PrevRegion is the region before snapshot applied
@@ -234,7 +284,7 @@ func recoverFromApplyingState(engines *Engines, raftWB *WriteBatch, regionID uin
 
 	raftStateKey := RaftStateKey(regionID)
 	raftState := raftState{}
-	val, err = getValue(engines.raft, raftStateKey)
+	val, err = engines.raft.GetState(regionID)
 	if err != nil && err != badger.ErrKeyNotFound {
 		return errors.WithStack(err)
 	}
@@ -273,6 +323,10 @@ type PeerStorage struct {
 	cache *EntryCache
 	stats *CacheQueryStats
 
+	// logFetcher is nil if the raft logs are always read synchronously.
+	logFetcher *raftLogFetcher
+	logFetches map[uint64]*raftLogFetch
+
 	Tag string
 }
 
@@ -341,12 +395,12 @@ func getApplyState(db *badger.DB, regionID uint64) (applyState, error) {
 	return applyState, nil
 }
 
-func getRaftEntry(db *badger.DB, regionID, idx uint64) (*eraftpb.Entry, error) {
-	entry := new(eraftpb.Entry)
-	if err := getMsg(db, RaftLogKey(regionID, idx), entry); err != nil {
+func getRaftEntry(raftEngine RaftEngine, regionID, idx uint64) (*eraftpb.Entry, error) {
+	ents, _, err := raftEngine.FetchEntries(regionID, idx, idx+1, math.MaxUint64, nil)
+	if err != nil {
 		return nil, storageError(fmt.Sprintf("entry %d of %d not found", idx, regionID))
 	}
-	return entry, nil
+	return &ents[0], nil
 }
 
 func getValueTxn(txn *badger.Txn, key []byte) ([]byte, error) {
@@ -371,10 +425,10 @@ func getValue(engine *badger.DB, key []byte) ([]byte, error) {
 	return result, err
 }
 
-func initRaftState(raftEngine *badger.DB, region *metapb.Region) (raftState, error) {
+func initRaftState(raftEngine RaftEngine, region *metapb.Region) (raftState, error) {
 	stateKey := RaftStateKey(region.Id)
 	raftState := raftState{}
-	val, err := getValue(raftEngine, stateKey)
+	val, err := raftEngine.GetState(region.Id)
 	if err != nil && err != badger.ErrKeyNotFound {
 		return raftState, err
 	}
@@ -417,7 +471,7 @@ func initApplyState(kvEngine *badger.DB, region *metapb.Region) (applyState, err
 	return applyState, nil
 }
 
-func initLastTerm(raftEngine *badger.DB, region *metapb.Region,
+func initLastTerm(raftEngine RaftEngine, region *metapb.Region,
 	raftState raftState, applyState applyState) (uint64, error) {
 	lastIdx := raftState.lastIndex
 	if lastIdx == 0 {
@@ -429,9 +483,7 @@ func initLastTerm(raftEngine *badger.DB, region *metapb.Region,
 	} else {
 		y.Assert(lastIdx > RaftInitLogIndex)
 	}
-	lastLogKey := RaftLogKey(region.Id, lastIdx)
-	e := new(eraftpb.Entry)
-	err := getMsg(raftEngine, lastLogKey, e)
+	e, err := getRaftEntry(raftEngine, region.Id, lastIdx)
 	if err != nil {
 		return 0, errors.Errorf("[region %s] entry at %d doesn't exist, may lost data.", region, lastIdx)
 	}
@@ -481,6 +533,10 @@ func (ps *PeerStorage) IsApplyingSnapshot() bool {
 
 // Entries implements the raft.Storage Entries method.
 func (ps *PeerStorage) Entries(low, high, maxSize uint64) ([]eraftpb.Entry, error) {
+	return ps.entries(low, high, maxSize, ps.canFetchAsync(low))
+}
+
+func (ps *PeerStorage) entries(low, high, maxSize uint64, async bool) ([]eraftpb.Entry, error) {
 	err := ps.checkRange(low, high)
 	if err != nil {
 		return nil, err
@@ -497,7 +553,10 @@ func (ps *PeerStorage) Entries(low, high, maxSize uint64) ([]eraftpb.Entry, erro
 	if high <= cacheLow {
 		// not overlap
 		ps.stats.miss++
-		ents, _, err = fetchEntriesTo(ps.Engines.raft, reginID, low, high, maxSize, ents)
+		if async {
+			return ps.fetchEntriesAsync(low, high, maxSize)
+		}
+		ents, _, err = ps.Engines.raft.FetchEntries(reginID, low, high, maxSize, ents)
 		if err != nil {
 			return ents, err
 		}
@@ -506,7 +565,10 @@ func (ps *PeerStorage) Entries(low, high, maxSize uint64) ([]eraftpb.Entry, erro
 	var fetchedSize, beginIdx uint64
 	if low < cacheLow {
 		ps.stats.miss++
-		ents, fetchedSize, err = fetchEntriesTo(ps.Engines.raft, reginID, low, cacheLow, maxSize, ents)
+		if async {
+			return ps.fetchEntriesAsync(low, cacheLow, maxSize)
+		}
+		ents, fetchedSize, err = ps.Engines.raft.FetchEntries(reginID, low, cacheLow, maxSize, ents)
 		if err != nil {
 			return ents, err
 		}
@@ -534,7 +596,7 @@ func (ps *PeerStorage) Term(idx uint64) (uint64, error) {
 	if ps.truncatedTerm() == ps.lastTerm || idx == ps.raftState.lastIndex {
 		return ps.lastTerm, nil
 	}
-	entries, err := ps.Entries(idx, idx+1, math.MaxUint64)
+	entries, err := ps.entries(idx, idx+1, math.MaxUint64, false)
 	if err != nil {
 		return 0, err
 	}
@@ -730,110 +792,21 @@ func (ps *PeerStorage) clearExtraData(newRegion *metapb.Region) {
 	}
 }
 
-func fetchEntriesTo(engine *badger.DB, regionID, low, high, maxSize uint64, buf []eraftpb.Entry) ([]eraftpb.Entry, uint64, error) {
-	var totalSize uint64
-	nextIndex := low
-	exceededMaxSize := false
-	txn := engine.NewTransaction(false)
-	defer txn.Discard()
-	if high-low <= raftLogMultiGetCnt {
-		// If election happens in inactive regions, they will just try
-		// to fetch one empty log.
-		for i := low; i < high; i++ {
-			key := RaftLogKey(regionID, i)
-			item, err := txn.Get(key)
-			if err == badger.ErrKeyNotFound {
-				return nil, 0, raft.ErrUnavailable
-			} else if err != nil {
-				return nil, 0, err
-			}
-			val, err := item.Value()
-			if err != nil {
-				return nil, 0, err
-			}
-			var entry eraftpb.Entry
-			err = entry.Unmarshal(val)
-			if err != nil {
-				return nil, 0, err
-			}
-			y.Assert(entry.Index == i)
-			totalSize += uint64(len(val))
-
-			if len(buf) == 0 || totalSize <= maxSize {
-				buf = append(buf, entry)
-			}
-			if totalSize > maxSize {
-				break
-			}
-		}
-		return buf, totalSize, nil
-	}
-	startKey := RaftLogKey(regionID, low)
-	endKey := RaftLogKey(regionID, high)
-	iter := dbreader.NewIterator(txn, false, startKey, endKey)
-	defer iter.Close()
-	for iter.Seek(startKey); iter.Valid(); iter.Next() {
-		item := iter.Item()
-		if bytes.Compare(item.Key(), endKey) >= 0 {
-			break
-		}
-		val, err := item.Value()
-		if err != nil {
-			return nil, 0, err
-		}
-		var entry eraftpb.Entry
-		err = entry.Unmarshal(val)
-		if err != nil {
-			return nil, 0, err
-		}
-		// May meet gap or has been compacted.
-		if entry.Index != nextIndex {
-			break
-		}
-		nextIndex++
-		totalSize += uint64(len(val))
-		exceededMaxSize = totalSize > maxSize
-		if !exceededMaxSize || len(buf) == 0 {
-			buf = append(buf, entry)
-		}
-		if exceededMaxSize {
-			break
-		}
-	}
-	// If we get the correct number of entries, returns,
-	// or the total size almost exceeds max_size, returns.
-	if len(buf) == int(high-low) || exceededMaxSize {
-		return buf, totalSize, nil
-	}
-	// Here means we don't fetch enough entries.
-	return nil, 0, raft.ErrUnavailable
-}
-
 // ClearMeta deletes meta.
 func ClearMeta(engines *Engines, kvWB, raftWB *WriteBatch, regionID uint64, lastIndex uint64) error {
 	start := time.Now()
 	kvWB.Delete(y.KeyWithTs(RegionStateKey(regionID), KvTS))
 	kvWB.Delete(y.KeyWithTs(ApplyStateKey(regionID), KvTS))
+	kvWB.Delete(y.KeyWithTs(SnapshotLocksKey(regionID), KvTS))
 
 	firstIndex := lastIndex + 1
-	beginLogKey := RaftLogKey(regionID, 0)
-	endLogKey := RaftLogKey(regionID, firstIndex)
-	err := engines.raft.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-		it.Seek(beginLogKey)
-		if it.Valid() && bytes.Compare(it.Item().Key(), endLogKey) < 0 {
-			logIdx, err1 := RaftLogIndex(it.Item().Key())
-			if err1 != nil {
-				return err1
-			}
-			firstIndex = logIdx
-		}
-		return nil
-	})
+	logIdx, err := engines.raft.FirstIndex(regionID)
 	if err != nil {
 		return err
 	}
+	if logIdx > 0 && logIdx < firstIndex {
+		firstIndex = logIdx
+	}
 	for i := firstIndex; i <= lastIndex; i++ {
 		raftWB.Delete(y.KeyWithTs(RaftLogKey(regionID, i), RaftTS))
 	}
@@ -1068,7 +1041,7 @@ func createAndInitSnapshot(snap *regionSnapshot, key SnapKey, mgr *SnapManager)
 	return snapshot, err
 }
 
-func getAppliedIdxTermForSnapshot(raft *badger.DB, kv *badger.Txn, regionID uint64) (uint64, uint64, error) {
+func getAppliedIdxTermForSnapshot(raft RaftEngine, kv *badger.Txn, regionID uint64) (uint64, uint64, error) {
 	applyState := applyState{}
 	val, err := getValueTxn(kv, ApplyStateKey(regionID))
 	if err != nil {
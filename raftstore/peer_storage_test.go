@@ -63,9 +63,8 @@ func appendEnts(t *testing.T, peerStore *PeerStorage, ents []eraftpb.Entry) {
 func validateCache(t *testing.T, peerStore *PeerStorage, expEnts []eraftpb.Entry) {
 	assert.Equal(t, peerStore.cache.cache, expEnts)
 	for _, e := range expEnts {
-		key := RaftLogKey(peerStore.region.Id, e.Index)
-		e2 := new(eraftpb.Entry)
-		assert.Nil(t, getMsg(peerStore.Engines.raft, key, e2))
+		e2, err := getRaftEntry(peerStore.Engines.raft, peerStore.region.Id, e.Index)
+		assert.Nil(t, err)
 		assert.Equal(t, *e2, e)
 	}
 }
@@ -101,7 +100,7 @@ func getMetaKeyCount(t *testing.T, peerStore *PeerStorage) int {
 		return nil
 	})
 	require.Nil(t, err)
-	err = peerStore.Engines.raft.View(func(txn *badger.Txn) error {
+	err = peerStore.Engines.raft.(*badgerRaftEngine).db.View(func(txn *badger.Txn) error {
 		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
 		for it.Seek(raftStart); it.Valid(); it.Next() {
@@ -402,3 +401,82 @@ func TestPeerStorageCacheUpdate(t *testing.T) {
 	// invalid compaction should be ignored.
 	peerStore.CompactTo(capacity)
 }
+
+func TestPeerStorageAsyncFetch(t *testing.T) {
+	ents := []eraftpb.Entry{
+		newTestEntry(3, 3), newTestEntry(4, 4), newTestEntry(5, 5), newTestEntry(6, 6)}
+	peerStore := newTestPeerStorageFromEnts(t, ents)
+	defer cleanUpTestData(peerStore)
+	peerStore.cache.cache = nil
+	sender := make(chan task, 2)
+	maxBytes := uint64(ents[1].Size() + ents[2].Size())
+	peerStore.logFetcher = newRaftLogFetcher(sender, maxBytes)
+
+	// The entries are temporarily unavailable until they are fetched.
+	fetched, err := peerStore.Entries(4, 7, math.MaxUint64)
+	require.Nil(t, err)
+	assert.Len(t, fetched, 0)
+	require.Len(t, sender, 1)
+	fetched, err = peerStore.Entries(4, 7, math.MaxUint64)
+	require.Nil(t, err)
+	assert.Len(t, fetched, 0)
+	require.Len(t, sender, 1)
+
+	// The fetch bytes are bounded.
+	fetched, err = peerStore.Entries(5, 7, math.MaxUint64)
+	require.Nil(t, err)
+	assert.Len(t, fetched, 0)
+	require.Len(t, sender, 1)
+
+	// Term is always read synchronously.
+	term, err := peerStore.Term(5)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(5), term)
+
+	fetchTask := (<-sender).data.(*raftLogFetchTask)
+	assert.Equal(t, maxBytes, fetchTask.reserved)
+	ents2, _, err := peerStore.Engines.raft.FetchEntries(peerStore.region.Id, fetchTask.low, fetchTask.high, fetchTask.maxSize, nil)
+	require.Nil(t, err)
+	require.True(t, peerStore.onLogFetched(&raftLogFetchResult{task: fetchTask, ents: ents2}))
+	fetched, err = peerStore.Entries(4, 7, uint64(ents[1].Size()))
+	require.Nil(t, err)
+	assert.Equal(t, ents[1:2], fetched)
+	assert.Equal(t, uint64(0), peerStore.logFetcher.bytes)
+	assert.Len(t, peerStore.logFetches, 0)
+
+	// The entries not applied are read synchronously.
+	peerStore.applyState.appliedIndex = 4
+	fetched, err = peerStore.Entries(5, 7, math.MaxUint64)
+	require.Nil(t, err)
+	assert.Equal(t, ents[2:], fetched)
+
+	// The fetches are dropped after the peer steps down.
+	_, err = peerStore.Entries(4, 7, math.MaxUint64)
+	require.Nil(t, err)
+	peerStore.clearLogFetches()
+	fetchTask = (<-sender).data.(*raftLogFetchTask)
+	assert.False(t, peerStore.onLogFetched(&raftLogFetchResult{task: fetchTask}))
+	assert.Equal(t, uint64(0), peerStore.logFetcher.bytes)
+}
+
+func TestEntryCacheMemory(t *testing.T) {
+	mem := &entryCacheMemory{limit: 1}
+	ec := &EntryCache{}
+	ents := []eraftpb.Entry{newTestEntry(3, 3), newTestEntry(4, 4), newTestEntry(5, 5)}
+	ec.append("", ents[:1])
+	ec.setMemory(mem)
+	assert.Equal(t, int64(ents[0].Size()), mem.size)
+	ec.append("", ents[1:])
+	assert.Equal(t, int64(ents[0].Size()+ents[1].Size()+ents[2].Size()), mem.size)
+	assert.True(t, mem.exceeded())
+
+	// The conflicting entries are replaced.
+	ec.append("", []eraftpb.Entry{newTestEntry(4, 6)})
+	assert.Equal(t, int64(ents[0].Size()*2), mem.size)
+	ec.compactTo(4)
+	assert.Equal(t, int64(ents[0].Size()), mem.size)
+	assert.Equal(t, ec.size, uint64(mem.size))
+	ec.clear()
+	assert.Equal(t, int64(0), mem.size)
+	assert.False(t, mem.exceeded())
+}
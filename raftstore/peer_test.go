@@ -17,8 +17,11 @@ import (
 	"testing"
 
 	"github.com/ngaut/unistore/raftstore/raftlog"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
 	"github.com/stretchr/testify/assert"
+	"github.com/zhangjinpeng1987/raft"
 )
 
 func TestGetSyncLogFromRequest(t *testing.T) {
@@ -215,3 +218,59 @@ func TestRequestInspector(t *testing.T) {
 		assert.NotNil(t, err)
 	}
 }
+
+func TestPickSnapDelegate(t *testing.T) {
+	progress := map[uint64]raft.Progress{
+		1: {Match: 100, Next: 101, State: raft.ProgressStateReplicate, RecentActive: true},
+		2: {Match: 100, Next: 101, State: raft.ProgressStateReplicate, RecentActive: true},
+		3: {Match: 0, Next: 5, State: raft.ProgressStateProbe, RecentActive: true},
+		4: {Match: 90, Next: 91, State: raft.ProgressStateReplicate, RecentActive: true},
+	}
+	target, delegate := pickSnapDelegate(1, 50, 100, progress)
+	assert.Equal(t, uint64(3), target)
+	assert.Equal(t, uint64(2), delegate)
+
+	// Followers lagging behind or inactive can't be the delegate.
+	progress[2] = raft.Progress{Match: 100, Next: 101, State: raft.ProgressStateReplicate}
+	target, delegate = pickSnapDelegate(1, 50, 100, progress)
+	assert.Equal(t, uint64(0), target)
+	assert.Equal(t, uint64(0), delegate)
+	target, delegate = pickSnapDelegate(1, 50, 90, progress)
+	assert.Equal(t, uint64(3), target)
+	assert.Equal(t, uint64(4), delegate)
+
+	// No peer needs a snapshot.
+	target, delegate = pickSnapDelegate(1, 4, 90, progress)
+	assert.Equal(t, uint64(0), target)
+	assert.Equal(t, uint64(0), delegate)
+}
+
+func TestHandleStaleMsg(t *testing.T) {
+	trans := new(recordTransport)
+	// The vote of peer 3 removed from the region is received by peer 1.
+	msg := newFilterTestMsg(1, 3, 1, eraftpb.MessageType_MsgRequestVote)
+	epoch := &metapb.RegionEpoch{ConfVer: 2, Version: 1}
+	handleStaleMsg(trans, msg, epoch, false, nil)
+	assert.Equal(t, 0, trans.count())
+
+	handleStaleMsg(trans, msg, epoch, true, nil)
+	assert.Equal(t, 1, trans.count())
+	gcMsg := trans.msgs[0]
+	assert.Equal(t, msg.ToPeer, gcMsg.FromPeer)
+	assert.Equal(t, msg.FromPeer, gcMsg.ToPeer)
+	assert.Equal(t, epoch, gcMsg.RegionEpoch)
+	assert.True(t, gcMsg.IsTombstone)
+}
+
+func TestSnapDelegateMsg(t *testing.T) {
+	m := &snapDelegateMsg{tp: snapDelegateRequest, target: &metapb.Peer{Id: 5, StoreId: 3}, minIndex: 1 << 40}
+	m2 := new(snapDelegateMsg)
+	assert.Nil(t, m2.unmarshal(m.marshal()))
+	assert.Equal(t, m, m2)
+
+	data := m.marshal()
+	assert.NotNil(t, m2.unmarshal(data[:len(data)-1]))
+	assert.NotNil(t, m2.unmarshal(nil))
+	data[0] = byte(snapDelegateFailure + 1)
+	assert.NotNil(t, m2.unmarshal(data))
+}
@@ -14,10 +14,12 @@
 package raftstore
 
 import (
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/cznic/mathutil"
 	"github.com/pingcap/tidb/store/mockstore/unistore/metrics"
 )
 
@@ -33,6 +35,8 @@ type applyBatch struct {
 	msgs      []Msg
 	peers     map[uint64]*peerState
 	proposals []*regionProposal
+	// pendingApply is the count of the raft logs to apply in msgs.
+	pendingApply int
 }
 
 func (b *applyBatch) iterCallbacks(f func(cb *Callback)) {
@@ -59,6 +63,7 @@ type raftWorker struct {
 
 	msgCnt            uint64
 	movePeerCandidate uint64
+	load              *threadLoad
 }
 
 func newRaftWorker(ctx *GlobalContext, ch chan Msg, pm *router) *raftWorker {
@@ -71,13 +76,17 @@ func newRaftWorker(ctx *GlobalContext, ch chan Msg, pm *router) *raftWorker {
 		localStats:    new(storeStats),
 	}
 	applyResCh := make(chan Msg, cap(ch))
+	applyCtx := newApplyContext("", ctx.regionTaskSender, ctx.engine, applyResCh, ctx.cfg)
+	applyCtx.cdcObserver = ctx.cdcObserver
+	applyCtx.flowController = ctx.flowController
+	applyCtx.slowScore = ctx.slowScore
 	return &raftWorker{
 		raftCh:     ch,
 		applyResCh: applyResCh,
 		raftCtx:    raftCtx,
 		pr:         pm,
 		applyCh:    make(chan *applyBatch, 1),
-		applyCtx:   newApplyContext("", ctx.regionTaskSender, ctx.engine, applyResCh, ctx.cfg),
+		applyCtx:   applyCtx,
 	}
 }
 
@@ -86,7 +95,8 @@ func newRaftWorker(ctx *GlobalContext, ch chan Msg, pm *router) *raftWorker {
 // After commands are handled, we collect apply messages by peers, make a applyBatch, send it to apply channel.
 func (rw *raftWorker) run(closeCh <-chan struct{}, wg *sync.WaitGroup) {
 	defer wg.Done()
-	timeTicker := time.NewTicker(rw.raftCtx.cfg.RaftBaseTickInterval)
+	timeTicker := rw.raftCtx.cfg.Clock.NewTicker(rw.raftCtx.cfg.RaftBaseTickInterval)
+	defer timeTicker.Stop()
 	var msgs []Msg
 	for {
 		for i := range msgs {
@@ -101,7 +111,8 @@ func (rw *raftWorker) run(closeCh <-chan struct{}, wg *sync.WaitGroup) {
 			msgs = append(msgs, msg)
 		case msg := <-rw.applyResCh:
 			msgs = append(msgs, msg)
-		case <-timeTicker.C:
+		case <-timeTicker.C():
+			rw.evictEntryCaches()
 			rw.pr.peers.Range(func(key, value interface{}) bool {
 				msgs = append(msgs, NewPeerMsg(MsgTypeTick, key.(uint64), nil))
 				return true
@@ -138,6 +149,7 @@ func (rw *raftWorker) run(closeCh <-chan struct{}, wg *sync.WaitGroup) {
 		if rw.raftCtx.hasReady {
 			rw.handleRaftReady(peerStateMap, batch)
 		}
+		rw.raftCtx.trans.Flush()
 		rw.raftCtx.flushLocalStats()
 		doneRaftTime := time.Now()
 		batch.iterCallbacks(func(cb *Callback) {
@@ -151,10 +163,58 @@ func (rw *raftWorker) run(closeCh <-chan struct{}, wg *sync.WaitGroup) {
 		}
 		applyMsgs.msgs = applyMsgs.msgs[:0]
 		rw.removeQueuedSnapshots()
+		batch.pendingApply = countApplyEntries(batch.msgs)
+		rw.raftCtx.flowController.addPendingApply(batch.pendingApply)
+		rw.load.observe(rw.raftStartTime)
 		rw.applyCh <- batch
 	}
 }
 
+// evictEntryCaches compacts the entry caches when they exceed the memory limit of the store. The
+// caches of the coldest regions are evicted first, and the entries replicated to all the peers are
+// evicted before the entries the lagging followers still need.
+func (rw *raftWorker) evictEntryCaches() {
+	mem := rw.raftCtx.entryCacheMem
+	if !mem.exceeded() {
+		return
+	}
+	var peers []*Peer
+	rw.pr.peers.Range(func(_, value interface{}) bool {
+		fsm := value.(*peerState).peer
+		if !fsm.stopped && fsm.peer.Store().cache.length() > 0 {
+			peers = append(peers, fsm.peer)
+		}
+		return true
+	})
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Store().cache.lastAppend.Before(peers[j].Store().cache.lastAppend)
+	})
+	for _, p := range peers {
+		if !mem.exceeded() {
+			return
+		}
+		store := p.Store()
+		appliedIdx := store.AppliedIndex()
+		replicatedIdx := appliedIdx
+		if p.IsLeader() {
+			replicatedIdx = mathutil.MinUint64(p.GetMinProgress(), appliedIdx)
+		}
+		size := store.cache.size
+		store.MaybeGCCache(replicatedIdx, appliedIdx)
+		store.CompactTo(replicatedIdx + 1)
+		entryCacheEvictedReplicated.Add(float64(size - store.cache.size))
+	}
+	for _, p := range peers {
+		if !mem.exceeded() {
+			return
+		}
+		store := p.Store()
+		size := store.cache.size
+		store.CompactTo(store.AppliedIndex() + 1)
+		entryCacheEvictedApplied.Add(float64(size - store.cache.size))
+	}
+}
+
 func (rw *raftWorker) getPeerState(peersMap map[uint64]*peerState, regionID uint64) *peerState {
 	peer, ok := peersMap[regionID]
 	if !ok {
@@ -169,6 +229,7 @@ func (rw *raftWorker) handleRaftReady(peers map[uint64]*peerState, batch *applyB
 		msg := Msg{Type: MsgTypeApplyProposal, Data: proposal}
 		rw.raftCtx.applyMsgs.appendMsg(proposal.RegionID, msg)
 	}
+	mustEvalFailpoint(FailpointRaftBeforeSaveKV)
 	kvWB := rw.raftCtx.kvWB
 	if len(kvWB.entries) > 0 {
 		err := kvWB.WriteToKV(rw.raftCtx.engine.kv)
@@ -177,6 +238,7 @@ func (rw *raftWorker) handleRaftReady(peers map[uint64]*peerState, batch *applyB
 		}
 		kvWB.Reset()
 	}
+	mustEvalFailpoint(FailpointRaftBetweenSave)
 	raftWB := rw.raftCtx.raftWB
 	if len(raftWB.entries) > 0 {
 		err := raftWB.WriteToRaft(rw.raftCtx.engine.raft)
@@ -185,6 +247,7 @@ func (rw *raftWorker) handleRaftReady(peers map[uint64]*peerState, batch *applyB
 		}
 		raftWB.Reset()
 	}
+	mustEvalFailpoint(FailpointRaftAfterSave)
 	readyRes := rw.raftCtx.ReadyRes
 	rw.raftCtx.ReadyRes = nil
 	if len(readyRes) > 0 {
@@ -194,6 +257,7 @@ func (rw *raftWorker) handleRaftReady(peers map[uint64]*peerState, batch *applyB
 		}
 	}
 	dur := time.Since(rw.raftStartTime)
+	rw.raftCtx.slowScore.observe(inspectRaftReady, dur)
 	if !rw.raftCtx.isBusy {
 		electionTimeout := rw.raftCtx.cfg.RaftBaseTickInterval * time.Duration(rw.raftCtx.cfg.RaftElectionTimeoutTicks)
 		if dur > electionTimeout {
@@ -219,9 +283,10 @@ func (rw *raftWorker) removeQueuedSnapshots() {
 }
 
 type applyWorker struct {
-	r   *router
-	ch  chan *applyBatch
-	ctx *applyContext
+	r    *router
+	ch   chan *applyBatch
+	ctx  *applyContext
+	load *threadLoad
 }
 
 func newApplyWorker(r *router, ch chan *applyBatch, ctx *applyContext) *applyWorker {
@@ -247,6 +312,7 @@ func (aw *applyWorker) run(wg *sync.WaitGroup) {
 		for _, peer := range batch.peers {
 			peer.apply.redoIndex = peer.apply.applyState.appliedIndex + 1
 		}
+		aw.ctx.cdcObserver.beginApply()
 		for _, msg := range batch.msgs {
 			ps := batch.peers[msg.RegionID]
 			if ps == nil {
@@ -256,6 +322,10 @@ func (aw *applyWorker) run(wg *sync.WaitGroup) {
 			ps.apply.handleTask(aw.ctx, msg)
 		}
 		aw.ctx.flush()
+		aw.ctx.cdcObserver.endApply()
+		aw.ctx.flowController.addPendingApply(-batch.pendingApply)
+		aw.load.observe(begin)
+		aw.ctx.slowScore.observe(inspectApply, time.Since(begin))
 	}
 }
 
@@ -273,14 +343,15 @@ func newStoreWorker(ctx *GlobalContext, r *router) *storeWorker {
 
 func (sw *storeWorker) run(closeCh <-chan struct{}, wg *sync.WaitGroup) {
 	defer wg.Done()
-	timeTicker := time.NewTicker(sw.store.ctx.cfg.RaftBaseTickInterval)
+	timeTicker := sw.store.ctx.cfg.Clock.NewTicker(sw.store.ctx.cfg.RaftBaseTickInterval)
+	defer timeTicker.Stop()
 	storeTicker := sw.store.ticker
 	for {
 		var msg Msg
 		select {
 		case <-closeCh:
 			return
-		case <-timeTicker.C:
+		case <-timeTicker.C():
 			storeTicker.tickClock()
 			for i := range storeTicker.schedules {
 				if storeTicker.isOnStoreTick(StoreTick(i)) {
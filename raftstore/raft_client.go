@@ -19,6 +19,7 @@ import (
 	"time"
 
 	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/raft_serverpb"
 	"github.com/pingcap/kvproto/pkg/tikvpb"
@@ -29,8 +30,17 @@ import (
 	"google.golang.org/grpc/keepalive"
 )
 
+// unreachableReporter reports the raft messages that can't be sent, so raft stops sending appends to
+// the peers until they are reachable again.
+type unreachableReporter interface {
+	ReportUnreachable(msg *raft_serverpb.RaftMessage)
+}
+
 type raftConn struct {
-	msgCh           chan *raft_serverpb.RaftMessage
+	msgCh chan *raft_serverpb.RaftMessage
+	// priorityCh is the lane of the vote and the snapshot status messages, they are sent before the
+	// queued appends.
+	priorityCh      chan *raft_serverpb.RaftMessage
 	ctx             context.Context
 	cancel          context.CancelFunc
 	nextRetryTime   time.Time
@@ -38,6 +48,12 @@ type raftConn struct {
 	addr            string
 	storeID         uint64
 	cfg             *Config
+	reporter        unreachableReporter
+
+	// overflowed are the messages dropped by the full queues keyed by the peer, they are reported
+	// by the sender as the queues are only full if the sender is busy.
+	overflowMu sync.Mutex
+	overflowed map[uint64]*raft_serverpb.RaftMessage
 
 	pdCli        pd.Client
 	batch        *tikvpb.BatchRaftMessage
@@ -45,26 +61,55 @@ type raftConn struct {
 	streamCancel context.CancelFunc
 }
 
-func newRaftConn(storeID uint64, cfg *Config, pdCli pd.Client) *raftConn {
+func newRaftConn(storeID uint64, cfg *Config, pdCli pd.Client, reporter unreachableReporter) *raftConn {
 	ctx, cancel := context.WithCancel(context.Background())
 	rc := &raftConn{
-		msgCh:   make(chan *raft_serverpb.RaftMessage, 256),
-		ctx:     ctx,
-		cancel:  cancel,
-		storeID: storeID,
-		cfg:     cfg,
-		pdCli:   pdCli,
-		batch:   new(tikvpb.BatchRaftMessage),
+		msgCh:      make(chan *raft_serverpb.RaftMessage, raftConnQueueSize),
+		priorityCh: make(chan *raft_serverpb.RaftMessage, raftConnPriorityQueueSize),
+		ctx:        ctx,
+		cancel:     cancel,
+		storeID:    storeID,
+		cfg:        cfg,
+		reporter:   reporter,
+		pdCli:      pdCli,
+		batch:      new(tikvpb.BatchRaftMessage),
 	}
 	go rc.runSender()
 	return rc
 }
 
-const maxBatchSize = 128
+const (
+	maxBatchSize = 128
+	// maxBatchBytes bounds the size of a batch below the message size limit of gRPC.
+	maxBatchBytes = 1024 * 1024
+
+	raftConnQueueSize         = 4096
+	raftConnPriorityQueueSize = 256
+)
+
+func isPriorityRaftMsg(msg *raft_serverpb.RaftMessage) bool {
+	switch msg.GetMessage().GetMsgType() {
+	case eraftpb.MessageType_MsgRequestVote, eraftpb.MessageType_MsgRequestVoteResponse,
+		eraftpb.MessageType_MsgRequestPreVote, eraftpb.MessageType_MsgRequestPreVoteResponse,
+		eraftpb.MessageType_MsgTimeoutNow, eraftpb.MessageType_MsgSnapStatus:
+		return true
+	}
+	return false
+}
 
 func (c *raftConn) runSender() {
 	for {
+		c.reportOverflowed()
+		// Check the priority lane first, select picks a ready case randomly.
 		select {
+		case msg := <-c.priorityCh:
+			c.senderHandleMsg(msg)
+			continue
+		default:
+		}
+		select {
+		case msg := <-c.priorityCh:
+			c.senderHandleMsg(msg)
 		case msg := <-c.msgCh:
 			c.senderHandleMsg(msg)
 		case <-c.ctx.Done():
@@ -74,24 +119,41 @@ func (c *raftConn) runSender() {
 	}
 }
 
-func (c *raftConn) senderHandleMsg(msg *raft_serverpb.RaftMessage) {
+// fetchBatch fills the batch with msg and the queued messages, the priority ones go first. The batch
+// is bounded by maxBatchSize and maxBatchBytes, but it has at least one message.
+func (c *raftConn) fetchBatch(msg *raft_serverpb.RaftMessage) {
 	c.resetBatchRaftMsg()
 	batch := c.batch
 	batch.Msgs = append(batch.Msgs, msg)
-	chLen := len(c.msgCh)
-	for i := 0; i < chLen && len(batch.Msgs) < maxBatchSize; i++ {
-		batch.Msgs = append(batch.Msgs, <-c.msgCh)
+	size := msg.Size()
+	for _, ch := range []chan *raft_serverpb.RaftMessage{c.priorityCh, c.msgCh} {
+		for len(batch.Msgs) < maxBatchSize && size < maxBatchBytes {
+			select {
+			case m := <-ch:
+				batch.Msgs = append(batch.Msgs, m)
+				size += m.Size()
+				continue
+			default:
+			}
+			break
+		}
 	}
+}
+
+func (c *raftConn) senderHandleMsg(msg *raft_serverpb.RaftMessage) {
+	c.fetchBatch(msg)
+	batch := c.batch
 	var err error
 	if c.stream == nil {
 		if time.Now().Before(c.nextRetryTime) {
-			// drop the messages directly.
+			c.reportBatchUnreachable()
 			return
 		}
 		err = c.newStream()
 		if err != nil {
 			c.nextRetryTime = time.Now().Add(time.Second)
 			log.Warn("failed to create raft stream", zap.Error(err))
+			c.reportBatchUnreachable()
 			return
 		}
 		log.Info("new raft stream")
@@ -101,6 +163,37 @@ func (c *raftConn) senderHandleMsg(msg *raft_serverpb.RaftMessage) {
 		c.streamCancel()
 		c.stream = nil
 		log.Warn("failed to send batch raft message", zap.Error(err))
+		c.reportBatchUnreachable()
+	}
+}
+
+// reportBatchUnreachable reports the peers of the batch unreachable, once for every peer.
+func (c *raftConn) reportBatchUnreachable() {
+	raftMsgDroppedUnreachable.Add(float64(len(c.batch.Msgs)))
+	if c.reporter == nil {
+		return
+	}
+	reported := make(map[uint64]struct{}, len(c.batch.Msgs))
+	for _, msg := range c.batch.Msgs {
+		peerID := msg.GetToPeer().GetId()
+		if _, ok := reported[peerID]; ok {
+			continue
+		}
+		reported[peerID] = struct{}{}
+		c.reporter.ReportUnreachable(msg)
+	}
+}
+
+func (c *raftConn) reportOverflowed() {
+	c.overflowMu.Lock()
+	overflowed := c.overflowed
+	c.overflowed = nil
+	c.overflowMu.Unlock()
+	if c.reporter == nil {
+		return
+	}
+	for _, msg := range overflowed {
+		c.reporter.ReportUnreachable(msg)
 	}
 }
 
@@ -155,13 +248,28 @@ func (c *raftConn) Stop() {
 	c.cancel()
 }
 
+// Send queues the message without blocking, the message is dropped and reported unreachable if the
+// queue is full.
 func (c *raftConn) Send(msg *raft_serverpb.RaftMessage) error {
+	ch := c.msgCh
+	if isPriorityRaftMsg(msg) {
+		ch = c.priorityCh
+	}
 	select {
-	case c.msgCh <- msg:
+	case ch <- msg:
 		return nil
 	case <-c.ctx.Done():
 		return c.ctx.Err()
+	default:
 	}
+	raftMsgDroppedFull.Inc()
+	c.overflowMu.Lock()
+	if c.overflowed == nil {
+		c.overflowed = make(map[uint64]*raft_serverpb.RaftMessage)
+	}
+	c.overflowed[msg.GetToPeer().GetId()] = msg
+	c.overflowMu.Unlock()
+	return nil
 }
 
 type connKey struct {
@@ -173,15 +281,19 @@ type connKey struct {
 type RaftClient struct {
 	config *Config
 	sync.RWMutex
-	conns map[connKey]*raftConn
-	pdCli pd.Client
+	conns    map[connKey]*raftConn
+	pdCli    pd.Client
+	reporter unreachableReporter
+	// heartbeats buffers the heartbeats until Flush if CoalesceHeartbeats is enabled.
+	heartbeats *heartbeatCoalescer
 }
 
 func newRaftClient(config *Config, pdCli pd.Client) *RaftClient {
 	return &RaftClient{
-		config: config,
-		conns:  make(map[connKey]*raftConn),
-		pdCli:  pdCli,
+		config:     config,
+		conns:      make(map[connKey]*raftConn),
+		pdCli:      pdCli,
+		heartbeats: newHeartbeatCoalescer(),
 	}
 }
 
@@ -193,13 +305,20 @@ func (c *RaftClient) getConn(storeID, regionID uint64) *raftConn {
 	if ok {
 		return conn
 	}
-	conn = newRaftConn(storeID, c.config, c.pdCli)
+	conn = newRaftConn(storeID, c.config, c.pdCli, c.reporter)
 	c.conns[key] = conn
 	return conn
 }
 
 // Send sends the raft message.
 func (c *RaftClient) Send(msg *raft_serverpb.RaftMessage) {
+	if c.config.CoalesceHeartbeats && c.heartbeats.add(msg) {
+		return
+	}
+	c.send(msg)
+}
+
+func (c *RaftClient) send(msg *raft_serverpb.RaftMessage) {
 	storeID := msg.GetToPeer().GetStoreId()
 	conn := c.getConn(storeID, msg.GetRegionId())
 	if err := conn.Send(msg); err != nil {
@@ -207,9 +326,9 @@ func (c *RaftClient) Send(msg *raft_serverpb.RaftMessage) {
 	}
 }
 
-// Flush flushes the RaftClient.
+// Flush sends the buffered heartbeats, one coalesced heartbeat for every store.
 func (c *RaftClient) Flush() {
-	// Not support BufferHint
+	c.heartbeats.flush(c.send)
 }
 
 // Stop stops the RaftClient.
@@ -0,0 +1,120 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/kvproto/pkg/tikvpb"
+	"github.com/stretchr/testify/require"
+)
+
+type testUnreachableReporter struct {
+	mu    sync.Mutex
+	peers []uint64
+}
+
+func (r *testUnreachableReporter) ReportUnreachable(msg *raft_serverpb.RaftMessage) {
+	r.mu.Lock()
+	r.peers = append(r.peers, msg.GetToPeer().GetId())
+	r.mu.Unlock()
+}
+
+func (r *testUnreachableReporter) reported() []uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]uint64{}, r.peers...)
+}
+
+func newTestRaftMsg(toPeerID uint64, tp eraftpb.MessageType, dataSize int) *raft_serverpb.RaftMessage {
+	msg := &raft_serverpb.RaftMessage{
+		RegionId: 1,
+		ToPeer:   &metapb.Peer{Id: toPeerID, StoreId: 2},
+		Message:  &eraftpb.Message{MsgType: tp},
+	}
+	if dataSize > 0 {
+		msg.Message.Entries = []*eraftpb.Entry{{Data: make([]byte, dataSize)}}
+	}
+	return msg
+}
+
+func newTestRaftConn(reporter unreachableReporter) *raftConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &raftConn{
+		msgCh:      make(chan *raft_serverpb.RaftMessage, raftConnQueueSize),
+		priorityCh: make(chan *raft_serverpb.RaftMessage, raftConnPriorityQueueSize),
+		ctx:        ctx,
+		cancel:     cancel,
+		reporter:   reporter,
+		batch:      new(tikvpb.BatchRaftMessage),
+	}
+}
+
+func TestRaftConnBatch(t *testing.T) {
+	c := newTestRaftConn(nil)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, c.Send(newTestRaftMsg(2, eraftpb.MessageType_MsgAppend, maxBatchBytes/2)))
+	}
+	require.Nil(t, c.Send(newTestRaftMsg(3, eraftpb.MessageType_MsgRequestVote, 0)))
+	require.Equal(t, 3, len(c.msgCh))
+	require.Equal(t, 1, len(c.priorityCh))
+
+	// The vote goes before the appends, and the batch is bounded by bytes.
+	c.fetchBatch(<-c.msgCh)
+	require.Len(t, c.batch.Msgs, 3)
+	require.Equal(t, eraftpb.MessageType_MsgAppend, c.batch.Msgs[0].Message.MsgType)
+	require.Equal(t, eraftpb.MessageType_MsgRequestVote, c.batch.Msgs[1].Message.MsgType)
+	require.Equal(t, 1, len(c.msgCh))
+
+	// The batch is bounded by count.
+	for i := 0; i < maxBatchSize*2; i++ {
+		require.Nil(t, c.Send(newTestRaftMsg(2, eraftpb.MessageType_MsgHeartbeat, 0)))
+	}
+	c.fetchBatch(<-c.msgCh)
+	require.Len(t, c.batch.Msgs, maxBatchSize)
+}
+
+func TestRaftConnUnreachable(t *testing.T) {
+	reporter := new(testUnreachableReporter)
+	c := newTestRaftConn(reporter)
+	for i := 0; i < raftConnQueueSize; i++ {
+		require.Nil(t, c.Send(newTestRaftMsg(2, eraftpb.MessageType_MsgAppend, 0)))
+	}
+	// The overflowed messages are reported once for every peer.
+	require.Nil(t, c.Send(newTestRaftMsg(2, eraftpb.MessageType_MsgAppend, 0)))
+	require.Nil(t, c.Send(newTestRaftMsg(2, eraftpb.MessageType_MsgAppend, 0)))
+	c.reportOverflowed()
+	require.Equal(t, []uint64{2}, reporter.reported())
+
+	// The messages are reported if the store can't be resolved.
+	reporter = new(testUnreachableReporter)
+	c = newRaftConn(2, NewDefaultConfig(), newMockPD(1).newClient(), reporter)
+	defer c.Stop()
+	require.Nil(t, c.Send(newTestRaftMsg(2, eraftpb.MessageType_MsgAppend, 0)))
+	require.Nil(t, c.Send(newTestRaftMsg(3, eraftpb.MessageType_MsgAppend, 0)))
+	require.Eventually(t, func() bool {
+		return len(reporter.reported()) == 2
+	}, time.Second, 10*time.Millisecond)
+	// The messages are reported before the retry.
+	require.Nil(t, c.Send(newTestRaftMsg(2, eraftpb.MessageType_MsgHeartbeat, 0)))
+	require.Eventually(t, func() bool {
+		return len(reporter.reported()) == 3
+	}, time.Second, 10*time.Millisecond)
+}
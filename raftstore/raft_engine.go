@@ -0,0 +1,255 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/store/mockstore/unistore/metrics"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/dbreader"
+	"github.com/zhangjinpeng1987/raft"
+	"go.uber.org/zap"
+)
+
+// RaftEngine stores the raft logs and the raft states of the regions. The raft write batches only
+// contain the RaftLogKey and the RaftStateKey keys, an empty value deletes the key.
+type RaftEngine interface {
+	// Write writes the raft write batch atomically.
+	Write(wb *WriteBatch) error
+	// GetState returns the raft state of the region, badger.ErrKeyNotFound is returned if there is none.
+	GetState(regionID uint64) ([]byte, error)
+	// FetchEntries appends the raft logs in [low, high) to buf until the total size exceeds maxSize,
+	// at least one entry is appended. raft.ErrUnavailable is returned if the raft logs are missing.
+	FetchEntries(regionID, low, high, maxSize uint64, buf []eraftpb.Entry) ([]eraftpb.Entry, uint64, error)
+	// FirstIndex returns the first index of the raft logs of the region, 0 if there is none.
+	FirstIndex(regionID uint64) (uint64, error)
+	// GC deletes the raft logs in [startIdx, endIdx) and returns the count of the deleted raft logs,
+	// startIdx 0 means from the first raft log.
+	GC(regionID, startIdx, endIdx uint64) (uint64, error)
+	// IsEmpty returns true if there is no raft log or raft state.
+	IsEmpty() (bool, error)
+	// Offset returns the current write offset, the high 32 bits are the file number.
+	Offset() uint64
+	// IterateEntries calls fn for the raft logs written since offset in the written order.
+	IterateEntries(offset uint64, fn func(regionID, index uint64, val []byte)) error
+	// SetRecoveryOffset tells the engine the raft logs written since offset may be iterated to
+	// recover the lock store, so they must be kept.
+	SetRecoveryOffset(offset uint64)
+	Close() error
+}
+
+type badgerRaftEngine struct {
+	db *badger.DB
+}
+
+// NewBadgerRaftEngine returns a RaftEngine stores the raft logs in the badger DB.
+func NewBadgerRaftEngine(db *badger.DB) RaftEngine {
+	return &badgerRaftEngine{db: db}
+}
+
+func (e *badgerRaftEngine) Write(wb *WriteBatch) error {
+	if len(wb.entries) > 0 {
+		start := time.Now()
+		err := e.db.Update(func(txn *badger.Txn) error {
+			for _, entry := range wb.entries {
+				if len(entry.Value) == 0 {
+					entry.SetDelete()
+				}
+				err1 := txn.SetEntry(entry)
+				if err1 != nil {
+					return err1
+				}
+			}
+			return nil
+		})
+		metrics.RaftDBUpdate.Observe(time.Since(start).Seconds())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (e *badgerRaftEngine) GetState(regionID uint64) ([]byte, error) {
+	return getValue(e.db, RaftStateKey(regionID))
+}
+
+func (e *badgerRaftEngine) FetchEntries(regionID, low, high, maxSize uint64, buf []eraftpb.Entry) ([]eraftpb.Entry, uint64, error) {
+	var totalSize uint64
+	nextIndex := low
+	exceededMaxSize := false
+	txn := e.db.NewTransaction(false)
+	defer txn.Discard()
+	if high-low <= raftLogMultiGetCnt {
+		// If election happens in inactive regions, they will just try
+		// to fetch one empty log.
+		for i := low; i < high; i++ {
+			key := RaftLogKey(regionID, i)
+			item, err := txn.Get(key)
+			if err == badger.ErrKeyNotFound {
+				return nil, 0, raft.ErrUnavailable
+			} else if err != nil {
+				return nil, 0, err
+			}
+			val, err := item.Value()
+			if err != nil {
+				return nil, 0, err
+			}
+			var entry eraftpb.Entry
+			err = entry.Unmarshal(val)
+			if err != nil {
+				return nil, 0, err
+			}
+			y.Assert(entry.Index == i)
+			totalSize += uint64(len(val))
+
+			if len(buf) == 0 || totalSize <= maxSize {
+				buf = append(buf, entry)
+			}
+			if totalSize > maxSize {
+				break
+			}
+		}
+		return buf, totalSize, nil
+	}
+	startKey := RaftLogKey(regionID, low)
+	endKey := RaftLogKey(regionID, high)
+	iter := dbreader.NewIterator(txn, false, startKey, endKey)
+	defer iter.Close()
+	for iter.Seek(startKey); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		if bytes.Compare(item.Key(), endKey) >= 0 {
+			break
+		}
+		val, err := item.Value()
+		if err != nil {
+			return nil, 0, err
+		}
+		var entry eraftpb.Entry
+		err = entry.Unmarshal(val)
+		if err != nil {
+			return nil, 0, err
+		}
+		// May meet gap or has been compacted.
+		if entry.Index != nextIndex {
+			break
+		}
+		nextIndex++
+		totalSize += uint64(len(val))
+		exceededMaxSize = totalSize > maxSize
+		if !exceededMaxSize || len(buf) == 0 {
+			buf = append(buf, entry)
+		}
+		if exceededMaxSize {
+			break
+		}
+	}
+	// If we get the correct number of entries, returns,
+	// or the total size almost exceeds max_size, returns.
+	if len(buf) == int(high-low) || exceededMaxSize {
+		return buf, totalSize, nil
+	}
+	// Here means we don't fetch enough entries.
+	return nil, 0, raft.ErrUnavailable
+}
+
+func (e *badgerRaftEngine) FirstIndex(regionID uint64) (uint64, error) {
+	return e.seekFirstIndex(regionID, 0)
+}
+
+// seekFirstIndex returns the first index of the raft logs of the region, def if there is none.
+func (e *badgerRaftEngine) seekFirstIndex(regionID, def uint64) (uint64, error) {
+	firstIdx := def
+	err := e.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		it.Seek(RaftLogKey(regionID, 0))
+		if it.Valid() && bytes.Compare(it.Item().Key(), RaftLogKey(regionID, math.MaxUint64)) <= 0 {
+			var err error
+			firstIdx, err = RaftLogIndex(it.Item().Key())
+			return err
+		}
+		return nil
+	})
+	return firstIdx, err
+}
+
+func (e *badgerRaftEngine) GC(regionID, startIdx, endIdx uint64) (uint64, error) {
+	// Find the raft log idx range needed to be gc.
+	firstIdx := startIdx
+	if firstIdx == 0 {
+		var err error
+		if firstIdx, err = e.seekFirstIndex(regionID, endIdx); err != nil {
+			return 0, err
+		}
+	}
+
+	if firstIdx >= endIdx {
+		log.Info("no need to gc", zap.Uint64("region id", regionID))
+		return 0, nil
+	}
+
+	raftWb := WriteBatch{}
+	for idx := firstIdx; idx < endIdx; idx++ {
+		key := y.KeyWithTs(RaftLogKey(regionID, idx), RaftTS)
+		raftWb.Delete(key)
+		if raftWb.size >= MaxDeleteBatchSize {
+			// Avoid large write batch to reduce latency.
+			if err := e.Write(&raftWb); err != nil {
+				return 0, err
+			}
+			raftWb.Reset()
+		}
+	}
+	// todo, disable WAL here.
+	if raftWb.Len() != 0 {
+		if err := e.Write(&raftWb); err != nil {
+			return 0, err
+		}
+	}
+	return endIdx - firstIdx, nil
+}
+
+func (e *badgerRaftEngine) IsEmpty() (bool, error) {
+	return isRangeEmpty(e.db, MinKey, MaxDataKey)
+}
+
+func (e *badgerRaftEngine) Offset() uint64 {
+	return e.db.GetVLogOffset()
+}
+
+func (e *badgerRaftEngine) IterateEntries(offset uint64, fn func(regionID, index uint64, val []byte)) error {
+	return e.db.IterateVLog(offset, func(entry badger.Entry) {
+		key := entry.Key.UserKey
+		if !isRaftLogKey(key) || len(entry.Value) == 0 {
+			return
+		}
+		fn(binary.BigEndian.Uint64(key[2:]), binary.BigEndian.Uint64(key[11:]), entry.Value)
+	})
+}
+
+// SetRecoveryOffset does nothing, the value log files of badger are kept by ValueLogMaxNumFiles.
+func (e *badgerRaftEngine) SetRecoveryOffset(offset uint64) {}
+
+func (e *badgerRaftEngine) Close() error {
+	return e.db.Close()
+}
@@ -0,0 +1,730 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/badger"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/store/mockstore/unistore/metrics"
+	"github.com/zhangjinpeng1987/raft"
+	"go.uber.org/zap"
+)
+
+const (
+	logFileSuffix = ".rlog"
+	// logRecordHeaderSize is the size of the crc32 and the length of the payload of a record.
+	logRecordHeaderSize = 8
+	// logRewriteFileCount is the count of the log files to rewrite the live raft logs in the oldest
+	// file, so the oldest file can be purged when some regions are idle.
+	logRewriteFileCount = 8
+)
+
+// The ops of a record, every op starts with the op and the region id.
+const (
+	// logOpEntry is followed by the index, the length and the raft log.
+	logOpEntry byte = iota + 1
+	// logOpDeleteEntry is followed by the index, the raft logs from the index are deleted.
+	logOpDeleteEntry
+	// logOpState is followed by the length and the raft state.
+	logOpState
+	logOpDeleteState
+	// logOpCompact is followed by the index, the raft logs before the index are deleted.
+	logOpCompact
+	// logOpRewriteEntry is a logOpEntry moved out of an old file, it's not a new raft log.
+	logOpRewriteEntry
+)
+
+var (
+	logCRCTable     = crc32.MakeTable(crc32.Castagnoli)
+	errLogCorrupted = errors.New("raft log record corrupted")
+)
+
+// LogRaftEngineOptions is the options of the log raft engine.
+type LogRaftEngineOptions struct {
+	// FileSize is the size to rotate the log file.
+	FileSize int64
+	// SyncWrites syncs the log file after every write.
+	SyncWrites bool
+}
+
+type logPos struct {
+	file   uint32
+	offset uint32
+	length uint32
+}
+
+// regionLogIndex locates the raft logs [first, first+len(positions)) and keeps the raft state of a region.
+type regionLogIndex struct {
+	first     uint64
+	positions []logPos
+	state     []byte
+	stateFile uint32
+}
+
+type logFile struct {
+	id   uint32
+	fd   *os.File
+	size int64
+	// live is the count of the raft logs and the raft states in the index located in the file.
+	live int
+}
+
+// logRaftEngine is a RaftEngine stores the raft logs and the raft states of all the regions in a shared
+// append-only log. A write batch is appended to the active file as a record, so the peer worker
+// fsyncs once for the batched writes of all the regions. The raft logs are located by an in-memory
+// index, GC only updates the index and a file is purged when nothing in it is live.
+type logRaftEngine struct {
+	dir  string
+	opts LogRaftEngineOptions
+
+	// writeMu serializes the writes, the index and the files are only changed with it held.
+	writeMu sync.Mutex
+	buf     []byte
+	// recoveryFile is the first file the lock store may be recovered from, it's never purged.
+	recoveryFile uint32
+
+	// mu protects the index and the files for the reads, the files are not closed while being read.
+	mu      sync.RWMutex
+	regions map[uint64]*regionLogIndex
+	// files are the log files ordered by id, the last one is the active file.
+	files []*logFile
+}
+
+// OpenLogRaftEngine opens the log raft engine in dir, the index is rebuilt by replaying the log files.
+func OpenLogRaftEngine(dir string, opts LogRaftEngineOptions) (RaftEngine, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	e := &logRaftEngine{
+		dir:     dir,
+		opts:    opts,
+		regions: make(map[uint64]*regionLogIndex),
+	}
+	ids, err := listLogFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i, id := range ids {
+		if i > 0 && id != ids[i-1]+1 {
+			e.closeFiles()
+			return nil, errors.Errorf("raft log file %d is missing", ids[i-1]+1)
+		}
+		f, err := e.openFile(id, os.O_RDWR)
+		if err != nil {
+			e.closeFiles()
+			return nil, err
+		}
+		e.files = append(e.files, f)
+	}
+	if err = e.replay(); err != nil {
+		e.closeFiles()
+		return nil, err
+	}
+	if len(e.files) == 0 {
+		f, err := e.openFile(1, os.O_RDWR|os.O_CREATE|os.O_EXCL)
+		if err != nil {
+			return nil, err
+		}
+		e.files = append(e.files, f)
+	}
+	return e, nil
+}
+
+func listLogFiles(dir string) ([]uint32, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var ids []uint32
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasSuffix(name, logFileSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, logFileSuffix), 16, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (e *logRaftEngine) filePath(id uint32) string {
+	return filepath.Join(e.dir, fmt.Sprintf("%08x%s", id, logFileSuffix))
+}
+
+func (e *logRaftEngine) openFile(id uint32, flag int) (*logFile, error) {
+	fd, err := os.OpenFile(e.filePath(id), flag, 0644)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, errors.WithStack(err)
+	}
+	return &logFile{id: id, fd: fd, size: info.Size()}, nil
+}
+
+func (e *logRaftEngine) closeFiles() {
+	for _, f := range e.files {
+		f.fd.Close()
+	}
+	e.files = nil
+}
+
+// replay rebuilds the index from the log files, the torn record at the end of the active file is
+// truncated.
+func (e *logRaftEngine) replay() error {
+	for i, f := range e.files {
+		end, err := iterateLogRecords(f, 0, func(off int64, payload []byte) error {
+			return e.applyRecord(f, off, payload)
+		})
+		if err == errLogCorrupted && i == len(e.files)-1 {
+			log.Warn("truncate the torn raft log record", zap.Uint32("file", f.id), zap.Int64("offset", end))
+			if err = f.fd.Truncate(end); err != nil {
+				return errors.WithStack(err)
+			}
+			f.size = end
+			continue
+		}
+		if err != nil {
+			return errors.Annotatef(err, "replay raft log file %d", f.id)
+		}
+	}
+	return nil
+}
+
+// iterateLogRecords calls fn for the records from start, it returns the end offset of the last
+// valid record.
+func iterateLogRecords(f *logFile, start int64, fn func(off int64, payload []byte) error) (int64, error) {
+	reader := bufio.NewReaderSize(io.NewSectionReader(f.fd, start, f.size-start), 1024*1024)
+	off := start
+	var header [logRecordHeaderSize]byte
+	for off < f.size {
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return off, errLogCorrupted
+		}
+		length := int64(binary.BigEndian.Uint32(header[4:]))
+		if off+logRecordHeaderSize+length > f.size {
+			return off, errLogCorrupted
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return off, errLogCorrupted
+		}
+		if crc32.Checksum(payload, logCRCTable) != binary.BigEndian.Uint32(header[:4]) {
+			return off, errLogCorrupted
+		}
+		if err := fn(off, payload); err != nil {
+			return off, err
+		}
+		off += logRecordHeaderSize + length
+	}
+	return off, nil
+}
+
+// applyRecord applies the ops of the record at off of the file to the index.
+func (e *logRaftEngine) applyRecord(f *logFile, off int64, payload []byte) error {
+	for i := 0; i < len(payload); {
+		if i+9 > len(payload) {
+			return errLogCorrupted
+		}
+		op := payload[i]
+		regionID := binary.BigEndian.Uint64(payload[i+1:])
+		i += 9
+		switch op {
+		case logOpEntry, logOpRewriteEntry:
+			if i+12 > len(payload) {
+				return errLogCorrupted
+			}
+			index := binary.BigEndian.Uint64(payload[i:])
+			length := binary.BigEndian.Uint32(payload[i+8:])
+			i += 12
+			if i+int(length) > len(payload) {
+				return errLogCorrupted
+			}
+			pos := logPos{file: f.id, offset: uint32(off) + logRecordHeaderSize + uint32(i), length: length}
+			e.setEntry(regionID, index, pos)
+			i += int(length)
+		case logOpDeleteEntry, logOpCompact:
+			if i+8 > len(payload) {
+				return errLogCorrupted
+			}
+			index := binary.BigEndian.Uint64(payload[i:])
+			i += 8
+			if op == logOpDeleteEntry {
+				e.deleteEntries(regionID, index)
+			} else {
+				e.compactEntries(regionID, index)
+			}
+		case logOpState:
+			if i+4 > len(payload) {
+				return errLogCorrupted
+			}
+			length := int(binary.BigEndian.Uint32(payload[i:]))
+			i += 4
+			if i+length > len(payload) {
+				return errLogCorrupted
+			}
+			e.setState(regionID, payload[i:i+length], f)
+			i += length
+		case logOpDeleteState:
+			e.deleteState(regionID)
+		default:
+			return errLogCorrupted
+		}
+	}
+	return nil
+}
+
+func (e *logRaftEngine) file(id uint32) *logFile {
+	return e.files[id-e.files[0].id]
+}
+
+func (e *logRaftEngine) region(regionID uint64) *regionLogIndex {
+	r := e.regions[regionID]
+	if r == nil {
+		r = new(regionLogIndex)
+		e.regions[regionID] = r
+	}
+	return r
+}
+
+func (e *logRaftEngine) maybeRemoveRegion(regionID uint64, r *regionLogIndex) {
+	if len(r.positions) == 0 && r.state == nil {
+		delete(e.regions, regionID)
+	}
+}
+
+func (e *logRaftEngine) setEntry(regionID, index uint64, pos logPos) {
+	r := e.region(regionID)
+	n := uint64(len(r.positions))
+	switch {
+	case n > 0 && index >= r.first && index < r.first+n:
+		e.file(r.positions[index-r.first].file).live--
+		r.positions[index-r.first] = pos
+	case n > 0 && index == r.first+n:
+		r.positions = append(r.positions, pos)
+	default:
+		// The raft logs before a gap are never read after a snapshot is applied.
+		e.dropEntries(r, 0)
+		r.first = index
+		r.positions = append(r.positions, pos)
+	}
+	e.file(pos.file).live++
+}
+
+// deleteEntries deletes the raft logs from index. The raft logs are only deleted from the tail by
+// the write batches, the head is deleted by GC.
+func (e *logRaftEngine) deleteEntries(regionID, index uint64) {
+	r := e.regions[regionID]
+	if r == nil || index >= r.first+uint64(len(r.positions)) {
+		return
+	}
+	if index < r.first {
+		index = r.first
+	}
+	e.dropEntries(r, int(index-r.first))
+	e.maybeRemoveRegion(regionID, r)
+}
+
+func (e *logRaftEngine) dropEntries(r *regionLogIndex, from int) {
+	for _, pos := range r.positions[from:] {
+		e.file(pos.file).live--
+	}
+	r.positions = r.positions[:from]
+}
+
+// compactEntries deletes the raft logs before index and returns the count of the deleted raft logs.
+func (e *logRaftEngine) compactEntries(regionID, index uint64) uint64 {
+	r := e.regions[regionID]
+	if r == nil || index <= r.first {
+		return 0
+	}
+	cnt := index - r.first
+	if cnt > uint64(len(r.positions)) {
+		cnt = uint64(len(r.positions))
+	}
+	for _, pos := range r.positions[:cnt] {
+		e.file(pos.file).live--
+	}
+	r.positions = r.positions[cnt:]
+	r.first += cnt
+	e.maybeRemoveRegion(regionID, r)
+	return cnt
+}
+
+func (e *logRaftEngine) setState(regionID uint64, state []byte, f *logFile) {
+	r := e.region(regionID)
+	if r.state != nil {
+		e.file(r.stateFile).live--
+	}
+	r.state = append([]byte{}, state...)
+	r.stateFile = f.id
+	f.live++
+}
+
+func (e *logRaftEngine) deleteState(regionID uint64) {
+	r := e.regions[regionID]
+	if r == nil || r.state == nil {
+		return
+	}
+	e.file(r.stateFile).live--
+	r.state = nil
+	e.maybeRemoveRegion(regionID, r)
+}
+
+func appendLogOp(buf []byte, op byte, regionID uint64) []byte {
+	buf = append(buf, op)
+	return appendUint64(buf, regionID)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendBytes(buf []byte, v []byte) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(len(v)))
+	return append(append(buf, b[:]...), v...)
+}
+
+func isRaftStateKey(key []byte) bool {
+	return len(key) == 11 &&
+		key[0] == LocalPrefix &&
+		key[1] == RegionRaftPrefix &&
+		key[10] == RaftStateSuffix
+}
+
+func (e *logRaftEngine) Write(wb *WriteBatch) error {
+	if len(wb.entries) == 0 {
+		return nil
+	}
+	start := time.Now()
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+	buf := e.buf[:0]
+	for _, entry := range wb.entries {
+		key := entry.Key.UserKey
+		switch {
+		case isRaftLogKey(key):
+			regionID, index := binary.BigEndian.Uint64(key[2:]), binary.BigEndian.Uint64(key[11:])
+			if len(entry.Value) == 0 {
+				buf = appendUint64(appendLogOp(buf, logOpDeleteEntry, regionID), index)
+			} else {
+				buf = appendBytes(appendUint64(appendLogOp(buf, logOpEntry, regionID), index), entry.Value)
+			}
+		case isRaftStateKey(key):
+			regionID := binary.BigEndian.Uint64(key[2:])
+			if len(entry.Value) == 0 {
+				buf = appendLogOp(buf, logOpDeleteState, regionID)
+			} else {
+				buf = appendBytes(appendLogOp(buf, logOpState, regionID), entry.Value)
+			}
+		default:
+			return errors.Errorf("unexpected raft engine key %v", key)
+		}
+	}
+	e.buf = buf
+	err := e.appendRecord(buf)
+	if err == nil && e.activeFile().size >= e.opts.FileSize {
+		err = e.rotate()
+	}
+	metrics.RaftDBUpdate.Observe(time.Since(start).Seconds())
+	return err
+}
+
+func (e *logRaftEngine) activeFile() *logFile {
+	return e.files[len(e.files)-1]
+}
+
+// appendRecord writes the payload to the active file and applies it to the index, writeMu must be held.
+func (e *logRaftEngine) appendRecord(payload []byte) error {
+	f := e.activeFile()
+	rec := make([]byte, logRecordHeaderSize, logRecordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(rec, crc32.Checksum(payload, logCRCTable))
+	binary.BigEndian.PutUint32(rec[4:], uint32(len(payload)))
+	rec = append(rec, payload...)
+	// Write at the offset, so a failed write is overwritten by the next one.
+	if _, err := f.fd.WriteAt(rec, f.size); err != nil {
+		return errors.WithStack(err)
+	}
+	if e.opts.SyncWrites {
+		if err := f.fd.Sync(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	off := f.size
+	f.size += int64(len(rec))
+	return e.applyRecord(f, off, payload)
+}
+
+// rotate creates a new active file and writes the raft states into it, so the old files are not
+// kept for the raft states of the idle regions.
+func (e *logRaftEngine) rotate() error {
+	old := e.activeFile()
+	if err := old.fd.Sync(); err != nil {
+		return errors.WithStack(err)
+	}
+	f, err := e.openFile(old.id+1, os.O_RDWR|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.files = append(e.files, f)
+	e.mu.Unlock()
+	var buf []byte
+	for regionID, r := range e.regions {
+		if r.state != nil {
+			buf = appendBytes(appendLogOp(buf, logOpState, regionID), r.state)
+		}
+	}
+	if len(buf) > 0 {
+		if err = e.appendRecord(buf); err != nil {
+			return err
+		}
+	}
+	return e.purge()
+}
+
+// purge removes the oldest files with nothing live.
+func (e *logRaftEngine) purge() error {
+	for len(e.files) > 1 {
+		f := e.files[0]
+		if f.live > 0 || f.id >= e.recoveryFile {
+			return nil
+		}
+		e.mu.Lock()
+		e.files = e.files[1:]
+		e.mu.Unlock()
+		f.fd.Close()
+		if err := os.Remove(e.filePath(f.id)); err != nil {
+			return errors.WithStack(err)
+		}
+		log.Info("purge raft log file", zap.Uint32("file", f.id))
+	}
+	return nil
+}
+
+// rewriteOldest rewrites the raft logs of the regions having raft logs in the oldest file, if there
+// are too many files, so the oldest file can be purged.
+func (e *logRaftEngine) rewriteOldest() error {
+	if len(e.files) < logRewriteFileCount {
+		return nil
+	}
+	oldest := e.files[0]
+	if oldest.live == 0 || oldest.id >= e.recoveryFile {
+		return nil
+	}
+	for regionID, r := range e.regions {
+		inOldest := false
+		for _, pos := range r.positions {
+			if pos.file == oldest.id {
+				inOldest = true
+				break
+			}
+		}
+		if !inOldest {
+			continue
+		}
+		// All the raft logs of the region are rewritten, the raft logs after the rewritten ones may
+		// be in a file purged before they are replayed.
+		var buf []byte
+		for i, pos := range r.positions {
+			val := make([]byte, pos.length)
+			if _, err := e.file(pos.file).fd.ReadAt(val, int64(pos.offset)); err != nil {
+				return errors.WithStack(err)
+			}
+			buf = appendBytes(appendUint64(appendLogOp(buf, logOpRewriteEntry, regionID), r.first+uint64(i)), val)
+		}
+		if err := e.appendRecord(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *logRaftEngine) GetState(regionID uint64) ([]byte, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	r := e.regions[regionID]
+	if r == nil || r.state == nil {
+		return nil, badger.ErrKeyNotFound
+	}
+	return r.state, nil
+}
+
+func (e *logRaftEngine) FetchEntries(regionID, low, high, maxSize uint64, buf []eraftpb.Entry) ([]eraftpb.Entry, uint64, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	r := e.regions[regionID]
+	if r == nil || low < r.first || high > r.first+uint64(len(r.positions)) {
+		return nil, 0, raft.ErrUnavailable
+	}
+	var totalSize uint64
+	for i := low; i < high; i++ {
+		pos := r.positions[i-r.first]
+		val := make([]byte, pos.length)
+		if _, err := e.file(pos.file).fd.ReadAt(val, int64(pos.offset)); err != nil {
+			return nil, 0, errors.WithStack(err)
+		}
+		var entry eraftpb.Entry
+		if err := entry.Unmarshal(val); err != nil {
+			return nil, 0, err
+		}
+		totalSize += uint64(len(val))
+		if len(buf) == 0 || totalSize <= maxSize {
+			buf = append(buf, entry)
+		}
+		if totalSize > maxSize {
+			break
+		}
+	}
+	return buf, totalSize, nil
+}
+
+func (e *logRaftEngine) FirstIndex(regionID uint64) (uint64, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	r := e.regions[regionID]
+	if r == nil || len(r.positions) == 0 {
+		return 0, nil
+	}
+	return r.first, nil
+}
+
+// GC deletes all the raft logs before endIdx, the files are purged when nothing in them is live.
+func (e *logRaftEngine) GC(regionID, startIdx, endIdx uint64) (uint64, error) {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+	var cnt uint64
+	if r := e.regions[regionID]; r != nil && r.first < endIdx {
+		cnt = endIdx - r.first
+		if cnt > uint64(len(r.positions)) {
+			cnt = uint64(len(r.positions))
+		}
+	}
+	if cnt == 0 {
+		log.Info("no need to gc", zap.Uint64("region id", regionID))
+		return 0, nil
+	}
+	if err := e.appendRecord(appendUint64(appendLogOp(nil, logOpCompact, regionID), endIdx)); err != nil {
+		return 0, err
+	}
+	if err := e.rewriteOldest(); err != nil {
+		return 0, err
+	}
+	return cnt, e.purge()
+}
+
+func (e *logRaftEngine) IsEmpty() (bool, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return len(e.regions) == 0, nil
+}
+
+func (e *logRaftEngine) Offset() uint64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	f := e.activeFile()
+	return uint64(f.id)<<32 | uint64(f.size)
+}
+
+func (e *logRaftEngine) IterateEntries(offset uint64, fn func(regionID, index uint64, val []byte)) error {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+	fileID, start := uint32(offset>>32), int64(uint32(offset))
+	for _, f := range e.files {
+		if f.id < fileID {
+			continue
+		}
+		if f.id > fileID {
+			start = 0
+		}
+		_, err := iterateLogRecords(f, start, func(_ int64, payload []byte) error {
+			return iterateLogEntries(payload, fn)
+		})
+		if err != nil {
+			return errors.Annotatef(err, "iterate raft log file %d", f.id)
+		}
+	}
+	return nil
+}
+
+// iterateLogEntries calls fn for the raft logs written by the record, the rewritten ones are skipped.
+func iterateLogEntries(payload []byte, fn func(regionID, index uint64, val []byte)) error {
+	for i := 0; i < len(payload); {
+		if i+9 > len(payload) {
+			return errLogCorrupted
+		}
+		op := payload[i]
+		regionID := binary.BigEndian.Uint64(payload[i+1:])
+		i += 9
+		switch op {
+		case logOpEntry, logOpRewriteEntry:
+			index := binary.BigEndian.Uint64(payload[i:])
+			length := int(binary.BigEndian.Uint32(payload[i+8:]))
+			i += 12
+			if op == logOpEntry {
+				fn(regionID, index, payload[i:i+length])
+			}
+			i += length
+		case logOpDeleteEntry, logOpCompact:
+			i += 8
+		case logOpState:
+			i += 4 + int(binary.BigEndian.Uint32(payload[i:]))
+		case logOpDeleteState:
+		default:
+			return errLogCorrupted
+		}
+	}
+	return nil
+}
+
+func (e *logRaftEngine) SetRecoveryOffset(offset uint64) {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+	e.recoveryFile = uint32(offset >> 32)
+}
+
+func (e *logRaftEngine) Close() error {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+	err := e.activeFile().fd.Sync()
+	e.closeFiles()
+	return errors.WithStack(err)
+}
@@ -0,0 +1,187 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng1987/raft"
+)
+
+func writeTestRaftLogs(t *testing.T, engine RaftEngine, regionID uint64, ents ...eraftpb.Entry) {
+	wb := new(WriteBatch)
+	for i := range ents {
+		require.Nil(t, wb.SetMsg(y.KeyWithTs(RaftLogKey(regionID, ents[i].Index), RaftTS), &ents[i]))
+	}
+	require.Nil(t, engine.Write(wb))
+}
+
+func mustFetchTestRaftLogs(t *testing.T, engine RaftEngine, regionID, low, high uint64, expTerms ...uint64) {
+	ents, _, err := engine.FetchEntries(regionID, low, high, math.MaxUint64, nil)
+	require.Nil(t, err)
+	require.Len(t, ents, len(expTerms))
+	for i, e := range ents {
+		require.Equal(t, low+uint64(i), e.Index)
+		require.Equal(t, expTerms[i], e.Term)
+	}
+}
+
+func TestLogRaftEngine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft_log_engine")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	engine, err := OpenLogRaftEngine(dir, LogRaftEngineOptions{FileSize: 1024 * 1024})
+	require.Nil(t, err)
+	empty, err := engine.IsEmpty()
+	require.Nil(t, err)
+	require.True(t, empty)
+
+	for i := uint64(1); i <= 10; i++ {
+		writeTestRaftLogs(t, engine, 1, newTestEntry(i, 1))
+	}
+	wb := new(WriteBatch)
+	wb.Set(y.KeyWithTs(RaftStateKey(1), RaftTS), []byte("state"))
+	require.Nil(t, engine.Write(wb))
+	// Overwrite the conflicting raft logs from 8.
+	wb = new(WriteBatch)
+	require.Nil(t, wb.SetMsg(y.KeyWithTs(RaftLogKey(1, 8), RaftTS), &eraftpb.Entry{Index: 8, Term: 2}))
+	wb.Delete(y.KeyWithTs(RaftLogKey(1, 9), RaftTS))
+	wb.Delete(y.KeyWithTs(RaftLogKey(1, 10), RaftTS))
+	require.Nil(t, engine.Write(wb))
+
+	check := func(engine RaftEngine) {
+		mustFetchTestRaftLogs(t, engine, 1, 1, 9, 1, 1, 1, 1, 1, 1, 1, 2)
+		_, _, err := engine.FetchEntries(1, 8, 10, math.MaxUint64, nil)
+		require.Equal(t, raft.ErrUnavailable, err)
+		ents, _, err := engine.FetchEntries(1, 1, 9, 1, nil)
+		require.Nil(t, err)
+		require.Len(t, ents, 1)
+		state, err := engine.GetState(1)
+		require.Nil(t, err)
+		require.Equal(t, []byte("state"), state)
+		_, err = engine.GetState(2)
+		require.Equal(t, badger.ErrKeyNotFound, err)
+		first, err := engine.FirstIndex(1)
+		require.Nil(t, err)
+		require.Equal(t, uint64(1), first)
+	}
+	check(engine)
+	require.Nil(t, engine.Close())
+	engine, err = OpenLogRaftEngine(dir, LogRaftEngineOptions{FileSize: 1024 * 1024})
+	require.Nil(t, err)
+	check(engine)
+
+	cnt, err := engine.GC(1, 0, 5)
+	require.Nil(t, err)
+	require.Equal(t, uint64(4), cnt)
+	_, _, err = engine.FetchEntries(1, 4, 6, math.MaxUint64, nil)
+	require.Equal(t, raft.ErrUnavailable, err)
+	mustFetchTestRaftLogs(t, engine, 1, 5, 9, 1, 1, 1, 2)
+
+	// A torn record at the end is truncated.
+	offset := engine.Offset()
+	require.Nil(t, engine.Close())
+	f, err := os.OpenFile(engine.(*logRaftEngine).filePath(uint32(offset>>32)), os.O_WRONLY|os.O_APPEND, 0644)
+	require.Nil(t, err)
+	_, err = f.Write([]byte{1, 2, 3, 4, 0, 0, 1, 0, 5})
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+	engine, err = OpenLogRaftEngine(dir, LogRaftEngineOptions{FileSize: 1024 * 1024})
+	require.Nil(t, err)
+	require.Equal(t, offset, engine.Offset())
+	first, err := engine.FirstIndex(1)
+	require.Nil(t, err)
+	require.Equal(t, uint64(5), first)
+
+	// Delete the raft logs and the raft state.
+	wb = new(WriteBatch)
+	for i := uint64(5); i <= 8; i++ {
+		wb.Delete(y.KeyWithTs(RaftLogKey(1, i), RaftTS))
+	}
+	wb.Delete(y.KeyWithTs(RaftStateKey(1), RaftTS))
+	require.Nil(t, engine.Write(wb))
+	empty, err = engine.IsEmpty()
+	require.Nil(t, err)
+	require.True(t, empty)
+	require.Nil(t, engine.Close())
+}
+
+func TestLogRaftEnginePurge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft_log_engine")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	opts := LogRaftEngineOptions{FileSize: 512}
+	engine, err := OpenLogRaftEngine(dir, opts)
+	require.Nil(t, err)
+	e := engine.(*logRaftEngine)
+
+	// Region 2 is idle, its raft logs are in the oldest file.
+	writeTestRaftLogs(t, engine, 2, newTestEntry(1, 1), newTestEntry(2, 1))
+	wb := new(WriteBatch)
+	wb.Set(y.KeyWithTs(RaftStateKey(2), RaftTS), []byte("state"))
+	require.Nil(t, engine.Write(wb))
+	recoveryOffset := engine.Offset()
+	for i := uint64(1); i <= 200; i++ {
+		writeTestRaftLogs(t, engine, 1, newTestEntry(i, 1))
+	}
+	require.True(t, len(e.files) > logRewriteFileCount)
+
+	// The files after the recovery offset are kept.
+	_, err = engine.GC(1, 0, 190)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), e.files[0].id)
+
+	engine.SetRecoveryOffset(engine.Offset())
+	_, err = engine.GC(1, 0, 195)
+	require.Nil(t, err)
+	require.True(t, len(e.files) < logRewriteFileCount)
+	require.True(t, e.files[0].id > 1)
+	mustFetchTestRaftLogs(t, engine, 2, 1, 3, 1, 1)
+	mustFetchTestRaftLogs(t, engine, 1, 195, 201, 1, 1, 1, 1, 1, 1)
+
+	// The rewritten raft logs of region 2 are not iterated.
+	iterated := make(map[uint64]bool)
+	require.Nil(t, engine.IterateEntries(recoveryOffset, func(regionID, index uint64, val []byte) {
+		require.Equal(t, uint64(1), regionID)
+		require.False(t, iterated[index])
+		iterated[index] = true
+	}))
+	offset := engine.Offset()
+	writeTestRaftLogs(t, engine, 1, newTestEntry(201, 1))
+	var indices []uint64
+	require.Nil(t, engine.IterateEntries(offset, func(regionID, index uint64, val []byte) {
+		indices = append(indices, index)
+	}))
+	require.Equal(t, []uint64{201}, indices)
+
+	require.Nil(t, engine.Close())
+	engine, err = OpenLogRaftEngine(dir, opts)
+	require.Nil(t, err)
+	mustFetchTestRaftLogs(t, engine, 2, 1, 3, 1, 1)
+	mustFetchTestRaftLogs(t, engine, 1, 195, 202, 1, 1, 1, 1, 1, 1, 1)
+	state, err := engine.GetState(2)
+	require.Nil(t, err)
+	require.Equal(t, []byte("state"), state)
+	first, err := engine.FirstIndex(1)
+	require.Nil(t, err)
+	require.Equal(t, uint64(195), first)
+	require.Nil(t, engine.Close())
+}
@@ -16,8 +16,8 @@ package raftlog
 import (
 	"encoding/binary"
 	"fmt"
-	"unsafe"
 
+	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
 )
 
@@ -34,30 +34,103 @@ const (
 	TypeRolback             CustomRaftLogType = 3
 	TypePessimisticLock     CustomRaftLogType = 4
 	TypePessimisticRollback CustomRaftLogType = 5
+
+	// The types added in version 1.
+	TypeDeleteRange                    CustomRaftLogType = 6
+	TypeRawPut                         CustomRaftLogType = 7
+	TypeRawDelete                      CustomRaftLogType = 8
+	TypePessimisticLockWithForUpdateTS CustomRaftLogType = 9
+	TypeOnePC                          CustomRaftLogType = 10
+
+	// CustomRaftLogVersion is the max version of the CustomRaftLog supported by this version, a log
+	// with a newer version is rejected by DecodeCustom.
+	CustomRaftLogVersion uint16 = 1
 )
 
+// Version returns the version of the CustomRaftLog that introduced the type. A log is written with
+// the version of its type, so the peers of an older version can still apply the old types.
+func (tp CustomRaftLogType) Version() uint16 {
+	if tp >= TypeDeleteRange {
+		return 1
+	}
+	return 0
+}
+
 // CustomRaftLog is the raft log format for unistore to store Prewrite/Commit/PessimisticLock.
 //  | flag(1) | type(1) | version(2) | header(40) | entries
 //
-// It reduces the cost of marshal/unmarshal and avoid DB lookup during apply.
+// All the integers are little endian. It reduces the cost of marshal/unmarshal and avoid DB lookup
+// during apply.
 type CustomRaftLog struct {
-	header *CustomHeader
+	header CustomHeader
 	Data   []byte
 }
 
-// NewCustom returns a new CustomRaftLog.
+// customHeaderOffset is the offset of the header in the data.
+const customHeaderOffset = 4
+
+// NewCustom returns a new CustomRaftLog of the data built by CustomBuilder, the data is not validated.
 func NewCustom(data []byte) *CustomRaftLog {
-	rlog := &CustomRaftLog{}
-	rlog.header = (*CustomHeader)(unsafe.Pointer(&data[4]))
-	rlog.Data = data
+	rlog := &CustomRaftLog{Data: data}
+	rlog.header.Unmarshal(data[customHeaderOffset:])
 	return rlog
 }
 
+// DecodeCustom decodes the data of a CustomRaftLog read from the raft log. It returns an error if the
+// data is truncated or malformed, or the version is not supported.
+func DecodeCustom(data []byte) (*CustomRaftLog, error) {
+	if len(data) < customHeaderOffset+headerSize {
+		return nil, errors.Errorf("custom raft log is too short, %d bytes", len(data))
+	}
+	if data[0] != CustomRaftLogFlag {
+		return nil, errors.Errorf("invalid custom raft log flag %d", data[0])
+	}
+	if version := endian.Uint16(data[2:]); version > CustomRaftLogVersion {
+		return nil, errors.Errorf("unsupported custom raft log version %d, the max supported version is %d",
+			version, CustomRaftLogVersion)
+	}
+	rlog := NewCustom(data)
+	if tp := rlog.Type(); tp.Version() > rlog.Version() {
+		return nil, errors.Errorf("custom raft log type %d needs version %d, but the log version is %d",
+			tp, tp.Version(), rlog.Version())
+	}
+	if err := rlog.validate(); err != nil {
+		return nil, err
+	}
+	return rlog, nil
+}
+
+// validate iterates through all the entries to check that they are in range.
+func (c *CustomRaftLog) validate() error {
+	switch c.Type() {
+	case TypePrewrite, TypePessimisticLock:
+		return c.iterateLock(func(key, val []byte) {})
+	case TypeCommit:
+		return c.iterateCommit(func(key, val []byte, commitTS uint64) {})
+	case TypeRolback:
+		return c.iterateRollback(func(key []byte, startTS uint64, deleteLock bool) {})
+	case TypePessimisticRollback, TypeRawDelete:
+		return c.iteratePessimisticRollback(func(key []byte) {})
+	case TypeDeleteRange:
+		return c.iterateDeleteRange(func(startKey, endKey []byte) {})
+	case TypeRawPut:
+		return c.iterateLock(func(key, val []byte) {})
+	case TypePessimisticLockWithForUpdateTS, TypeOnePC:
+		return c.iterateCommit(func(key, val []byte, ts uint64) {})
+	}
+	return errors.Errorf("unknown custom raft log type %d", c.Type())
+}
+
 // Type returns the type of the CustomRaftLog.
 func (c *CustomRaftLog) Type() CustomRaftLogType {
 	return CustomRaftLogType(c.Data[1])
 }
 
+// Version returns the version of the CustomRaftLog.
+func (c *CustomRaftLog) Version() uint16 {
+	return endian.Uint16(c.Data[2:])
+}
+
 // RegionID implements the RaftLog RegionID method.
 func (c *CustomRaftLog) RegionID() uint64 {
 	return c.header.RegionID
@@ -102,15 +175,30 @@ type CustomHeader struct {
 	Term     uint64
 }
 
-const headerSize = int(unsafe.Sizeof(CustomHeader{}))
+const headerSize = 40
 
 // Marshal returns the encoded bytes.
 func (h *CustomHeader) Marshal() []byte {
 	data := make([]byte, headerSize)
-	*(*CustomHeader)(unsafe.Pointer(&data[0])) = *h
+	endian.PutUint64(data, h.RegionID)
+	endian.PutUint32(data[8:], h.Epoch.ver)
+	endian.PutUint32(data[12:], h.Epoch.confVer)
+	endian.PutUint64(data[16:], h.PeerID)
+	endian.PutUint64(data[24:], h.StoreID)
+	endian.PutUint64(data[32:], h.Term)
 	return data
 }
 
+// Unmarshal decodes the header from the data, the data must be at least headerSize bytes.
+func (h *CustomHeader) Unmarshal(data []byte) {
+	h.RegionID = endian.Uint64(data)
+	h.Epoch.ver = endian.Uint32(data[8:])
+	h.Epoch.confVer = endian.Uint32(data[12:])
+	h.PeerID = endian.Uint64(data[16:])
+	h.StoreID = endian.Uint64(data[24:])
+	h.Term = endian.Uint64(data[32:])
+}
+
 // Epoch stores the information about its epoch.
 type Epoch struct {
 	ver     uint32
@@ -137,66 +225,166 @@ func (e Epoch) String() string {
 	return fmt.Sprintf("{Ver:%d, ConfVer:%d}", e.ver, e.confVer)
 }
 
+// entryReader reads the entries of a CustomRaftLog, it stops at the first read out of range.
+type entryReader struct {
+	data []byte
+	err  error
+}
+
+func (c *CustomRaftLog) entries() *entryReader {
+	return &entryReader{data: c.Data[customHeaderOffset+headerSize:]}
+}
+
+func (r *entryReader) more() bool {
+	return r.err == nil && len(r.data) > 0
+}
+
+func (r *entryReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data) {
+		r.err = errors.Errorf("custom raft log entry is truncated, need %d bytes but %d left", n, len(r.data))
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *entryReader) u8() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *entryReader) u16() uint16 {
+	if b := r.next(2); b != nil {
+		return endian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *entryReader) u32() uint32 {
+	if b := r.next(4); b != nil {
+		return endian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *entryReader) u64() uint64 {
+	if b := r.next(8); b != nil {
+		return endian.Uint64(b)
+	}
+	return 0
+}
+
 // IterateLock iterates through all locks of the CustomRaftLog.
 func (c *CustomRaftLog) IterateLock(itFunc func(key, val []byte)) {
-	i := 4 + headerSize
-	for i < len(c.Data) {
-		keyLen := endian.Uint16(c.Data[i:])
-		i += 2
-		key := c.Data[i : i+int(keyLen)]
-		i += int(keyLen)
-		valLen := endian.Uint32(c.Data[i:])
-		i += 4
-		val := c.Data[i : i+int(valLen)]
-		i += int(valLen)
-		itFunc(key, val)
+	_ = c.iterateLock(itFunc)
+}
+
+func (c *CustomRaftLog) iterateLock(itFunc func(key, val []byte)) error {
+	r := c.entries()
+	for r.more() {
+		key := r.next(int(r.u16()))
+		val := r.next(int(r.u32()))
+		if r.err == nil {
+			itFunc(key, val)
+		}
 	}
+	return r.err
 }
 
 // IterateCommit iterates through all commits of the CustomRaftLog.
 func (c *CustomRaftLog) IterateCommit(itFunc func(key, val []byte, commitTS uint64)) {
-	i := 4 + headerSize
-	for i < len(c.Data) {
-		keyLen := endian.Uint16(c.Data[i:])
-		i += 2
-		key := c.Data[i : i+int(keyLen)]
-		i += int(keyLen)
-		valLen := endian.Uint32(c.Data[i:])
-		i += 4
-		val := c.Data[i : i+int(valLen)]
-		i += int(valLen)
-		commitTS := endian.Uint64(c.Data[i:])
-		i += 8
-		itFunc(key, val, commitTS)
+	_ = c.iterateCommit(itFunc)
+}
+
+func (c *CustomRaftLog) iterateCommit(itFunc func(key, val []byte, commitTS uint64)) error {
+	r := c.entries()
+	for r.more() {
+		key := r.next(int(r.u16()))
+		val := r.next(int(r.u32()))
+		commitTS := r.u64()
+		if r.err == nil {
+			itFunc(key, val, commitTS)
+		}
 	}
+	return r.err
 }
 
 // IterateRollback iterates through all rollbacks of the CustomRaftLog.
 func (c *CustomRaftLog) IterateRollback(itFunc func(key []byte, startTS uint64, deleteLock bool)) {
-	i := 4 + headerSize
-	for i < len(c.Data) {
-		keyLen := endian.Uint16(c.Data[i:])
-		i += 2
-		key := c.Data[i : i+int(keyLen)]
-		i += int(keyLen)
-		startTS := endian.Uint64(c.Data[i:])
-		i += 8
-		del := c.Data[i]
-		i++
-		itFunc(key, startTS, del > 0)
+	_ = c.iterateRollback(itFunc)
+}
+
+func (c *CustomRaftLog) iterateRollback(itFunc func(key []byte, startTS uint64, deleteLock bool)) error {
+	r := c.entries()
+	for r.more() {
+		key := r.next(int(r.u16()))
+		startTS := r.u64()
+		del := r.u8()
+		if r.err == nil {
+			itFunc(key, startTS, del > 0)
+		}
 	}
+	return r.err
 }
 
 // IteratePessimisticRollback iterates through all pessimistic rollbacks of the CustomRaftLog.
 func (c *CustomRaftLog) IteratePessimisticRollback(itFunc func(key []byte)) {
-	i := 4 + headerSize
-	for i < len(c.Data) {
-		keyLen := endian.Uint16(c.Data[i:])
-		i += 2
-		key := c.Data[i : i+int(keyLen)]
-		i += int(keyLen)
-		itFunc(key)
+	_ = c.iteratePessimisticRollback(itFunc)
+}
+
+func (c *CustomRaftLog) iteratePessimisticRollback(itFunc func(key []byte)) error {
+	r := c.entries()
+	for r.more() {
+		key := r.next(int(r.u16()))
+		if r.err == nil {
+			itFunc(key)
+		}
 	}
+	return r.err
+}
+
+// IterateDeleteRange iterates through all the ranges of a TypeDeleteRange log.
+func (c *CustomRaftLog) IterateDeleteRange(itFunc func(startKey, endKey []byte)) {
+	_ = c.iterateDeleteRange(itFunc)
+}
+
+func (c *CustomRaftLog) iterateDeleteRange(itFunc func(startKey, endKey []byte)) error {
+	r := c.entries()
+	for r.more() {
+		startKey := r.next(int(r.u16()))
+		endKey := r.next(int(r.u16()))
+		if r.err == nil {
+			itFunc(startKey, endKey)
+		}
+	}
+	return r.err
+}
+
+// IterateRawPut iterates through all the puts of a TypeRawPut log.
+func (c *CustomRaftLog) IterateRawPut(itFunc func(key, val []byte)) {
+	_ = c.iterateLock(itFunc)
+}
+
+// IterateRawDelete iterates through all the deletes of a TypeRawDelete log.
+func (c *CustomRaftLog) IterateRawDelete(itFunc func(key []byte)) {
+	_ = c.iteratePessimisticRollback(itFunc)
+}
+
+// IteratePessimisticLockWithForUpdateTS iterates through all the locks of a
+// TypePessimisticLockWithForUpdateTS log.
+func (c *CustomRaftLog) IteratePessimisticLockWithForUpdateTS(itFunc func(key, val []byte, forUpdateTS uint64)) {
+	_ = c.iterateCommit(itFunc)
+}
+
+// IterateOnePC iterates through all the prewritten and committed keys of a TypeOnePC log.
+func (c *CustomRaftLog) IterateOnePC(itFunc func(key, val []byte, commitTS uint64)) {
+	_ = c.iterateCommit(itFunc)
 }
 
 // CustomBuilder represents a custom builder.
@@ -252,9 +440,40 @@ func (b *CustomBuilder) AppendPessimisticRollback(key []byte) {
 	b.cnt++
 }
 
-// SetType sets the CustomRaftLogType of the CustomBuilder.
+// AppendDeleteRange appends a range [startKey, endKey) to delete into the CustomBuilder.
+func (b *CustomBuilder) AppendDeleteRange(startKey, endKey []byte) {
+	b.data = append(b.data, u16ToBytes(uint16(len(startKey)))...)
+	b.data = append(b.data, startKey...)
+	b.data = append(b.data, u16ToBytes(uint16(len(endKey)))...)
+	b.data = append(b.data, endKey...)
+	b.cnt++
+}
+
+// AppendRawPut appends a raw put into the CustomBuilder, the layout is the same as a lock.
+func (b *CustomBuilder) AppendRawPut(key, value []byte) {
+	b.AppendLock(key, value)
+}
+
+// AppendRawDelete appends a raw delete into the CustomBuilder.
+func (b *CustomBuilder) AppendRawDelete(key []byte) {
+	b.AppendPessimisticRollback(key)
+}
+
+// AppendPessimisticLockWithForUpdateTS appends a pessimistic lock and its for-update-ts into the
+// CustomBuilder, so the applier can tell if the lock is older than the one in the lock store.
+func (b *CustomBuilder) AppendPessimisticLockWithForUpdateTS(key, value []byte, forUpdateTS uint64) {
+	b.AppendCommit(key, value, forUpdateTS)
+}
+
+// AppendOnePC appends a key which is prewritten and committed in one log into the CustomBuilder.
+func (b *CustomBuilder) AppendOnePC(key, value []byte, commitTS uint64) {
+	b.AppendCommit(key, value, commitTS)
+}
+
+// SetType sets the CustomRaftLogType of the CustomBuilder, the version is set to the version of the type.
 func (b *CustomBuilder) SetType(tp CustomRaftLogType) {
 	b.data[1] = byte(tp)
+	endian.PutUint16(b.data[2:], tp.Version())
 }
 
 // GetType gets the CustomRaftLogType of the CustomBuilder.
@@ -0,0 +1,230 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftlog
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// customEntry is an entry of any type, the unused fields are zero.
+type customEntry struct {
+	key, val []byte
+	ts       uint64
+	del      bool
+}
+
+var customTypes = []CustomRaftLogType{TypePrewrite, TypeCommit, TypeRolback, TypePessimisticLock, TypePessimisticRollback,
+	TypeDeleteRange, TypeRawPut, TypeRawDelete, TypePessimisticLockWithForUpdateTS, TypeOnePC}
+
+func randBytes(rnd *rand.Rand, maxLen int) []byte {
+	b := make([]byte, rnd.Intn(maxLen+1))
+	rnd.Read(b)
+	return b
+}
+
+func randCustomLog(rnd *rand.Rand) (CustomHeader, CustomRaftLogType, []customEntry, []byte) {
+	header := CustomHeader{
+		RegionID: rnd.Uint64(),
+		Epoch:    NewEpoch(uint64(rnd.Uint32()), uint64(rnd.Uint32())),
+		PeerID:   rnd.Uint64(),
+		StoreID:  rnd.Uint64(),
+		Term:     rnd.Uint64(),
+	}
+	tp := customTypes[rnd.Intn(len(customTypes))]
+	b := NewBuilder(header)
+	b.SetType(tp)
+	entries := make([]customEntry, rnd.Intn(5))
+	for i := range entries {
+		e := customEntry{key: randBytes(rnd, 16)}
+		switch tp {
+		case TypePrewrite, TypePessimisticLock:
+			e.val = randBytes(rnd, 32)
+			b.AppendLock(e.key, e.val)
+		case TypeCommit:
+			e.val, e.ts = randBytes(rnd, 32), rnd.Uint64()
+			b.AppendCommit(e.key, e.val, e.ts)
+		case TypeRolback:
+			e.ts, e.del = rnd.Uint64(), rnd.Intn(2) == 1
+			b.AppendRollback(e.key, e.ts, e.del)
+		case TypePessimisticRollback:
+			b.AppendPessimisticRollback(e.key)
+		case TypeDeleteRange:
+			e.val = randBytes(rnd, 16)
+			b.AppendDeleteRange(e.key, e.val)
+		case TypeRawPut:
+			e.val = randBytes(rnd, 32)
+			b.AppendRawPut(e.key, e.val)
+		case TypeRawDelete:
+			b.AppendRawDelete(e.key)
+		case TypePessimisticLockWithForUpdateTS:
+			e.val, e.ts = randBytes(rnd, 32), rnd.Uint64()
+			b.AppendPessimisticLockWithForUpdateTS(e.key, e.val, e.ts)
+		case TypeOnePC:
+			e.val, e.ts = randBytes(rnd, 32), rnd.Uint64()
+			b.AppendOnePC(e.key, e.val, e.ts)
+		}
+		entries[i] = e
+	}
+	return header, tp, entries, b.Build().Marshal()
+}
+
+func collectEntries(c *CustomRaftLog) []customEntry {
+	var entries []customEntry
+	switch c.Type() {
+	case TypePrewrite, TypePessimisticLock:
+		c.IterateLock(func(key, val []byte) {
+			entries = append(entries, customEntry{key: key, val: val})
+		})
+	case TypeCommit:
+		c.IterateCommit(func(key, val []byte, commitTS uint64) {
+			entries = append(entries, customEntry{key: key, val: val, ts: commitTS})
+		})
+	case TypeRolback:
+		c.IterateRollback(func(key []byte, startTS uint64, deleteLock bool) {
+			entries = append(entries, customEntry{key: key, ts: startTS, del: deleteLock})
+		})
+	case TypePessimisticRollback:
+		c.IteratePessimisticRollback(func(key []byte) {
+			entries = append(entries, customEntry{key: key})
+		})
+	case TypeDeleteRange:
+		c.IterateDeleteRange(func(startKey, endKey []byte) {
+			entries = append(entries, customEntry{key: startKey, val: endKey})
+		})
+	case TypeRawPut:
+		c.IterateRawPut(func(key, val []byte) {
+			entries = append(entries, customEntry{key: key, val: val})
+		})
+	case TypeRawDelete:
+		c.IterateRawDelete(func(key []byte) {
+			entries = append(entries, customEntry{key: key})
+		})
+	case TypePessimisticLockWithForUpdateTS:
+		c.IteratePessimisticLockWithForUpdateTS(func(key, val []byte, forUpdateTS uint64) {
+			entries = append(entries, customEntry{key: key, val: val, ts: forUpdateTS})
+		})
+	case TypeOnePC:
+		c.IterateOnePC(func(key, val []byte, commitTS uint64) {
+			entries = append(entries, customEntry{key: key, val: val, ts: commitTS})
+		})
+	}
+	return entries
+}
+
+func requireEntriesEqual(t *testing.T, expected, actual []customEntry) {
+	require.Equal(t, len(expected), len(actual))
+	for i := range expected {
+		require.True(t, bytes.Equal(expected[i].key, actual[i].key))
+		require.True(t, bytes.Equal(expected[i].val, actual[i].val))
+		require.Equal(t, expected[i].ts, actual[i].ts)
+		require.Equal(t, expected[i].del, actual[i].del)
+	}
+}
+
+func TestCustomHeaderEncoding(t *testing.T) {
+	header := CustomHeader{RegionID: 1, Epoch: NewEpoch(2, 3), PeerID: 4, StoreID: 5, Term: 6}
+	data := header.Marshal()
+	// The encoding is little endian regardless of the host byte order.
+	require.Equal(t, []byte{
+		1, 0, 0, 0, 0, 0, 0, 0,
+		2, 0, 0, 0, 3, 0, 0, 0,
+		4, 0, 0, 0, 0, 0, 0, 0,
+		5, 0, 0, 0, 0, 0, 0, 0,
+		6, 0, 0, 0, 0, 0, 0, 0,
+	}, data)
+	var decoded CustomHeader
+	decoded.Unmarshal(data)
+	require.Equal(t, header, decoded)
+}
+
+func TestDecodeCustomInvalid(t *testing.T) {
+	b := NewBuilder(CustomHeader{RegionID: 1})
+	b.SetType(TypeCommit)
+	b.AppendCommit([]byte("k"), []byte("v"), 10)
+	data := b.Build().Marshal()
+	c, err := DecodeCustom(data)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), c.RegionID())
+
+	cases := map[string][]byte{
+		"empty":     nil,
+		"no header": data[:customHeaderOffset+headerSize-1],
+		"truncated": data[:len(data)-1],
+		"flag":      append([]byte{0}, data[1:]...),
+		"version":   append(append([]byte{}, data[:2]...), append(u16ToBytes(CustomRaftLogVersion+1), data[4:]...)...),
+		"type":      append(append([]byte{}, data[:1]...), append([]byte{99}, data[2:]...)...),
+		"key len":   append(append([]byte{}, data[:customHeaderOffset+headerSize]...), 0xff, 0xff, 'k'),
+	}
+	for name, data := range cases {
+		_, err = DecodeCustom(data)
+		require.NotNil(t, err, name)
+	}
+}
+
+func TestCustomRaftLogVersion(t *testing.T) {
+	for _, tp := range customTypes {
+		b := NewBuilder(CustomHeader{RegionID: 1})
+		b.SetType(tp)
+		data := b.Build().Marshal()
+		c, err := DecodeCustom(data)
+		require.Nil(t, err)
+		require.Equal(t, tp.Version(), c.Version())
+		require.True(t, c.Version() <= CustomRaftLogVersion)
+		if tp.Version() > 0 {
+			// A log of a new type is rejected if it has an older version.
+			data[2] = 0
+			_, err = DecodeCustom(data)
+			require.NotNil(t, err)
+		}
+	}
+	require.Equal(t, uint16(0), TypePessimisticRollback.Version())
+	require.Equal(t, uint16(1), TypeOnePC.Version())
+}
+
+// TestCustomRaftLogFuzz checks the round trip of random logs, and that DecodeCustom never panics or
+// returns a log whose iteration reads out of range for the mutated data.
+func TestCustomRaftLogFuzz(t *testing.T) {
+	rnd := rand.New(rand.NewSource(0))
+	for i := 0; i < 2000; i++ {
+		header, tp, entries, data := randCustomLog(rnd)
+		c, err := DecodeCustom(data)
+		require.Nil(t, err)
+		require.Equal(t, tp, c.Type())
+		require.Equal(t, header, c.header)
+		requireEntriesEqual(t, entries, collectEntries(c))
+
+		// A truncated log is rejected unless it's cut at the boundary of the entries.
+		for j := 0; j < len(data); j++ {
+			c, err = DecodeCustom(data[:j])
+			if j < customHeaderOffset+headerSize {
+				require.NotNil(t, err, fmt.Sprintf("truncated at %d", j))
+			} else if err == nil {
+				decoded := collectEntries(c)
+				requireEntriesEqual(t, entries[:len(decoded)], decoded)
+			}
+		}
+		mutated := append([]byte{}, data...)
+		for j := rnd.Intn(4); j >= 0; j-- {
+			mutated[rnd.Intn(len(mutated))] = byte(rnd.Intn(256))
+		}
+		if c, err = DecodeCustom(mutated); err == nil {
+			collectEntries(c)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/ngaut/unistore/config"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/pberror"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+var (
+	errRawCFNotSupported  = errors.New("only the default column family is supported for raw kv")
+	errRawTTLNotSupported = errors.New("ttl is not supported for raw kv")
+	errRawEmptyValue      = errors.New("empty value is not supported for raw kv")
+)
+
+// RawKVStore serves the raw kv API in the raft mode. The raw kv data is stored in the kv engine with
+// the RawDataPrefix, so it doesn't mix with the MVCC data. The writes are proposed as raft commands,
+// and the reads are served after the leader lease is checked by the region manager.
+type RawKVStore struct {
+	db     *badger.DB
+	rm     tikv.RegionManager
+	writer *raftDBWriter
+}
+
+// NewRawKVStore returns a new RawKVStore, the bundle is the kv engine of the store.
+func NewRawKVStore(conf *config.Config, rm tikv.RegionManager, router *Router, bundle *mvcc.DBBundle) *RawKVStore {
+	return &RawKVStore{
+		db:     bundle.DB,
+		rm:     rm,
+		writer: NewDBWriter(conf, router).(*raftDBWriter),
+	}
+}
+
+// RawGet implements the tikvpb.TikvServer RawGet method.
+func (s *RawKVStore) RawGet(_ context.Context, req *kvrpcpb.RawGetRequest) (*kvrpcpb.RawGetResponse, error) {
+	resp := new(kvrpcpb.RawGetResponse)
+	if err := checkRawCF(req.Cf); err != nil {
+		resp.Error = err.Error()
+		return resp, nil
+	}
+	_, regErr := s.getRegion(req.Context, req.Key)
+	if regErr != nil {
+		resp.RegionError = regErr
+		return resp, nil
+	}
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+	val, err := getRawValue(txn, req.Key)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp, nil
+	}
+	resp.Value = val
+	resp.NotFound = val == nil
+	return resp, nil
+}
+
+// RawBatchGet implements the tikvpb.TikvServer RawBatchGet method, only the existing keys are returned.
+func (s *RawKVStore) RawBatchGet(_ context.Context, req *kvrpcpb.RawBatchGetRequest) (*kvrpcpb.RawBatchGetResponse, error) {
+	resp := new(kvrpcpb.RawBatchGetResponse)
+	if err := checkRawCF(req.Cf); err != nil {
+		resp.RegionError = &errorpb.Error{Message: err.Error()}
+		return resp, nil
+	}
+	_, regErr := s.getRegion(req.Context, req.Keys...)
+	if regErr != nil {
+		resp.RegionError = regErr
+		return resp, nil
+	}
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+	for _, key := range req.Keys {
+		val, err := getRawValue(txn, key)
+		if err != nil {
+			resp.Pairs = append(resp.Pairs, &kvrpcpb.KvPair{Key: key, Error: &kvrpcpb.KeyError{Abort: err.Error()}})
+			continue
+		}
+		if val != nil {
+			resp.Pairs = append(resp.Pairs, &kvrpcpb.KvPair{Key: key, Value: val})
+		}
+	}
+	return resp, nil
+}
+
+// RawScan implements the tikvpb.TikvServer RawScan method. The scan stops at the end of the region, a
+// reverse scan scans [EndKey, StartKey) in descending order.
+func (s *RawKVStore) RawScan(_ context.Context, req *kvrpcpb.RawScanRequest) (*kvrpcpb.RawScanResponse, error) {
+	resp := new(kvrpcpb.RawScanResponse)
+	if err := checkRawCF(req.Cf); err != nil {
+		resp.RegionError = &errorpb.Error{Message: err.Error()}
+		return resp, nil
+	}
+	region, regErr := s.getRegion(req.Context)
+	if regErr != nil {
+		resp.RegionError = regErr
+		return resp, nil
+	}
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+	kvs, err := scanRaw(txn, region, &kvrpcpb.KeyRange{StartKey: req.StartKey, EndKey: req.EndKey},
+		int(req.Limit), req.KeyOnly, req.Reverse)
+	if err != nil {
+		resp.RegionError = &errorpb.Error{Message: err.Error()}
+		return resp, nil
+	}
+	resp.Kvs = kvs
+	return resp, nil
+}
+
+// RawBatchScan implements the tikvpb.TikvServer RawBatchScan method.
+func (s *RawKVStore) RawBatchScan(_ context.Context, req *kvrpcpb.RawBatchScanRequest) (*kvrpcpb.RawBatchScanResponse, error) {
+	resp := new(kvrpcpb.RawBatchScanResponse)
+	if err := checkRawCF(req.Cf); err != nil {
+		resp.RegionError = &errorpb.Error{Message: err.Error()}
+		return resp, nil
+	}
+	region, regErr := s.getRegion(req.Context)
+	if regErr != nil {
+		resp.RegionError = regErr
+		return resp, nil
+	}
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+	for _, r := range req.Ranges {
+		kvs, err := scanRaw(txn, region, r, int(req.EachLimit), req.KeyOnly, req.Reverse)
+		if err != nil {
+			resp.RegionError = &errorpb.Error{Message: err.Error()}
+			return resp, nil
+		}
+		resp.Kvs = append(resp.Kvs, kvs...)
+	}
+	return resp, nil
+}
+
+// RawPut implements the tikvpb.TikvServer RawPut method.
+func (s *RawKVStore) RawPut(_ context.Context, req *kvrpcpb.RawPutRequest) (*kvrpcpb.RawPutResponse, error) {
+	resp := new(kvrpcpb.RawPutResponse)
+	if err := checkRawPut(req.Cf, req.Ttl, req.Value); err != nil {
+		resp.Error = err.Error()
+		return resp, nil
+	}
+	resp.RegionError = s.write(req.Context, [][]byte{req.Key}, func(wb rawWriteBatch) {
+		wb.RawPut(req.Key, req.Value)
+	})
+	return resp, nil
+}
+
+// RawBatchPut implements the tikvpb.TikvServer RawBatchPut method.
+func (s *RawKVStore) RawBatchPut(_ context.Context, req *kvrpcpb.RawBatchPutRequest) (*kvrpcpb.RawBatchPutResponse, error) {
+	resp := new(kvrpcpb.RawBatchPutResponse)
+	if len(req.Pairs) == 0 {
+		return resp, nil
+	}
+	keys := make([][]byte, 0, len(req.Pairs))
+	for _, pair := range req.Pairs {
+		if err := checkRawPut(req.Cf, req.Ttl, pair.Value); err != nil {
+			resp.Error = err.Error()
+			return resp, nil
+		}
+		keys = append(keys, pair.Key)
+	}
+	resp.RegionError = s.write(req.Context, keys, func(wb rawWriteBatch) {
+		for _, pair := range req.Pairs {
+			wb.RawPut(pair.Key, pair.Value)
+		}
+	})
+	return resp, nil
+}
+
+// RawDelete implements the tikvpb.TikvServer RawDelete method.
+func (s *RawKVStore) RawDelete(_ context.Context, req *kvrpcpb.RawDeleteRequest) (*kvrpcpb.RawDeleteResponse, error) {
+	resp := new(kvrpcpb.RawDeleteResponse)
+	if err := checkRawCF(req.Cf); err != nil {
+		resp.Error = err.Error()
+		return resp, nil
+	}
+	resp.RegionError = s.write(req.Context, [][]byte{req.Key}, func(wb rawWriteBatch) {
+		wb.RawDelete(req.Key)
+	})
+	return resp, nil
+}
+
+// RawBatchDelete implements the tikvpb.TikvServer RawBatchDelete method.
+func (s *RawKVStore) RawBatchDelete(_ context.Context, req *kvrpcpb.RawBatchDeleteRequest) (*kvrpcpb.RawBatchDeleteResponse, error) {
+	resp := new(kvrpcpb.RawBatchDeleteResponse)
+	if err := checkRawCF(req.Cf); err != nil {
+		resp.Error = err.Error()
+		return resp, nil
+	}
+	if len(req.Keys) == 0 {
+		return resp, nil
+	}
+	resp.RegionError = s.write(req.Context, req.Keys, func(wb rawWriteBatch) {
+		for _, key := range req.Keys {
+			wb.RawDelete(key)
+		}
+	})
+	return resp, nil
+}
+
+// RawDeleteRange implements the tikvpb.TikvServer RawDeleteRange method, the range must be in the region.
+func (s *RawKVStore) RawDeleteRange(_ context.Context, req *kvrpcpb.RawDeleteRangeRequest) (*kvrpcpb.RawDeleteRangeResponse, error) {
+	resp := new(kvrpcpb.RawDeleteRangeResponse)
+	if err := checkRawCF(req.Cf); err != nil {
+		resp.Error = err.Error()
+		return resp, nil
+	}
+	region, regErr := s.getRegion(req.Context, req.StartKey)
+	if regErr != nil {
+		resp.RegionError = regErr
+		return resp, nil
+	}
+	_, regionEnd := rawDataRange(RawStartKey(region), RawEndKey(region))
+	if bytes.Compare(RawDataEndKey(req.EndKey), regionEnd) > 0 {
+		resp.RegionError = ErrToPbError(&ErrKeyNotInRegion{Key: req.EndKey, Region: region})
+		return resp, nil
+	}
+	resp.RegionError = s.write(req.Context, nil, func(wb rawWriteBatch) {
+		wb.RawDeleteRange(req.StartKey, req.EndKey)
+	})
+	return resp, nil
+}
+
+// getRegion checks the leader of the region and the keys are in the region.
+func (s *RawKVStore) getRegion(ctx *kvrpcpb.Context, keys ...[]byte) (*metapb.Region, *errorpb.Error) {
+	regCtx, regErr := s.rm.GetRegionFromCtx(ctx)
+	if regErr != nil {
+		return nil, regErr
+	}
+	region := regCtx.Meta()
+	for _, key := range keys {
+		if err := CheckKeyInRegion(codec.EncodeBytes(nil, key), region); err != nil {
+			return nil, ErrToPbError(&ErrKeyNotInRegion{Key: key, Region: region})
+		}
+	}
+	return region, nil
+}
+
+// write proposes the raw kv writes to the region and waits for them to be applied.
+func (s *RawKVStore) write(ctx *kvrpcpb.Context, keys [][]byte, fn func(wb rawWriteBatch)) *errorpb.Error {
+	if _, regErr := s.getRegion(ctx, keys...); regErr != nil {
+		return regErr
+	}
+	wb := s.writer.newRawWriteBatch(ctx)
+	fn(wb)
+	if err := s.writer.Write(wb); err != nil {
+		if pbErr, ok := errors.Cause(err).(*pberror.PBError); ok {
+			return pbErr.RequestErr
+		}
+		return ErrToPbError(err)
+	}
+	return nil
+}
+
+func checkRawCF(cf string) error {
+	if cf != "" && cf != CFDefault {
+		return errRawCFNotSupported
+	}
+	return nil
+}
+
+func checkRawPut(cf string, ttl uint64, value []byte) error {
+	if err := checkRawCF(cf); err != nil {
+		return err
+	}
+	if ttl != 0 {
+		return errRawTTLNotSupported
+	}
+	// An empty value can't be told from a deleted one in a snapshot.
+	if len(value) == 0 {
+		return errRawEmptyValue
+	}
+	return nil
+}
+
+// getRawValue returns the value of the raw key, or nil if the key doesn't exist.
+func getRawValue(txn *badger.Txn, key []byte) ([]byte, error) {
+	item, err := txn.Get(RawDataKey(key))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if item.IsEmpty() {
+		return nil, nil
+	}
+	return item.ValueCopy(nil)
+}
+
+// scanRaw scans the raw kv data of the range in the region. An empty end key means no upper bound, the
+// start key is the upper bound of a reverse scan.
+func scanRaw(txn *badger.Txn, region *metapb.Region, r *kvrpcpb.KeyRange, limit int, keyOnly, reverse bool) ([]*kvrpcpb.KvPair, error) {
+	lower, upper := RawDataKey(r.StartKey), RawDataEndKey(r.EndKey)
+	if reverse {
+		lower, upper = RawDataKey(r.EndKey), RawDataEndKey(r.StartKey)
+	}
+	regionStart, regionEnd := rawDataRange(RawStartKey(region), RawEndKey(region))
+	if bytes.Compare(lower, regionStart) < 0 {
+		lower = regionStart
+	}
+	if bytes.Compare(upper, regionEnd) > 0 {
+		upper = regionEnd
+	}
+	opts := badger.DefaultIteratorOptions
+	opts.Reverse = reverse
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	seekKey := lower
+	if reverse {
+		seekKey = upper
+	}
+	var kvs []*kvrpcpb.KvPair
+	for it.Seek(seekKey); it.Valid() && len(kvs) < limit; it.Next() {
+		item := it.Item()
+		key := item.Key()
+		if bytes.Compare(key, upper) >= 0 {
+			if reverse {
+				continue
+			}
+			break
+		}
+		if bytes.Compare(key, lower) < 0 {
+			break
+		}
+		if item.IsEmpty() {
+			continue
+		}
+		pair := &kvrpcpb.KvPair{Key: item.KeyCopy(nil)[1:]}
+		if !keyOnly {
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return nil, err
+			}
+			pair.Value = val
+		}
+		kvs = append(kvs, pair)
+	}
+	return kvs, nil
+}
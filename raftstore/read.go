@@ -14,6 +14,7 @@
 package raftstore
 
 import (
+	"context"
 	"fmt"
 	stdatomic "sync/atomic"
 	"time"
@@ -40,10 +41,18 @@ type leaderChecker struct {
 	appliedIndexTerm atomic.Uint64
 	leaderLease      unsafe.Pointer // *RemoteLease
 	region           unsafe.Pointer // *metapb.Region
+	clock            Clock
+	proposalTimeout  time.Duration
 }
 
 func (c *leaderChecker) IsLeader(ctx *kvrpcpb.Context, router *Router) *errorpb.Error {
-	snapTime := time.Now()
+	return c.IsLeaderContext(context.Background(), ctx, router)
+}
+
+// IsLeaderContext checks the leadership like IsLeader, the read index command is canceled when the
+// goCtx is done.
+func (c *leaderChecker) IsLeaderContext(goCtx context.Context, ctx *kvrpcpb.Context, router *Router) *errorpb.Error {
+	snapTime := c.clock.Now()
 	isExpired, err := c.isExpired(ctx, &snapTime)
 	if err != nil {
 		return ErrToPbError(err)
@@ -71,15 +80,16 @@ func (c *leaderChecker) IsLeader(ctx *kvrpcpb.Context, router *Router) *errorpb.
 		Request:  raftlog.NewRequest(cmd),
 		Callback: cb,
 	}
+	if c.proposalTimeout > 0 {
+		msg.Deadline = msg.SendTime.Add(c.proposalTimeout)
+	}
 	err = router.router.sendRaftCommand(msg)
 	if err != nil {
 		return ErrToPbError(err)
 	}
 
-	cb.wg.Wait()
-
-	if cb.resp.Header.Error != nil {
-		return cb.resp.Header.Error
+	if resp := cb.waitContext(goCtx, c.proposalTimeout); resp.Header.Error != nil {
+		return resp.Header.Error
 	}
 	return nil
 }
@@ -149,6 +149,20 @@ func (ri *regionCtx) updateRegionEpoch(epoch *metapb.RegionEpoch) {
 	atomic.StorePointer(&ri.regionEpoch, (unsafe.Pointer)(epoch))
 }
 
+// peer returns the peer of the region on this store, nil if it's unknown.
+func (ri *regionCtx) peer() *metapb.Peer {
+	checker, ok := ri.leaderChecker.(*leaderChecker)
+	if !ok {
+		return nil
+	}
+	for _, peer := range ri.meta.Peers {
+		if peer.Id == checker.peerID {
+			return peer
+		}
+	}
+	return nil
+}
+
 func (ri *regionCtx) decodeRawStartKey() []byte {
 	if len(ri.meta.StartKey) == 0 {
 		return nil
@@ -398,7 +412,10 @@ func (rm *RaftRegionManager) runEventHandler() {
 			rm.mu.RLock()
 			region := rm.regions[x.ctx.RegionID]
 			rm.mu.RUnlock()
-			region.updateRegionEpoch(x.epoch)
+			// The region may be destroyed before the event is handled.
+			if region != nil {
+				region.updateRegionEpoch(x.epoch)
+			}
 		case *peerDestroyEvent:
 			rm.mu.Lock()
 			delete(rm.regions, x.regionID)
@@ -411,7 +428,7 @@ func (rm *RaftRegionManager) runEventHandler() {
 			rm.mu.RLock()
 			region := rm.regions[x.regionID]
 			rm.mu.RUnlock()
-			if bytes.Equal(region.rawStartKey, []byte{}) && len(region.meta.Peers) > 0 {
+			if region != nil && bytes.Equal(region.rawStartKey, []byte{}) && len(region.meta.Peers) > 0 {
 				newRole := tikv.Follower
 				if x.newState == raft.StateLeader {
 					newRole = tikv.Leader
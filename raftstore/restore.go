@@ -14,41 +14,48 @@
 package raftstore
 
 import (
+	"bytes"
 	"encoding/binary"
+	"math"
+	"sort"
 
+	"github.com/ngaut/unistore/raftstore/raftlog"
 	"github.com/pingcap/badger"
 	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
 	"github.com/pingcap/log"
 	"github.com/pingcap/tidb/store/mockstore/unistore/lockstore"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/dbreader"
 	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
 	"github.com/pingcap/tidb/util/codec"
 )
 
 // RestoreLockStore restores the lock store.
-func RestoreLockStore(offset uint64, bundle *mvcc.DBBundle, raftDB *badger.DB) error {
+func RestoreLockStore(offset uint64, bundle *mvcc.DBBundle, raftEngine RaftEngine) error {
 	appliedIndices := make(map[uint64]uint64)
-	var err error
 	txn := bundle.DB.NewTransaction(false)
 	defer txn.Discard()
+	restoredIndices, err := restoreSnapshotLocks(offset, txn, bundle.LockStore, raftEngine)
+	if err != nil {
+		return err
+	}
 	iterCnt := 0
-	err1 := raftDB.IterateVLog(offset, func(e badger.Entry) {
+	err1 := raftEngine.IterateEntries(offset, func(regionID, index uint64, val []byte) {
 		iterCnt++
 		if err != nil {
 			return
 		}
-		if !isRaftLogKey(e.Key.UserKey) {
-			return
-		}
-		applied, err := isRaftLogApplied(e.Key.UserKey, appliedIndices, txn)
-		if err != nil {
+		if restoredIndex, ok := restoredIndices[regionID]; ok && index <= restoredIndex {
 			return
 		}
-		if !applied {
+		var applied bool
+		applied, err = isRaftLogApplied(regionID, index, appliedIndices, txn)
+		if err != nil || !applied {
 			return
 		}
 		var entry eraftpb.Entry
-		err = entry.Unmarshal(e.Value)
+		err = entry.Unmarshal(val)
 		if err != nil {
 			return
 		}
@@ -66,8 +73,115 @@ func RestoreLockStore(offset uint64, bundle *mvcc.DBBundle, raftDB *badger.DB) e
 	return err1
 }
 
+// restoreSnapshotLocks restores the locks of the snapshots applied after the lock store is dumped at
+// offset, and the applied raft logs after the snapshots. It returns the index of the regions before
+// which the raft logs are restored.
+func restoreSnapshotLocks(offset uint64, txn *badger.Txn, lockStore *lockstore.MemStore,
+	raftEngine RaftEngine) (map[uint64]uint64, error) {
+	var snapLocks []*snapshotLocks
+	var regionIDs []uint64
+	startKey, endKey := []byte{LocalPrefix, RegionRaftPrefix}, RegionMetaMinKey
+	it := dbreader.NewIterator(txn, false, startKey, endKey)
+	for it.Seek(startKey); it.Valid(); it.Next() {
+		item := it.Item()
+		key := item.Key()
+		if bytes.Compare(key, endKey) >= 0 {
+			break
+		}
+		if len(key) != len(SnapshotLocksKey(0)) || key[len(key)-1] != SnapshotLocksSuffix {
+			continue
+		}
+		val, err := item.Value()
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		locks := new(snapshotLocks)
+		if err = locks.Unmarshal(val); err != nil {
+			it.Close()
+			return nil, err
+		}
+		if locks.offset >= offset {
+			snapLocks = append(snapLocks, locks)
+			regionIDs = append(regionIDs, binary.BigEndian.Uint64(key[2:]))
+		}
+	}
+	it.Close()
+	// The later snapshot of an overlapped range is restored later.
+	sort.Sort(snapshotLocksByOffset{snapLocks, regionIDs})
+	restoredIndices := make(map[uint64]uint64, len(snapLocks))
+	for i, locks := range snapLocks {
+		regionID := regionIDs[i]
+		deleteLockRange(lockStore, locks.startKey, locks.endKey)
+		for j := 0; j < len(locks.pairs); j += 2 {
+			lockStore.Put(locks.pairs[j], locks.pairs[j+1])
+		}
+		restoredIndices[regionID] = locks.index
+		appliedIdx, err := loadAppliedIdx(regionID, txn)
+		if err != nil {
+			return nil, err
+		}
+		if appliedIdx <= locks.index {
+			continue
+		}
+		entries, _, err := raftEngine.FetchEntries(regionID, locks.index+1, appliedIdx+1, math.MaxUint64, nil)
+		if err != nil {
+			// The raft logs written since offset are still restored.
+			log.S().Warnf("region %d fetch raft logs after snapshot index %d failed: %v", regionID, locks.index, err)
+			continue
+		}
+		for j := range entries {
+			if err = restoreAppliedEntry(&entries[j], txn, lockStore); err != nil {
+				return nil, err
+			}
+		}
+		restoredIndices[regionID] = appliedIdx
+	}
+	if len(snapLocks) > 0 {
+		log.S().Info("restore lock store restored the locks of", len(snapLocks), "snapshots")
+	}
+	return restoredIndices, nil
+}
+
+type snapshotLocksByOffset struct {
+	locks     []*snapshotLocks
+	regionIDs []uint64
+}
+
+func (s snapshotLocksByOffset) Len() int {
+	return len(s.locks)
+}
+
+func (s snapshotLocksByOffset) Less(i, j int) bool {
+	return s.locks[i].offset < s.locks[j].offset
+}
+
+func (s snapshotLocksByOffset) Swap(i, j int) {
+	s.locks[i], s.locks[j] = s.locks[j], s.locks[i]
+	s.regionIDs[i], s.regionIDs[j] = s.regionIDs[j], s.regionIDs[i]
+}
+
+// newSnapshotLocks returns the locks of the region in the lock store, which are applied from the
+// snapshot at index.
+func newSnapshotLocks(lockStore *lockstore.MemStore, region *metapb.Region, index uint64) *snapshotLocks {
+	locks := &snapshotLocks{index: index, startKey: RawStartKey(region), endKey: RawEndKey(region)}
+	it := lockStore.NewIterator()
+	for it.Seek(locks.startKey); it.Valid() && bytes.Compare(it.Key(), locks.endKey) < 0; it.Next() {
+		locks.pairs = append(locks.pairs, safeCopy(it.Key()), safeCopy(it.Value()))
+	}
+	return locks
+}
+
 func restoreAppliedEntry(entry *eraftpb.Entry, txn *badger.Txn, lockStore *lockstore.MemStore) error {
-	if entry.EntryType != eraftpb.EntryType_EntryNormal {
+	if entry.EntryType != eraftpb.EntryType_EntryNormal || len(entry.Data) == 0 {
+		return nil
+	}
+	if entry.Data[0] == raftlog.CustomRaftLogFlag {
+		cl, err := raftlog.DecodeCustom(entry.Data)
+		if err != nil {
+			return err
+		}
+		restoreCustomLog(cl, lockStore)
 		return nil
 	}
 	var raftCmdRequest raft_cmdpb.RaftCmdRequest
@@ -89,7 +203,10 @@ func restoreAppliedEntry(entry *eraftpb.Entry, txn *badger.Txn, lockStore *locks
 		case *commitOp:
 			restoreCommit(*x, lockStore)
 		case *rollbackOp:
+			restoreRollback(*x, lockStore)
 		case *raft_cmdpb.DeleteRangeRequest:
+			restoreDeleteRange(x, lockStore)
+		case *raft_cmdpb.PutRequest, *raft_cmdpb.DeleteRequest:
 		default:
 			log.S().Fatalf("invalid input op=%v", x)
 		}
@@ -97,6 +214,46 @@ func restoreAppliedEntry(entry *eraftpb.Entry, txn *badger.Txn, lockStore *locks
 	return nil
 }
 
+// restoreCustomLog applies the lock changes of the CustomRaftLog to the lock store like execCustomLog.
+func restoreCustomLog(cl *raftlog.CustomRaftLog, lockStore *lockstore.MemStore) {
+	switch cl.Type() {
+	case raftlog.TypePrewrite, raftlog.TypePessimisticLock:
+		cl.IterateLock(func(key, val []byte) {
+			lockStore.Put(key, val)
+		})
+	case raftlog.TypeCommit:
+		cl.IterateCommit(func(key, val []byte, commitTS uint64) {
+			lockStore.Delete(key)
+		})
+	case raftlog.TypeRolback:
+		cl.IterateRollback(func(key []byte, startTS uint64, deleteLock bool) {
+			if deleteLock {
+				lockStore.Delete(key)
+			}
+		})
+	case raftlog.TypePessimisticRollback:
+		cl.IteratePessimisticRollback(func(key []byte) {
+			lockStore.Delete(key)
+		})
+	case raftlog.TypeDeleteRange:
+		cl.IterateDeleteRange(func(startKey, endKey []byte) {
+			deleteLockRange(lockStore, startKey, endKey)
+		})
+	case raftlog.TypeRawPut, raftlog.TypeRawDelete:
+		// The raw kv data has no lock.
+	case raftlog.TypePessimisticLockWithForUpdateTS:
+		cl.IteratePessimisticLockWithForUpdateTS(func(key, val []byte, forUpdateTS uint64) {
+			if !isStalePessimisticLock(lockStore.Get(key, nil), val, forUpdateTS) {
+				lockStore.Put(key, val)
+			}
+		})
+	case raftlog.TypeOnePC:
+		cl.IterateOnePC(func(key, val []byte, commitTS uint64) {
+			lockStore.Delete(key)
+		})
+	}
+}
+
 func restorePrewrite(op prewriteOp, txn *badger.Txn, lockStore *lockstore.MemStore) {
 	key, value := convertPrewriteToLock(op, txn)
 	lockStore.Put(key, value)
@@ -110,6 +267,45 @@ func restoreCommit(op commitOp, lockStore *lockstore.MemStore) {
 	lockStore.Delete(rawKey)
 }
 
+func restoreRollback(op rollbackOp, lockStore *lockstore.MemStore) {
+	if op.delLock == nil {
+		return
+	}
+	_, rawKey, err := codec.DecodeBytes(op.delLock.Key, nil)
+	if err != nil {
+		panic(err)
+	}
+	lockStore.Delete(rawKey)
+}
+
+func restoreDeleteRange(req *raft_cmdpb.DeleteRangeRequest, lockStore *lockstore.MemStore) {
+	if req.Cf == CFDefault {
+		// The raw kv data has no lock.
+		return
+	}
+	_, startKey, err := codec.DecodeBytes(req.StartKey, nil)
+	if err != nil {
+		panic(err)
+	}
+	_, endKey, err := codec.DecodeBytes(req.EndKey, nil)
+	if err != nil {
+		panic(err)
+	}
+	deleteLockRange(lockStore, startKey, endKey)
+}
+
+// deleteLockRange deletes the locks in the range [startKey, endKey) from the lock store.
+func deleteLockRange(lockStore *lockstore.MemStore, startKey, endKey []byte) {
+	var keys [][]byte
+	it := lockStore.NewIterator()
+	for it.Seek(startKey); it.Valid() && bytes.Compare(it.Key(), endKey) < 0; it.Next() {
+		keys = append(keys, safeCopy(it.Key()))
+	}
+	for _, key := range keys {
+		lockStore.Delete(key)
+	}
+}
+
 func isRaftLogKey(key []byte) bool {
 	return len(key) == RegionRaftLogLen &&
 		key[0] == LocalPrefix &&
@@ -117,8 +313,7 @@ func isRaftLogKey(key []byte) bool {
 		key[10] == RaftLogSuffix
 }
 
-func isRaftLogApplied(key []byte, appliedIndices map[uint64]uint64, txn *badger.Txn) (bool, error) {
-	regionID := binary.BigEndian.Uint64(key[2:])
+func isRaftLogApplied(regionID, idx uint64, appliedIndices map[uint64]uint64, txn *badger.Txn) (bool, error) {
 	appliedIdx, ok := appliedIndices[regionID]
 	if !ok {
 		var err error
@@ -129,7 +324,6 @@ func isRaftLogApplied(key []byte, appliedIndices map[uint64]uint64, txn *badger.
 		log.S().Info("region", regionID, "appliedIdx", appliedIdx)
 		appliedIndices[regionID] = appliedIdx
 	}
-	idx := binary.BigEndian.Uint64(key[11:])
 	return appliedIdx >= idx, nil
 }
 
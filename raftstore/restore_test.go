@@ -16,11 +16,14 @@ package raftstore
 import (
 	"testing"
 
+	"github.com/ngaut/unistore/raftstore/raftlog"
+	"github.com/pingcap/badger/y"
 	"github.com/pingcap/kvproto/pkg/eraftpb"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	rcpb "github.com/pingcap/kvproto/pkg/raft_cmdpb"
 	"github.com/pingcap/tidb/store/mockstore/unistore/lockstore"
 	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+	"github.com/pingcap/tidb/util/codec"
 	"github.com/stretchr/testify/require"
 )
 
@@ -65,6 +68,7 @@ func TestRestore(t *testing.T) {
 	txn := engines.kv.DB.NewTransaction(true)
 	err := restoreAppliedEntry(genEntry(wb, t), txn, lockStore)
 	require.Nil(t, err)
+	require.NotNil(t, lockStore.Get(k1, nil))
 
 	// Restore commit
 	wbCommit := &raftWriteBatch{
@@ -75,16 +79,25 @@ func TestRestore(t *testing.T) {
 	txn = engines.kv.DB.NewTransaction(true)
 	err = restoreAppliedEntry(genEntry(wbCommit, t), txn, lockStore)
 	require.Nil(t, err)
+	require.Nil(t, lockStore.Get(k1, nil))
 
 	// Restore common rollback
 	wbRollback := &raftWriteBatch{
 		startTS:  3,
 		commitTS: 0,
 	}
+	expectLock.StartTS = 3
+	wbRollback.Prewrite(k1, &expectLock)
+	txn = engines.kv.DB.NewTransaction(true)
+	err = restoreAppliedEntry(genEntry(wbRollback, t), txn, lockStore)
+	require.Nil(t, err)
+	require.NotNil(t, lockStore.Get(k1, nil))
+	wbRollback.requests = nil
 	wbRollback.Rollback(k1, true)
 	txn = engines.kv.DB.NewTransaction(true)
 	err = restoreAppliedEntry(genEntry(wbRollback, t), txn, lockStore)
 	require.Nil(t, err)
+	require.Nil(t, lockStore.Get(k1, nil))
 
 	// Restore pessimistic rollback
 	wbPessimisticRollback := &raftWriteBatch{
@@ -95,4 +108,159 @@ func TestRestore(t *testing.T) {
 	txn = engines.kv.DB.NewTransaction(true)
 	err = restoreAppliedEntry(genEntry(wbPessimisticRollback, t), txn, lockStore)
 	require.Nil(t, err)
+
+	// Restore raw kv writes, the raw kv data has no lock.
+	wbPrewrite := &raftWriteBatch{startTS: 7}
+	expectLock.StartTS = 7
+	wbPrewrite.Prewrite(k1, &expectLock)
+	err = restoreAppliedEntry(genEntry(wbPrewrite, t), txn, lockStore)
+	require.Nil(t, err)
+	wbRaw := &raftWriteBatch{}
+	wbRaw.RawPut(k1, v1)
+	wbRaw.RawDelete(k1)
+	wbRaw.RawDeleteRange(k1, []byte("tl"))
+	err = restoreAppliedEntry(genEntry(wbRaw, t), txn, lockStore)
+	require.Nil(t, err)
+	require.NotNil(t, lockStore.Get(k1, nil))
+
+	// Restore transactional delete range
+	wbDeleteRange := &raftWriteBatch{}
+	wbDeleteRange.requests = append(wbDeleteRange.requests, &rcpb.Request{
+		CmdType: rcpb.CmdType_DeleteRange,
+		DeleteRange: &rcpb.DeleteRangeRequest{
+			StartKey: codec.EncodeBytes(nil, k1),
+			EndKey:   codec.EncodeBytes(nil, []byte("tl")),
+		},
+	})
+	err = restoreAppliedEntry(genEntry(wbDeleteRange, t), txn, lockStore)
+	require.Nil(t, err)
+	require.Nil(t, lockStore.Get(k1, nil))
+}
+
+func TestRestoreCustomLog(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	lockStore := lockstore.NewMemStore(1000)
+	restore := func(tp raftlog.CustomRaftLogType, fn func(b *raftlog.CustomBuilder)) {
+		b := raftlog.NewBuilder(raftlog.CustomHeader{})
+		b.SetType(tp)
+		fn(b)
+		txn := engines.kv.DB.NewTransaction(false)
+		defer txn.Discard()
+		require.Nil(t, restoreAppliedEntry(&eraftpb.Entry{Data: b.Build().Marshal()}, txn, lockStore))
+	}
+	newLock := func(startTS, forUpdateTS uint64, op kvrpcpb.Op) []byte {
+		lock := &mvcc.Lock{LockHdr: mvcc.LockHdr{StartTS: startTS, ForUpdateTS: forUpdateTS, Op: uint8(op)}}
+		return lock.MarshalBinary()
+	}
+	k1, k2, k3 := []byte("tk1"), []byte("tk2"), []byte("tk3")
+
+	restore(raftlog.TypePrewrite, func(b *raftlog.CustomBuilder) {
+		b.AppendLock(k1, newLock(1, 0, kvrpcpb.Op_Put))
+		b.AppendLock(k2, newLock(1, 0, kvrpcpb.Op_Put))
+	})
+	require.NotNil(t, lockStore.Get(k1, nil))
+	restore(raftlog.TypeCommit, func(b *raftlog.CustomBuilder) {
+		b.AppendCommit(k1, newLock(1, 0, kvrpcpb.Op_Put), 2)
+	})
+	require.Nil(t, lockStore.Get(k1, nil))
+	restore(raftlog.TypeRolback, func(b *raftlog.CustomBuilder) {
+		b.AppendRollback(k2, 1, true)
+	})
+	require.Nil(t, lockStore.Get(k2, nil))
+
+	restore(raftlog.TypePessimisticLock, func(b *raftlog.CustomBuilder) {
+		b.AppendLock(k1, newLock(3, 3, kvrpcpb.Op_PessimisticLock))
+	})
+	require.NotNil(t, lockStore.Get(k1, nil))
+	restore(raftlog.TypePessimisticRollback, func(b *raftlog.CustomBuilder) {
+		b.AppendPessimisticRollback(k1)
+	})
+	require.Nil(t, lockStore.Get(k1, nil))
+
+	// A pessimistic lock with an older for-update-ts doesn't overwrite the lock.
+	restore(raftlog.TypePessimisticLockWithForUpdateTS, func(b *raftlog.CustomBuilder) {
+		b.AppendPessimisticLockWithForUpdateTS(k1, newLock(4, 10, kvrpcpb.Op_PessimisticLock), 10)
+	})
+	restore(raftlog.TypePessimisticLockWithForUpdateTS, func(b *raftlog.CustomBuilder) {
+		b.AppendPessimisticLockWithForUpdateTS(k1, newLock(4, 5, kvrpcpb.Op_PessimisticLock), 5)
+	})
+	require.Equal(t, uint64(10), mvcc.DecodeLock(lockStore.Get(k1, nil)).ForUpdateTS)
+	// Pushing the min-commit-ts of a prewritten lock is restored.
+	restore(raftlog.TypePrewrite, func(b *raftlog.CustomBuilder) {
+		b.AppendLock(k2, newLock(4, 10, kvrpcpb.Op_Put))
+	})
+	restore(raftlog.TypePessimisticLockWithForUpdateTS, func(b *raftlog.CustomBuilder) {
+		lock := &mvcc.Lock{LockHdr: mvcc.LockHdr{StartTS: 4, ForUpdateTS: 10, MinCommitTS: 15, Op: uint8(kvrpcpb.Op_Put)}}
+		b.AppendPessimisticLockWithForUpdateTS(k2, lock.MarshalBinary(), 10)
+	})
+	require.Equal(t, uint64(15), mvcc.DecodeLock(lockStore.Get(k2, nil)).MinCommitTS)
+
+	// The 1PC commit deletes the pessimistic lock.
+	restore(raftlog.TypeOnePC, func(b *raftlog.CustomBuilder) {
+		b.AppendOnePC(k1, newLock(4, 10, kvrpcpb.Op_Put), 11)
+	})
+	require.Nil(t, lockStore.Get(k1, nil))
+
+	// The raw kv writes don't change the locks, the delete range deletes the locks in the range.
+	restore(raftlog.TypePrewrite, func(b *raftlog.CustomBuilder) {
+		b.AppendLock(k1, newLock(12, 0, kvrpcpb.Op_Put))
+		b.AppendLock(k2, newLock(12, 0, kvrpcpb.Op_Put))
+		b.AppendLock(k3, newLock(12, 0, kvrpcpb.Op_Put))
+	})
+	restore(raftlog.TypeRawPut, func(b *raftlog.CustomBuilder) {
+		b.AppendRawPut(k1, []byte("v"))
+	})
+	restore(raftlog.TypeRawDelete, func(b *raftlog.CustomBuilder) {
+		b.AppendRawDelete(k1)
+	})
+	require.NotNil(t, lockStore.Get(k1, nil))
+	restore(raftlog.TypeDeleteRange, func(b *raftlog.CustomBuilder) {
+		b.AppendDeleteRange(k1, k3)
+	})
+	require.Nil(t, lockStore.Get(k1, nil))
+	require.Nil(t, lockStore.Get(k2, nil))
+	require.NotNil(t, lockStore.Get(k3, nil))
+}
+
+func TestRestoreSnapshotLocks(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	regionID := uint64(1)
+	region := genTestRegion(regionID, 1, 1)
+	k1, k2, k3 := []byte("tk1"), []byte("tk2"), []byte("tk3")
+	lock := &mvcc.Lock{LockHdr: mvcc.LockHdr{StartTS: 1, Op: uint8(kvrpcpb.Op_Put)}}
+
+	// The snapshot at index 5 applies the locks of k1 and k2, the raft log at index 6 commits k1.
+	lockStore := engines.kv.LockStore
+	lockStore.Put(k1, lock.MarshalBinary())
+	lockStore.Put(k2, lock.MarshalBinary())
+	snapLocks := newSnapshotLocks(lockStore, region, 5)
+	b := raftlog.NewBuilder(raftlog.CustomHeader{})
+	b.SetType(raftlog.TypeCommit)
+	b.AppendCommit(k1, lock.MarshalBinary(), 2)
+	raftWB := new(WriteBatch)
+	entry := &eraftpb.Entry{Index: 6, Term: 5, Data: b.Build().Marshal()}
+	require.Nil(t, raftWB.SetMsg(y.KeyWithTs(RaftLogKey(regionID, 6), RaftTS), entry))
+	require.Nil(t, engines.raft.Write(raftWB))
+	snapLocks.offset = engines.raft.Offset()
+	kvWB := new(WriteBatch)
+	kvWB.Set(y.KeyWithTs(ApplyStateKey(regionID), KvTS), applyState{appliedIndex: 6, truncatedIndex: 5, truncatedTerm: 5}.Marshal())
+	kvWB.Set(y.KeyWithTs(SnapshotLocksKey(regionID), KvTS), snapLocks.Marshal())
+	require.Nil(t, kvWB.WriteToKV(engines.kv))
+
+	// The lock store dumped later contains the locks already.
+	lockStore.Delete(k1)
+	lockStore.Put(k3, lock.MarshalBinary())
+	require.Nil(t, RestoreLockStore(snapLocks.offset+1, engines.kv, engines.raft))
+	require.Nil(t, lockStore.Get(k1, nil))
+	require.NotNil(t, lockStore.Get(k2, nil))
+	require.NotNil(t, lockStore.Get(k3, nil))
+
+	// The lock store dumped earlier doesn't contain the locks, the locks in the region range are
+	// replaced, and the raft logs after the snapshot are restored even if they are written earlier.
+	require.Nil(t, RestoreLockStore(snapLocks.offset, engines.kv, engines.raft))
+	require.Nil(t, lockStore.Get(k1, nil))
+	require.NotNil(t, lockStore.Get(k2, nil))
+	require.Nil(t, lockStore.Get(k3, nil))
 }
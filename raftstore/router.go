@@ -81,11 +81,24 @@ func (pr *router) send(regionID uint64, msg Msg) error {
 }
 
 func (pr *router) sendRaftCommand(cmd *MsgRaftCmd) error {
+	if cmd.Callback != nil {
+		cmd.Callback.deadline = cmd.Deadline
+	}
 	regionID := cmd.Request.RegionID()
 	return pr.send(regionID, NewPeerMsg(MsgTypeRaftCmd, regionID, cmd))
 }
 
 func (pr *router) sendRaftMessage(msg *raft_serverpb.RaftMessage) error {
+	if isCoalescedHeartbeat(msg) {
+		msgs, err := splitCoalescedHeartbeat(msg)
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			pr.sendRaftMessage(m)
+		}
+		return nil
+	}
 	regionID := msg.RegionId
 	if pr.send(regionID, NewPeerMsg(MsgTypeRaftMessage, regionID, msg)) != nil {
 		pr.sendStore(NewPeerMsg(MsgTypeStoreRaftMessage, regionID, msg))
@@ -126,8 +139,8 @@ func (r *Router) SplitRegion(ctx *kvrpcpb.Context, keys [][]byte) ([]*metapb.Reg
 	if err != nil {
 		return nil, err
 	}
-	cb.wg.Wait()
-	return cb.resp.GetAdminResponse().GetSplits().GetRegions(), nil
+	resp := cb.wait(0)
+	return resp.GetAdminResponse().GetSplits().GetRegions(), nil
 }
 
 var errPeerNotFound = errors.New("peer not found")
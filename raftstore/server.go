@@ -35,6 +35,7 @@ type RaftInnerServer struct {
 	globalConfig  *config.Config
 	storeMeta     metapb.Store
 	eventObserver PeerEventObserver
+	cdcObserver   *cdcObserver
 
 	node        *Node
 	snapManager *SnapManager
@@ -44,6 +45,9 @@ type RaftInnerServer struct {
 	snapWorker  *worker
 	lsDumper    *lockStoreDumper
 	raftCli     *RaftClient
+	// trans replaces the gRPC transport if it's set, it's used by the in-process test cluster.
+	trans       Transport
+	filterTrans *FilterTransport
 }
 
 // Raft implements the tikv.InnerServer Raft method.
@@ -116,8 +120,14 @@ func (ris *RaftInnerServer) Setup(pdClient pd.Client) {
 	router, batchSystem := createRaftBatchSystem(ris.globalConfig, cfg)
 
 	ris.router = router // TODO: init with local reader
-	ris.snapManager = NewSnapManager(cfg.SnapPath, router)
+	ris.snapManager = new(SnapManagerBuilder).
+		BuildRateLimit(cfg.SnapBuildRateLimit).
+		SendRateLimit(cfg.SnapSendRateLimit).
+		ApplyRateLimit(cfg.SnapApplyRateLimit).
+		Build(cfg.SnapPath, router)
 	ris.batchSystem = batchSystem
+	ris.cdcObserver = newCDCObserver()
+	batchSystem.cdcObserver = ris.cdcObserver
 	ris.lsDumper = &lockStoreDumper{
 		stopCh:      make(chan struct{}),
 		engines:     ris.engines,
@@ -140,18 +150,32 @@ func (ris *RaftInnerServer) SetPeerEventObserver(ob PeerEventObserver) {
 	ris.eventObserver = ob
 }
 
+// AddRaftMessageFilter adds a filter to the outgoing raft messages, it must be called after Start.
+func (ris *RaftInnerServer) AddRaftMessageFilter(f RaftMessageFilter) {
+	ris.filterTrans.AddFilter(f)
+}
+
+// ClearRaftMessageFilters removes all the filters of the outgoing raft messages.
+func (ris *RaftInnerServer) ClearRaftMessageFilters() {
+	ris.filterTrans.ClearFilters()
+}
+
 // Start implements the tikv.InnerServer Start method.
 func (ris *RaftInnerServer) Start(pdClient pd.Client) error {
 	ris.node = NewNode(ris.batchSystem, &ris.storeMeta, ris.raftConfig, pdClient, ris.eventObserver)
 
-	raftClient := newRaftClient(ris.raftConfig, pdClient)
-	trans := NewServerTransport(raftClient, ris.snapWorker.sender, ris.router)
-	err := ris.node.Start(context.TODO(), ris.engines, trans, ris.snapManager, ris.pdWorker, ris.router)
+	trans := ris.trans
+	if trans == nil {
+		ris.raftCli = newRaftClient(ris.raftConfig, pdClient)
+		trans = NewServerTransport(ris.raftCli, ris.snapWorker.sender, ris.router)
+	}
+	ris.filterTrans = NewFilterTransport(trans, ris.router)
+	err := ris.node.Start(context.TODO(), ris.engines, ris.filterTrans, ris.snapManager, ris.pdWorker, ris.router)
 	if err != nil {
 		return err
 	}
-	ris.raftCli = raftClient
 	snapRunner := newSnapRunner(ris.snapManager, ris.raftConfig, ris.router, pdClient)
+	ris.snapWorker.load = ris.batchSystem.ctx.threadLoads.register(ris.snapWorker.name)
 	ris.snapWorker.start(snapRunner)
 	go ris.lsDumper.run()
 	return nil
@@ -161,7 +185,10 @@ func (ris *RaftInnerServer) Start(pdClient pd.Client) error {
 func (ris *RaftInnerServer) Stop() error {
 	ris.snapWorker.stop()
 	ris.node.stop()
-	ris.raftCli.Stop()
+	close(ris.lsDumper.stopCh)
+	if ris.raftCli != nil {
+		ris.raftCli.Stop()
+	}
 	if err := ris.engines.raft.Close(); err != nil {
 		return err
 	}
@@ -179,11 +206,11 @@ type lockStoreDumper struct {
 
 func (dumper *lockStoreDumper) run() {
 	ticker := time.NewTicker(time.Second * 10)
-	lastFileNum := dumper.engines.raft.GetVLogOffset() >> 32
+	lastFileNum := dumper.engines.raft.Offset() >> 32
 	for {
 		select {
 		case <-ticker.C:
-			vlogOffset := dumper.engines.raft.GetVLogOffset()
+			vlogOffset := dumper.engines.raft.Offset()
 			currentFileNum := vlogOffset >> 32
 			if currentFileNum-lastFileNum >= dumper.fileNumDiff {
 				meta := make([]byte, 8)
@@ -191,11 +218,15 @@ func (dumper *lockStoreDumper) run() {
 				// Waiting for the raft log to be applied.
 				// TODO: it is possible that some log is not applied after sleep, find a better way to make sure this.
 				time.Sleep(5 * time.Second)
-				err := dumper.engines.kv.LockStore.DumpToFile(filepath.Join(dumper.engines.kvPath, LockstoreFileName), meta)
+				err := evalFailpoint(FailpointLockStoreBeforeDump)
+				if err == nil {
+					err = dumper.engines.kv.LockStore.DumpToFile(filepath.Join(dumper.engines.kvPath, LockstoreFileName), meta)
+				}
 				if err != nil {
 					log.Error("dump lock store failed", zap.Error(err))
 					continue
 				}
+				dumper.engines.raft.SetRecoveryOffset(vlogOffset)
 				lastFileNum = currentFileNum
 			}
 		case <-dumper.stopCh:
@@ -0,0 +1,122 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/log"
+)
+
+const (
+	inspectRaftReady = iota
+	inspectApply
+	inspectRaftEngine
+	inspectKVEngine
+	inspectTypeCount
+)
+
+var inspectTypeNames = [inspectTypeCount]string{"raft_ready", "apply", "raft_engine", "kv_engine"}
+
+const (
+	minSlowScore = 1
+	maxSlowScore = 100
+)
+
+// slowScore tracks the slowness of the store. Every inspect round, the score is doubled if any of the
+// latencies exceeds the threshold, and decreased by 1 otherwise, so only a store slow for several
+// rounds in a row gets a high score, and the score drops slowly after it recovers.
+type slowScore struct {
+	threshold time.Duration
+	// latencies are the max latencies in nanoseconds of every inspect type in the current round.
+	latencies [inspectTypeCount]int64
+	// probeStart is the start time in unix nanoseconds of the engine probe in progress, 0 if there is
+	// no probe in progress.
+	probeStart int64
+	// score is only accessed by the store worker.
+	score float64
+}
+
+func newSlowScore(threshold time.Duration) *slowScore {
+	return &slowScore{threshold: threshold, score: minSlowScore}
+}
+
+// observe records the latency of the inspect type, it can be called concurrently.
+func (s *slowScore) observe(tp int, d time.Duration) {
+	inspectDuration.WithLabelValues(inspectTypeNames[tp]).Observe(d.Seconds())
+	for {
+		old := atomic.LoadInt64(&s.latencies[tp])
+		if int64(d) <= old || atomic.CompareAndSwapInt64(&s.latencies[tp], old, int64(d)) {
+			return
+		}
+	}
+}
+
+// startProbe returns true if there is no engine probe in progress, the caller should send the probe.
+func (s *slowScore) startProbe() bool {
+	return atomic.CompareAndSwapInt64(&s.probeStart, 0, time.Now().UnixNano())
+}
+
+// tick ends the current round and returns the updated score.
+func (s *slowScore) tick() float64 {
+	slow := false
+	for tp := range s.latencies {
+		if time.Duration(atomic.SwapInt64(&s.latencies[tp], 0)) > s.threshold {
+			slow = true
+		}
+	}
+	// A probe that doesn't return is slower than any latency.
+	if start := atomic.LoadInt64(&s.probeStart); start != 0 && time.Since(time.Unix(0, start)) > s.threshold {
+		slow = true
+	}
+	if slow {
+		s.score *= 2
+		if s.score > maxSlowScore {
+			s.score = maxSlowScore
+		}
+	} else if s.score > minSlowScore {
+		s.score--
+	}
+	slowScoreGauge.Set(s.score)
+	return s.score
+}
+
+type inspectTaskHandler struct {
+	engines   *Engines
+	slowScore *slowScore
+}
+
+// handle writes small batches to the raft and kv engines and records the latencies. The writes are
+// deletions of the keys that never exist, so nothing is left in the engines.
+func (r *inspectTaskHandler) handle(t task) {
+	defer atomic.StoreInt64(&r.slowScore.probeStart, 0)
+	start := time.Now()
+	wb := new(WriteBatch)
+	// Region 0 never exists.
+	wb.Delete(y.KeyWithTs(RaftStateKey(0), RaftTS))
+	if err := wb.WriteToRaft(r.engines.raft); err != nil {
+		log.S().Errorf("inspect raft engine failed, err %v", err)
+	}
+	r.slowScore.observe(inspectRaftEngine, time.Since(start))
+
+	start = time.Now()
+	wb = new(WriteBatch)
+	wb.Delete(y.KeyWithTs(storeInspectKey, KvTS))
+	if err := wb.WriteToKV(r.engines.kv); err != nil {
+		log.S().Errorf("inspect kv engine failed, err %v", err)
+	}
+	r.slowScore.observe(inspectKVEngine, time.Since(start))
+}
@@ -0,0 +1,49 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowScore(t *testing.T) {
+	s := newSlowScore(100 * time.Millisecond)
+	require.Equal(t, float64(1), s.tick())
+
+	// The max latency in a round is checked.
+	s.observe(inspectApply, time.Second)
+	s.observe(inspectApply, time.Millisecond)
+	require.Equal(t, float64(2), s.tick())
+	require.Equal(t, float64(1), s.tick())
+
+	// The score is doubled every slow round up to 100.
+	for i := 0; i < 7; i++ {
+		s.observe(inspectKVEngine, time.Second)
+		s.tick()
+	}
+	require.Equal(t, float64(100), s.score)
+	require.Equal(t, float64(99), s.tick())
+
+	// The probe not returned in time makes the round slow.
+	require.True(t, s.startProbe())
+	require.False(t, s.startProbe())
+	atomic.StoreInt64(&s.probeStart, time.Now().Add(-time.Second).UnixNano())
+	require.Equal(t, float64(100), s.tick())
+	atomic.StoreInt64(&s.probeStart, 0)
+	require.Equal(t, float64(99), s.tick())
+}
@@ -131,8 +131,9 @@ func newApplyOptions(db *mvcc.DBBundle, region *metapb.Region, abort *uint32, bu
 
 // ApplyResult represents the apply result.
 type ApplyResult struct {
-	HasPut      bool
-	RegionState *rspb.RegionLocalState
+	HasPut        bool
+	RegionState   *rspb.RegionLocalState
+	SnapshotLocks *snapshotLocks
 }
 
 // Snapshot is an interface for snapshot.
@@ -153,6 +154,10 @@ type Snapshot interface {
 	TotalSize() uint64
 	Save() error
 	Apply(option ApplyOptions) (ApplyResult, error)
+	// WrittenSize returns the size of the data already written, used to resume receiving.
+	WrittenSize() uint64
+	// Skip skips the first n bytes before reading, used to resume sending.
+	Skip(n uint64) error
 }
 
 // copySnapshot is a helper function to copy snapshot.
@@ -255,6 +260,8 @@ type CFFile struct {
 	WrittenSize uint64
 	Checksum    uint32
 	WriteDigest hash.Hash32
+	// Writer writes the received data to the File with the rate limit.
+	Writer *LimitWriter
 }
 
 // MetaFile represents a meta file.
@@ -395,30 +402,60 @@ func NewSnapForReceiving(dir string, key SnapKey, snapshotMeta *rspb.SnapshotMet
 	if s.Exists() {
 		return s, nil
 	}
-	f, err := os.OpenFile(s.MetaFile.TmpPath, os.O_CREATE|os.O_WRONLY, 0600)
+	f, err := os.OpenFile(s.MetaFile.TmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
 	if err != nil {
 		return nil, err
 	}
 	s.MetaFile.File = f
 	s.holdTmpFiles = true
 
+	// The tmp files left by a broken transfer are kept, so we can resume receiving from the end of them.
+	resumable := true
 	for _, cfFile := range s.CFFiles {
 		if cfFile.Size == 0 {
 			continue
 		}
-		f, err = os.OpenFile(cfFile.TmpPath, os.O_CREATE|os.O_WRONLY, 0600)
+		f, err = os.OpenFile(cfFile.TmpPath, os.O_CREATE|os.O_RDWR, 0600)
 		if err != nil {
 			return nil, err
 		}
 		cfFile.File = f
+		cfFile.Writer = NewLimitWriter(f, limiter, snapRecvThrottled)
 		cfFile.WriteDigest = crc32.NewIEEE()
+		if !resumable {
+			if err = f.Truncate(0); err != nil {
+				return nil, errors.WithStack(err)
+			}
+			continue
+		}
+		if err = resumeCFFile(cfFile); err != nil {
+			return nil, err
+		}
+		// The data is written in order, the later files are invalid if this one is not complete.
+		resumable = cfFile.WrittenSize == cfFile.Size
 	}
 	return s, nil
 }
 
+// resumeCFFile loads the data already written in the tmp file to the digest and seeks to the end of it.
+func resumeCFFile(cfFile *CFFile) error {
+	n, err := io.Copy(cfFile.WriteDigest, io.LimitReader(cfFile.File, int64(cfFile.Size)))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err = cfFile.File.Truncate(n); err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err = cfFile.File.Seek(n, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+	cfFile.WrittenSize = uint64(n)
+	return nil
+}
+
 // NewSnapForApplying returns a new snap for applying.
-func NewSnapForApplying(dir string, key SnapKey, sizeTrack *int64, deleter SnapshotDeleter) (*Snap, error) {
-	return NewSnap(dir, key, sizeTrack, false, false, deleter, nil)
+func NewSnapForApplying(dir string, key SnapKey, sizeTrack *int64, deleter SnapshotDeleter, limiter *IOLimiter) (*Snap, error) {
+	return NewSnap(dir, key, sizeTrack, false, false, deleter, limiter)
 }
 
 func (s *Snap) initForBuilding() error {
@@ -602,6 +639,8 @@ func (s *Snap) Build(dbSnap *regionSnapshot, region *metapb.Region, snapData *rs
 	if s.Exists() {
 		err := s.validate()
 		if err == nil {
+			// The snapshot is built before but failed to send, reuse it.
+			s.setSnapData(snapData, stat)
 			return nil
 		}
 		log.S().Errorf("[region %d] file %s is corrupted, will rebuild: %v", region.Id, s.Path(), err)
@@ -616,7 +655,7 @@ func (s *Snap) Build(dbSnap *regionSnapshot, region *metapb.Region, snapData *rs
 		}
 	}
 
-	builder, err := newSnapBuilder(s.CFFiles, dbSnap, region)
+	builder, err := newSnapBuilder(s.CFFiles, dbSnap, region, s.limiter)
 	if err != nil {
 		return err
 	}
@@ -639,13 +678,17 @@ func (s *Snap) Build(dbSnap *regionSnapshot, region *metapb.Region, snapData *rs
 	if err != nil {
 		return err
 	}
+	s.setSnapData(snapData, stat)
+	return nil
+}
+
+// setSnapData sets the snapshot meta data of the built snapshot.
+func (s *Snap) setSnapData(snapData *rspb.RaftSnapshotData, stat *SnapStatistics) {
 	totalSize := s.TotalSize()
 	stat.Size = totalSize
-	// set snapshot meta data
 	snapData.FileSize = totalSize
 	snapData.Version = snapshotVersion
 	snapData.Meta = s.MetaFile.Meta
-	return nil
 }
 
 // Path implements the Snapshot Path method.
@@ -784,6 +827,10 @@ func (s *Snap) Apply(opts ApplyOptions) (ApplyResult, error) {
 		if item == nil {
 			break
 		}
+		if err1 = evalFailpoint(FailpointSnapApplyItem); err1 != nil {
+			return result, err1
+		}
+		throttle(s.limiter, len(item.key.UserKey)+len(item.val), snapApplyThrottled)
 		switch item.applySnapType {
 		case applySnapTypePut:
 			result.HasPut = true
@@ -838,6 +885,30 @@ func (s *Snap) Read(b []byte) (int, error) {
 	return 0, io.EOF
 }
 
+// Skip implements the Snapshot Skip method.
+func (s *Snap) Skip(n uint64) error {
+	if n > s.TotalSize() {
+		return errors.Errorf("skip %d bytes exceeds the size %d of snapshot %s", n, s.TotalSize(), s.Path())
+	}
+	for ; s.cfIndex < len(s.CFFiles) && n > 0; s.cfIndex++ {
+		cfFile := s.CFFiles[s.cfIndex]
+		if n < cfFile.Size {
+			_, err := cfFile.File.Seek(int64(n), io.SeekStart)
+			return errors.WithStack(err)
+		}
+		n -= cfFile.Size
+	}
+	return nil
+}
+
+// WrittenSize implements the Snapshot WrittenSize method.
+func (s *Snap) WrittenSize() (total uint64) {
+	for _, cf := range s.CFFiles {
+		total += cf.WrittenSize
+	}
+	return
+}
+
 // Write implements the Snapshot Write method.
 func (s *Snap) Write(b []byte) (int, error) {
 	if len(b) == 0 {
@@ -855,7 +926,7 @@ func (s *Snap) Write(b []byte) (int, error) {
 			s.cfIndex++
 			continue
 		}
-		file := cfFile.File
+		file := cfFile.Writer
 		digest := cfFile.WriteDigest
 		if len(nextBuf) > int(left) {
 			_, err := file.Write(nextBuf[:left])
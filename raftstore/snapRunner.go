@@ -17,6 +17,7 @@ import (
 	"bytes"
 	"context"
 	"io"
+	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -28,6 +29,7 @@ import (
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
 )
 
 type snapRunner struct {
@@ -109,21 +111,49 @@ func (r *snapRunner) sendSnap(storeID uint64, msg *raft_serverpb.RaftMessage) er
 	if err != nil {
 		return err
 	}
-	err = stream.Send(&raft_serverpb.SnapshotChunk{Message: msg})
+	compression, _ := parseSnapCompression(r.config.SnapCompression)
+	opts := snapStreamOptions{resumable: r.config.SnapResume, compression: compression}
+	head := &raft_serverpb.SnapshotChunk{Message: msg}
+	if opts != (snapStreamOptions{}) {
+		head.Data = opts.marshal()
+	}
+	err = stream.Send(head)
 	if err != nil {
 		return err
 	}
+	var offset uint64
+	if opts.resumable {
+		// The receiver sends the header right after the first chunk if resuming is requested.
+		header, err := stream.Header()
+		if err != nil {
+			return err
+		}
+		offset = snapReceivedSizeFromHeader(header)
+	}
+	if offset > 0 {
+		log.Info("resume sending snapshot", zap.Stringer("snap key", snapKey), zap.Uint64("offset", offset))
+		if err = snap.Skip(offset); err != nil {
+			return err
+		}
+	}
 
+	reader := NewLimitReader(snap, r.snapManager.sendLimiter, snapSendThrottled)
 	buf := make([]byte, snapChunkLen)
-	for remain := snap.TotalSize(); remain > 0; remain -= uint64(len(buf)) {
+	var sentSize uint64
+	for remain := snap.TotalSize() - offset; remain > 0; remain -= uint64(len(buf)) {
 		if remain < uint64(len(buf)) {
 			buf = buf[:remain]
 		}
-		_, err := io.ReadFull(snap, buf)
+		_, err := io.ReadFull(reader, buf)
 		if err != nil {
 			return errors.Errorf("failed to read snapshot chunk: %v", err)
 		}
-		err = stream.Send(&raft_serverpb.SnapshotChunk{Data: buf})
+		data := buf
+		if compression != snapCompressionNone {
+			data = compressSnapChunk(compression, buf)
+		}
+		sentSize += uint64(len(data))
+		err = stream.Send(&raft_serverpb.SnapshotChunk{Data: data})
 		if err != nil {
 			return err
 		}
@@ -133,10 +163,67 @@ func (r *snapRunner) sendSnap(storeID uint64, msg *raft_serverpb.RaftMessage) er
 		return err
 	}
 
-	log.Info("sent snapshot", zap.Uint64("region id", snapKey.RegionID), zap.Stringer("snap key", snapKey), zap.Uint64("size", snap.TotalSize()), zap.Duration("duration", time.Since(start)))
+	log.Info("sent snapshot", zap.Uint64("region id", snapKey.RegionID), zap.Stringer("snap key", snapKey), zap.Uint64("size", snap.TotalSize()),
+		zap.Uint64("sent size", sentSize), zap.Stringer("compression", compression), zap.Duration("duration", time.Since(start)))
 	return nil
 }
 
+// snapReceivedSizeKey is set in the header by the receiver to tell the sender where to resume from.
+const snapReceivedSizeKey = "snap-received-size"
+
+const snapOptionResumable byte = 1
+
+// snapStreamOptions are requested by the sender in the data of the first chunk, which is ignored by
+// the old receivers.
+type snapStreamOptions struct {
+	// resumable asks the receiver to keep the data received before and send the received size in the header.
+	resumable bool
+	// compression is the compression of the following chunks.
+	compression snapCompression
+}
+
+// The options format is | flags(1) | compression(1) |.
+func (o snapStreamOptions) marshal() []byte {
+	var flags byte
+	if o.resumable {
+		flags |= snapOptionResumable
+	}
+	return []byte{flags, byte(o.compression)}
+}
+
+// unmarshalSnapStreamOptions returns the options in the first chunk, the data of old senders is empty.
+func unmarshalSnapStreamOptions(data []byte) (snapStreamOptions, error) {
+	var o snapStreamOptions
+	if len(data) > 0 {
+		o.resumable = data[0]&snapOptionResumable != 0
+	}
+	if len(data) > 1 {
+		o.compression = snapCompression(data[1])
+		if o.compression > snapCompressionZstd {
+			return o, errors.Errorf("unknown snapshot compression %d", data[1])
+		}
+	}
+	return o, nil
+}
+
+// snapReceivedSizeFromHeader returns the size of the data the receiver already has, 0 means sending from the beginning.
+func snapReceivedSizeFromHeader(header metadata.MD) uint64 {
+	values := header.Get(snapReceivedSizeKey)
+	if len(values) == 0 {
+		return 0
+	}
+	size, err := strconv.ParseUint(values[0], 10, 64)
+	if err != nil {
+		log.S().Warnf("invalid snapshot received size %s", values[0])
+		return 0
+	}
+	return size
+}
+
+func sendSnapHeader(stream tikvpb.Tikv_SnapshotServer, receivedSize uint64) error {
+	return stream.SendHeader(metadata.Pairs(snapReceivedSizeKey, strconv.FormatUint(receivedSize, 10)))
+}
+
 func (r *snapRunner) recv(t recvSnapTask) {
 	if n := atomic.LoadInt64(&r.receivingCount); n > int64(r.config.ConcurrentRecvSnapLimit) {
 		log.Warn("too many recving snapshot tasks, ignore")
@@ -168,6 +255,10 @@ func (r *snapRunner) recvSnap(stream tikvpb.Tikv_SnapshotServer) (*raft_serverpb
 		return nil, errors.Errorf("failed to create snap key: %v", err)
 	}
 
+	opts, err := unmarshalSnapStreamOptions(head.GetData())
+	if err != nil {
+		return nil, err
+	}
 	data := message.GetSnapshot().GetData()
 	snap, err := r.snapManager.GetSnapshotForReceiving(snapKey, data)
 	if err != nil {
@@ -175,11 +266,33 @@ func (r *snapRunner) recvSnap(stream tikvpb.Tikv_SnapshotServer) (*raft_serverpb
 	}
 	if snap.Exists() {
 		log.Info("snapshot file already exists, skip receiving", zap.Stringer("snap key", snapKey), zap.String("file", snap.Path()))
+		if opts.resumable {
+			if err := sendSnapHeader(stream, snap.TotalSize()); err != nil {
+				return nil, err
+			}
+		}
 		if err := stream.SendAndClose(&raft_serverpb.Done{}); err != nil {
 			return nil, err
 		}
 		return head.GetMessage(), nil
 	}
+	if offset := snap.WrittenSize(); offset > 0 {
+		if opts.resumable {
+			log.Info("resume receiving snapshot", zap.Stringer("snap key", snapKey), zap.Uint64("offset", offset))
+		} else {
+			// The sender always sends from the beginning, drop the data received before.
+			snap.Delete()
+			snap, err = r.snapManager.GetSnapshotForReceiving(snapKey, data)
+			if err != nil {
+				return nil, errors.Errorf("%v failed to create snapshot file: %v", snapKey, err)
+			}
+		}
+	}
+	if opts.resumable {
+		if err := sendSnapHeader(stream, snap.WrittenSize()); err != nil {
+			return nil, err
+		}
+	}
 	r.snapManager.Register(snapKey, SnapEntryReceiving)
 	defer r.snapManager.Deregister(snapKey, SnapEntryReceiving)
 
@@ -195,6 +308,12 @@ func (r *snapRunner) recvSnap(stream tikvpb.Tikv_SnapshotServer) (*raft_serverpb
 		if len(data) == 0 {
 			return nil, errors.Errorf("%v receive chunk with empty data", snapKey)
 		}
+		if opts.compression != snapCompressionNone {
+			data, err = decompressSnapChunk(data)
+			if err != nil {
+				return nil, errors.Errorf("%v failed to decompress snapshot chunk: %v", snapKey, err)
+			}
+		}
 		_, err = bytes.NewReader(data).WriteTo(snap)
 		if err != nil {
 			return nil, errors.Errorf("%v failed to write snapshot file %v: %v", snapKey, snap.Path(), err)
@@ -203,6 +322,8 @@ func (r *snapRunner) recvSnap(stream tikvpb.Tikv_SnapshotServer) (*raft_serverpb
 
 	err = snap.Save()
 	if err != nil {
+		// The received data may be corrupted, delete it so the next transfer starts from the beginning.
+		snap.Delete()
 		return nil, err
 	}
 
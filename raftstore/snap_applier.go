@@ -139,6 +139,11 @@ func (ai *snapApplier) nextLock() (*applySnapItem, error) {
 	mvccLock.PrimaryLen = uint16(len(lv.primary))
 	mvccLock.Primary = lv.primary
 	mvccLock.Value = val
+	mvccLock.ForUpdateTS = lv.forUpdateTS
+	mvccLock.MinCommitTS = lv.minCommitTS
+	mvccLock.UseAsyncCommit = lv.useAsyncCommit
+	mvccLock.Secondaries = lv.secondaries
+	mvccLock.SecondaryNum = uint32(len(lv.secondaries))
 	item.val = mvccLock.MarshalBinary()
 	if len(ai.lockCFData) > 1 {
 		ai.curLockKey, ai.curLockValue, ai.lockCFData, err = readEntryFromPlainFile(ai.lockCFData)
@@ -197,7 +202,10 @@ func (ai *snapApplier) nextWrite() (*applySnapItem, error) {
 	}
 	item.applySnapType = applySnapTypePut
 	item.key = y.KeyWithTs(ai.curWriteKey, ai.curWriteCommitTS)
-	item.userMeta = mvcc.NewDBUserMeta(writeVal.startTS, ai.curWriteCommitTS)
+	if ai.curWriteKey[0] != RawDataPrefix {
+		// The raw kv data has no user meta.
+		item.userMeta = mvcc.NewDBUserMeta(writeVal.startTS, ai.curWriteCommitTS)
+	}
 	val, err := ai.popFullValue(ai.curWriteKey, writeVal.startTS, writeVal.shortValue, writeVal.writeType)
 	if err != nil {
 		return nil, err
@@ -240,7 +248,11 @@ func readEntryFromPlainFile(data []byte) (key, value, remain []byte, err error)
 	if len(key) == 0 {
 		return
 	}
-	key = key[1:]
+	// The key is encoded like the sst keys without the ts.
+	_, key, err = codec.DecodeBytes(key[1:], nil)
+	if err != nil {
+		return
+	}
 	data, value, err = codec.DecodeCompactBytes(data)
 	if err != nil {
 		return
@@ -24,13 +24,16 @@ import (
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/tidb/store/mockstore/unistore/lockstore"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/dbreader"
 	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
 	"github.com/pingcap/tidb/util/codec"
 )
 
-func newSnapBuilder(cfFiles []*CFFile, snap *regionSnapshot, region *metapb.Region) (*snapBuilder, error) {
+func newSnapBuilder(cfFiles []*CFFile, snap *regionSnapshot, region *metapb.Region, limiter *IOLimiter) (*snapBuilder, error) {
 	b := new(snapBuilder)
 	b.cfFiles = cfFiles
+	b.limiter = limiter
+	b.startKey = RawStartKey(region)
 	b.endKey = RawEndKey(region)
 	b.extraEndKey = mvcc.EncodeExtraTxnStatusKey(b.endKey, 0)
 	b.txn = snap.txn
@@ -39,7 +42,7 @@ func newSnapBuilder(cfFiles []*CFFile, snap *regionSnapshot, region *metapb.Regi
 	b.dbIterator = b.txn.NewIterator(itOpt)
 	// extraIterator doesn't need to read all versions because startTS is encoded in the key.
 	b.extraIterator = b.txn.NewIterator(badger.DefaultIteratorOptions)
-	startKey := RawStartKey(region)
+	startKey := b.startKey
 
 	b.dbIterator.Seek(startKey)
 	if b.dbIterator.Valid() && !b.reachEnd(b.dbIterator.Item().Key()) {
@@ -74,6 +77,7 @@ func newSnapBuilder(cfFiles []*CFFile, snap *regionSnapshot, region *metapb.Regi
 // snapBuilder builds snapshot files.
 // TODO: handle rollbacks and locks the region later.
 type snapBuilder struct {
+	startKey        []byte
 	endKey          []byte
 	extraEndKey     []byte
 	txn             *badger.Txn
@@ -84,6 +88,7 @@ type snapBuilder struct {
 	curDBKey        []byte
 	curExtraKey     []byte
 	lockCFWriter    *os.File
+	limiter         *IOLimiter
 	defaultCFWriter *rocksdb.SstFileWriter
 	writeCFWriter   *rocksdb.SstFileWriter
 	cfFiles         []*CFFile
@@ -99,8 +104,16 @@ func (b *snapBuilder) build() error {
 		b.extraIterator.Close()
 		b.txn.Discard()
 	}()
+	if err := b.buildTxnData(); err != nil {
+		return err
+	}
+	return b.buildRawData()
+}
+
+func (b *snapBuilder) buildTxnData() error {
 	for {
 		var err error
+		lastSize := b.size
 		switch b.currentKeyType() {
 		case currentKeyDB:
 			if len(b.curDBKey) == 0 {
@@ -121,7 +134,32 @@ func (b *snapBuilder) build() error {
 		if err != nil {
 			return err
 		}
+		throttle(b.limiter, b.size-lastSize, snapBuildThrottled)
+	}
+}
+
+// buildRawData adds the raw kv data of the region to the write CF as puts at KvTS after the transactional
+// data. The raw data keys are greater than all the transactional data keys, so the CF files are still sorted.
+func (b *snapBuilder) buildRawData() error {
+	startKey, endKey := rawDataRange(b.startKey, b.endKey)
+	it := dbreader.NewIterator(b.txn, false, startKey, endKey)
+	defer it.Close()
+	for it.Seek(startKey); it.Valid(); it.Next() {
+		item := it.Item()
+		if bytes.Compare(item.Key(), endKey) >= 0 {
+			break
+		}
+		val, err := item.Value()
+		if err != nil {
+			return err
+		}
+		lastSize := b.size
+		if err = b.addSSTKey(item.Key(), KvTS, KvTS, val, byte(kvrpcpb.Op_Put)); err != nil {
+			return err
+		}
+		throttle(b.limiter, b.size-lastSize, snapBuildThrottled)
 	}
+	return nil
 }
 
 const (
@@ -131,11 +169,13 @@ const (
 )
 
 func (b *snapBuilder) currentKeyType() (keyType int) {
+	// The smallest of the current keys, the locks after the last DB key must not be skipped.
+	// The lock goes first on ties, its value in the default CF has the largest ts of the key.
 	curKey := b.curDBKey
-	if len(curKey) == 0 || (len(b.curLockKey) > 0 && bytes.Compare(b.curLockKey, curKey) < 0) {
-		keyType = currentKeyLock
+	if len(b.curLockKey) > 0 && (len(curKey) == 0 || bytes.Compare(b.curLockKey, curKey) <= 0) {
+		keyType, curKey = currentKeyLock, b.curLockKey
 	}
-	if len(curKey) == 0 || (len(b.curExtraKey) > 0 && bytes.Compare(b.curExtraKey, curKey) < 0) {
+	if len(b.curExtraKey) > 0 && (len(curKey) == 0 || bytes.Compare(b.curExtraKey, curKey) < 0) {
 		keyType = currentKeyExtra
 	}
 	return
@@ -157,6 +197,10 @@ func (b *snapBuilder) addLockEntry() error {
 	lockCFVal.startTS = l.StartTS
 	lockCFVal.primary = l.Primary
 	lockCFVal.ttl = uint64(l.TTL)
+	lockCFVal.forUpdateTS = l.ForUpdateTS
+	lockCFVal.minCommitTS = l.MinCommitTS
+	lockCFVal.useAsyncCommit = l.UseAsyncCommit
+	lockCFVal.secondaries = l.Secondaries
 	if len(l.Value) <= shortValueMaxLen {
 		lockCFVal.shortVal = l.Value
 	} else {
@@ -254,7 +298,7 @@ func (b *snapBuilder) addSSTKey(key []byte, startTS, commitTS uint64, val []byte
 	if len(val) <= shortValueMaxLen {
 		writeCFVal.shortValue = val
 	} else {
-		defaultCFKey := encodeRocksDBSSTKey(b.curDBKey, &startTS)
+		defaultCFKey := encodeRocksDBSSTKey(key, &startTS)
 		err := b.defaultCFWriter.Put(defaultCFKey, val)
 		if err != nil {
 			return err
@@ -19,9 +19,13 @@ import (
 	"github.com/pingcap/tidb/util/codec"
 )
 
+// The prefixes of the optional fields in the lock CF value, the same as TiKV.
 const (
-	shortValuePrefix = 'v'
-	shortValueMaxLen = 64
+	shortValuePrefix  = 'v'
+	forUpdatePrefix   = 'f'
+	minCommitTSPrefix = 'm'
+	asyncCommitPrefix = 'a'
+	shortValueMaxLen  = 64
 )
 
 var (
@@ -103,11 +107,15 @@ func encodeWriteCFValue(v *writeCFValue) []byte {
 }
 
 type lockCFValue struct {
-	lockType byte
-	primary  []byte
-	startTS  uint64
-	ttl      uint64
-	shortVal []byte
+	lockType       byte
+	primary        []byte
+	startTS        uint64
+	ttl            uint64
+	shortVal       []byte
+	forUpdateTS    uint64
+	minCommitTS    uint64
+	useAsyncCommit bool
+	secondaries    [][]byte
 }
 
 func decodeLockCFValue(b []byte) (*lockCFValue, error) {
@@ -132,14 +140,34 @@ func decodeLockCFValue(b []byte) (*lockCFValue, error) {
 			return nil, errors.WithStack(err)
 		}
 	}
-	if len(b) == 0 {
-		return lv, nil
+	for len(b) > 0 {
+		switch b[0] {
+		case shortValuePrefix:
+			if len(b) < 2 || len(b) < 2+int(b[1]) {
+				return nil, errBadLockFormat
+			}
+			lv.shortVal = b[2 : 2+int(b[1])]
+			b = b[2+int(b[1]):]
+		case forUpdatePrefix:
+			b, lv.forUpdateTS, err = codec.DecodeUint(b[1:])
+		case minCommitTSPrefix:
+			b, lv.minCommitTS, err = codec.DecodeUint(b[1:])
+		case asyncCommitPrefix:
+			var cnt uint64
+			b, cnt, err = codec.DecodeUvarint(b[1:])
+			lv.useAsyncCommit = true
+			for i := uint64(0); i < cnt && err == nil; i++ {
+				var secondary []byte
+				b, secondary, err = codec.DecodeCompactBytes(b)
+				lv.secondaries = append(lv.secondaries, secondary)
+			}
+		default:
+			return nil, errBadLockFormat
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
 	}
-	flag, l := b[0], b[1]
-	b = b[2:]
-	y.Assert(flag == shortValuePrefix)
-	y.Assert(int(l) == len(b))
-	lv.shortVal = b
 	return lv, nil
 }
 
@@ -152,5 +180,20 @@ func encodeLockCFValue(v *lockCFValue, buf []byte) []byte {
 		buf = append(buf, shortValuePrefix, byte(len(v.shortVal)))
 		buf = append(buf, v.shortVal...)
 	}
+	if v.forUpdateTS > 0 {
+		buf = append(buf, forUpdatePrefix)
+		buf = codec.EncodeUint(buf, v.forUpdateTS)
+	}
+	if v.minCommitTS > 0 {
+		buf = append(buf, minCommitTSPrefix)
+		buf = codec.EncodeUint(buf, v.minCommitTS)
+	}
+	if v.useAsyncCommit {
+		buf = append(buf, asyncCommitPrefix)
+		buf = codec.EncodeUvarint(buf, uint64(len(v.secondaries)))
+		for _, secondary := range v.secondaries {
+			buf = codec.EncodeCompactBytes(buf, secondary)
+		}
+	}
 	return buf
 }
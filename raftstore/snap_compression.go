@@ -0,0 +1,136 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/pingcap/errors"
+)
+
+// snapCompression is the compression type of the snapshot chunks sent over the wire.
+type snapCompression byte
+
+const (
+	snapCompressionNone snapCompression = 0
+	snapCompressionLz4  snapCompression = 1
+	snapCompressionZstd snapCompression = 2
+)
+
+func parseSnapCompression(s string) (snapCompression, error) {
+	switch s {
+	case "", "none":
+		return snapCompressionNone, nil
+	case "lz4":
+		return snapCompressionLz4, nil
+	case "zstd":
+		return snapCompressionZstd, nil
+	}
+	return snapCompressionNone, errors.Errorf("unknown snapshot compression %s", s)
+}
+
+func (c snapCompression) String() string {
+	switch c {
+	case snapCompressionNone:
+		return "none"
+	case snapCompressionLz4:
+		return "lz4"
+	case snapCompressionZstd:
+		return "zstd"
+	}
+	return "unknown"
+}
+
+// The encoder and decoder are safe to be used concurrently with EncodeAll and DecodeAll.
+// The decoded size and the window size are limited to the chunk size to reject the malicious chunks.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(snapChunkLen))
+)
+
+// lz4HashTablePool reuses the hash tables of lz4.CompressBlock, which are too large to be allocated for every chunk.
+var lz4HashTablePool = sync.Pool{
+	New: func() interface{} {
+		return new([1 << 16]int)
+	},
+}
+
+// compressSnapChunk compresses the chunk and prepends the compression type to it.
+// The chunk is kept uncompressed if it can not be compressed well, like the compressed SST blocks.
+//
+// The lz4 chunk format is | type(1) | raw size(varint) | lz4 block |, the zstd chunk is | type(1) | zstd frame |.
+func compressSnapChunk(tp snapCompression, data []byte) []byte {
+	var compressed []byte
+	switch tp {
+	case snapCompressionLz4:
+		compressed = make([]byte, 1+binary.MaxVarintLen64+lz4.CompressBlockBound(len(data)))
+		compressed[0] = byte(tp)
+		l := 1 + binary.PutUvarint(compressed[1:], uint64(len(data)))
+		ht := lz4HashTablePool.Get().(*[1 << 16]int)
+		n, err := lz4.CompressBlock(data, compressed[l:], ht[:])
+		lz4HashTablePool.Put(ht)
+		if err != nil || n == 0 {
+			compressed = nil
+		} else {
+			compressed = compressed[:l+n]
+		}
+	case snapCompressionZstd:
+		compressed = zstdEncoder.EncodeAll(data, []byte{byte(tp)})
+	}
+	if compressed == nil || len(compressed) >= len(data)-len(data)/8 {
+		compressed = make([]byte, 1+len(data))
+		compressed[0] = byte(snapCompressionNone)
+		copy(compressed[1:], data)
+	}
+	return compressed
+}
+
+// decompressSnapChunk decompresses the chunk compressed by compressSnapChunk.
+func decompressSnapChunk(chunk []byte) ([]byte, error) {
+	if len(chunk) == 0 {
+		return nil, errors.New("empty snapshot chunk")
+	}
+	data := chunk[1:]
+	switch snapCompression(chunk[0]) {
+	case snapCompressionNone:
+		return data, nil
+	case snapCompressionLz4:
+		size, n := binary.Uvarint(data)
+		if n <= 0 || size > snapChunkLen {
+			return nil, errors.New("invalid lz4 snapshot chunk")
+		}
+		raw := make([]byte, size)
+		m, err := lz4.UncompressBlock(data[n:], raw)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if uint64(m) != size {
+			return nil, errors.Errorf("lz4 snapshot chunk size mismatch, expect %d, got %d", size, m)
+		}
+		return raw, nil
+	case snapCompressionZstd:
+		raw, err := zstdDecoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if len(raw) > snapChunkLen {
+			return nil, errors.New("invalid zstd snapshot chunk")
+		}
+		return raw, nil
+	}
+	return nil, errors.Errorf("unknown snapshot chunk compression %d", chunk[0])
+}
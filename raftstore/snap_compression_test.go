@@ -0,0 +1,79 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapChunkCompression(t *testing.T) {
+	compressible := bytes.Repeat([]byte("unistore snapshot chunk "), snapChunkLen/24)
+	random := make([]byte, snapChunkLen)
+	rand.Read(random)
+
+	for _, tp := range []snapCompression{snapCompressionNone, snapCompressionLz4, snapCompressionZstd} {
+		parsed, err := parseSnapCompression(tp.String())
+		require.Nil(t, err)
+		assert.Equal(t, tp, parsed)
+
+		chunk := compressSnapChunk(tp, compressible)
+		assert.Equal(t, byte(tp), chunk[0])
+		if tp != snapCompressionNone {
+			assert.True(t, len(chunk) < len(compressible)/2)
+		}
+		data, err := decompressSnapChunk(chunk)
+		require.Nil(t, err)
+		assert.Equal(t, compressible, data)
+
+		// Incompressible data is sent as it is.
+		chunk = compressSnapChunk(tp, random)
+		assert.Equal(t, byte(snapCompressionNone), chunk[0])
+		data, err = decompressSnapChunk(chunk)
+		require.Nil(t, err)
+		assert.Equal(t, random, data)
+	}
+	_, err := parseSnapCompression("snappy")
+	assert.NotNil(t, err)
+	_, err = decompressSnapChunk([]byte{byte(snapCompressionLz4), 1, 2})
+	assert.NotNil(t, err)
+	_, err = decompressSnapChunk([]byte{9, 1, 2})
+	assert.NotNil(t, err)
+
+	// The chunks decoded larger than the chunk size are rejected.
+	large := make([]byte, snapChunkLen+1)
+	_, err = decompressSnapChunk(compressSnapChunk(snapCompressionLz4, large))
+	assert.NotNil(t, err)
+	_, err = decompressSnapChunk(compressSnapChunk(snapCompressionZstd, large))
+	assert.NotNil(t, err)
+	frame := zstdEncoder.EncodeAll(make([]byte, snapChunkLen), nil)
+	_, err = decompressSnapChunk(append(append([]byte{byte(snapCompressionZstd)}, frame...), frame...))
+	assert.NotNil(t, err)
+}
+
+func TestSnapCompressionOptions(t *testing.T) {
+	for _, tp := range []snapCompression{snapCompressionNone, snapCompressionLz4, snapCompressionZstd} {
+		opts, err := unmarshalSnapStreamOptions(snapStreamOptions{compression: tp}.marshal())
+		require.Nil(t, err)
+		assert.Equal(t, tp, opts.compression)
+	}
+
+	// The chunks compressed by an unknown compression can't be received.
+	_, err := unmarshalSnapStreamOptions([]byte{0, 3})
+	assert.NotNil(t, err)
+}
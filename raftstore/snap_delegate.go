@@ -0,0 +1,367 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng1987/raft"
+)
+
+// kvproto has no message to generate snapshots on followers. The snapshot delegation messages are
+// encoded by snapDelegateMsg in the context of the raft message instead of giving the kvproto fields
+// another meaning. They are marked as extra messages to be handled before the raft message is stepped,
+// the type is not used by kvproto, and the stores that don't know it ignore the messages.
+const extraMsgTypeSnapDelegate rspb.ExtraMessageType = 100
+
+// The leader generates the snapshot itself if the follower doesn't accept the request in a few election
+// timeouts, the request or the response may be lost.
+const snapDelegateAcceptElections = 3
+
+type snapDelegateMsgType byte
+
+const (
+	// snapDelegateRequest is sent by the leader to ask the follower to generate a snapshot and send it to
+	// the target peer.
+	snapDelegateRequest snapDelegateMsgType = 1 + iota
+	// snapDelegateAccept is sent back by the follower when it starts to generate the snapshot.
+	snapDelegateAccept
+	// snapDelegateFinish is sent back by the follower after the snapshot is sent.
+	snapDelegateFinish
+	// snapDelegateFailure is sent back by the follower if it rejects the request or fails to send the
+	// snapshot, the leader generates the snapshot itself then.
+	snapDelegateFailure
+)
+
+// snapDelegateMsg is a snapshot delegation message between the leader and the follower.
+type snapDelegateMsg struct {
+	tp     snapDelegateMsgType
+	target *metapb.Peer
+	// minIndex is the minimal index of the requested snapshot, the leader can't append logs to the target
+	// peer after a snapshot older than its truncated index.
+	minIndex uint64
+}
+
+func (m *snapDelegateMsg) marshal() []byte {
+	buf := make([]byte, 1, 1+3*binary.MaxVarintLen64)
+	buf[0] = byte(m.tp)
+	var tmp [binary.MaxVarintLen64]byte
+	for _, v := range []uint64{m.target.GetId(), m.target.GetStoreId(), m.minIndex} {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+	}
+	return buf
+}
+
+func (m *snapDelegateMsg) unmarshal(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("empty snapshot delegation message")
+	}
+	m.tp = snapDelegateMsgType(data[0])
+	if m.tp < snapDelegateRequest || m.tp > snapDelegateFailure {
+		return errors.Errorf("unknown snapshot delegation message type %d", m.tp)
+	}
+	data = data[1:]
+	var fields [3]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("corrupted snapshot delegation message")
+		}
+		fields[i] = v
+		data = data[n:]
+	}
+	m.target = &metapb.Peer{Id: fields[0], StoreId: fields[1]}
+	m.minIndex = fields[2]
+	return nil
+}
+
+// delegatingSnap is the snapshot generation delegated to a follower by the leader.
+type delegatingSnap struct {
+	// task is scheduled by the leader itself if the delegation fails.
+	task      *GenSnapTask
+	target    *metapb.Peer
+	delegate  *metapb.Peer
+	startTime time.Time
+	// accepted is true after the delegate starts to generate the snapshot.
+	accepted bool
+}
+
+// delegatedSnap is the snapshot generation the follower accepts from the leader.
+type delegatedSnap struct {
+	leader   *metapb.Peer
+	target   *metapb.Peer
+	notifier chan *eraftpb.Snapshot
+	// sending is true after the snapshot is generated and handed to the transport.
+	sending   bool
+	startTime time.Time
+}
+
+func (p *Peer) newSnapDelegateMessage(to *metapb.Peer, m *snapDelegateMsg) *rspb.RaftMessage {
+	return &rspb.RaftMessage{
+		RegionId: p.regionID,
+		FromPeer: p.Meta,
+		ToPeer:   to,
+		RegionEpoch: &metapb.RegionEpoch{
+			ConfVer: p.Region().RegionEpoch.ConfVer,
+			Version: p.Region().RegionEpoch.Version,
+		},
+		Message:  &eraftpb.Message{Context: m.marshal()},
+		ExtraMsg: &rspb.ExtraMessage{Type: extraMsgTypeSnapDelegate},
+	}
+}
+
+// pickSnapDelegate returns a peer waiting for a snapshot and a caught-up follower to generate it, 0 means not found.
+func pickSnapDelegate(selfID, truncatedIdx, committedIdx uint64, progress map[uint64]raft.Progress) (targetID, delegateID uint64) {
+	ids := make([]uint64, 0, len(progress))
+	for id := range progress {
+		if id != selfID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var delegateMatch uint64
+	for _, id := range ids {
+		pr := progress[id]
+		if pr.Next <= truncatedIdx {
+			// The logs it needs have been compacted, raft is asking for a snapshot for it.
+			if targetID == 0 {
+				targetID = id
+			}
+			continue
+		}
+		if pr.State != raft.ProgressStateReplicate || !pr.RecentActive || pr.Match < committedIdx {
+			continue
+		}
+		if delegateID == 0 || pr.Match > delegateMatch {
+			delegateID, delegateMatch = id, pr.Match
+		}
+	}
+	if targetID == 0 || delegateID == 0 {
+		return 0, 0
+	}
+	return targetID, delegateID
+}
+
+// maybeDelegateSnapGeneration asks a follower to generate the snapshot the raft of the leader is requesting.
+// The generating task is kept by the leader and scheduled later if the delegation fails.
+func (d *peerMsgHandler) maybeDelegateSnapGeneration() {
+	ps := d.peer.Store()
+	if ps.genSnapTask == nil || !d.ctx.cfg.SnapGenerateOnFollower || !d.peer.IsLeader() || d.peer.delegatingSnap != nil {
+		return
+	}
+	status := d.peer.RaftGroup.Status()
+	targetID, delegateID := pickSnapDelegate(d.peerID(), ps.truncatedIndex(), status.Commit, status.Progress)
+	target, delegate := d.peer.getPeerFromCache(targetID), d.peer.getPeerFromCache(delegateID)
+	if target == nil || delegate == nil {
+		return
+	}
+	msg := d.peer.newSnapDelegateMessage(delegate, &snapDelegateMsg{
+		tp:       snapDelegateRequest,
+		target:   target,
+		minIndex: ps.truncatedIndex(),
+	})
+	if err := d.ctx.trans.Send(msg); err != nil {
+		log.S().Warnf("%s failed to ask %s to generate snapshot for %s, generate it locally: %v", d.tag(), delegate, target, err)
+		return
+	}
+	log.S().Infof("%s ask %s to generate snapshot for %s", d.tag(), delegate, target)
+	d.peer.delegatingSnap = &delegatingSnap{
+		task:      ps.genSnapTask,
+		target:    target,
+		delegate:  delegate,
+		startTime: d.peer.clock.Now(),
+	}
+	ps.genSnapTask = nil
+}
+
+// fallbackSnapGeneration lets the leader generate the snapshot itself.
+func (d *peerMsgHandler) fallbackSnapGeneration() {
+	s := d.peer.delegatingSnap
+	d.peer.delegatingSnap = nil
+	if d.peer.Store().snapState.StateType == SnapStateGenerating {
+		d.peer.Store().genSnapTask = s.task
+		d.hasReady = true
+	}
+}
+
+func (d *peerMsgHandler) onExtraMessage(msg *rspb.RaftMessage) {
+	if msg.ExtraMsg.Type != extraMsgTypeSnapDelegate {
+		log.S().Warnf("%s ignore unsupported extra message %v", d.tag(), msg.ExtraMsg.Type)
+		return
+	}
+	m := new(snapDelegateMsg)
+	if err := m.unmarshal(msg.GetMessage().GetContext()); err != nil {
+		log.S().Warnf("%s ignore invalid snapshot delegation message from %s: %v", d.tag(), msg.FromPeer, err)
+		return
+	}
+	if m.tp == snapDelegateRequest {
+		d.onGenSnapshotRequest(msg.FromPeer, msg.RegionEpoch, m)
+	} else {
+		d.onGenSnapshotResponse(msg.FromPeer, m)
+	}
+}
+
+func (d *peerMsgHandler) onGenSnapshotRequest(leader *metapb.Peer, leaderEpoch *metapb.RegionEpoch, m *snapDelegateMsg) {
+	target := m.target
+	var reason string
+	epoch := d.region().GetRegionEpoch()
+	switch {
+	case d.peer.IsLeader() || d.peer.LeaderID() != leader.GetId():
+		reason = "leader changed"
+	case leaderEpoch.GetConfVer() != epoch.GetConfVer() || leaderEpoch.GetVersion() != epoch.GetVersion():
+		reason = "epoch not match"
+	case findPeer(d.region(), target.GetStoreId()).GetId() != target.GetId():
+		reason = "target peer not found"
+	case d.peer.delegatedSnap != nil:
+		reason = "another snapshot is generating"
+	case d.peer.IsApplyingSnapshot() || d.peer.HasPendingSnapshot():
+		reason = "applying snapshot"
+	case d.peer.Store().AppliedIndex() < m.minIndex:
+		reason = "applied index is too small"
+	}
+	if reason != "" {
+		log.S().Infof("%s reject to generate snapshot for %s: %s", d.tag(), target, reason)
+		d.sendGenSnapshotResponse(leader, target, snapDelegateFailure)
+		return
+	}
+
+	log.S().Infof("%s generate snapshot for %s on behalf of leader %s", d.tag(), target, leader)
+	d.peer.insertPeerCache(leader)
+	d.peer.insertPeerCache(target)
+	ch := make(chan *eraftpb.Snapshot, 1)
+	d.peer.delegatedSnap = &delegatedSnap{
+		leader:    leader,
+		target:    target,
+		notifier:  ch,
+		startTime: d.peer.clock.Now(),
+	}
+	d.ctx.applyMsgs.appendMsg(d.regionID(), Msg{
+		Type: MsgTypeApplySnapshot,
+		Data: newGenSnapTask(d.regionID(), ch),
+	})
+	d.sendGenSnapshotResponse(leader, target, snapDelegateAccept)
+}
+
+func (d *peerMsgHandler) sendGenSnapshotResponse(leader, target *metapb.Peer, tp snapDelegateMsgType) {
+	msg := d.peer.newSnapDelegateMessage(leader, &snapDelegateMsg{tp: tp, target: target})
+	if err := d.ctx.trans.Send(msg); err != nil {
+		log.S().Warnf("%s failed to send generate snapshot response to %s: %v", d.tag(), leader, err)
+	}
+}
+
+func (d *peerMsgHandler) onGenSnapshotResponse(from *metapb.Peer, m *snapDelegateMsg) {
+	s := d.peer.delegatingSnap
+	if s == nil || s.delegate.GetId() != from.GetId() || s.target.GetId() != m.target.GetId() {
+		return
+	}
+	switch m.tp {
+	case snapDelegateAccept:
+		s.accepted = true
+		return
+	case snapDelegateFailure:
+		log.S().Infof("%s %s failed to generate snapshot for %s, generate it locally", d.tag(), s.delegate, s.target)
+		d.fallbackSnapGeneration()
+		return
+	}
+	log.S().Infof("%s %s sent snapshot to %s, takes %v", d.tag(), s.delegate, s.target, d.peer.clock.Now().Sub(s.startTime))
+	d.peer.delegatingSnap = nil
+	ps := d.peer.Store()
+	if ps.snapState.StateType == SnapStateGenerating {
+		// The snapshot the leader was waiting for is not needed anymore.
+		ps.snapState = SnapState{StateType: SnapStateRelax}
+		ps.snapTriedCnt = 0
+	}
+}
+
+// checkSnapDelegation sends the snapshot generated on behalf of the leader, and handles the timeout on both sides.
+func (d *peerMsgHandler) checkSnapDelegation() {
+	now := d.peer.clock.Now()
+	timeout := d.ctx.cfg.SnapDelegateTimeout
+	if s := d.peer.delegatingSnap; s != nil {
+		acceptTimeout := snapDelegateAcceptElections * d.ctx.cfg.RaftBaseTickInterval * time.Duration(d.ctx.cfg.RaftElectionTimeoutTicks)
+		if !d.peer.IsLeader() || now.Sub(s.startTime) > timeout || (!s.accepted && now.Sub(s.startTime) > acceptTimeout) {
+			log.S().Infof("%s generating snapshot on %s for %s is timeout, generate it locally", d.tag(), s.delegate, s.target)
+			d.fallbackSnapGeneration()
+		}
+	}
+	s := d.peer.delegatedSnap
+	if s == nil || s.sending {
+		if s != nil && now.Sub(s.startTime) > timeout {
+			d.peer.delegatedSnap = nil
+		}
+		return
+	}
+	var snap *eraftpb.Snapshot
+	select {
+	case snap = <-s.notifier:
+	default:
+		if now.Sub(s.startTime) > timeout {
+			d.peer.delegatedSnap = nil
+			d.sendGenSnapshotResponse(s.leader, s.target, snapDelegateFailure)
+		}
+		return
+	}
+	if snap.GetMetadata() == nil || d.peer.LeaderID() != s.leader.GetId() {
+		d.peer.delegatedSnap = nil
+		d.sendGenSnapshotResponse(s.leader, s.target, snapDelegateFailure)
+		return
+	}
+	// The target peer takes the snapshot as it is sent by the leader, and responds to the leader directly.
+	msg := &rspb.RaftMessage{
+		RegionId: d.regionID(),
+		FromPeer: s.leader,
+		ToPeer:   s.target,
+		RegionEpoch: &metapb.RegionEpoch{
+			ConfVer: d.region().RegionEpoch.ConfVer,
+			Version: d.region().RegionEpoch.Version,
+		},
+		Message: &eraftpb.Message{
+			MsgType:  eraftpb.MessageType_MsgSnapshot,
+			From:     s.leader.GetId(),
+			To:       s.target.GetId(),
+			Term:     d.peer.Term(),
+			Snapshot: snap,
+		},
+	}
+	if err := d.ctx.trans.Send(msg); err != nil {
+		d.peer.delegatedSnap = nil
+		d.sendGenSnapshotResponse(s.leader, s.target, snapDelegateFailure)
+		return
+	}
+	s.sending = true
+}
+
+// onDelegatedSnapshotStatus reports the status of the snapshot sent on behalf of the leader to the leader.
+// Returns false if the snapshot is not a delegated one.
+func (d *peerMsgHandler) onDelegatedSnapshotStatus(toPeerID uint64, status raft.SnapshotStatus) bool {
+	s := d.peer.delegatedSnap
+	if s == nil || !s.sending || s.target.GetId() != toPeerID {
+		return false
+	}
+	d.peer.delegatedSnap = nil
+	log.S().Infof("%s report delegated snapshot status %s %v", d.tag(), s.target, status)
+	tp := snapDelegateFailure
+	if status == raft.SnapshotFinish {
+		tp = snapDelegateFinish
+	}
+	d.sendGenSnapshotResponse(s.leader, s.target, tp)
+	return true
+}
@@ -25,6 +25,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/ngaut/unistore/util"
 	"github.com/pingcap/errors"
 	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
 	"github.com/pingcap/log"
@@ -75,8 +76,12 @@ type SnapManager struct {
 	registryLock sync.RWMutex
 	registry     map[SnapKey][]SnapEntry
 	router       *router
-	limiter      *IOLimiter
 	MaxTotalSize uint64
+
+	// The limiters are shared by all the regions in the store.
+	buildLimiter *IOLimiter
+	sendLimiter  *IOLimiter
+	applyLimiter *IOLimiter
 }
 
 // NewSnapManager returns a new SnapManager.
@@ -180,6 +185,57 @@ func (sm *SnapManager) ListIdleSnap() ([]SnapKeyWithSending, error) {
 	return results, nil
 }
 
+// deleteStaleTmpFiles deletes the tmp files left by broken snapshot transfers which are not resumed before timeout.
+// The file ages are measured in the wall time as the modification times are, not by the raftstore clock.
+func (sm *SnapManager) deleteStaleTmpFiles(timeout time.Duration) error {
+	fis, err := ioutil.ReadDir(sm.base)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(name, snapRevPrefix) || !strings.HasSuffix(name, tmpFileSuffix) {
+			continue
+		}
+		if time.Since(fi.ModTime()) < timeout {
+			continue
+		}
+		key, ok := parseSnapTmpFileName(name)
+		if !ok {
+			log.S().Warnf("failed to parse snapshot tmp file %s, skip it", name)
+			continue
+		}
+		if sm.HasRegistered(key) {
+			continue
+		}
+		log.S().Infof("delete stale snapshot tmp file %s", name)
+		if _, err = util.DeleteFileIfExists(filepath.Join(sm.base, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseSnapTmpFileName parses the snapshot key from the tmp file name like
+// "rev_{region}_{term}_{index}_{cf}.sst.tmp" or "rev_{region}_{term}_{index}.meta.tmp".
+func parseSnapTmpFileName(name string) (key SnapKey, ok bool) {
+	numberStrs := strings.SplitN(strings.SplitN(name, ".", 2)[0], "_", 5)
+	if len(numberStrs) < 4 {
+		return key, false
+	}
+	var err error
+	if key.RegionID, err = strconv.ParseUint(numberStrs[1], 10, 64); err != nil {
+		return key, false
+	}
+	if key.Term, err = strconv.ParseUint(numberStrs[2], 10, 64); err != nil {
+		return key, false
+	}
+	if key.Index, err = strconv.ParseUint(numberStrs[3], 10, 64); err != nil {
+		return key, false
+	}
+	return key, true
+}
+
 // HasRegistered checks if the snapshot key is registered.
 func (sm *SnapManager) HasRegistered(key SnapKey) bool {
 	sm.registryLock.RLock()
@@ -201,7 +257,7 @@ func (sm *SnapManager) GetSnapshotForBuilding(key SnapKey) (Snapshot, error) {
 			return nil, err
 		}
 	}
-	return NewSnapForBuilding(sm.base, key, sm.snapSize, sm, sm.limiter)
+	return NewSnapForBuilding(sm.base, key, sm.snapSize, sm, sm.buildLimiter)
 }
 
 func (sm *SnapManager) deleteOldIdleSnaps() error {
@@ -255,12 +311,12 @@ func (sm *SnapManager) GetSnapshotForReceiving(snapKey SnapKey, data []byte) (Sn
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	return NewSnapForReceiving(sm.base, snapKey, snapshotData.Meta, sm.snapSize, sm, sm.limiter)
+	return NewSnapForReceiving(sm.base, snapKey, snapshotData.Meta, sm.snapSize, sm, sm.sendLimiter)
 }
 
 // GetSnapshotForApplying gets the snapshot for applying with the given snapshot key.
 func (sm *SnapManager) GetSnapshotForApplying(snapKey SnapKey) (Snapshot, error) {
-	snap, err := NewSnapForApplying(sm.base, snapKey, sm.snapSize, sm)
+	snap, err := NewSnapForApplying(sm.base, snapKey, sm.snapSize, sm, sm.applyLimiter)
 	if err != nil {
 		return nil, err
 	}
@@ -364,7 +420,10 @@ func (sm *SnapManager) DeleteSnapshot(key SnapKey, snapshot Snapshot, checkEntry
 
 // SnapManagerBuilder represents a snapshot manager builder.
 type SnapManagerBuilder struct {
-	maxTotalSize uint64
+	maxTotalSize   uint64
+	buildRateLimit uint64
+	sendRateLimit  uint64
+	applyRateLimit uint64
 }
 
 // MaxTotalSize returns the max total size of the SnapManagerBuilder.
@@ -373,6 +432,24 @@ func (smb *SnapManagerBuilder) MaxTotalSize(v uint64) *SnapManagerBuilder {
 	return smb
 }
 
+// BuildRateLimit sets the bytes per second limit of building snapshots, 0 means no limit.
+func (smb *SnapManagerBuilder) BuildRateLimit(v uint64) *SnapManagerBuilder {
+	smb.buildRateLimit = v
+	return smb
+}
+
+// SendRateLimit sets the bytes per second limit of sending and receiving snapshots, 0 means no limit.
+func (smb *SnapManagerBuilder) SendRateLimit(v uint64) *SnapManagerBuilder {
+	smb.sendRateLimit = v
+	return smb
+}
+
+// ApplyRateLimit sets the bytes per second limit of applying snapshots, 0 means no limit.
+func (smb *SnapManagerBuilder) ApplyRateLimit(v uint64) *SnapManagerBuilder {
+	smb.applyRateLimit = v
+	return smb
+}
+
 // Build builds a router with the given path.
 func (smb *SnapManagerBuilder) Build(path string, router *router) *SnapManager {
 	var maxTotalSize uint64 = math.MaxUint64
@@ -384,7 +461,9 @@ func (smb *SnapManagerBuilder) Build(path string, router *router) *SnapManager {
 		snapSize:     new(int64),
 		registry:     map[SnapKey][]SnapEntry{},
 		router:       router,
-		limiter:      NewInfLimiter(),
 		MaxTotalSize: maxTotalSize,
+		buildLimiter: NewIOLimiter(smb.buildRateLimit),
+		sendLimiter:  NewIOLimiter(smb.sendRateLimit),
+		applyLimiter: NewIOLimiter(smb.applyRateLimit),
 	}
 }
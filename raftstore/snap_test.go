@@ -14,10 +14,15 @@
 package raftstore
 
 import (
+	"bytes"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/pingcap/badger"
 	"github.com/pingcap/badger/y"
@@ -29,6 +34,7 @@ import (
 	"github.com/pingcap/tidb/util/codec"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
 )
 
 var (
@@ -235,7 +241,7 @@ func doTestSnapFile(t *testing.T, dbHasData bool) {
 	assert.Equal(t, atomic.LoadInt64(sizeTrack), size)
 
 	// Ensure a snapshot could be applied to DB.
-	s4, err := NewSnapForApplying(dstDir, key, sizeTrack, deleter)
+	s4, err := NewSnapForApplying(dstDir, key, sizeTrack, deleter, nil)
 	require.Nil(t, err)
 	assert.True(t, s4.Exists())
 
@@ -346,7 +352,7 @@ func TestSnapshotCorruptionSizeOrChecksum(t *testing.T) {
 	assert.Equal(t, 1, len(metas))
 
 	snapMeta := metas[0]
-	s5, err := NewSnapForApplying(dstDir, key, sizeTrack, deleter)
+	s5, err := NewSnapForApplying(dstDir, key, sizeTrack, deleter, nil)
 	require.Nil(t, err)
 	require.True(t, s5.Exists())
 
@@ -368,7 +374,7 @@ func TestSnapshotCorruptionSizeOrChecksum(t *testing.T) {
 	corruptSnapSizeIn(t, dstDir)
 	_, err = NewSnapForReceiving(dstDir, key, snapMeta, sizeTrack, deleter, nil)
 	require.NotNil(t, err)
-	_, err = NewSnapForApplying(dstDir, key, sizeTrack, deleter)
+	_, err = NewSnapForApplying(dstDir, key, sizeTrack, deleter, nil)
 	require.NotNil(t, err)
 }
 
@@ -487,7 +493,7 @@ func TestSnapshotCorruptionOnMetaFile(t *testing.T) {
 
 	assert.Equal(t, 1, corruptSnapshotMetaFile(t, dstDir))
 
-	_, err = NewSnapForApplying(dstDir, key, sizeTrack, deleter)
+	_, err = NewSnapForApplying(dstDir, key, sizeTrack, deleter, nil)
 	require.NotNil(t, err)
 	_, err = NewSnapForReceiving(dstDir, key, snapData.Meta, sizeTrack, deleter, nil)
 	require.NotNil(t, err)
@@ -723,3 +729,231 @@ func TestSnapMaxTotalSize(t *testing.T) {
 	}
 }
 */
+
+func TestSnapResumeReceiving(t *testing.T) {
+	snapDir, err := ioutil.TempDir("", "snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(snapDir)
+	key := SnapKey{RegionID: 1, Term: 1, Index: 1}
+	sizeTrack := new(int64)
+	var deleter SnapshotDeleter
+
+	// Prepare a snapshot for sending.
+	s1, err := NewSnap(snapDir, key, sizeTrack, true, false, deleter, nil)
+	require.Nil(t, err)
+	var data []byte
+	for i, cfFile := range s1.CFFiles {
+		cfData := bytes.Repeat([]byte{byte(i)}, 1000*(i+1))
+		require.Nil(t, ioutil.WriteFile(cfFile.Path, cfData, 0600))
+		cfFile.Size = uint64(len(cfData))
+		cfFile.Checksum = crc32.ChecksumIEEE(cfData)
+		data = append(data, cfData...)
+	}
+	meta, err := genSnapshotMeta(s1.CFFiles)
+	require.Nil(t, err)
+	metaData, err := meta.Marshal()
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(s1.MetaFile.Path, metaData, 0600))
+	totalSize := uint64(len(data))
+
+	dstDir, err := ioutil.TempDir("", "snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dstDir)
+
+	// Receive a part of the snapshot and break.
+	s2, err := NewSnapForSending(snapDir, key, sizeTrack, deleter)
+	require.Nil(t, err)
+	s3, err := NewSnapForReceiving(dstDir, key, meta, sizeTrack, deleter, nil)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(0), s3.WrittenSize())
+	half := int64(totalSize/2) - 500
+	n, err := io.CopyN(s3, s2, half)
+	require.Nil(t, err)
+	assert.Equal(t, half, n)
+
+	// Resume from the data already received.
+	s4, err := NewSnapForReceiving(dstDir, key, meta, sizeTrack, deleter, nil)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(half), s4.WrittenSize())
+	s5, err := NewSnapForSending(snapDir, key, sizeTrack, deleter)
+	require.Nil(t, err)
+	require.Nil(t, s5.Skip(s4.WrittenSize()))
+	n, err = io.Copy(s4, s5)
+	require.Nil(t, err)
+	assert.Equal(t, int64(totalSize)-half, n)
+	require.Nil(t, s4.Save())
+	assert.True(t, s4.Exists())
+
+	s6, err := NewSnapForSending(snapDir, key, sizeTrack, deleter)
+	require.Nil(t, err)
+	assert.NotNil(t, s6.Skip(totalSize+1))
+	require.Nil(t, s6.Skip(totalSize))
+	n, err = io.Copy(ioutil.Discard, s6)
+	require.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+func TestSnapStreamOptions(t *testing.T) {
+	// The first chunk of old senders or the senders not requesting any options.
+	opts, err := unmarshalSnapStreamOptions(nil)
+	require.Nil(t, err)
+	assert.Equal(t, snapStreamOptions{}, opts)
+
+	expected := snapStreamOptions{resumable: true, compression: snapCompressionZstd}
+	opts, err = unmarshalSnapStreamOptions(expected.marshal())
+	require.Nil(t, err)
+	assert.Equal(t, expected, opts)
+
+	// The header of the receivers which don't resume.
+	assert.Equal(t, uint64(0), snapReceivedSizeFromHeader(nil))
+	assert.Equal(t, uint64(1024), snapReceivedSizeFromHeader(metadata.Pairs(snapReceivedSizeKey, "1024")))
+}
+
+func TestSnapBuildExisting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dbBundle := openDBBundle(t, dir)
+	defer dbBundle.DB.Close()
+	err = dbBundle.DB.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(&badger.Entry{
+			Key:      y.KeyWithTs(snapTestKey, 100),
+			UserMeta: mvcc.NewDBUserMeta(50, 100),
+			Value:    []byte("value"),
+		})
+	})
+	require.Nil(t, err)
+
+	snapDir, err := ioutil.TempDir("", "snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(snapDir)
+	region := genTestRegion(1, 1, 1)
+	key := SnapKey{RegionID: 1, Term: 1, Index: 1}
+	sizeTrack := new(int64)
+	var deleter SnapshotDeleter
+	build := func() (*rspb.RaftSnapshotData, *SnapStatistics) {
+		s, err := NewSnapForBuilding(snapDir, key, sizeTrack, deleter, nil)
+		require.Nil(t, err)
+		regionSnap := &regionSnapshot{txn: dbBundle.DB.NewTransaction(false), lockSnap: dbBundle.LockStore}
+		defer regionSnap.txn.Discard()
+		snapData := &rspb.RaftSnapshotData{Region: region}
+		stat := new(SnapStatistics)
+		require.Nil(t, s.Build(regionSnap, region, snapData, stat, deleter))
+		return snapData, stat
+	}
+	snapData1, stat1 := build()
+	assert.True(t, snapData1.FileSize > 0)
+	assert.NotNil(t, snapData1.Meta)
+
+	// The snapshot built for a failed send is reused with the same meta.
+	snapData2, stat2 := build()
+	assert.Equal(t, snapData1, snapData2)
+	assert.Equal(t, stat1.Size, stat2.Size)
+}
+
+func TestSnapDeleteStaleTmpFiles(t *testing.T) {
+	snapDir, err := ioutil.TempDir("", "snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(snapDir)
+	mgr := NewSnapManager(snapDir, nil)
+	mgr.Register(SnapKey{RegionID: 1, Term: 2, Index: 4}, SnapEntryReceiving)
+	names := []string{
+		"rev_1_2_3_default.sst.tmp",
+		"rev_1_2_4_default.sst.tmp",
+		"rev_bad_2_3.meta.tmp",
+		"rev.tmp",
+		"rev_1_2_5.meta.tmp",
+	}
+	stale := time.Now().Add(-time.Hour)
+	for i, name := range names {
+		path := filepath.Join(snapDir, name)
+		require.Nil(t, ioutil.WriteFile(path, []byte("data"), 0600))
+		// The last file is not stale.
+		if i < len(names)-1 {
+			require.Nil(t, os.Chtimes(path, stale, stale))
+		}
+	}
+
+	// The files with unparsable names are skipped instead of failing the GC.
+	require.Nil(t, mgr.deleteStaleTmpFiles(time.Minute))
+	for i, name := range names {
+		_, err = os.Stat(filepath.Join(snapDir, name))
+		if i == 0 {
+			assert.True(t, os.IsNotExist(err), name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+	}
+}
+
+func TestSnapBuildLockOnCommittedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dbBundle := openDBBundle(t, dir)
+	defer dbBundle.DB.Close()
+	// The lock value is written to the default CF, before the committed versions of the same key.
+	fillDBBundleData(t, dbBundle)
+
+	snapDir, err := ioutil.TempDir("", "snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(snapDir)
+	region := genTestRegion(1, 1, 1)
+	key := SnapKey{RegionID: 1, Term: 1, Index: 1}
+	sizeTrack := new(int64)
+	var deleter SnapshotDeleter
+	s1, err := NewSnapForBuilding(snapDir, key, sizeTrack, deleter, nil)
+	require.Nil(t, err)
+	regionSnap := &regionSnapshot{txn: dbBundle.DB.NewTransaction(false), lockSnap: dbBundle.LockStore}
+	snapData := &rspb.RaftSnapshotData{Region: region}
+	stat := new(SnapStatistics)
+	require.Nil(t, s1.Build(regionSnap, region, snapData, stat, deleter))
+	assert.Equal(t, 5, stat.KVCount)
+
+	applier, err := newSnapApplier(s1.CFFiles)
+	require.Nil(t, err)
+	defer applier.close()
+	var lock []byte
+	var commitTSs []uint64
+	for {
+		item, err := applier.next()
+		require.Nil(t, err)
+		if item == nil {
+			break
+		}
+		assert.Equal(t, snapTestKey, item.key.UserKey)
+		switch item.applySnapType {
+		case applySnapTypeLock:
+			lock = item.val
+		case applySnapTypePut:
+			commitTSs = append(commitTSs, item.key.Version)
+		}
+	}
+	require.NotNil(t, lock)
+	l := mvcc.DecodeLock(lock)
+	assert.Equal(t, uint64(250), l.StartTS)
+	assert.Equal(t, make([]byte, 128), l.Value)
+	assert.Equal(t, []uint64{200, 100}, commitTSs)
+}
+
+func TestSnapIOLimiter(t *testing.T) {
+	// A zero rate means no limit.
+	assert.Equal(t, NewInfLimiter().Limit(), NewIOLimiter(0).Limit())
+
+	limiter := NewIOLimiter(100 * KB)
+	data := make([]byte, 110*KB)
+	buf := new(bytes.Buffer)
+	start := time.Now()
+	// The first 100KB are allowed by the burst, the rest 10KB should wait about 100ms.
+	n, err := NewLimitWriter(buf, limiter, snapSendThrottled).Write(data)
+	require.Nil(t, err)
+	assert.Equal(t, len(data), n)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	start = time.Now()
+	out := make([]byte, len(data))
+	_, err = io.ReadFull(NewLimitReader(bytes.NewReader(data), limiter, snapSendThrottled), out)
+	require.Nil(t, err)
+	assert.Equal(t, data, out)
+	assert.True(t, time.Since(start) >= 500*time.Millisecond)
+}
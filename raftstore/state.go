@@ -16,6 +16,9 @@ package raftstore
 import (
 	"encoding/binary"
 	"fmt"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/util/codec"
 )
 
 type applyState struct {
@@ -68,3 +71,56 @@ func (s *raftState) Unmarshal(data []byte) {
 	s.commit = binary.LittleEndian.Uint64(data[16:])
 	s.lastIndex = binary.LittleEndian.Uint64(data[24:])
 }
+
+// snapshotLocks is the locks of a region applied from a snapshot. The lock store is only persisted by
+// the periodic dump, so the locks are saved with the region state when the snapshot is applied.
+type snapshotLocks struct {
+	// offset is the raft engine offset when the locks are saved, a lock store dumped at a larger
+	// offset contains the locks already.
+	offset uint64
+	// index is the snapshot index, the raft logs after it change the locks.
+	index    uint64
+	startKey []byte
+	endKey   []byte
+	// pairs is the keys and the values of the locks.
+	pairs [][]byte
+}
+
+func (s *snapshotLocks) Marshal() []byte {
+	bin := make([]byte, 16)
+	binary.LittleEndian.PutUint64(bin, s.offset)
+	binary.LittleEndian.PutUint64(bin[8:], s.index)
+	bin = codec.EncodeCompactBytes(bin, s.startKey)
+	bin = codec.EncodeCompactBytes(bin, s.endKey)
+	for _, b := range s.pairs {
+		bin = codec.EncodeCompactBytes(bin, b)
+	}
+	return bin
+}
+
+func (s *snapshotLocks) Unmarshal(data []byte) error {
+	if len(data) < 16 {
+		return errors.Errorf("invalid snapshot locks length %d", len(data))
+	}
+	s.offset = binary.LittleEndian.Uint64(data)
+	s.index = binary.LittleEndian.Uint64(data[8:])
+	var err error
+	if data, s.startKey, err = codec.DecodeCompactBytes(data[16:]); err != nil {
+		return err
+	}
+	if data, s.endKey, err = codec.DecodeCompactBytes(data); err != nil {
+		return err
+	}
+	s.pairs = s.pairs[:0]
+	for len(data) > 0 {
+		var b []byte
+		if data, b, err = codec.DecodeCompactBytes(data); err != nil {
+			return err
+		}
+		s.pairs = append(s.pairs, b)
+	}
+	if len(s.pairs)%2 != 0 {
+		return errors.Errorf("invalid snapshot locks pairs count %d", len(s.pairs))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/pdpb"
+)
+
+// threadLoad accounts the busy time of a store thread.
+type threadLoad struct {
+	name string
+	// busy is the busy time in nanoseconds since the last collect.
+	busy int64
+}
+
+// observe adds the time since start to the busy time, l can be nil.
+func (l *threadLoad) observe(start time.Time) {
+	if l != nil {
+		atomic.AddInt64(&l.busy, int64(time.Since(start)))
+	}
+}
+
+// threadLoads collects the busy time of the store threads, they are reported to PD as the CPU usages
+// of the threads, since the goroutines of a thread can't be told apart by the process CPU time.
+type threadLoads struct {
+	mu          sync.Mutex
+	loads       []*threadLoad
+	lastCollect time.Time
+}
+
+func newThreadLoads() *threadLoads {
+	return &threadLoads{lastCollect: time.Now()}
+}
+
+func (t *threadLoads) register(name string) *threadLoad {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := &threadLoad{name: name}
+	t.loads = append(t.loads, l)
+	return l
+}
+
+// collect returns the busy percent of every thread since the last collect.
+func (t *threadLoads) collect() []*pdpb.RecordPair {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	elapsed := now.Sub(t.lastCollect)
+	t.lastCollect = now
+	pairs := make([]*pdpb.RecordPair, 0, len(t.loads))
+	for _, l := range t.loads {
+		busy := atomic.SwapInt64(&l.busy, 0)
+		var percent uint64
+		if elapsed > 0 {
+			percent = uint64(busy * 100 / int64(elapsed))
+		}
+		pairs = append(pairs, &pdpb.RecordPair{Key: l.name, Value: percent})
+	}
+	return pairs
+}
+
+const (
+	diskProbeFileName = "disk_probe"
+	diskProbeSize     = 4096
+)
+
+// probeDiskLatency writes and syncs a small file in the dir, and returns the time it takes. A disk
+// going bad shows up in the latency long before the writes fail.
+func probeDiskLatency(dir string) (time.Duration, error) {
+	start := time.Now()
+	f, err := os.OpenFile(filepath.Join(dir, diskProbeFileName), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = f.Write(make([]byte, diskProbeSize)); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return time.Since(start), err
+}
@@ -0,0 +1,60 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestThreadLoads(t *testing.T) {
+	loads := newThreadLoads()
+	busy := loads.register("busy")
+	loads.register("idle")
+	var nilLoad *threadLoad
+	nilLoad.observe(time.Now())
+
+	time.Sleep(20 * time.Millisecond)
+	busy.observe(time.Now().Add(-10 * time.Millisecond))
+	pairs := loads.collect()
+	require.Len(t, pairs, 2)
+	require.Equal(t, "busy", pairs[0].Key)
+	require.True(t, pairs[0].Value > 0 && pairs[0].Value <= 50, "%d", pairs[0].Value)
+	require.Equal(t, "idle", pairs[1].Key)
+	require.Equal(t, uint64(0), pairs[1].Value)
+
+	// The busy time is reset by the collect.
+	pairs = loads.collect()
+	require.Equal(t, uint64(0), pairs[0].Value)
+}
+
+func TestProbeDiskLatency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk_probe")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dur, err := probeDiskLatency(dir)
+	require.Nil(t, err)
+	require.True(t, dur > 0)
+	info, err := os.Stat(filepath.Join(dir, diskProbeFileName))
+	require.Nil(t, err)
+	require.Equal(t, int64(diskProbeSize), info.Size())
+
+	_, err = probeDiskLatency(filepath.Join(dir, "not_exist"))
+	require.NotNil(t, err)
+}
@@ -0,0 +1,435 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/dbreader"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/pberror"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+// txnRequestTimeout is how long a transactional request waits for the response. The request may
+// still be applied after the timeout, e.g. it's proposed just before the leader is stopped.
+const txnRequestTimeout = 2 * time.Second
+
+// waitCallback waits for the response of the callback, it returns nil if it times out.
+func waitCallback(cb *Callback) *raft_cmdpb.RaftCmdResponse {
+	select {
+	case <-cb.doneCh:
+		return cb.resp
+	case <-time.After(txnRequestTimeout):
+		return nil
+	}
+}
+
+// txnLeader returns the region containing the key and its leader reported to PD.
+func (c *testCluster) txnLeader(key []byte) (*metapb.Region, *metapb.Peer, *testStore, error) {
+	region, leader := c.pd.getRegion(codec.EncodeBytes(nil, key))
+	if region == nil || leader == nil {
+		return nil, nil, nil, errors.Errorf("no leader for key %q", key)
+	}
+	s := c.getStore(leader.GetStoreId())
+	if s == nil {
+		return nil, nil, nil, errors.Errorf("store %d of the leader is not running", leader.GetStoreId())
+	}
+	return region, leader, s, nil
+}
+
+// updateLeader updates the leader reported to PD by the NotLeader error, so the next request can
+// be sent to the new leader without waiting for its heartbeat.
+func (c *testCluster) updateLeader(region *metapb.Region, err error) {
+	if pbErr, ok := errors.Cause(err).(*pberror.PBError); ok {
+		if l := pbErr.RequestErr.GetNotLeader().GetLeader(); l != nil {
+			c.pd.putRegion(region, l)
+		}
+	}
+}
+
+// txnWrite sends the prewrite of the lock or the commit if commitTS is not zero through the
+// raftDBWriter of the leader. The result is unknown if it returns an error.
+func (c *testCluster) txnWrite(key []byte, lock *mvcc.Lock, commitTS uint64) error {
+	region, leader, s, err := c.txnLeader(key)
+	if err != nil {
+		return err
+	}
+	writer := NewDBWriter(&c.globalConf, s.server.GetRaftstoreRouter())
+	ctx := &kvrpcpb.Context{
+		RegionId:    region.GetId(),
+		RegionEpoch: region.GetRegionEpoch(),
+		Peer:        leader,
+	}
+	wb := writer.NewWriteBatch(lock.StartTS, commitTS, ctx)
+	if commitTS == 0 {
+		wb.Prewrite(key, lock)
+	} else {
+		wb.Commit(key, lock)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- writer.Write(wb)
+	}()
+	select {
+	case err = <-errCh:
+		c.updateLeader(region, err)
+		return err
+	case <-time.After(txnRequestTimeout):
+		return errors.Errorf("write %q timeout", key)
+	}
+}
+
+// txnRead waits until the leader of the region containing the key has applied all the writes
+// committed before, then calls fn with the kv engine of the leader.
+func (c *testCluster) txnRead(key []byte, fn func(kv *mvcc.DBBundle)) error {
+	region, leader, s, err := c.txnLeader(key)
+	if err != nil {
+		return err
+	}
+	req := &raft_cmdpb.RaftCmdRequest{
+		Header: &raft_cmdpb.RaftRequestHeader{
+			RegionId:    region.GetId(),
+			Peer:        leader,
+			RegionEpoch: region.GetRegionEpoch(),
+		},
+		Requests: []*raft_cmdpb.Request{{CmdType: raft_cmdpb.CmdType_Snap}},
+	}
+	cb := NewCallback()
+	if err = s.server.GetRaftstoreRouter().SendCommand(req, cb); err != nil {
+		return err
+	}
+	resp := waitCallback(cb)
+	if resp == nil {
+		return errors.Errorf("read %q timeout", key)
+	}
+	if resp.GetHeader().GetError() != nil {
+		err = &pberror.PBError{RequestErr: resp.Header.Error}
+		c.updateLeader(region, err)
+		return err
+	}
+	if !c.readOnStore(leader.GetStoreId(), fn) {
+		return errors.Errorf("store %d of the leader is not running", leader.GetStoreId())
+	}
+	return nil
+}
+
+// txnRetry calls fn until it succeeds, it returns the last error after testClusterTimeout.
+func txnRetry(fn func() error) error {
+	var err error
+	for start := time.Now(); time.Since(start) < testClusterTimeout; time.Sleep(20 * time.Millisecond) {
+		if err = fn(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// TxnGet reads the key at the ts, it waits for the lock of the transaction that may be committed
+// before the ts.
+func (c *testCluster) TxnGet(key []byte, ts uint64) ([]byte, error) {
+	var val []byte
+	err := txnRetry(func() error {
+		var readErr error
+		err := c.txnRead(key, func(kv *mvcc.DBBundle) {
+			if lock := kv.LockStore.Get(key, nil); len(lock) > 0 && mvcc.DecodeLock(lock).StartTS <= ts {
+				readErr = errors.Errorf("key %q is locked", key)
+				return
+			}
+			txn := kv.DB.NewTransaction(false)
+			defer txn.Discard()
+			val, readErr = dbreader.NewDBReader(nil, nil, txn).Get(key, ts)
+		})
+		if err != nil {
+			return err
+		}
+		return readErr
+	})
+	return val, err
+}
+
+// TxnPrewrite writes the lock of the key, prewriting a key twice is harmless.
+func (c *testCluster) TxnPrewrite(key []byte, lock *mvcc.Lock) error {
+	return txnRetry(func() error {
+		return c.txnWrite(key, lock, 0)
+	})
+}
+
+// TxnCommit commits the prewritten lock of the key. Committing a key twice panics the applier, so
+// the commit is only retried after confirming that the lock still exists.
+func (c *testCluster) TxnCommit(key []byte, lock *mvcc.Lock, commitTS uint64) error {
+	if c.txnWrite(key, lock, commitTS) == nil {
+		return nil
+	}
+	return txnRetry(func() error {
+		var locked bool
+		err := c.txnRead(key, func(kv *mvcc.DBBundle) {
+			val := kv.LockStore.Get(key, nil)
+			locked = len(val) > 0 && mvcc.DecodeLock(val).StartTS == lock.StartTS
+		})
+		if err != nil || !locked {
+			return err
+		}
+		return c.txnWrite(key, lock, commitTS)
+	})
+}
+
+// bankTxn is a committed transfer, reads and writes are the balances of the accounts.
+type bankTxn struct {
+	startTS  uint64
+	commitTS uint64
+	reads    map[int]int
+	writes   map[int]int
+}
+
+// bankRead is a snapshot of the balances of all the accounts.
+type bankRead struct {
+	ts       uint64
+	balances []int
+}
+
+// bankHistory records the transfers and the snapshot reads of the bank workload.
+type bankHistory struct {
+	initial []int
+
+	mu    sync.Mutex
+	txns  []bankTxn
+	reads []bankRead
+}
+
+func (h *bankHistory) addTxn(txn bankTxn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.txns = append(h.txns, txn)
+}
+
+func (h *bankHistory) addRead(read bankRead) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reads = append(h.reads, read)
+}
+
+// check replays the transfers in the commit order and verifies that every read, including the
+// reads of the transfers, sees exactly the transfers committed before its ts. It's what snapshot
+// isolation guarantees, the total balance is never changed as a consequence.
+func (h *bankHistory) check() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	txns := append([]bankTxn(nil), h.txns...)
+	sort.Slice(txns, func(i, j int) bool { return txns[i].commitTS < txns[j].commitTS })
+	var total int
+	for _, b := range h.initial {
+		total += b
+	}
+	type query struct {
+		ts       uint64
+		balances map[int]int
+		name     string
+	}
+	queries := make([]query, 0, len(h.reads)+len(txns))
+	for i, txn := range txns {
+		if txn.commitTS <= txn.startTS {
+			return errors.Errorf("txn %d commit ts %d is not after the start ts", txn.startTS, txn.commitTS)
+		}
+		if i > 0 && txn.commitTS == txns[i-1].commitTS {
+			return errors.Errorf("txn %d and txn %d have the same commit ts %d", txns[i-1].startTS, txn.startTS, txn.commitTS)
+		}
+		var before, after int
+		for acct, b := range txn.writes {
+			before += txn.reads[acct]
+			after += b
+		}
+		if before != after {
+			return errors.Errorf("txn %d changes the balance from %d to %d", txn.startTS, before, after)
+		}
+		queries = append(queries, query{ts: txn.startTS, balances: txn.reads, name: fmt.Sprintf("txn %d", txn.startTS)})
+	}
+	for _, read := range h.reads {
+		balances := make(map[int]int, len(read.balances))
+		sum := 0
+		for acct, b := range read.balances {
+			balances[acct] = b
+			sum += b
+		}
+		if sum != total {
+			return errors.Errorf("read %d sees total %d, expect %d", read.ts, sum, total)
+		}
+		queries = append(queries, query{ts: read.ts, balances: balances, name: fmt.Sprintf("read %d", read.ts)})
+	}
+	sort.Slice(queries, func(i, j int) bool { return queries[i].ts < queries[j].ts })
+	state := append([]int(nil), h.initial...)
+	next := 0
+	for _, q := range queries {
+		for ; next < len(txns) && txns[next].commitTS < q.ts; next++ {
+			for acct, b := range txns[next].writes {
+				state[acct] = b
+			}
+		}
+		for acct, b := range q.balances {
+			if state[acct] != b {
+				return errors.Errorf("%s sees balance %d of account %d, expect %d", q.name, b, acct, state[acct])
+			}
+		}
+	}
+	return nil
+}
+
+// bankWorkload transfers money between the accounts concurrently and reads all the balances in
+// snapshots. The transfers on the same account are serialized by the latches like the scheduler
+// of the tikv server, so they never conflict.
+type bankWorkload struct {
+	c        *testCluster
+	accounts int
+	latches  []sync.Mutex
+	history  *bankHistory
+}
+
+func newBankWorkload(c *testCluster, accounts, balance int) *bankWorkload {
+	w := &bankWorkload{
+		c:        c,
+		accounts: accounts,
+		latches:  make([]sync.Mutex, accounts),
+		history:  &bankHistory{initial: make([]int, accounts)},
+	}
+	for i := 0; i < accounts; i++ {
+		w.history.initial[i] = balance
+		c.MustPut(w.key(i), []byte(strconv.Itoa(balance)))
+	}
+	return w
+}
+
+func (w *bankWorkload) key(acct int) []byte {
+	return []byte(fmt.Sprintf("t_account_%03d", acct))
+}
+
+func (w *bankWorkload) get(acct int, ts uint64) (int, error) {
+	val, err := w.c.TxnGet(w.key(acct), ts)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(val))
+}
+
+// transfer moves a random amount from one account to another with a two-phase commit.
+func (w *bankWorkload) transfer(rnd *rand.Rand) error {
+	from, to := rnd.Intn(w.accounts), rnd.Intn(w.accounts-1)
+	if to >= from {
+		to++
+	}
+	first, second := from, to
+	if first > second {
+		first, second = second, first
+	}
+	w.latches[first].Lock()
+	defer w.latches[first].Unlock()
+	w.latches[second].Lock()
+	defer w.latches[second].Unlock()
+
+	txn := bankTxn{startTS: w.c.pd.allocID(), reads: make(map[int]int), writes: make(map[int]int)}
+	for _, acct := range []int{from, to} {
+		b, err := w.get(acct, txn.startTS)
+		if err != nil {
+			return err
+		}
+		txn.reads[acct] = b
+	}
+	amount := 0
+	if txn.reads[from] > 0 {
+		amount = rnd.Intn(txn.reads[from]) + 1
+	}
+	txn.writes[from] = txn.reads[from] - amount
+	txn.writes[to] = txn.reads[to] + amount
+
+	primary := w.key(from)
+	locks := make(map[int]*mvcc.Lock, 2)
+	for _, acct := range []int{from, to} {
+		value := []byte(strconv.Itoa(txn.writes[acct]))
+		locks[acct] = &mvcc.Lock{
+			LockHdr: mvcc.LockHdr{
+				StartTS:    txn.startTS,
+				TTL:        3000,
+				Op:         uint8(kvrpcpb.Op_Put),
+				PrimaryLen: uint16(len(primary)),
+			},
+			Primary: primary,
+			Value:   value,
+		}
+		if err := w.c.TxnPrewrite(w.key(acct), locks[acct]); err != nil {
+			return err
+		}
+	}
+	txn.commitTS = w.c.pd.allocID()
+	for _, acct := range []int{from, to} {
+		if err := w.c.TxnCommit(w.key(acct), locks[acct], txn.commitTS); err != nil {
+			return err
+		}
+	}
+	w.history.addTxn(txn)
+	return nil
+}
+
+// read reads the balances of all the accounts in a snapshot.
+func (w *bankWorkload) read() error {
+	read := bankRead{ts: w.c.pd.allocID(), balances: make([]int, w.accounts)}
+	for acct := range read.balances {
+		b, err := w.get(acct, read.ts)
+		if err != nil {
+			return err
+		}
+		read.balances[acct] = b
+	}
+	w.history.addRead(read)
+	return nil
+}
+
+// run runs the transfer and read workers until stopCh is closed, and returns the first error.
+func (w *bankWorkload) run(transferWorkers, readWorkers int, stopCh <-chan struct{}) error {
+	var wg sync.WaitGroup
+	errCh := make(chan error, transferWorkers+readWorkers)
+	worker := func(seed int64, fn func(rnd *rand.Rand) error) {
+		defer wg.Done()
+		rnd := rand.New(rand.NewSource(seed))
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			if err := fn(rnd); err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}
+	for i := 0; i < transferWorkers; i++ {
+		wg.Add(1)
+		go worker(int64(i), w.transfer)
+	}
+	for i := 0; i < readWorkers; i++ {
+		wg.Add(1)
+		go worker(int64(i), func(*rand.Rand) error { return w.read() })
+	}
+	wg.Wait()
+	close(errCh)
+	return <-errCh
+}
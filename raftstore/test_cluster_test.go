@@ -0,0 +1,781 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ngaut/unistore/config"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/store/mockstore/unistore/lockstore"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/dbreader"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/pberror"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng1987/raft"
+)
+
+// testClusterTimeout is how long the Must* helpers of the test cluster wait before failing the test.
+const testClusterTimeout = 10 * time.Second
+
+// testCluster runs multiple raft stores in one process. The stores talk to each other by
+// testTransport and share a mockPD.
+type testCluster struct {
+	t          *testing.T
+	dir        string
+	pd         *mockPD
+	globalConf config.Config
+	cfgFn      func(*Config)
+
+	mu     sync.RWMutex
+	stores map[uint64]*testStore
+	// storeIDs keeps the stores in the order they are created.
+	storeIDs []uint64
+	// filters are added to every store, including the restarted ones.
+	filters []RaftMessageFilter
+
+	// clock is shared by all the stores in the simulation mode, and is advanced by driveClock.
+	clock       *SimClock
+	clockPaused int32
+	clockStopCh chan struct{}
+	// rnd is seeded in the simulation mode, the random choices of a test should use it to be replayed.
+	rnd *rand.Rand
+}
+
+type testStore struct {
+	id      uint64
+	dir     string
+	pdCli   *mockPDClient
+	engines *Engines
+	server  *RaftInnerServer
+	rm      *RaftRegionManager
+	stopped bool
+}
+
+func newTestRaftConfig() *Config {
+	cfg := NewDefaultConfig()
+	cfg.RaftBaseTickInterval = 10 * time.Millisecond
+	cfg.RaftStoreMaxLeaderLease = 50 * time.Millisecond
+	cfg.PdHeartbeatTickInterval = 50 * time.Millisecond
+	cfg.PdStoreHeartbeatTickInterval = time.Second
+	cfg.RaftLogGCTickInterval = 50 * time.Millisecond
+	cfg.RaftRejectTransferLeaderDuration = 0
+	cfg.CoalesceHeartbeats = true
+	return cfg
+}
+
+// newTestCluster starts a cluster with count stores. The first store bootstraps the cluster, so all
+// the regions only have a peer on it at the beginning. cfgFn can be used to adjust the store configs.
+func newTestCluster(t *testing.T, count int, cfgFn func(*Config)) *testCluster {
+	return newTestClusterWithConf(t, count, config.DefaultConf, cfgFn)
+}
+
+// newTestClusterWithConf starts a cluster like newTestCluster with the global config of the stores,
+// e.g. to write the raft logs in another format.
+func newTestClusterWithConf(t *testing.T, count int, conf config.Config, cfgFn func(*Config)) *testCluster {
+	return startTestCluster(t, count, conf, nil, rand.New(rand.NewSource(time.Now().UnixNano())), cfgFn)
+}
+
+var simSeed = flag.Int64("sim-seed", 0, "the seed of the simulation mode test clusters, 0 means a random seed")
+
+// newSimTestCluster starts a cluster in the simulation mode, the stores share a SimClock which is
+// advanced by a base tick interval every millisecond until the clock is paused. The seed is logged,
+// the test can be replayed by the -sim-seed flag.
+func newSimTestCluster(t *testing.T, count int, cfgFn func(*Config)) *testCluster {
+	seed := *simSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	t.Logf("sim test cluster seed %d", seed)
+	return startTestCluster(t, count, config.DefaultConf, NewSimClock(time.Now()), rand.New(rand.NewSource(seed)), cfgFn)
+}
+
+func startTestCluster(t *testing.T, count int, conf config.Config, clock *SimClock, rnd *rand.Rand, cfgFn func(*Config)) *testCluster {
+	dir, err := ioutil.TempDir("", "unistore_cluster")
+	require.Nil(t, err)
+	c := &testCluster{
+		t:          t,
+		dir:        dir,
+		pd:         newMockPD(1),
+		globalConf: conf,
+		cfgFn:      cfgFn,
+		stores:     make(map[uint64]*testStore),
+		clock:      clock,
+		rnd:        rnd,
+	}
+	if clock != nil {
+		c.clockStopCh = make(chan struct{})
+		go c.driveClock()
+	}
+	for i := 0; i < count; i++ {
+		s := &testStore{
+			dir:   filepath.Join(dir, fmt.Sprintf("store%d", i)),
+			pdCli: c.pd.newClient(),
+		}
+		c.startStore(s)
+		c.mu.Lock()
+		c.stores[s.id] = s
+		c.storeIDs = append(c.storeIDs, s.id)
+		c.mu.Unlock()
+	}
+	// The first store splits the bootstrapped region into 5 regions, wait for PD to know them so
+	// the tests start with a stable region layout.
+	c.retry(func() bool {
+		return c.pd.regionCount() >= 5
+	}, "pre-split regions are not reported to PD")
+	return c
+}
+
+func openTestStoreEngines(t *testing.T, dir string) *Engines {
+	kvPath, raftPath := filepath.Join(dir, "kv"), filepath.Join(dir, "raft")
+	require.Nil(t, os.MkdirAll(kvPath, os.ModePerm))
+	require.Nil(t, os.MkdirAll(raftPath, os.ModePerm))
+	kvOpts := badger.DefaultOptions
+	kvOpts.Dir = kvPath
+	kvOpts.ValueDir = kvPath
+	kvOpts.ValueThreshold = 256
+	kvOpts.ManagedTxns = true
+	kvDB, err := badger.Open(kvOpts)
+	require.Nil(t, err)
+	raftOpts := badger.DefaultOptions
+	raftOpts.Dir = raftPath
+	raftOpts.ValueDir = raftPath
+	raftOpts.ValueThreshold = 0
+	raftDB, err := badger.Open(raftOpts)
+	require.Nil(t, err)
+	bundle := &mvcc.DBBundle{
+		DB:        kvDB,
+		LockStore: lockstore.NewMemStore(8 << 20),
+	}
+	raftEngine := NewBadgerRaftEngine(raftDB)
+	require.Nil(t, RestoreLockStore(0, bundle, raftEngine))
+	return NewEngines(bundle, raftEngine, kvPath, raftPath)
+}
+
+func (c *testCluster) startStore(s *testStore) {
+	s.engines = openTestStoreEngines(c.t, s.dir)
+	cfg := newTestRaftConfig()
+	if c.cfgFn != nil {
+		c.cfgFn(cfg)
+	}
+	if c.clock != nil {
+		cfg.Clock = c.clock
+	}
+	cfg.SnapPath = filepath.Join(s.dir, "snap")
+	require.Nil(c.t, os.MkdirAll(cfg.SnapPath, os.ModePerm))
+	s.server = NewRaftInnerServer(&c.globalConf, s.engines, cfg)
+	s.server.Setup(s.pdCli)
+	s.rm = NewRaftRegionManager(s.server.GetStoreMeta(), s.server.GetRaftstoreRouter(), tikv.NewDetectorServer())
+	s.server.SetPeerEventObserver(s.rm)
+	s.server.trans = &testTransport{cluster: c, store: s, coalesce: cfg.CoalesceHeartbeats, heartbeats: newHeartbeatCoalescer()}
+	require.Nil(c.t, s.server.Start(s.pdCli))
+	c.mu.RLock()
+	for _, f := range c.filters {
+		s.server.AddRaftMessageFilter(f)
+	}
+	c.mu.RUnlock()
+	s.id = s.server.GetStoreMeta().GetId()
+	c.mu.Lock()
+	s.stopped = false
+	c.mu.Unlock()
+}
+
+// StopStore stops the store, the messages sent to it are dropped until it's restarted.
+func (c *testCluster) StopStore(storeID uint64) {
+	c.mu.Lock()
+	s := c.stores[storeID]
+	require.False(c.t, s.stopped)
+	s.stopped = true
+	c.mu.Unlock()
+	// Stop the store out of the lock, the raftstore may be blocked on sending messages.
+	require.Nil(c.t, s.server.Stop())
+	// No more peer events are sent after the store is stopped, stop the event handler so the stopped
+	// store can be released.
+	close(s.rm.eventCh)
+}
+
+// RestartStore starts the stopped store with its data.
+func (c *testCluster) RestartStore(storeID uint64) {
+	c.mu.Lock()
+	s := c.stores[storeID]
+	require.True(c.t, s.stopped)
+	c.mu.Unlock()
+	// Start the store out of the lock, it may send messages to the other stores.
+	c.startStore(s)
+	require.Equal(c.t, storeID, s.id)
+}
+
+// Shutdown stops all the stores and removes the data.
+func (c *testCluster) Shutdown() {
+	for _, id := range c.storeIDs {
+		c.mu.RLock()
+		stopped := c.stores[id].stopped
+		c.mu.RUnlock()
+		if !stopped {
+			c.StopStore(id)
+		}
+	}
+	if c.clockStopCh != nil {
+		close(c.clockStopCh)
+	}
+	_ = os.RemoveAll(c.dir)
+}
+
+func (c *testCluster) driveClock() {
+	step := newTestRaftConfig().RaftBaseTickInterval
+	for {
+		select {
+		case <-c.clockStopCh:
+			return
+		case <-time.After(time.Millisecond):
+		}
+		if atomic.LoadInt32(&c.clockPaused) == 0 {
+			c.clock.Advance(step)
+		}
+	}
+}
+
+// PauseClock stops advancing the clock of the simulation mode, nothing depending on time happens
+// until the clock is advanced again.
+func (c *testCluster) PauseClock() {
+	atomic.StoreInt32(&c.clockPaused, 1)
+}
+
+// ResumeClock advances the clock of the simulation mode continuously again.
+func (c *testCluster) ResumeClock() {
+	atomic.StoreInt32(&c.clockPaused, 0)
+}
+
+// AdvanceClock advances the paused clock of the simulation mode by d, tick by tick.
+func (c *testCluster) AdvanceClock(d time.Duration) {
+	step := newTestRaftConfig().RaftBaseTickInterval
+	for ; d > 0; d -= step {
+		if d < step {
+			step = d
+		}
+		c.clock.Advance(step)
+		// Let the workers receive the tick before the next one.
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// AddFilter adds the filter to the outgoing raft messages of all the stores.
+func (c *testCluster) AddFilter(f RaftMessageFilter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.filters = append(c.filters, f)
+	for _, s := range c.stores {
+		if !s.stopped {
+			s.server.AddRaftMessageFilter(f)
+		}
+	}
+}
+
+// ClearFilters removes all the filters of the stores.
+func (c *testCluster) ClearFilters() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.filters = nil
+	for _, s := range c.stores {
+		if !s.stopped {
+			s.server.ClearRaftMessageFilters()
+		}
+	}
+}
+
+// Partition splits the stores into groups which can't talk to each other.
+func (c *testCluster) Partition(groups ...[]uint64) {
+	c.AddFilter(NewPartitionFilter(groups...))
+}
+
+// getStore returns the store if it's running.
+func (c *testCluster) getStore(storeID uint64) *testStore {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	s, ok := c.stores[storeID]
+	if !ok || s.stopped {
+		return nil
+	}
+	return s
+}
+
+// retry calls fn until it returns true, the test fails after testClusterTimeout.
+func (c *testCluster) retry(fn func() bool, format string, args ...interface{}) {
+	start := time.Now()
+	for !fn() {
+		if time.Since(start) > testClusterTimeout {
+			require.FailNow(c.t, fmt.Sprintf(format, args...))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// GetRegion returns the region containing the user key. Note that only the keys in the TiDB data
+// range, e.g. "t..." keys, are included in the snapshots.
+func (c *testCluster) GetRegion(key []byte) *metapb.Region {
+	var region *metapb.Region
+	c.retry(func() bool {
+		region, _ = c.pd.getRegion(codec.EncodeBytes(nil, key))
+		return region != nil
+	}, "region not found for %q", key)
+	return region
+}
+
+// LeaderOf returns the leader of the region reported to PD.
+func (c *testCluster) LeaderOf(regionID uint64) *metapb.Peer {
+	_, leader := c.pd.getRegionByID(regionID)
+	return leader
+}
+
+// sendRequest sends the request to the leader of the region, it retries if the request is rejected
+// before being proposed.
+func (c *testCluster) sendRequest(regionID uint64, fn func(region *metapb.Region, leader *metapb.Peer, s *testStore) error) {
+	var lastErr error
+	for start := time.Now(); time.Since(start) < testClusterTimeout; time.Sleep(20 * time.Millisecond) {
+		region, leader := c.pd.getRegionByID(regionID)
+		if region == nil || leader == nil {
+			continue
+		}
+		s := c.getStore(leader.GetStoreId())
+		if s == nil {
+			continue
+		}
+		lastErr = fn(region, leader, s)
+		if lastErr == nil {
+			return
+		}
+		if !isRetryableRequestErr(lastErr) {
+			require.FailNow(c.t, fmt.Sprintf("region %d request failed: %v", regionID, lastErr))
+		}
+		if l := errors.Cause(lastErr).(*pberror.PBError).RequestErr.GetNotLeader().GetLeader(); l != nil {
+			c.pd.putRegion(region, l)
+		}
+	}
+	require.FailNow(c.t, fmt.Sprintf("region %d request timeout, last error: %v", regionID, lastErr))
+}
+
+// isRetryableRequestErr returns true if the request is rejected before being applied, or the conf
+// change is rejected because the newly added peer hasn't caught up yet.
+func isRetryableRequestErr(err error) bool {
+	pbErr, ok := errors.Cause(err).(*pberror.PBError)
+	if !ok {
+		return false
+	}
+	reqErr := pbErr.RequestErr
+	return reqErr.GetNotLeader() != nil || reqErr.GetEpochNotMatch() != nil || reqErr.GetServerIsBusy() != nil ||
+		reqErr.GetRegionNotFound() != nil || reqErr.GetStaleCommand() != nil || strings.HasPrefix(reqErr.GetMessage(), "unsafe to perform conf change")
+}
+
+func (c *testCluster) sendAdminRequest(regionID uint64, admin *raft_cmdpb.AdminRequest) *raft_cmdpb.AdminResponse {
+	var resp *raft_cmdpb.AdminResponse
+	c.sendRequest(regionID, func(region *metapb.Region, leader *metapb.Peer, s *testStore) error {
+		req := &raft_cmdpb.RaftCmdRequest{
+			Header: &raft_cmdpb.RaftRequestHeader{
+				RegionId:    regionID,
+				Peer:        leader,
+				RegionEpoch: region.RegionEpoch,
+			},
+			AdminRequest: admin,
+		}
+		cb := NewCallback()
+		if err := s.server.GetRaftstoreRouter().SendCommand(req, cb); err != nil {
+			return &pberror.PBError{RequestErr: ErrResp(err).Header.Error}
+		}
+		cmdResp := cb.wait(0)
+		if cmdResp.GetHeader().GetError() != nil {
+			return &pberror.PBError{RequestErr: cmdResp.Header.Error}
+		}
+		resp = cmdResp.AdminResponse
+		return nil
+	})
+	return resp
+}
+
+// MustPut writes the key with a prewrite and a commit through raft.
+func (c *testCluster) MustPut(key, value []byte) {
+	lock := c.newTestLock(key, value)
+	c.mustWriteLock(key, lock, 0)
+	c.mustWriteLock(key, lock, c.pd.allocID())
+}
+
+// MustPrewrite prewrites the key through raft and returns the start ts of the lock.
+func (c *testCluster) MustPrewrite(key, value []byte) uint64 {
+	lock := c.newTestLock(key, value)
+	c.mustWriteLock(key, lock, 0)
+	return lock.StartTS
+}
+
+func (c *testCluster) newTestLock(key, value []byte) *mvcc.Lock {
+	return &mvcc.Lock{
+		LockHdr: mvcc.LockHdr{
+			StartTS:    c.pd.allocID(),
+			TTL:        3000,
+			Op:         uint8(kvrpcpb.Op_Put),
+			PrimaryLen: uint16(len(key)),
+		},
+		Primary: key,
+		Value:   value,
+	}
+}
+
+// mustWriteLock prewrites the lock if commitTS is 0, otherwise commits it.
+func (c *testCluster) mustWriteLock(key []byte, lock *mvcc.Lock, commitTS uint64) {
+	c.mustWrite(key, lock.StartTS, commitTS, func(wb mvcc.WriteBatch) {
+		if commitTS > 0 {
+			wb.Commit(key, lock)
+		} else {
+			wb.Prewrite(key, lock)
+		}
+	})
+}
+
+// mustWrite proposes the writes of the transaction to the region containing the key.
+func (c *testCluster) mustWrite(key []byte, startTS, commitTS uint64, fn func(wb mvcc.WriteBatch)) {
+	regionID := c.GetRegion(key).GetId()
+	c.sendRequest(regionID, func(region *metapb.Region, leader *metapb.Peer, s *testStore) error {
+		writer := NewDBWriter(&c.globalConf, s.server.GetRaftstoreRouter())
+		ctx := &kvrpcpb.Context{
+			RegionId:    region.GetId(),
+			RegionEpoch: region.GetRegionEpoch(),
+			Peer:        leader,
+		}
+		wb := writer.NewWriteBatch(startTS, commitTS, ctx)
+		fn(wb)
+		return writer.Write(wb)
+	})
+}
+
+// mustDeleteRange deletes the transactional data and locks in [startKey, endKey) of the region
+// containing startKey through the DBWriter.
+func (c *testCluster) mustDeleteRange(startKey, endKey []byte) {
+	regionID := c.GetRegion(startKey).GetId()
+	c.sendRequest(regionID, func(region *metapb.Region, leader *metapb.Peer, s *testStore) error {
+		regCtx, regErr := s.rm.GetRegionFromCtx(&kvrpcpb.Context{
+			RegionId:    region.GetId(),
+			RegionEpoch: region.GetRegionEpoch(),
+			Peer:        leader,
+		})
+		if regErr != nil {
+			return &pberror.PBError{RequestErr: regErr}
+		}
+		writer := NewDBWriter(&c.globalConf, s.server.GetRaftstoreRouter())
+		return writer.DeleteRange(startKey, endKey, regCtx)
+	})
+}
+
+// mustRawWrite proposes the raw kv writes to the region containing the key.
+func (c *testCluster) mustRawWrite(key []byte, fn func(wb rawWriteBatch)) {
+	regionID := c.GetRegion(key).GetId()
+	c.sendRequest(regionID, func(region *metapb.Region, leader *metapb.Peer, s *testStore) error {
+		writer := NewDBWriter(&c.globalConf, s.server.GetRaftstoreRouter()).(*raftDBWriter)
+		wb := writer.newRawWriteBatch(&kvrpcpb.Context{
+			RegionId:    region.GetId(),
+			RegionEpoch: region.GetRegionEpoch(),
+			Peer:        leader,
+		})
+		fn(wb)
+		return writer.Write(wb)
+	})
+}
+
+// GetRawOnStore reads the raw kv value of the key on the store.
+func (c *testCluster) GetRawOnStore(storeID uint64, key []byte) []byte {
+	var val []byte
+	var err error
+	ok := c.readOnStore(storeID, func(kv *mvcc.DBBundle) {
+		txn := kv.DB.NewTransaction(false)
+		defer txn.Discard()
+		val, err = getRawValue(txn, key)
+	})
+	require.True(c.t, ok, "store %d is not running", storeID)
+	require.Nil(c.t, err)
+	return val
+}
+
+// MustRawGetEqualOnStore waits until the raw kv value of the key is replicated to the store.
+func (c *testCluster) MustRawGetEqualOnStore(storeID uint64, key, value []byte) {
+	c.retry(func() bool {
+		return bytes.Equal(c.GetRawOnStore(storeID, key), value)
+	}, "raw value of %q on store %d mismatch", key, storeID)
+}
+
+// readOnStore calls fn with the kv engine of the store, the store can't be stopped until fn returns.
+// It returns false if the store is not running.
+func (c *testCluster) readOnStore(storeID uint64, fn func(kv *mvcc.DBBundle)) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	s, ok := c.stores[storeID]
+	if !ok || s.stopped {
+		return false
+	}
+	fn(s.engines.kv)
+	return true
+}
+
+// GetOnStore reads the latest committed value of the key on the store.
+func (c *testCluster) GetOnStore(storeID uint64, key []byte) []byte {
+	var val []byte
+	var err error
+	ok := c.readOnStore(storeID, func(kv *mvcc.DBBundle) {
+		txn := kv.DB.NewTransaction(false)
+		defer txn.Discard()
+		val, err = dbreader.NewDBReader(nil, nil, txn).Get(key, math.MaxUint64)
+	})
+	require.True(c.t, ok, "store %d is not running", storeID)
+	require.Nil(c.t, err)
+	return val
+}
+
+// GetLockOnStore reads the lock of the key in the lock store of the store.
+func (c *testCluster) GetLockOnStore(storeID uint64, key []byte) []byte {
+	var val []byte
+	ok := c.readOnStore(storeID, func(kv *mvcc.DBBundle) {
+		val = kv.LockStore.Get(key, nil)
+	})
+	require.True(c.t, ok, "store %d is not running", storeID)
+	return val
+}
+
+// MustLockOnStore waits until the lock store of the store has the lock of startTS for the key, or no
+// lock for the key if startTS is 0.
+func (c *testCluster) MustLockOnStore(storeID uint64, key []byte, startTS uint64) {
+	c.retry(func() bool {
+		val := c.GetLockOnStore(storeID, key)
+		if startTS == 0 {
+			return len(val) == 0
+		}
+		return len(val) > 0 && mvcc.DecodeLock(val).StartTS == startTS
+	}, "lock of %q on store %d mismatch", key, storeID)
+}
+
+// MustGet reads the key on the leader.
+func (c *testCluster) MustGet(key []byte) []byte {
+	var val []byte
+	regionID := c.GetRegion(key).GetId()
+	c.retry(func() bool {
+		leader := c.LeaderOf(regionID)
+		if leader == nil || c.getStore(leader.GetStoreId()) == nil {
+			return false
+		}
+		val = c.GetOnStore(leader.GetStoreId(), key)
+		return true
+	}, "no leader for region %d", regionID)
+	return val
+}
+
+// MustGetEqualOnStore waits until the value of the key is replicated to the store.
+func (c *testCluster) MustGetEqualOnStore(storeID uint64, key, value []byte) {
+	c.retry(func() bool {
+		return bytes.Equal(c.GetOnStore(storeID, key), value)
+	}, "value of %q on store %d mismatch", key, storeID)
+}
+
+// MustTransferLeader transfers the leader of the region to the peer.
+func (c *testCluster) MustTransferLeader(regionID uint64, peer *metapb.Peer) {
+	c.retry(func() bool {
+		if c.LeaderOf(regionID).GetId() == peer.GetId() {
+			return true
+		}
+		c.sendAdminRequest(regionID, &raft_cmdpb.AdminRequest{
+			CmdType:        raft_cmdpb.AdminCmdType_TransferLeader,
+			TransferLeader: &raft_cmdpb.TransferLeaderRequest{Peer: peer},
+		})
+		time.Sleep(100 * time.Millisecond)
+		return c.LeaderOf(regionID).GetId() == peer.GetId()
+	}, "failed to transfer leader of region %d to %s", regionID, peer)
+}
+
+func (c *testCluster) mustChangePeer(regionID uint64, tp eraftpb.ConfChangeType, peer *metapb.Peer) {
+	c.sendAdminRequest(regionID, &raft_cmdpb.AdminRequest{
+		CmdType: raft_cmdpb.AdminCmdType_ChangePeer,
+		ChangePeer: &raft_cmdpb.ChangePeerRequest{
+			ChangeType: tp,
+			Peer:       peer,
+		},
+	})
+}
+
+// MustAddPeer adds a peer on the store to the region and waits until it's initialized.
+func (c *testCluster) MustAddPeer(regionID, storeID uint64) *metapb.Peer {
+	peer := &metapb.Peer{Id: c.pd.allocID(), StoreId: storeID}
+	c.mustChangePeer(regionID, eraftpb.ConfChangeType_AddNode, peer)
+	c.retry(func() bool {
+		s := c.getStore(storeID)
+		if s == nil {
+			return false
+		}
+		state, err := getRegionLocalState(s.engines.kv.DB, regionID)
+		return err == nil && state.GetState() == rspb.PeerState_Normal && findPeer(state.Region, storeID).GetId() == peer.GetId()
+	}, "peer %s of region %d is not initialized", peer, regionID)
+	return peer
+}
+
+// MustRemovePeer removes the peer from the region and waits until it's destroyed.
+func (c *testCluster) MustRemovePeer(regionID uint64, peer *metapb.Peer) {
+	c.mustChangePeer(regionID, eraftpb.ConfChangeType_RemoveNode, peer)
+	c.MustPeerTombstone(regionID, peer)
+}
+
+// MustPeerTombstone waits until the peer is destroyed.
+func (c *testCluster) MustPeerTombstone(regionID uint64, peer *metapb.Peer) {
+	c.retry(func() bool {
+		s := c.getStore(peer.GetStoreId())
+		if s == nil {
+			return true
+		}
+		state, err := getRegionLocalState(s.engines.kv.DB, regionID)
+		return err == nil && state.GetState() == rspb.PeerState_Tombstone
+	}, "peer %s of region %d is not destroyed", peer, regionID)
+}
+
+// MustSplit splits the region containing the user key at the key, and returns the left and right regions.
+func (c *testCluster) MustSplit(key []byte) (left, right *metapb.Region) {
+	splitKey := codec.EncodeBytes(nil, key)
+	regionID := c.GetRegion(key).GetId()
+	c.retry(func() bool {
+		region, leader := c.pd.getRegionByID(regionID)
+		if bytes.Equal(region.GetStartKey(), splitKey) || bytes.Equal(region.GetEndKey(), splitKey) {
+			return true
+		}
+		if leader == nil || c.getStore(leader.GetStoreId()) == nil {
+			return false
+		}
+		_, _ = c.getStore(leader.GetStoreId()).server.GetRaftstoreRouter().SplitRegion(&kvrpcpb.Context{
+			RegionId:    regionID,
+			RegionEpoch: region.GetRegionEpoch(),
+			Peer:        leader,
+		}, [][]byte{splitKey})
+		return false
+	}, "failed to split region %d at %q", regionID, key)
+	c.retry(func() bool {
+		left, _ = c.pd.getRegion(splitKey[:len(splitKey)-1])
+		right, _ = c.pd.getRegion(splitKey)
+		return left != nil && right != nil && left.GetId() != right.GetId()
+	}, "split regions of %q not found", key)
+	return left, right
+}
+
+// testTransport delivers the raft messages to the stores of the test cluster directly, the heartbeats
+// are coalesced like the RaftClient does.
+type testTransport struct {
+	cluster    *testCluster
+	store      *testStore
+	coalesce   bool
+	heartbeats *heartbeatCoalescer
+}
+
+func (t *testTransport) Send(msg *rspb.RaftMessage) error {
+	if msg.GetMessage().GetSnapshot() != nil {
+		go t.sendSnapshot(msg)
+		return nil
+	}
+	if t.coalesce && t.heartbeats.add(msg) {
+		return nil
+	}
+	return t.send(msg)
+}
+
+func (t *testTransport) Flush() {
+	t.heartbeats.flush(func(msg *rspb.RaftMessage) {
+		if err := t.send(msg); err != nil {
+			log.S().Error(err)
+		}
+	})
+}
+
+func (t *testTransport) send(msg *rspb.RaftMessage) error {
+	t.cluster.mu.RLock()
+	defer t.cluster.mu.RUnlock()
+	if to, ok := t.cluster.stores[msg.GetToPeer().GetStoreId()]; ok && !to.stopped {
+		return to.server.router.sendRaftMessage(msg)
+	}
+	return nil
+}
+
+func (t *testTransport) sendSnapshot(msg *rspb.RaftMessage) {
+	status := raft.SnapshotFinish
+	if err := t.copySnapshot(msg); err != nil {
+		log.S().Warnf("failed to send snapshot %s: %v", msg.GetMessage().GetSnapshot().GetMetadata(), err)
+		status = raft.SnapshotFailure
+	}
+	t.cluster.mu.RLock()
+	defer t.cluster.mu.RUnlock()
+	if !t.store.stopped {
+		(&ServerTransport{router: t.store.server.router}).ReportSnapshotStatus(msg, status)
+	}
+}
+
+// copySnapshot copies the snapshot files from the sender to the receiver like the snapRunner does.
+func (t *testTransport) copySnapshot(msg *rspb.RaftMessage) error {
+	to := t.cluster.getStore(msg.GetToPeer().GetStoreId())
+	if to == nil {
+		return errors.Errorf("store %d is not running", msg.GetToPeer().GetStoreId())
+	}
+	key, err := SnapKeyFromSnap(msg.GetMessage().GetSnapshot())
+	if err != nil {
+		return err
+	}
+	fromMgr, toMgr := t.store.server.snapManager, to.server.snapManager
+	fromMgr.Register(key, SnapEntrySending)
+	defer fromMgr.Deregister(key, SnapEntrySending)
+	src, err := fromMgr.GetSnapshotForSending(key)
+	if err != nil {
+		return err
+	}
+	if !src.Exists() {
+		return errors.Errorf("missing snap file: %v", src.Path())
+	}
+	dst, err := toMgr.GetSnapshotForReceiving(key, msg.GetMessage().GetSnapshot().GetData())
+	if err != nil {
+		return err
+	}
+	if !dst.Exists() {
+		toMgr.Register(key, SnapEntryReceiving)
+		defer toMgr.Deregister(key, SnapEntryReceiving)
+		if _, err = io.Copy(dst, src); err != nil {
+			return err
+		}
+		if err = dst.Save(); err != nil {
+			return err
+		}
+	}
+	t.cluster.mu.RLock()
+	defer t.cluster.mu.RUnlock()
+	if to.stopped {
+		return errors.Errorf("store %d is not running", to.id)
+	}
+	return to.server.router.sendRaftMessage(msg)
+}
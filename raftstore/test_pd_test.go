@@ -0,0 +1,240 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/pdpb"
+	pdclient "github.com/tikv/pd/client"
+)
+
+// mockPD is an in-memory PD shared by all the stores of a test cluster.
+type mockPD struct {
+	clusterID uint64
+	id        uint64
+
+	mu           sync.RWMutex
+	bootstrapped bool
+	stores       map[uint64]*metapb.Store
+	regions      map[uint64]*metapb.Region
+	leaders      map[uint64]*metapb.Peer
+	storeStats   map[uint64]*pdpb.StoreStats
+}
+
+func newMockPD(clusterID uint64) *mockPD {
+	return &mockPD{
+		clusterID:  clusterID,
+		stores:     make(map[uint64]*metapb.Store),
+		regions:    make(map[uint64]*metapb.Region),
+		leaders:    make(map[uint64]*metapb.Peer),
+		storeStats: make(map[uint64]*pdpb.StoreStats),
+	}
+}
+
+func (pd *mockPD) allocID() uint64 {
+	return atomic.AddUint64(&pd.id, 1)
+}
+
+// putRegion updates the region if it's not older than the one in PD.
+func (pd *mockPD) putRegion(region *metapb.Region, leader *metapb.Peer) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	if old, ok := pd.regions[region.GetId()]; ok && IsEpochStale(region.GetRegionEpoch(), old.GetRegionEpoch()) {
+		return
+	}
+	// Remove the stale regions overlapped with the new one, they must have been split or merged.
+	for id, r := range pd.regions {
+		if id != region.GetId() && regionOverlaps(r, region) && IsEpochStale(r.GetRegionEpoch(), region.GetRegionEpoch()) {
+			delete(pd.regions, id)
+			delete(pd.leaders, id)
+		}
+	}
+	pd.regions[region.GetId()] = proto.Clone(region).(*metapb.Region)
+	if leader != nil {
+		pd.leaders[region.GetId()] = proto.Clone(leader).(*metapb.Peer)
+	}
+}
+
+func regionOverlaps(a, b *metapb.Region) bool {
+	return (len(b.EndKey) == 0 || bytes.Compare(a.StartKey, b.EndKey) < 0) &&
+		(len(a.EndKey) == 0 || bytes.Compare(b.StartKey, a.EndKey) < 0)
+}
+
+func (pd *mockPD) getRegion(key []byte) (*metapb.Region, *metapb.Peer) {
+	pd.mu.RLock()
+	defer pd.mu.RUnlock()
+	for id, r := range pd.regions {
+		if bytes.Compare(r.StartKey, key) <= 0 && (len(r.EndKey) == 0 || bytes.Compare(key, r.EndKey) < 0) {
+			return proto.Clone(r).(*metapb.Region), pd.leaders[id]
+		}
+	}
+	return nil, nil
+}
+
+func (pd *mockPD) getRegionByID(regionID uint64) (*metapb.Region, *metapb.Peer) {
+	pd.mu.RLock()
+	defer pd.mu.RUnlock()
+	r, ok := pd.regions[regionID]
+	if !ok {
+		return nil, nil
+	}
+	return proto.Clone(r).(*metapb.Region), pd.leaders[regionID]
+}
+
+// getStoreStats returns the last heartbeat stats of the store.
+func (pd *mockPD) getStoreStats(storeID uint64) *pdpb.StoreStats {
+	pd.mu.RLock()
+	defer pd.mu.RUnlock()
+	return pd.storeStats[storeID]
+}
+
+func (pd *mockPD) regionCount() int {
+	pd.mu.RLock()
+	defer pd.mu.RUnlock()
+	return len(pd.regions)
+}
+
+// mockPDClient implements pd.Client for one store of the test cluster.
+type mockPDClient struct {
+	*mockPD
+	handler atomic.Value
+}
+
+func (pd *mockPD) newClient() *mockPDClient {
+	return &mockPDClient{mockPD: pd}
+}
+
+func (c *mockPDClient) GetClusterID(ctx context.Context) uint64 {
+	return c.clusterID
+}
+
+func (c *mockPDClient) AllocID(ctx context.Context) (uint64, error) {
+	return c.allocID(), nil
+}
+
+func (c *mockPDClient) Bootstrap(ctx context.Context, store *metapb.Store, region *metapb.Region) (*pdpb.BootstrapResponse, error) {
+	c.mu.Lock()
+	if c.bootstrapped {
+		c.mu.Unlock()
+		return &pdpb.BootstrapResponse{
+			Header: &pdpb.ResponseHeader{
+				Error: &pdpb.Error{Type: pdpb.ErrorType_ALREADY_BOOTSTRAPPED},
+			},
+		}, nil
+	}
+	c.bootstrapped = true
+	c.stores[store.GetId()] = proto.Clone(store).(*metapb.Store)
+	c.mu.Unlock()
+	c.putRegion(region, region.GetPeers()[0])
+	return &pdpb.BootstrapResponse{}, nil
+}
+
+func (c *mockPDClient) IsBootstrapped(ctx context.Context) (bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.bootstrapped, nil
+}
+
+func (c *mockPDClient) PutStore(ctx context.Context, store *metapb.Store) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stores[store.GetId()] = proto.Clone(store).(*metapb.Store)
+	return nil
+}
+
+func (c *mockPDClient) GetStore(ctx context.Context, storeID uint64) (*metapb.Store, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	store, ok := c.stores[storeID]
+	if !ok {
+		return nil, errors.Errorf("store %d not found", storeID)
+	}
+	return proto.Clone(store).(*metapb.Store), nil
+}
+
+func (c *mockPDClient) GetRegion(ctx context.Context, key []byte) (*pdclient.Region, error) {
+	region, leader := c.getRegion(key)
+	if region == nil {
+		return nil, errors.Errorf("region not found for key %q", key)
+	}
+	return &pdclient.Region{Meta: region, Leader: leader}, nil
+}
+
+func (c *mockPDClient) GetRegionByID(ctx context.Context, regionID uint64) (*pdclient.Region, error) {
+	region, leader := c.getRegionByID(regionID)
+	if region == nil {
+		return nil, errors.Errorf("region %d not found", regionID)
+	}
+	return &pdclient.Region{Meta: region, Leader: leader}, nil
+}
+
+func (c *mockPDClient) ReportRegion(req *pdpb.RegionHeartbeatRequest) {
+	c.putRegion(req.GetRegion(), req.GetLeader())
+}
+
+func (c *mockPDClient) AskSplit(ctx context.Context, region *metapb.Region) (*pdpb.AskSplitResponse, error) {
+	resp := &pdpb.AskSplitResponse{NewRegionId: c.allocID()}
+	for range region.GetPeers() {
+		resp.NewPeerIds = append(resp.NewPeerIds, c.allocID())
+	}
+	return resp, nil
+}
+
+func (c *mockPDClient) AskBatchSplit(ctx context.Context, region *metapb.Region, count int) (*pdpb.AskBatchSplitResponse, error) {
+	resp := new(pdpb.AskBatchSplitResponse)
+	for i := 0; i < count; i++ {
+		id := &pdpb.SplitID{NewRegionId: c.allocID()}
+		for range region.GetPeers() {
+			id.NewPeerIds = append(id.NewPeerIds, c.allocID())
+		}
+		resp.Ids = append(resp.Ids, id)
+	}
+	return resp, nil
+}
+
+func (c *mockPDClient) ReportBatchSplit(ctx context.Context, regions []*metapb.Region) error {
+	for _, region := range regions {
+		c.putRegion(region, nil)
+	}
+	return nil
+}
+
+func (c *mockPDClient) GetGCSafePoint(ctx context.Context) (uint64, error) {
+	return 0, nil
+}
+
+func (c *mockPDClient) StoreHeartbeat(ctx context.Context, stats *pdpb.StoreStats) error {
+	c.mu.Lock()
+	c.storeStats[stats.StoreId] = stats
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *mockPDClient) GetTS(ctx context.Context) (int64, int64, error) {
+	return time.Now().UnixNano() / int64(time.Millisecond), 0, nil
+}
+
+func (c *mockPDClient) SetRegionHeartbeatResponseHandler(h func(*pdpb.RegionHeartbeatResponse)) {
+	c.handler.Store(h)
+}
+
+func (c *mockPDClient) Close() {}
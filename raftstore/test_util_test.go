@@ -44,8 +44,9 @@ func newTestEngines(t *testing.T) *Engines {
 	raftOpts.Dir = engines.raftPath
 	raftOpts.ValueDir = engines.raftPath
 	raftOpts.ValueThreshold = 256
-	engines.raft, err = badger.Open(raftOpts)
+	raftDB, err := badger.Open(raftOpts)
 	require.Nil(t, err)
+	engines.raft = NewBadgerRaftEngine(raftDB)
 	return engines
 }
 
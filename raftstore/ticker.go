@@ -42,12 +42,15 @@ func newTicker(regionID uint64, cfg *Config) *ticker {
 func newStoreTicker(cfg *Config) *ticker {
 	baseInterval := cfg.RaftBaseTickInterval
 	t := &ticker{
-		schedules: make([]tickSchedule, 4),
+		schedules: make([]tickSchedule, 7),
 	}
 	t.schedules[int(StoreTickCompactCheck)].interval = int64(cfg.RegionCompactCheckInterval / baseInterval)
 	t.schedules[int(StoreTickPdStoreHeartbeat)].interval = int64(cfg.PdStoreHeartbeatTickInterval / baseInterval)
 	t.schedules[int(StoreTickSnapGC)].interval = int64(cfg.SnapMgrGcTickInterval / baseInterval)
 	t.schedules[int(StoreTickConsistencyCheck)].interval = int64(cfg.ConsistencyCheckInterval / baseInterval)
+	t.schedules[int(StoreTickDiskCheck)].interval = int64(cfg.DiskCheckTickInterval / baseInterval)
+	t.schedules[int(StoreTickFlowCheck)].interval = int64(cfg.FlowCheckTickInterval / baseInterval)
+	t.schedules[int(StoreTickInspect)].interval = int64(cfg.InspectInterval / baseInterval)
 	return t
 }
 
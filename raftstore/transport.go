@@ -30,11 +30,14 @@ type ServerTransport struct {
 
 // NewServerTransport creates a new ServerTransport.
 func NewServerTransport(raftClient *RaftClient, snapScheduler chan<- task, router *router) *ServerTransport {
-	return &ServerTransport{
+	t := &ServerTransport{
 		raftClient:    raftClient,
 		router:        router,
 		snapScheduler: snapScheduler,
 	}
+	// The messages failed to be sent by the raft client are reported to the peers.
+	raftClient.reporter = t
+	return t
 }
 
 // Send sends the RaftMessage.
@@ -85,6 +88,16 @@ func (t *ServerTransport) ReportSnapshotStatus(msg *raft_serverpb.RaftMessage, s
 
 // ReportUnreachable sends the unreachable message.
 func (t *ServerTransport) ReportUnreachable(msg *raft_serverpb.RaftMessage) {
+	if isCoalescedHeartbeat(msg) {
+		msgs, err := splitCoalescedHeartbeat(msg)
+		if err != nil {
+			log.Error("report coalesced heartbeat unreachable failed", zap.Error(err))
+		}
+		for _, m := range msgs {
+			t.ReportUnreachable(m)
+		}
+		return
+	}
 	regionID := msg.GetRegionId()
 	toPeerID := msg.GetToPeer().GetId()
 	toStoreID := msg.GetToPeer().GetStoreId()
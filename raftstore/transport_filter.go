@@ -0,0 +1,244 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng1987/raft"
+)
+
+// RaftMessageFilter intercepts the raft messages sent by a store, it's used to inject network faults.
+type RaftMessageFilter interface {
+	// Filter passes the message to next zero or more times, maybe after a delay.
+	// It returns false if the message is dropped.
+	Filter(msg *rspb.RaftMessage, next func(*rspb.RaftMessage)) bool
+}
+
+// FilterTransport sends the raft messages through a chain of RaftMessageFilters before the
+// underlying Transport.
+type FilterTransport struct {
+	trans  Transport
+	router *router
+
+	mu      sync.RWMutex
+	filters []RaftMessageFilter
+}
+
+// NewFilterTransport creates a new FilterTransport, the router is used to report the dropped snapshots.
+func NewFilterTransport(trans Transport, router *router) *FilterTransport {
+	return &FilterTransport{
+		trans:  trans,
+		router: router,
+	}
+}
+
+// AddFilter appends the filter to the end of the chain.
+func (t *FilterTransport) AddFilter(f RaftMessageFilter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	filters := make([]RaftMessageFilter, len(t.filters), len(t.filters)+1)
+	copy(filters, t.filters)
+	t.filters = append(filters, f)
+}
+
+// ClearFilters removes all the filters.
+func (t *FilterTransport) ClearFilters() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.filters = nil
+}
+
+// Send implements the Transport Send method.
+func (t *FilterTransport) Send(msg *rspb.RaftMessage) error {
+	t.mu.RLock()
+	filters := t.filters
+	t.mu.RUnlock()
+	if len(filters) == 0 {
+		return t.trans.Send(msg)
+	}
+	send := func(m *rspb.RaftMessage) {
+		if err := t.trans.Send(m); err != nil {
+			log.S().Errorf("[region %d] send message failed %v", m.GetRegionId(), err)
+		}
+	}
+	for i := len(filters) - 1; i >= 0; i-- {
+		f, next := filters[i], send
+		send = func(m *rspb.RaftMessage) {
+			// The leader waits for the snapshot status before sending another snapshot.
+			if !f.Filter(m, next) && m.GetMessage().GetMsgType() == eraftpb.MessageType_MsgSnapshot {
+				(&ServerTransport{router: t.router}).ReportSnapshotStatus(m, raft.SnapshotFailure)
+			}
+		}
+	}
+	send(msg)
+	return nil
+}
+
+// Flush implements the Transport Flush method.
+func (t *FilterTransport) Flush() {
+	t.trans.Flush()
+}
+
+// RaftMessageMatcher returns true if the filter should be applied to the message.
+type RaftMessageMatcher func(msg *rspb.RaftMessage) bool
+
+// MatchRegion matches the messages of the regions.
+func MatchRegion(regionIDs ...uint64) RaftMessageMatcher {
+	return func(msg *rspb.RaftMessage) bool {
+		return containsID(regionIDs, msg.GetRegionId())
+	}
+}
+
+// MatchFromStore matches the messages sent from the stores.
+func MatchFromStore(storeIDs ...uint64) RaftMessageMatcher {
+	return func(msg *rspb.RaftMessage) bool {
+		return containsID(storeIDs, msg.GetFromPeer().GetStoreId())
+	}
+}
+
+// MatchToStore matches the messages sent to the stores.
+func MatchToStore(storeIDs ...uint64) RaftMessageMatcher {
+	return func(msg *rspb.RaftMessage) bool {
+		return containsID(storeIDs, msg.GetToPeer().GetStoreId())
+	}
+}
+
+// MatchMsgType matches the messages of the types.
+func MatchMsgType(types ...eraftpb.MessageType) RaftMessageMatcher {
+	return func(msg *rspb.RaftMessage) bool {
+		if msg.GetMessage() == nil {
+			return false
+		}
+		for _, tp := range types {
+			if msg.GetMessage().GetMsgType() == tp {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchAll matches the messages matched by all the matchers.
+func MatchAll(matchers ...RaftMessageMatcher) RaftMessageMatcher {
+	return func(msg *rspb.RaftMessage) bool {
+		for _, m := range matchers {
+			if !m(msg) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func containsID(ids []uint64, id uint64) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// DropFilter drops the matched messages, a nil Match matches all the messages.
+type DropFilter struct {
+	Match RaftMessageMatcher
+}
+
+// NewDropSnapshotFilter creates a DropFilter which drops all the snapshot messages.
+func NewDropSnapshotFilter() *DropFilter {
+	return &DropFilter{Match: MatchMsgType(eraftpb.MessageType_MsgSnapshot)}
+}
+
+// Filter implements the RaftMessageFilter Filter method.
+func (f *DropFilter) Filter(msg *rspb.RaftMessage, next func(*rspb.RaftMessage)) bool {
+	if f.Match == nil || f.Match(msg) {
+		return false
+	}
+	next(msg)
+	return true
+}
+
+// DelayFilter delays the matched messages by Delay plus a random duration less than Jitter,
+// the messages are reordered if Jitter is set. A nil Match matches all the messages.
+type DelayFilter struct {
+	Match  RaftMessageMatcher
+	Delay  time.Duration
+	Jitter time.Duration
+}
+
+// Filter implements the RaftMessageFilter Filter method.
+func (f *DelayFilter) Filter(msg *rspb.RaftMessage, next func(*rspb.RaftMessage)) bool {
+	if f.Match != nil && !f.Match(msg) {
+		next(msg)
+		return true
+	}
+	delay := f.Delay
+	if f.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(f.Jitter)))
+	}
+	time.AfterFunc(delay, func() { next(msg) })
+	return true
+}
+
+// DuplicateFilter sends the matched messages twice, a nil Match matches all the messages.
+type DuplicateFilter struct {
+	Match RaftMessageMatcher
+}
+
+// Filter implements the RaftMessageFilter Filter method.
+func (f *DuplicateFilter) Filter(msg *rspb.RaftMessage, next func(*rspb.RaftMessage)) bool {
+	if f.Match == nil || f.Match(msg) {
+		next(proto.Clone(msg).(*rspb.RaftMessage))
+	}
+	next(msg)
+	return true
+}
+
+// PartitionFilter drops the messages between the stores in different groups, a store that is not in
+// any group can only talk to itself.
+type PartitionFilter struct {
+	groups map[uint64]int
+}
+
+// NewPartitionFilter creates a PartitionFilter with the groups of store IDs.
+func NewPartitionFilter(groups ...[]uint64) *PartitionFilter {
+	f := &PartitionFilter{groups: make(map[uint64]int)}
+	for i, group := range groups {
+		for _, storeID := range group {
+			f.groups[storeID] = i
+		}
+	}
+	return f
+}
+
+// Filter implements the RaftMessageFilter Filter method.
+func (f *PartitionFilter) Filter(msg *rspb.RaftMessage, next func(*rspb.RaftMessage)) bool {
+	from, to := msg.GetFromPeer().GetStoreId(), msg.GetToPeer().GetStoreId()
+	if from != to {
+		fromGroup, ok1 := f.groups[from]
+		toGroup, ok2 := f.groups[to]
+		if !ok1 || !ok2 || fromGroup != toGroup {
+			return false
+		}
+	}
+	next(msg)
+	return true
+}
@@ -0,0 +1,89 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/stretchr/testify/require"
+)
+
+type recordTransport struct {
+	mu   sync.Mutex
+	msgs []*rspb.RaftMessage
+}
+
+func (t *recordTransport) Send(msg *rspb.RaftMessage) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.msgs = append(t.msgs, msg)
+	return nil
+}
+
+func (t *recordTransport) Flush() {}
+
+func (t *recordTransport) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.msgs)
+}
+
+func newFilterTestMsg(regionID, fromStore, toStore uint64, tp eraftpb.MessageType) *rspb.RaftMessage {
+	return &rspb.RaftMessage{
+		RegionId: regionID,
+		FromPeer: &metapb.Peer{Id: fromStore, StoreId: fromStore},
+		ToPeer:   &metapb.Peer{Id: toStore, StoreId: toStore},
+		Message:  &eraftpb.Message{MsgType: tp},
+	}
+}
+
+func TestFilterTransport(t *testing.T) {
+	inner := new(recordTransport)
+	trans := NewFilterTransport(inner, nil)
+	app := eraftpb.MessageType_MsgAppend
+	hb := eraftpb.MessageType_MsgHeartbeat
+
+	trans.AddFilter(&DropFilter{Match: MatchAll(MatchRegion(1), MatchMsgType(app))})
+	require.Nil(t, trans.Send(newFilterTestMsg(1, 1, 2, app)))
+	require.Nil(t, trans.Send(newFilterTestMsg(1, 1, 2, hb)))
+	require.Nil(t, trans.Send(newFilterTestMsg(2, 1, 2, app)))
+	require.Equal(t, 2, inner.count())
+
+	trans.AddFilter(&DuplicateFilter{Match: MatchToStore(3)})
+	require.Nil(t, trans.Send(newFilterTestMsg(2, 1, 3, app)))
+	require.Nil(t, trans.Send(newFilterTestMsg(1, 1, 3, app)))
+	require.Equal(t, 4, inner.count())
+
+	trans.ClearFilters()
+	trans.AddFilter(NewPartitionFilter([]uint64{1}, []uint64{2, 3}))
+	require.Nil(t, trans.Send(newFilterTestMsg(1, 1, 2, hb)))
+	require.Nil(t, trans.Send(newFilterTestMsg(1, 2, 3, hb)))
+	require.Nil(t, trans.Send(newFilterTestMsg(1, 4, 4, hb)))
+	require.Nil(t, trans.Send(newFilterTestMsg(1, 4, 2, hb)))
+	require.Equal(t, 6, inner.count())
+
+	trans.ClearFilters()
+	trans.AddFilter(&DelayFilter{Match: MatchFromStore(1), Delay: 50 * time.Millisecond})
+	require.Nil(t, trans.Send(newFilterTestMsg(1, 1, 2, hb)))
+	require.Nil(t, trans.Send(newFilterTestMsg(1, 2, 1, hb)))
+	require.Equal(t, 7, inner.count())
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 8, inner.count())
+	require.Equal(t, uint64(1), inner.msgs[7].GetFromPeer().GetStoreId())
+}
@@ -110,16 +110,18 @@ type Lease struct {
 	maxDrift   time.Duration
 	lastUpdate time.Time
 	remote     *RemoteLease
+	clock      Clock
 
 	// Todo: use monotonic_raw instead of time.Now() to fix time jump back issue.
 }
 
-// NewLease creates a new Lease.
-func NewLease(maxLease time.Duration) *Lease {
+// NewLease creates a new Lease, the clock is used to inspect the lease if the ts is not given.
+func NewLease(maxLease time.Duration, clock Clock) *Lease {
 	return &Lease{
 		maxLease:   maxLease,
 		maxDrift:   maxLease / 3,
 		lastUpdate: time.Time{},
+		clock:      clock,
 	}
 }
 
@@ -175,7 +177,7 @@ func (l *Lease) Inspect(ts *time.Time) LeaseState {
 	}
 	if l.boundValid != nil {
 		if ts == nil {
-			t := time.Now()
+			t := l.clock.Now()
 			ts = &t
 		}
 		if ts.Before(*l.boundValid) {
@@ -220,11 +222,13 @@ func (l *Lease) MaybeNewRemoteLease(term uint64) *RemoteLease {
 	remote := &RemoteLease{
 		expiredTime: &expiredTime,
 		term:        term,
+		clock:       l.clock,
 	}
 	// Clone the remote.
 	remoteClone := &RemoteLease{
 		expiredTime: &expiredTime,
 		term:        term,
+		clock:       l.clock,
 	}
 	l.remote = remote
 	return remoteClone
@@ -236,13 +240,14 @@ func (l *Lease) MaybeNewRemoteLease(term uint64) *RemoteLease {
 type RemoteLease struct {
 	expiredTime *uint64
 	term        uint64
+	clock       Clock
 }
 
 // Inspect returns the lease state with the given time.
 func (r *RemoteLease) Inspect(ts *time.Time) LeaseState {
 	expiredTime := atomic.LoadUint64(r.expiredTime)
 	if ts == nil {
-		t := time.Now()
+		t := r.clock.Now()
 		ts = &t
 	}
 	if ts.Before(U64ToTime(expiredTime)) {
@@ -480,6 +485,31 @@ func checkTerm(rlog raftlog.RaftLog, term uint64) error {
 	return &ErrStaleCommand{}
 }
 
+// isAllowedWhenDiskFull returns true if the command can be proposed when the disk is almost full.
+// Only commands that do not consume more disk space are allowed, like admin commands, reads and deletes.
+func isAllowedWhenDiskFull(rlog raftlog.RaftLog) bool {
+	if custom, ok := rlog.(*raftlog.CustomRaftLog); ok {
+		switch custom.Type() {
+		case raftlog.TypePessimisticRollback, raftlog.TypeDeleteRange, raftlog.TypeRawDelete:
+			return true
+		}
+		return false
+	}
+	req := rlog.GetRaftCmdRequest()
+	if req.AdminRequest != nil {
+		return true
+	}
+	for _, r := range req.Requests {
+		switch r.CmdType {
+		case raft_cmdpb.CmdType_Delete, raft_cmdpb.CmdType_DeleteRange,
+			raft_cmdpb.CmdType_Get, raft_cmdpb.CmdType_Snap, raft_cmdpb.CmdType_ReadIndex:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 func checkPeerID(rlog raftlog.RaftLog, peerID uint64) error {
 	if rlog.PeerID() == peerID {
 		return nil
@@ -17,6 +17,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ngaut/unistore/raftstore/raftlog"
 	"github.com/pingcap/kvproto/pkg/eraftpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/raft_cmdpb"
@@ -35,7 +36,7 @@ func TestLease(t *testing.T) {
 	duration := 1500 * time.Millisecond
 
 	// Empty lease.
-	lease := NewLease(duration)
+	lease := NewLease(duration, SystemClock)
 	remote := lease.MaybeNewRemoteLease(1)
 	require.NotNil(t, remote)
 	inspectTest := func(lease *Lease, ts *time.Time, state LeaseState) {
@@ -314,3 +315,31 @@ func cloneEpoch(epoch *metapb.RegionEpoch) *metapb.RegionEpoch {
 		Version: epoch.Version,
 	}
 }
+
+func TestIsAllowedWhenDiskFull(t *testing.T) {
+	newReq := func(tps ...raft_cmdpb.CmdType) raftlog.RaftLog {
+		req := new(raft_cmdpb.RaftCmdRequest)
+		for _, tp := range tps {
+			req.Requests = append(req.Requests, &raft_cmdpb.Request{CmdType: tp})
+		}
+		return raftlog.NewRequest(req)
+	}
+	assert.True(t, isAllowedWhenDiskFull(newReq(raft_cmdpb.CmdType_Delete, raft_cmdpb.CmdType_DeleteRange)))
+	assert.True(t, isAllowedWhenDiskFull(newReq(raft_cmdpb.CmdType_Snap)))
+	assert.False(t, isAllowedWhenDiskFull(newReq(raft_cmdpb.CmdType_Put)))
+	assert.False(t, isAllowedWhenDiskFull(newReq(raft_cmdpb.CmdType_Delete, raft_cmdpb.CmdType_Put)))
+
+	admin := raftlog.NewRequest(&raft_cmdpb.RaftCmdRequest{
+		AdminRequest: &raft_cmdpb.AdminRequest{CmdType: raft_cmdpb.AdminCmdType_CompactLog},
+	})
+	assert.True(t, isAllowedWhenDiskFull(admin))
+
+	b := raftlog.NewBuilder(raftlog.CustomHeader{})
+	b.SetType(raftlog.TypePessimisticRollback)
+	b.AppendPessimisticRollback([]byte("k"))
+	assert.True(t, isAllowedWhenDiskFull(b.Build()))
+	b = raftlog.NewBuilder(raftlog.CustomHeader{})
+	b.SetType(raftlog.TypePrewrite)
+	b.AppendLock([]byte("k"), []byte("v"))
+	assert.False(t, isAllowedWhenDiskFull(b.Build()))
+}
@@ -49,6 +49,8 @@ const (
 	taskTypeSplitCheck     taskType = 2
 	taskTypeComputeHash    taskType = 3
 	taskTypeHalfSplitCheck taskType = 4
+	taskTypeRaftLogFetch   taskType = 5
+	taskTypeInspect        taskType = 6
 
 	taskTypePDAskSplit         taskType = 101
 	taskTypePDAskBatchSplit    taskType = 102
@@ -85,7 +87,7 @@ type regionTask struct {
 }
 
 type raftLogGCTask struct {
-	raftEngine *badger.DB
+	raftEngine RaftEngine
 	regionID   uint64
 	startIdx   uint64
 	endIdx     uint64
@@ -134,7 +136,9 @@ type pdStoreHeartbeatTask struct {
 	stats    *pdpb.StoreStats
 	engine   *badger.DB
 	path     string
+	raftPath string
 	capacity uint64
+	reserve  uint64
 }
 
 type pdReportBatchSplitTask struct {
@@ -174,6 +178,8 @@ type worker struct {
 	sender   chan<- task
 	receiver <-chan task
 	wg       *sync.WaitGroup
+	// load is the busy time of the worker, it's set before the worker is started.
+	load *threadLoad
 }
 
 type taskHandler interface {
@@ -196,7 +202,9 @@ func (w *worker) start(handler taskHandler) {
 			if task.tp == taskTypeStop {
 				return
 			}
+			start := time.Now()
 			handler.handle(task)
+			w.load.observe(start)
 		}
 	}()
 }
@@ -679,6 +687,7 @@ func (snapCtx *snapContext) applySnap(regionID uint64, status *JobStatus, builde
 	if result, err = snap.Apply(*applyOptions); err != nil {
 		return result, err
 	}
+	result.SnapshotLocks = newSnapshotLocks(snapCtx.engiens.kv.LockStore, regionState.GetRegion(), snapKey.Index)
 
 	regionState.State = rspb.PeerState_Normal
 	result.RegionState = regionState
@@ -758,6 +767,7 @@ func (snapCtx *snapContext) cleanUpRange(regionID uint64, startKey, endKey []byt
 
 type regionApplyState struct {
 	localState *rspb.RegionLocalState
+	snapLocks  *snapshotLocks
 	tableCount int
 }
 
@@ -802,7 +812,8 @@ func (r *regionTaskHandler) resetBuilder() error {
 	}
 	compressionType := config.ParseCompression(r.conf.Engine.IngestCompression)
 	if r.builder == nil {
-		r.builder = r.ctx.engiens.kv.DB.NewExternalTableBuilder(r.builderFile, compressionType, r.ctx.mgr.limiter)
+		// The apply rate is limited when reading the snapshot, so the builder is not limited again.
+		r.builder = r.ctx.engiens.kv.DB.NewExternalTableBuilder(r.builderFile, compressionType, nil)
 		r.builder.SetIsManaged()
 	} else {
 		r.builder.Reset(r.builderFile)
@@ -822,7 +833,7 @@ func (r *regionTaskHandler) handleApplyResult(result ApplyResult) error {
 		}
 	}
 
-	state := regionApplyState{localState: result.RegionState}
+	state := regionApplyState{localState: result.RegionState, snapLocks: result.SnapshotLocks}
 	if result.HasPut {
 		state.tableCount++
 		r.tableFiles = append(r.tableFiles, r.builderFile)
@@ -834,6 +845,7 @@ func (r *regionTaskHandler) handleApplyResult(result ApplyResult) error {
 
 func (r *regionTaskHandler) finishApply() error {
 	log.S().Infof("apply snapshot ingesting %d tables", len(r.tableFiles))
+	mustEvalFailpoint(FailpointRegionApplySnapBeforeIngest)
 	externalFiles := make([]badger.ExternalTableSpec, len(r.tableFiles))
 	for i, file := range r.tableFiles {
 		externalFiles[i] = badger.ExternalTableSpec{Filename: file.Name()}
@@ -843,11 +855,20 @@ func (r *regionTaskHandler) finishApply() error {
 		log.S().Errorf("ingest sst failed (first %d files succeeded): %s", n, err)
 	}
 
+	// Return as if the store crashed after the ingestion, the regions are left in the Applying state.
+	if err := evalFailpoint(FailpointRegionApplySnapBeforeUpdateState); err != nil {
+		if rmErr := r.removeTableFiles(); rmErr != nil {
+			log.S().Errorf("remove ingested sst files failed: %v", rmErr)
+		}
+		r.applyStates = nil
+		return err
+	}
 	wb := r.ctx.wb
 	r.ctx.wb = nil
 	var cnt int
 	for _, state := range r.applyStates {
-		if cnt >= n {
+		// Stop at the first region whose tables are not all ingested.
+		if cnt+state.tableCount > n {
 			break
 		}
 		cnt += state.tableCount
@@ -857,6 +878,9 @@ func (r *regionTaskHandler) finishApply() error {
 			return err
 		}
 		wb.Delete(y.KeyWithTs(SnapshotRaftStateKey(regionID), KvTS))
+		// The locks are in the lock store already, the lock store dumped after the offset contains them.
+		state.snapLocks.offset = r.ctx.engiens.raft.Offset()
+		wb.Set(y.KeyWithTs(SnapshotLocksKey(regionID), KvTS), state.snapLocks.Marshal())
 	}
 
 	if err := wb.WriteToKV(r.ctx.engiens.kv); err != nil {
@@ -865,14 +889,23 @@ func (r *regionTaskHandler) finishApply() error {
 
 	log.S().Infof("apply snapshot ingested %d tables", len(r.tableFiles))
 
-	for _, f := range r.tableFiles {
-		if err := os.Remove(f.Name()); err != nil {
-			return err
+	r.applyStates = nil
+	return r.removeTableFiles()
+}
+
+// removeTableFiles closes and removes the sst files built for the ingestion.
+func (r *regionTaskHandler) removeTableFiles() error {
+	files := r.tableFiles
+	r.tableFiles = nil
+	var firstErr error
+	for _, f := range files {
+		// The file may be closed by the builder already.
+		_ = f.Close()
+		if err := os.Remove(f.Name()); err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
-	r.tableFiles = nil
-	r.applyStates = nil
-	return nil
+	return firstErr
 }
 
 // handlePendingApplies tries to apply pending tasks if there is some.
@@ -939,56 +972,6 @@ type raftLogGCTaskHandler struct {
 // reduce OLTP QPS by 30% ~ 60%. We found that 32K is a proper choice.
 const MaxDeleteBatchSize int = 32 * 1024
 
-// gcRaftLog does the GC job and returns the count of logs collected.
-func (r *raftLogGCTaskHandler) gcRaftLog(raftDb *badger.DB, regionID, startIdx, endIdx uint64) (uint64, error) {
-
-	// Find the raft log idx range needed to be gc.
-	firstIdx := startIdx
-	if firstIdx == 0 {
-		firstIdx = endIdx
-		err := raftDb.View(func(txn *badger.Txn) error {
-			startKey := RaftLogKey(regionID, 0)
-			ite := txn.NewIterator(badger.DefaultIteratorOptions)
-			defer ite.Close()
-			if ite.Seek(startKey); ite.Valid() {
-				var err error
-				if firstIdx, err = RaftLogIndex(ite.Item().Key()); err != nil {
-					return err
-				}
-			}
-			return nil
-		})
-		if err != nil {
-			return 0, err
-		}
-	}
-
-	if firstIdx >= endIdx {
-		log.Info("no need to gc", zap.Uint64("region id", regionID))
-		return 0, nil
-	}
-
-	raftWb := WriteBatch{}
-	for idx := firstIdx; idx < endIdx; idx++ {
-		key := y.KeyWithTs(RaftLogKey(regionID, idx), RaftTS)
-		raftWb.Delete(key)
-		if raftWb.size >= MaxDeleteBatchSize {
-			// Avoid large write batch to reduce latency.
-			if err := raftWb.WriteToRaft(raftDb); err != nil {
-				return 0, err
-			}
-			raftWb.Reset()
-		}
-	}
-	// todo, disable WAL here.
-	if raftWb.Len() != 0 {
-		if err := raftWb.WriteToRaft(raftDb); err != nil {
-			return 0, err
-		}
-	}
-	return endIdx - firstIdx, nil
-}
-
 func (r *raftLogGCTaskHandler) reportCollected(collected uint64) {
 	if r.taskResCh == nil {
 		return
@@ -999,7 +982,7 @@ func (r *raftLogGCTaskHandler) reportCollected(collected uint64) {
 func (r *raftLogGCTaskHandler) handle(t task) {
 	logGcTask := t.data.(*raftLogGCTask)
 	log.Debug("execute gc log", zap.Uint64("region id", logGcTask.regionID), zap.Uint64("end index", logGcTask.endIdx))
-	collected, err := r.gcRaftLog(logGcTask.raftEngine, logGcTask.regionID, logGcTask.startIdx, logGcTask.endIdx)
+	collected, err := logGcTask.raftEngine.GC(logGcTask.regionID, logGcTask.startIdx, logGcTask.endIdx)
 	if err != nil {
 		log.Error("failed to gc", zap.Uint64("region id", logGcTask.regionID), zap.Uint64("collected", collected), zap.Error(err))
 	} else {
@@ -24,6 +24,7 @@ import (
 	"github.com/pingcap/badger"
 	"github.com/pingcap/badger/y"
 	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
 	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
 	"github.com/pingcap/tidb/store/mockstore/unistore/lockstore"
 	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
@@ -126,8 +127,9 @@ func newEnginesWithKVDb(t *testing.T, kv *mvcc.DBBundle) *Engines {
 	raftOpts.Dir = engines.raftPath
 	raftOpts.ValueDir = engines.raftPath
 	raftOpts.ValueThreshold = 256
-	engines.raft, err = badger.Open(raftOpts)
+	raftDB, err := badger.Open(raftOpts)
 	require.Nil(t, err)
+	engines.raft = NewBadgerRaftEngine(raftDB)
 	return engines
 }
 
@@ -269,6 +271,24 @@ func TestPendingApplies(t *testing.T) {
 	// todo, check cf num files at level 0 is 2
 }
 
+func TestFinishApplyWithoutTables(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	runner := newRegionTaskHandler(&config.DefaultConf, engines, nil, 0, 0)
+	runner.ctx.wb = new(WriteBatch)
+	// The snapshots of the empty regions don't build any table.
+	for _, regionID := range []uint64{1, 2} {
+		state := &rspb.RegionLocalState{State: rspb.PeerState_Normal, Region: &metapb.Region{Id: regionID}}
+		runner.applyStates = append(runner.applyStates, regionApplyState{localState: state, snapLocks: new(snapshotLocks)})
+	}
+	require.Nil(t, runner.finishApply())
+	for _, regionID := range []uint64{1, 2} {
+		state, err := getRegionLocalState(engines.kv.DB, regionID)
+		require.Nil(t, err)
+		assert.Equal(t, rspb.PeerState_Normal, state.State)
+	}
+}
+
 func TestGcRaftLog(t *testing.T) {
 	engines := newTestEngines(t)
 	defer cleanUpTestEngineData(engines)
@@ -360,8 +380,8 @@ func TestGcRaftLog(t *testing.T) {
 		runner.handle(h.raftLogGcTask)
 		res := <-taskResCh
 		assert.Equal(t, h.expectedCollected, uint64(res))
-		raftLogMustNotExist(t, raftDb, 1, h.nonExistRange[0], h.nonExistRange[1])
-		raftLogMustExist(t, raftDb, 1, h.existRange[0], h.existRange[1])
+		raftLogMustNotExist(t, raftDb.(*badgerRaftEngine).db, 1, h.nonExistRange[0], h.nonExistRange[1])
+		raftLogMustExist(t, raftDb.(*badgerRaftEngine).db, 1, h.existRange[0], h.existRange[1])
 	}
 }
 
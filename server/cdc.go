@@ -0,0 +1,23 @@
+package server
+
+import (
+	"github.com/pingcap/kvproto/pkg/cdcpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// EventFeed implements the cdcpb.ChangeDataServer EventFeed method.
+func (s *Server) EventFeed(stream cdcpb.ChangeData_EventFeedServer) error {
+	if s.cdc == nil {
+		return status.Error(codes.Unimplemented, "cdc is not supported without the raft store")
+	}
+	return s.cdc.EventFeed(stream)
+}
+
+// Stop stops the CDC service and the tikv.Server.
+func (s *Server) Stop() {
+	if s.cdc != nil {
+		s.cdc.Close()
+	}
+	s.Server.Stop()
+}
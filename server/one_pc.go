@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ngaut/unistore/raftstore"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/tikvpb"
+)
+
+// The raft store writer can't tell a 1PC commit from a normal commit by the write batch, so the prewrite
+// requests trying 1PC are marked before they are handled by tikv.Server. If the writer can't write 1PC
+// commits, TryOnePc is cleared and TiDB falls back to 2PC.
+
+// KvPrewrite implements the tikvpb.TikvServer KvPrewrite method.
+func (s *Server) KvPrewrite(ctx context.Context, req *kvrpcpb.PrewriteRequest) (*kvrpcpb.PrewriteResponse, error) {
+	if s.onePC != nil && req.TryOnePc {
+		if s.onePC.MarkOnePC(req.Context) {
+			defer s.onePC.UnmarkOnePC(req.Context)
+		} else {
+			req.TryOnePc = false
+		}
+	}
+	return s.Server.KvPrewrite(ctx, req)
+}
+
+// BatchCommands implements the tikvpb.TikvServer BatchCommands method.
+func (s *Server) BatchCommands(stream tikvpb.Tikv_BatchCommandsServer) error {
+	if s.onePC == nil {
+		return s.Server.BatchCommands(stream)
+	}
+	onePCStream := &onePCBatchCommandsStream{
+		Tikv_BatchCommandsServer: stream,
+		marker:                   s.onePC,
+		marked:                   make(map[uint64]*kvrpcpb.Context),
+	}
+	defer onePCStream.unmarkAll()
+	return s.Server.BatchCommands(onePCStream)
+}
+
+// onePCBatchCommandsStream marks the 1PC prewrite requests when they are received, and unmarks them
+// when their responses are sent.
+type onePCBatchCommandsStream struct {
+	tikvpb.Tikv_BatchCommandsServer
+	marker raftstore.OnePCMarker
+
+	mu     sync.Mutex
+	marked map[uint64]*kvrpcpb.Context
+	closed bool
+}
+
+func (s *onePCBatchCommandsStream) Recv() (*tikvpb.BatchCommandsRequest, error) {
+	req, err := s.Tikv_BatchCommandsServer.Recv()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	for i, r := range req.Requests {
+		prewrite := r.GetPrewrite()
+		if prewrite == nil || !prewrite.TryOnePc {
+			continue
+		}
+		if !s.closed && s.marker.MarkOnePC(prewrite.Context) {
+			s.marked[req.RequestIds[i]] = prewrite.Context
+		} else {
+			prewrite.TryOnePc = false
+		}
+	}
+	s.mu.Unlock()
+	return req, nil
+}
+
+func (s *onePCBatchCommandsStream) Send(resp *tikvpb.BatchCommandsResponse) error {
+	s.mu.Lock()
+	for _, id := range resp.RequestIds {
+		if ctx, ok := s.marked[id]; ok {
+			s.marker.UnmarkOnePC(ctx)
+			delete(s.marked, id)
+		}
+	}
+	s.mu.Unlock()
+	return s.Tikv_BatchCommandsServer.Send(resp)
+}
+
+// unmarkAll unmarks the requests without responses when the stream is closed.
+func (s *onePCBatchCommandsStream) unmarkAll() {
+	s.mu.Lock()
+	s.closed = true
+	for id, ctx := range s.marked {
+		s.marker.UnmarkOnePC(ctx)
+		delete(s.marked, id)
+	}
+	s.mu.Unlock()
+}
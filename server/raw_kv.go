@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+)
+
+// The raw kv requests in BatchCommands are still handled by tikv.Server, the raw kv clients should
+// disable the batch commands.
+
+// RawGet implements the tikvpb.TikvServer RawGet method.
+func (s *Server) RawGet(ctx context.Context, req *kvrpcpb.RawGetRequest) (*kvrpcpb.RawGetResponse, error) {
+	if s.rawKV == nil {
+		return s.Server.RawGet(ctx, req)
+	}
+	return s.rawKV.RawGet(ctx, req)
+}
+
+// RawBatchGet implements the tikvpb.TikvServer RawBatchGet method.
+func (s *Server) RawBatchGet(ctx context.Context, req *kvrpcpb.RawBatchGetRequest) (*kvrpcpb.RawBatchGetResponse, error) {
+	if s.rawKV == nil {
+		return s.Server.RawBatchGet(ctx, req)
+	}
+	return s.rawKV.RawBatchGet(ctx, req)
+}
+
+// RawScan implements the tikvpb.TikvServer RawScan method.
+func (s *Server) RawScan(ctx context.Context, req *kvrpcpb.RawScanRequest) (*kvrpcpb.RawScanResponse, error) {
+	if s.rawKV == nil {
+		return s.Server.RawScan(ctx, req)
+	}
+	return s.rawKV.RawScan(ctx, req)
+}
+
+// RawBatchScan implements the tikvpb.TikvServer RawBatchScan method.
+func (s *Server) RawBatchScan(ctx context.Context, req *kvrpcpb.RawBatchScanRequest) (*kvrpcpb.RawBatchScanResponse, error) {
+	if s.rawKV == nil {
+		return s.Server.RawBatchScan(ctx, req)
+	}
+	return s.rawKV.RawBatchScan(ctx, req)
+}
+
+// RawPut implements the tikvpb.TikvServer RawPut method.
+func (s *Server) RawPut(ctx context.Context, req *kvrpcpb.RawPutRequest) (*kvrpcpb.RawPutResponse, error) {
+	if s.rawKV == nil {
+		return s.Server.RawPut(ctx, req)
+	}
+	return s.rawKV.RawPut(ctx, req)
+}
+
+// RawBatchPut implements the tikvpb.TikvServer RawBatchPut method.
+func (s *Server) RawBatchPut(ctx context.Context, req *kvrpcpb.RawBatchPutRequest) (*kvrpcpb.RawBatchPutResponse, error) {
+	if s.rawKV == nil {
+		return s.Server.RawBatchPut(ctx, req)
+	}
+	return s.rawKV.RawBatchPut(ctx, req)
+}
+
+// RawDelete implements the tikvpb.TikvServer RawDelete method.
+func (s *Server) RawDelete(ctx context.Context, req *kvrpcpb.RawDeleteRequest) (*kvrpcpb.RawDeleteResponse, error) {
+	if s.rawKV == nil {
+		return s.Server.RawDelete(ctx, req)
+	}
+	return s.rawKV.RawDelete(ctx, req)
+}
+
+// RawBatchDelete implements the tikvpb.TikvServer RawBatchDelete method.
+func (s *Server) RawBatchDelete(ctx context.Context, req *kvrpcpb.RawBatchDeleteRequest) (*kvrpcpb.RawBatchDeleteResponse, error) {
+	if s.rawKV == nil {
+		return s.Server.RawBatchDelete(ctx, req)
+	}
+	return s.rawKV.RawBatchDelete(ctx, req)
+}
+
+// RawDeleteRange implements the tikvpb.TikvServer RawDeleteRange method.
+func (s *Server) RawDeleteRange(ctx context.Context, req *kvrpcpb.RawDeleteRangeRequest) (*kvrpcpb.RawDeleteRangeResponse, error) {
+	if s.rawKV == nil {
+		return s.Server.RawDeleteRange(ctx, req)
+	}
+	return s.rawKV.RawDeleteRange(ctx, req)
+}
@@ -18,12 +18,22 @@ import (
 )
 
 const (
-	subPathRaft = "raft"
-	subPathKV   = "kv"
+	subPathRaft    = "raft"
+	subPathRaftLog = "raftlog"
+	subPathKV      = "kv"
 )
 
-// New returns a new tikv.Server.
-func New(conf *config.Config, pdClient pd.Client) (*tikv.Server, error) {
+// Server is a tikv.Server with the raw kv API and the CDC service served by the raft store, they are not
+// supported if the raft store is not enabled.
+type Server struct {
+	*tikv.Server
+	rawKV *raftstore.RawKVStore
+	cdc   *raftstore.CDCService
+	onePC raftstore.OnePCMarker
+}
+
+// New returns a new Server.
+func New(conf *config.Config, pdClient pd.Client) (*Server, error) {
 	physical, logical, err := pdClient.GetTS(context.Background())
 	if err != nil {
 		return nil, err
@@ -56,7 +66,7 @@ func getRegionOptions(conf *config.Config) tikv.RegionOptions {
 	}
 }
 
-func setupRaftServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, pdClient pd.Client, conf *config.Config) (*tikv.Server, error) {
+func setupRaftServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, pdClient pd.Client, conf *config.Config) (*Server, error) {
 	dbPath := conf.Engine.DBPath
 	kvPath := filepath.Join(dbPath, "kv")
 	raftPath := filepath.Join(dbPath, "raft")
@@ -76,7 +86,7 @@ func setupRaftServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, pdClient
 	raftConf.SnapPath = snapPath
 	setupRaftStoreConf(raftConf, conf)
 
-	raftDB, err := createDB(subPathRaft, nil, &conf.Engine)
+	raftEngine, err := createRaftEngine(conf)
 	if err != nil {
 		return nil, err
 	}
@@ -88,18 +98,20 @@ func setupRaftServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, pdClient
 	if meta != nil {
 		offset = binary.LittleEndian.Uint64(meta)
 	}
-	err = raftstore.RestoreLockStore(offset, bundle, raftDB)
+	err = raftstore.RestoreLockStore(offset, bundle, raftEngine)
 	if err != nil {
 		return nil, err
 	}
+	raftEngine.SetRecoveryOffset(offset)
 
-	engines := raftstore.NewEngines(bundle, raftDB, kvPath, raftPath)
+	engines := raftstore.NewEngines(bundle, raftEngine, kvPath, raftPath)
 
 	innerServer := raftstore.NewRaftInnerServer(conf, engines, raftConf)
 	innerServer.Setup(pdClient)
 	router := innerServer.GetRaftstoreRouter()
 	storeMeta := innerServer.GetStoreMeta()
-	store := tikv.NewMVCCStore(&conf.Config, bundle, dbPath, safePoint, raftstore.NewDBWriter(conf, router), pdClient)
+	writer := raftstore.NewDBWriter(conf, router)
+	store := tikv.NewMVCCStore(&conf.Config, bundle, dbPath, safePoint, writer, pdClient)
 	rm := raftstore.NewRaftRegionManager(storeMeta, router, store.DeadlockDetectSvr)
 	innerServer.SetPeerEventObserver(rm)
 
@@ -109,10 +121,15 @@ func setupRaftServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, pdClient
 
 	store.StartDeadlockDetection(true)
 
-	return tikv.NewServer(rm, store, innerServer), nil
+	return &Server{
+		Server: tikv.NewServer(rm, store, innerServer),
+		rawKV:  raftstore.NewRawKVStore(conf, rm, router, bundle),
+		cdc:    innerServer.NewCDCService(rm, pdClient),
+		onePC:  writer.(raftstore.OnePCMarker),
+	}, nil
 }
 
-func setupStandAlongInnerServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, rm tikv.RegionManager, pdClient pd.Client, conf *config.Config) (*tikv.Server, error) {
+func setupStandAlongInnerServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, rm tikv.RegionManager, pdClient pd.Client, conf *config.Config) (*Server, error) {
 	innerServer := tikv.NewStandAlongInnerServer(bundle)
 	innerServer.Setup(pdClient)
 	store := tikv.NewMVCCStore(&conf.Config, bundle, conf.Engine.DBPath, safePoint, tikv.NewDBWriter(bundle), pdClient)
@@ -124,7 +141,7 @@ func setupStandAlongInnerServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint
 
 	store.StartDeadlockDetection(false)
 
-	return tikv.NewServer(rm, store, innerServer), nil
+	return &Server{Server: tikv.NewServer(rm, store, innerServer)}, nil
 }
 
 func setupRaftStoreConf(raftConf *raftstore.Config, conf *config.Config) {
@@ -136,12 +153,52 @@ func setupRaftStoreConf(raftConf *raftstore.Config, conf *config.Config) {
 	raftConf.RaftBaseTickInterval = config.ParseDuration(conf.RaftStore.RaftBaseTickInterval)
 	raftConf.RaftHeartbeatTicks = conf.RaftStore.RaftHeartbeatTicks
 	raftConf.RaftElectionTimeoutTicks = conf.RaftStore.RaftElectionTimeoutTicks
+	raftConf.CoalesceHeartbeats = conf.RaftStore.CoalesceHeartbeats
+	raftConf.DiskReserveSpace = conf.RaftStore.DiskReserveSpace
+	raftConf.SnapBuildRateLimit = conf.RaftStore.SnapBuildRateLimit
+	raftConf.SnapSendRateLimit = conf.RaftStore.SnapSendRateLimit
+	raftConf.SnapApplyRateLimit = conf.RaftStore.SnapApplyRateLimit
+	raftConf.SnapCompression = conf.RaftStore.SnapCompression
+	raftConf.SnapResume = conf.RaftStore.SnapResume
+	raftConf.SnapGenerateOnFollower = conf.RaftStore.SnapGenerateOnFollower
+	raftConf.SnapDelegateTimeout = config.ParseDuration(conf.RaftStore.SnapDelegateTimeout)
+	raftConf.CDCResolvedTsInterval = config.ParseDuration(conf.RaftStore.CDCResolvedTsInterval)
+	raftConf.ProposalTimeout = config.ParseDuration(conf.RaftStore.ProposalTimeout)
+	raftConf.RaftLogFetchMaxBytes = conf.RaftStore.RaftLogFetchMaxBytes
+	raftConf.RaftEntryCacheMemoryLimit = conf.RaftStore.RaftEntryCacheMemoryLimit
+	raftConf.FlowControlPendingCompactionSoftLimit = conf.RaftStore.FlowControlPendingCompactionSoftLimit
+	raftConf.FlowControlPendingCompactionHardLimit = conf.RaftStore.FlowControlPendingCompactionHardLimit
+	raftConf.FlowControlSlowdownRate = conf.RaftStore.FlowControlSlowdownRate
+	raftConf.FlowControlApplyPendingLimit = conf.RaftStore.FlowControlApplyPendingLimit
+	raftConf.InspectInterval = config.ParseDuration(conf.RaftStore.InspectInterval)
+	raftConf.InspectSlowThreshold = config.ParseDuration(conf.RaftStore.InspectSlowThreshold)
+	raftConf.SlowScoreThreshold = conf.RaftStore.SlowScoreThreshold
+
+	// engine block
+	// Writes are throttled before the kv engine stalls them at NumL0TablesStall.
+	raftConf.FlowControlL0TablesSoftLimit = (conf.Engine.NumL0Tables + conf.Engine.NumL0TablesStall) / 2
+	raftConf.FlowControlL0TablesHardLimit = conf.Engine.NumL0TablesStall - 1
+	raftConf.KVEngineL1Size = conf.Engine.L1Size
 
 	// coprocessor block
 	raftConf.SplitCheck.RegionMaxKeys = uint64(conf.Coprocessor.RegionMaxKeys)
 	raftConf.SplitCheck.RegionSplitKeys = uint64(conf.Coprocessor.RegionSplitKeys)
 }
 
+func createRaftEngine(conf *config.Config) (raftstore.RaftEngine, error) {
+	if conf.RaftStore.RaftEngine == "log" {
+		return raftstore.OpenLogRaftEngine(filepath.Join(conf.Engine.DBPath, subPathRaftLog), raftstore.LogRaftEngineOptions{
+			FileSize:   conf.RaftStore.RaftEngineFileSize,
+			SyncWrites: conf.Engine.SyncWrite,
+		})
+	}
+	raftDB, err := createDB(subPathRaft, nil, &conf.Engine)
+	if err != nil {
+		return nil, err
+	}
+	return raftstore.NewBadgerRaftEngine(raftDB), nil
+}
+
 func createDB(subPath string, safePoint *tikv.SafePoint, conf *tidbconfig.Engine) (*badger.DB, error) {
 	opts := badger.DefaultOptions
 	opts.NumCompactors = conf.NumCompactors